@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	registerCapability(capSource, "auditlog")
+}
+
+func NewAuditLogCommand() *cobra.Command {
+	return newImportCommand("auditlog", "Replay Percona/MariaDB/MySQL audit logs in json format", parseAuditLog)
+}
+
+// parseAuditLog parses a stream of json audit records. Records of the Percona
+// audit plugin are wrapped by `audit_record`, while records of the MySQL
+// enterprise audit (and its compatible plugins) are grouped by event class.
+func parseAuditLog(in io.Reader, out *sessionDumper) error {
+	dec := json.NewDecoder(in)
+	dec.UseNumber()
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return errors.Trace(err)
+		}
+		if delim, ok := tok.(json.Delim); ok && delim == '[' {
+			for dec.More() {
+				if err = decodeAuditRecord(dec, out); err != nil {
+					return err
+				}
+			}
+			if _, err = dec.Token(); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		} else if ok && delim == '{' {
+			rec, err := decodeAuditObject(dec)
+			if err != nil {
+				return err
+			}
+			if err = applyAuditRecord(rec, out); err != nil {
+				return err
+			}
+			continue
+		}
+		return errors.Errorf("unexpected token %v", tok)
+	}
+}
+
+func decodeAuditRecord(dec *json.Decoder, out *sessionDumper) error {
+	var rec map[string]interface{}
+	if err := dec.Decode(&rec); err != nil {
+		return errors.Trace(err)
+	}
+	return applyAuditRecord(rec, out)
+}
+
+// decodeAuditObject decodes the rest of an object whose opening delim has been consumed.
+func decodeAuditObject(dec *json.Decoder) (map[string]interface{}, error) {
+	rec := make(map[string]interface{})
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, errors.Errorf("unexpected key %v", tok)
+		}
+		var val interface{}
+		if err = dec.Decode(&val); err != nil {
+			return nil, errors.Trace(err)
+		}
+		rec[key] = val
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return rec, nil
+}
+
+func applyAuditRecord(rec map[string]interface{}, out *sessionDumper) error {
+	if inner, ok := rec["audit_record"].(map[string]interface{}); ok {
+		rec = inner
+	}
+	var (
+		conn  = auditUint(rec["connection_id"])
+		t     = auditTime(rec["timestamp"])
+		db    = auditString(rec["db"])
+		query = auditString(rec["sqltext"])
+		kind  = strings.ToLower(auditString(rec["name"]))
+	)
+	if len(query) == 0 {
+		query = auditString(rec["query"])
+	}
+	if cd, ok := rec["connection_data"].(map[string]interface{}); ok && len(db) == 0 {
+		db = auditString(cd["db"])
+	}
+	if gd, ok := rec["general_data"].(map[string]interface{}); ok {
+		if len(query) == 0 {
+			query = auditString(gd["query"])
+		}
+		if len(kind) == 0 {
+			kind = strings.ToLower(auditString(gd["command"]))
+		}
+	}
+	if len(kind) == 0 {
+		switch class, ev := auditString(rec["class"]), auditString(rec["event"]); {
+		case class == "connection" && ev == "connect":
+			kind = "connect"
+		case class == "connection" && ev == "disconnect":
+			kind = "quit"
+		case len(query) > 0:
+			kind = "query"
+		}
+	}
+	switch kind {
+	case "connect":
+		return out.Connect(conn, t, db)
+	case "quit", "disconnect":
+		out.Quit(conn, t)
+	case "change user", "init db":
+		return out.Use(conn, t, db)
+	case "query", "execute":
+		if len(query) > 0 {
+			return out.Query(conn, t, db, query)
+		}
+	}
+	return nil
+}
+
+func auditString(v interface{}) string {
+	switch x := v.(type) {
+	case string:
+		return x
+	case json.Number:
+		return x.String()
+	default:
+		return ""
+	}
+}
+
+func auditUint(v interface{}) uint64 {
+	n, _ := strconv.ParseUint(strings.TrimSpace(auditString(v)), 10, 64)
+	return n
+}
+
+func auditTime(v interface{}) int64 {
+	s := strings.TrimSpace(auditString(v))
+	if n, ok := v.(json.Number); ok {
+		if f, err := n.Float64(); err == nil {
+			// epoch in seconds or milliseconds
+			if f < 1e11 {
+				return int64(f * 1000)
+			}
+			return int64(f)
+		}
+	}
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05 MST", "2006-01-02 15:04:05.999999", "2006-01-02T15:04:05.999999"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t.UnixNano() / int64(time.Millisecond)
+		}
+	}
+	return 0
+}
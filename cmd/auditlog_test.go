@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/zyguan/mysql-replay/event"
+)
+
+func TestParseAuditLog(t *testing.T) {
+	layout := "2006-01-02 15:04:05"
+	testImport(t, parseAuditLog, []importCase{
+		{
+			name: "percona",
+			input: `{"audit_record":{"name":"Connect","record":"1_2021-06-01T10:00:00","timestamp":"2021-06-01T10:00:00 UTC","connection_id":"5","status":0,"user":"root","host":"localhost","db":"test"}}
+{"audit_record":{"name":"Query","record":"2_2021-06-01T10:00:00","timestamp":"2021-06-01T10:00:01 UTC","command_class":"select","connection_id":"5","status":0,"sqltext":"select 1","db":"test"}}
+{"audit_record":{"name":"Init DB","record":"3_2021-06-01T10:00:00","timestamp":"2021-06-01T10:00:02 UTC","command_class":"error","connection_id":"5","status":0,"sqltext":"","db":"db2"}}
+{"audit_record":{"name":"Quit","record":"4_2021-06-01T10:00:00","timestamp":"2021-06-01T10:00:03 UTC","connection_id":"5","status":0,"db":"db2"}}
+`,
+			expect: map[uint64][]event.MySQLEvent{
+				5: {
+					{Time: 1622541600000, Type: event.EventHandshake, DB: "test"},
+					{Time: 1622541601000, Type: event.EventQuery, Query: "select 1"},
+					{Time: 1622541602000, Type: event.EventQuery, Query: "use `db2`"},
+					{Time: 1622541603000, Type: event.EventQuit},
+				},
+			},
+		},
+		{
+			name: "mysql enterprise",
+			input: `[
+  {"timestamp":"2021-06-01 10:00:03","id":0,"class":"connection","event":"connect","connection_id":6,
+   "connection_data":{"connection_type":"tcp/ip","status":0,"db":"db1"}},
+  {"timestamp":"2021-06-01 10:00:04","id":1,"class":"general","event":"status","connection_id":6,
+   "general_data":{"command":"Query","sql_command":"select","query":"select 2","status":0}},
+  {"timestamp":"2021-06-01 10:00:05","id":2,"class":"connection","event":"disconnect","connection_id":6}
+]
+`,
+			expect: map[uint64][]event.MySQLEvent{
+				6: {
+					{Time: localMillis(layout, "2021-06-01 10:00:03"), Type: event.EventHandshake, DB: "db1"},
+					{Time: localMillis(layout, "2021-06-01 10:00:04"), Type: event.EventQuery, Query: "select 2"},
+					{Time: localMillis(layout, "2021-06-01 10:00:05"), Type: event.EventQuit},
+				},
+			},
+		},
+		{
+			name: "epoch timestamps and implicit sessions",
+			input: `{"timestamp":1622541600,"connection_id":7,"query":"select 3","db":"db3"}
+{"timestamp":1622541600500,"connection_id":7,"query":"select 4"}
+`,
+			expect: map[uint64][]event.MySQLEvent{
+				7: {
+					{Time: 1622541600000, Type: event.EventHandshake, DB: "db3"},
+					{Time: 1622541600000, Type: event.EventQuery, Query: "select 3"},
+					{Time: 1622541600500, Type: event.EventQuery, Query: "select 4"},
+				},
+			},
+		},
+	})
+}
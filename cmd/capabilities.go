@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+	"github.com/zyguan/mysql-replay/storage"
+	"github.com/zyguan/mysql-replay/stream"
+)
+
+// Version is expected to be set via -ldflags "-X github.com/zyguan/mysql-replay/cmd.Version=..."
+var Version = "dev"
+
+const (
+	capSource   = "sources"
+	capSink     = "sinks"
+	capExecutor = "executors"
+	capDriver   = "drivers"
+	capCodec    = "codecs"
+	capProtocol = "protocols"
+)
+
+var (
+	capLock sync.Mutex
+	caps    = map[string][]string{}
+)
+
+func registerCapability(kind string, name string) {
+	capLock.Lock()
+	defer capLock.Unlock()
+	caps[kind] = append(caps[kind], name)
+}
+
+func init() {
+	registerCapability(capSource, "pcap")
+	registerCapability(capSource, "tsv")
+	registerCapability(capSink, "tsv")
+	for _, scheme := range storage.Schemes() {
+		registerCapability(capSource, scheme)
+		registerCapability(capSink, scheme)
+	}
+	registerCapability(capSink, "sql-script")
+}
+
+type capabilityInfo struct {
+	Version      string              `json:"version"`
+	GoVersion    string              `json:"go_version"`
+	Platform     string              `json:"platform"`
+	EventFormats []int               `json:"event_formats"`
+	Commands     []string            `json:"commands"`
+	Protocol     map[string]bool     `json:"protocol"`
+	Components   map[string][]string `json:"components"`
+	CLI          []string            `json:"cli"`
+}
+
+func NewCapabilitiesCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "capabilities",
+		Aliases: []string{"version"},
+		Short:   "Print supported formats, protocol features and components as json",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			info := capabilityInfo{
+				Version:      Version,
+				GoVersion:    runtime.Version(),
+				Platform:     runtime.GOOS + "/" + runtime.GOARCH,
+				EventFormats: event.FormatVersions,
+				Commands:     stream.Commands(),
+				Protocol:     stream.Features(),
+				Components:   map[string][]string{},
+				CLI:          listCommands(cmd.Root(), nil, nil),
+			}
+			capLock.Lock()
+			for k, v := range caps {
+				info.Components[k] = append([]string{}, v...)
+				sort.Strings(info.Components[k])
+			}
+			capLock.Unlock()
+			// components of other packages are registered where they are defined
+			info.Components[capDriver] = replay.Drivers()
+			info.Components[capExecutor] = append(info.Components[capExecutor], replay.Executors()...)
+			sort.Strings(info.Components[capExecutor])
+			info.Components[capCodec] = event.Formats()
+			for _, p := range stream.Protocols() {
+				info.Components[capProtocol] = append(info.Components[capProtocol], p.Name())
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(info)
+		},
+	}
+	return cmd
+}
+
+func listCommands(cmd *cobra.Command, prefix []string, out []string) []string {
+	for _, sub := range cmd.Commands() {
+		if !sub.IsAvailableCommand() {
+			continue
+		}
+		path := append(append([]string{}, prefix...), sub.Name())
+		out = append(out, strings.Join(path, " "))
+		out = listCommands(sub, path, out)
+	}
+	return out
+}
@@ -0,0 +1,310 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+const (
+	captureModePFS  = "pfs"
+	captureModeTiDB = "tidb"
+)
+
+func init() {
+	registerCapability(capSource, "online")
+}
+
+func NewCaptureCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "capture",
+		Short: "Capture workloads from live traffic or the source itself",
+	}
+	cmd.AddCommand(NewCaptureLiveCmd())
+	cmd.AddCommand(NewCaptureOnlineCmd())
+	return cmd
+}
+
+func NewCaptureOnlineCmd() *cobra.Command {
+	var (
+		opts struct {
+			sourceDSN string
+			output    string
+			mode      string
+			interval  time.Duration
+			duration  time.Duration
+		}
+	)
+	cmd := &cobra.Command{
+		Use:   "online",
+		Short: "Capture statements by polling performance_schema (or TiDB statements summary) of the source",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if opts.mode != captureModePFS && opts.mode != captureModeTiDB {
+				return errors.New("unknown capture mode: " + opts.mode)
+			}
+			if _, err := mysql.ParseDSN(opts.sourceDSN); err != nil {
+				return errors.Annotate(err, "parse source dsn")
+			}
+			db, err := sql.Open("mysql", opts.sourceDSN)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			defer db.Close()
+			// use a single connection so that our own statements can be excluded by connection id
+			db.SetMaxOpenConns(1)
+			out, err := newSessionDumper(opts.output)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			if opts.duration > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, opts.duration)
+				defer cancel()
+			}
+			c := &onlineCapture{
+				db:       db,
+				out:      out,
+				mode:     opts.mode,
+				log:      zap.L().Named("capture"),
+				threads:  make(map[uint64]uint64),
+				sessions: make(map[uint64]struct{}),
+				counts:   make(map[string]int64),
+				schemas:  make(map[string]uint64),
+			}
+			return c.Run(ctx, opts.interval)
+		},
+	}
+	cmd.Flags().StringVar(&opts.sourceDSN, "source-dsn", "", "source dsn")
+	cmd.Flags().StringVarP(&opts.output, "output", "o", "", "output directory")
+	cmd.Flags().StringVar(&opts.mode, "mode", captureModePFS, "capture mode (pfs: performance_schema.events_statements_history_long, tidb: information_schema.statements_summary)")
+	cmd.Flags().DurationVar(&opts.interval, "interval", time.Second, "poll interval")
+	cmd.Flags().DurationVar(&opts.duration, "duration", 0, "stop capturing after the duration (0 means until interrupted)")
+	return cmd
+}
+
+type onlineCapture struct {
+	db   *sql.DB
+	out  *sessionDumper
+	mode string
+	log  *zap.Logger
+
+	// pfs mode
+	bootTime int64
+	connID   uint64
+	threads  map[uint64]uint64 // thread id -> last event id
+	sessions map[uint64]struct{}
+
+	// tidb mode
+	polled  bool
+	counts  map[string]int64
+	schemas map[string]uint64
+}
+
+func (c *onlineCapture) Run(ctx context.Context, interval time.Duration) error {
+	if c.mode == captureModePFS {
+		if err := c.initPFS(ctx); err != nil {
+			return err
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var err error
+		if c.mode == captureModePFS {
+			err = c.pollPFS(ctx)
+		} else {
+			err = c.pollTiDB(ctx, interval)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			c.log.Info("stop capturing")
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *onlineCapture) initPFS(ctx context.Context) error {
+	var (
+		name   string
+		uptime int64
+	)
+	if err := c.db.QueryRowContext(ctx, "show global status like 'Uptime'").Scan(&name, &uptime); err != nil {
+		return errors.Annotate(err, "query uptime")
+	}
+	if err := c.db.QueryRowContext(ctx, "select connection_id()").Scan(&c.connID); err != nil {
+		return errors.Annotate(err, "query connection id")
+	}
+	// TIMER_START is measured in picoseconds since the server started
+	c.bootTime = time.Now().UnixNano()/int64(time.Millisecond) - uptime*1000
+	c.log.Info("capture from performance_schema", zap.Int64("uptime", uptime), zap.Uint64("self", c.connID))
+	return nil
+}
+
+const pfsPollQuery = `select h.THREAD_ID, h.EVENT_ID, h.TIMER_START, h.SQL_TEXT, ifnull(h.CURRENT_SCHEMA, ''), t.PROCESSLIST_ID
+from performance_schema.events_statements_history_long h join performance_schema.threads t on h.THREAD_ID = t.THREAD_ID
+where t.PROCESSLIST_ID is not null and t.PROCESSLIST_ID <> ? and h.NESTING_EVENT_ID is null and h.SQL_TEXT is not null
+order by h.TIMER_START`
+
+func (c *onlineCapture) pollPFS(ctx context.Context) error {
+	rows, err := c.db.QueryContext(ctx, pfsPollQuery, c.connID)
+	if err != nil {
+		return errors.Annotate(err, "poll events_statements_history_long")
+	}
+	defer rows.Close()
+	cnt := 0
+	for rows.Next() {
+		var (
+			thread, eventID, timer, conn uint64
+			query, db                    string
+		)
+		if err = rows.Scan(&thread, &eventID, &timer, &query, &db, &conn); err != nil {
+			return errors.Trace(err)
+		}
+		if last, ok := c.threads[thread]; ok && eventID <= last {
+			continue
+		}
+		c.threads[thread] = eventID
+		t := c.bootTime + int64(timer/1e9)
+		if _, ok := c.sessions[conn]; !ok {
+			if err = c.out.Connect(conn, t, db); err != nil {
+				return err
+			}
+			c.sessions[conn] = struct{}{}
+		}
+		if err = c.out.Query(conn, t, db, query); err != nil {
+			return err
+		}
+		cnt += 1
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	if err = c.closeGoneSessions(ctx); err != nil {
+		return err
+	}
+	if cnt > 0 {
+		c.log.Debug("captured statements", zap.Int("count", cnt), zap.Int("sessions", len(c.sessions)))
+	}
+	return nil
+}
+
+func (c *onlineCapture) closeGoneSessions(ctx context.Context) error {
+	rows, err := c.db.QueryContext(ctx, "select PROCESSLIST_ID from performance_schema.threads where PROCESSLIST_ID is not null")
+	if err != nil {
+		return errors.Annotate(err, "poll threads")
+	}
+	defer rows.Close()
+	alive := make(map[uint64]struct{}, len(c.sessions))
+	for rows.Next() {
+		var conn uint64
+		if err = rows.Scan(&conn); err != nil {
+			return errors.Trace(err)
+		}
+		alive[conn] = struct{}{}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	for conn := range c.sessions {
+		if _, ok := alive[conn]; !ok {
+			c.out.Quit(conn, now)
+			delete(c.sessions, conn)
+		}
+	}
+	return nil
+}
+
+const tidbPollQuery = `select SUMMARY_BEGIN_TIME, DIGEST, ifnull(SCHEMA_NAME, ''), QUERY_SAMPLE_TEXT, EXEC_COUNT
+from information_schema.statements_summary
+where QUERY_SAMPLE_TEXT not like '%statements_summary%'`
+
+// pollTiDB replays increments of execution counts reported by the statements
+// summary. Since only a sample text is kept for each digest, statements are
+// grouped into one synthetic session per schema and evenly spread across the
+// poll interval.
+func (c *onlineCapture) pollTiDB(ctx context.Context, interval time.Duration) error {
+	rows, err := c.db.QueryContext(ctx, tidbPollQuery)
+	if err != nil {
+		return errors.Annotate(err, "poll statements_summary")
+	}
+	defer rows.Close()
+	type pending struct {
+		db    string
+		query string
+		delta int64
+	}
+	var batch []pending
+	for rows.Next() {
+		var (
+			begin, digest, db, query string
+			count                    int64
+		)
+		if err = rows.Scan(&begin, &digest, &db, &query, &count); err != nil {
+			return errors.Trace(err)
+		}
+		key := strings.Join([]string{begin, digest, db}, "/")
+		delta := count - c.counts[key]
+		c.counts[key] = count
+		if c.polled && delta > 0 {
+			batch = append(batch, pending{db, query, delta})
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	if !c.polled {
+		// the first poll only builds the baseline
+		c.polled = true
+		return nil
+	}
+	var total int64
+	for _, p := range batch {
+		total += p.delta
+	}
+	if total == 0 {
+		return nil
+	}
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	step := float64(interval.Milliseconds()) / float64(total)
+	start := now - interval.Milliseconds()
+	var i int64
+	for _, p := range batch {
+		conn, ok := c.schemas[p.db]
+		if !ok {
+			conn = uint64(len(c.schemas) + 1)
+			c.schemas[p.db] = conn
+			if err = c.out.Connect(conn, start, p.db); err != nil {
+				return err
+			}
+		}
+		for j := int64(0); j < p.delta; j++ {
+			if err = c.out.Query(conn, start+int64(float64(i)*step), p.db, p.query); err != nil {
+				return err
+			}
+			i += 1
+		}
+	}
+	c.log.Debug("captured statements", zap.Int64("count", total))
+	return nil
+}
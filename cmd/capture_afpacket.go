@@ -0,0 +1,136 @@
+//go:build linux && afpacket
+// +build linux,afpacket
+
+package cmd
+
+import (
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/afpacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/pingcap/errors"
+	"golang.org/x/net/bpf"
+)
+
+// The afpacket backend reads packets from TPACKETv3 rings mapped into memory,
+// which keeps up with much higher rates than libpcap. Build with
+// `-tags afpacket` to enable it.
+func init() {
+	liveBackends["afpacket"] = openAFPacket
+	registerCapability(capSource, "afpacket")
+}
+
+type afpacketLive struct {
+	*afpacket.TPacket
+}
+
+// openAFPacket opens cfg.fanout sockets of a fanout group, packets of a flow
+// are always delivered to the same socket.
+func openAFPacket(cfg liveSourceConfig) ([]liveSource, error) {
+	frameSize, blockSize, numBlocks := afpacketSizes(cfg.bufferSize, cfg.snaplen)
+	opts := []interface{}{
+		afpacket.OptFrameSize(frameSize),
+		afpacket.OptBlockSize(blockSize),
+		afpacket.OptNumBlocks(numBlocks),
+		afpacket.OptPollTimeout(pollTimeout),
+		afpacket.TPacketVersion3,
+		afpacket.SocketRaw,
+	}
+	if len(cfg.device) > 0 && cfg.device != "any" {
+		opts = append(opts, afpacket.OptInterface(cfg.device))
+	}
+	filter, err := compileBPF(cfg.filter, cfg.snaplen)
+	if err != nil {
+		return nil, err
+	}
+	n := cfg.fanout
+	if n < 1 {
+		n = 1
+	}
+	group := uint16(os.Getpid() & 0xffff)
+	sources := make([]liveSource, 0, n)
+	for i := 0; i < n; i++ {
+		h, err := afpacket.NewTPacket(opts...)
+		if err == nil && len(filter) > 0 {
+			err = h.SetBPF(filter)
+		}
+		if err == nil && n > 1 {
+			err = h.SetFanout(afpacket.FanoutHashWithDefrag, group)
+		}
+		if err != nil {
+			if h != nil {
+				h.Close()
+			}
+			for _, src := range sources {
+				src.Close()
+			}
+			return nil, errors.Trace(err)
+		}
+		sources = append(sources, afpacketLive{h})
+	}
+	return sources, nil
+}
+
+// pollTimeout bounds how long a read waits before checking for cancellation.
+const pollTimeout = 500 * time.Millisecond
+
+// afpacketSizes returns sizes of a ring of about bufferSize MB, frames are
+// large enough for snaplen bytes and blocks are multiples of pages.
+func afpacketSizes(bufferSize int, snaplen int) (frameSize int, blockSize int, numBlocks int) {
+	pageSize := os.Getpagesize()
+	if snaplen < pageSize {
+		frameSize = pageSize / (pageSize / snaplen)
+	} else {
+		frameSize = (snaplen/pageSize + 1) * pageSize
+	}
+	blockSize = frameSize * 128
+	numBlocks = bufferSize << 20 / blockSize
+	if numBlocks < 1 {
+		numBlocks = 1
+	}
+	return
+}
+
+// compileBPF compiles the filter expression by libpcap into raw instructions
+// of the socket filter.
+func compileBPF(expr string, snaplen int) ([]bpf.RawInstruction, error) {
+	if len(expr) == 0 {
+		return nil, nil
+	}
+	insts, err := pcap.CompileBPFFilter(layers.LinkTypeEthernet, snaplen, expr)
+	if err != nil {
+		return nil, errors.Annotate(err, "compile filter")
+	}
+	raw := make([]bpf.RawInstruction, len(insts))
+	for i, inst := range insts {
+		raw[i] = bpf.RawInstruction{Op: inst.Code, Jt: inst.Jt, Jf: inst.Jf, K: inst.K}
+	}
+	return raw, nil
+}
+
+func (h afpacketLive) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := h.TPacket.ReadPacketData()
+	if err == afpacket.ErrTimeout {
+		err = errLiveTimeout
+	}
+	return data, ci, err
+}
+
+func (h afpacketLive) LinkType() layers.LinkType {
+	return layers.LinkTypeEthernet
+}
+
+func (h afpacketLive) Dropped() int {
+	_, st, err := h.SocketStats()
+	if err != nil {
+		return 0
+	}
+	return int(st.Drops())
+}
+
+func (h afpacketLive) Close() {
+	h.TPacket.Close()
+}
@@ -0,0 +1,435 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/stats"
+	"github.com/zyguan/mysql-replay/stream"
+	"go.uber.org/zap"
+)
+
+func init() {
+	registerCapability(capSource, "live")
+}
+
+func NewCaptureLiveCmd() *cobra.Command {
+	var (
+		options = stream.FactoryOptions{Synchronized: true}
+		remote  remoteCapture
+		opts    struct {
+			source          liveSourceConfig
+			backend         string
+			output          string
+			pcapDir         string
+			segmentSize     int64
+			segmentDuration time.Duration
+			retainSize      int64
+			retainAge       time.Duration
+			ports           []uint
+			flushInterval   time.Duration
+			reportInterval  time.Duration
+			duration        time.Duration
+			maxMemory       int64
+		}
+	)
+	cmd := &cobra.Command{
+		Use:   "live",
+		Short: "Capture mysql sessions from a network interface continuously, writing events and rotating raw pcap segments",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(opts.output) == 0 && len(opts.pcapDir) == 0 {
+				return errors.New("neither output nor pcap dir is given")
+			}
+			var err error
+			if options.Ports, err = parsePortMap(nil, opts.ports, stream.MySQL); err != nil {
+				return err
+			}
+			open, ok := liveBackends[opts.backend]
+			if !ok {
+				return errors.New("unsupported capture backend: " + opts.backend)
+			} else if remote.Enabled() {
+				opts.backend = "ssh"
+				open = func(cfg liveSourceConfig) ([]liveSource, error) { return openRemoteLive(remote, cfg) }
+			}
+			if len(opts.source.filter) == 0 {
+				opts.source.filter = portFilter(opts.ports)
+			}
+			sources, err := open(opts.source)
+			if err != nil {
+				return errors.Annotate(err, "open "+opts.source.device)
+			}
+			defer func() {
+				for _, src := range sources {
+					src.Close()
+				}
+			}()
+
+			var roller *pcapRoller
+			if len(opts.pcapDir) > 0 {
+				if err = os.MkdirAll(opts.pcapDir, 0755); err != nil {
+					return errors.Trace(err)
+				}
+				roller = &pcapRoller{
+					dir:         opts.pcapDir,
+					snaplen:     uint32(opts.source.snaplen),
+					linkType:    sources[0].LinkType(),
+					maxSize:     opts.segmentSize,
+					maxDuration: opts.segmentDuration,
+					retainSize:  opts.retainSize,
+					retainAge:   opts.retainAge,
+					log:         zap.L().Named("pcap"),
+				}
+				defer roller.Close()
+			}
+			var assembler *dumpAssembler
+			if len(opts.output) > 0 {
+				if err = os.MkdirAll(opts.output, 0755); err != nil {
+					return errors.Trace(err)
+				}
+				budget := stream.NewMemoryBudget(opts.maxMemory)
+				options.Budget = budget
+				factory := stream.NewFactoryFromEventHandler(func(conn stream.ConnID) stream.MySQLEventHandler {
+					log := conn.Logger("capture")
+					out, err := os.CreateTemp(opts.output, "."+conn.HashStr()+".*")
+					if err != nil {
+						log.Error("failed to create file for dumping events", zap.Error(err))
+						return nil
+					}
+					h := newTextDumpHandler(conn.HashStr(), out, log, budget)
+					h.header.Source, h.header.Server = conn.SrcAddr(), conn.DstAddr()
+					return h
+				}, options)
+				assembler = newDumpAssembler(factory, 1, opts.flushInterval, budget)
+				defer assembler.Close()
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			if opts.duration > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, opts.duration)
+				defer cancel()
+			}
+			zap.L().Info("start capturing", zap.String("device", opts.source.device), zap.String("filter", opts.source.filter),
+				zap.String("backend", opts.backend), zap.Int("sockets", len(sources)))
+			c := &liveCapture{sources: sources, roller: roller, assembler: assembler}
+			return c.Run(ctx, opts.reportInterval)
+		},
+	}
+	cmd.Flags().StringVar(&opts.backend, "backend", "pcap", "capture backend ("+strings.Join(liveBackendNames(), "|")+")")
+	cmd.Flags().StringVarP(&opts.source.device, "interface", "i", "any", "network interface to capture from")
+	cmd.Flags().StringVar(&opts.source.filter, "filter", "", "bpf filter of packets (defaults to tcp packets of the mysql ports if any)")
+	cmd.Flags().IntVar(&opts.source.snaplen, "snaplen", 65535, "max bytes captured of each packet")
+	cmd.Flags().BoolVar(&opts.source.promisc, "promisc", false, "capture in promiscuous mode")
+	cmd.Flags().IntVar(&opts.source.fanout, "fanout", 1, "number of sockets in a fanout group read by goroutines of their own (afpacket only)")
+	cmd.Flags().IntVar(&opts.source.bufferSize, "buffer-size", 64, "size of the ring buffer of each socket in MB (afpacket only)")
+	cmd.Flags().StringVarP(&opts.output, "output", "o", "", "output directory of events")
+	cmd.Flags().StringVar(&opts.pcapDir, "pcap-dir", "", "output directory of raw pcap segments")
+	cmd.Flags().Int64Var(&opts.segmentSize, "segment-size", 256<<20, "start a new pcap segment once the current one reaches the size in bytes (0 means unlimited)")
+	cmd.Flags().DurationVar(&opts.segmentDuration, "segment-duration", 10*time.Minute, "start a new pcap segment once the current one spans the duration (0 means unlimited)")
+	cmd.Flags().Int64Var(&opts.retainSize, "retain-size", 0, "remove the oldest pcap segments once their total size exceeds the bytes (0 means unlimited)")
+	cmd.Flags().DurationVar(&opts.retainAge, "retain-age", 0, "remove pcap segments older than the duration (0 means unlimited)")
+	cmd.Flags().UintSliceVar(&opts.ports, "mysql-port", nil, "tcp ports of mysql servers, only connections to them are captured if any port is given (can be repeated)")
+	cmd.Flags().BoolVar(&options.ForceStart, "force-start", true, "accept streams even if no SYN have been seen")
+	cmd.Flags().BoolVar(&options.Results, "affected-rows", false, "dump rows affected (and latencies) of statements responded with ok packets, which are compared by play")
+	cmd.Flags().DurationVar(&opts.flushInterval, "flush-interval", time.Minute, "flush interval")
+	cmd.Flags().DurationVar(&opts.reportInterval, "report-interval", 5*time.Second, "report interval")
+	cmd.Flags().DurationVar(&opts.duration, "duration", 0, "stop capturing after the duration (0 means until interrupted)")
+	cmd.Flags().Int64Var(&opts.maxMemory, "max-memory", 0, "bound bytes buffered for reassembly and writing, streams idle for the longest time are closed once it's exceeded (0 means unlimited)")
+	remote.Register(cmd.Flags())
+	return cmd
+}
+
+// liveSourceConfig configures sources opened by capture backends.
+type liveSourceConfig struct {
+	device     string
+	filter     string
+	snaplen    int
+	promisc    bool
+	fanout     int
+	bufferSize int
+}
+
+// liveSource reads packets of a network interface, ReadPacketData returns
+// errLiveTimeout if no packet arrives for a while.
+type liveSource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+	// Dropped returns the number of packets dropped so far due to lack of
+	// buffer space.
+	Dropped() int
+	Close()
+}
+
+var errLiveTimeout = errors.New("live capture timeout")
+
+// liveBackends open sources of capture backends by names, a backend may open
+// several sources read concurrently (e.g. sockets of a fanout group).
+var liveBackends = map[string]func(cfg liveSourceConfig) ([]liveSource, error){
+	"pcap": openPcapLive,
+}
+
+func liveBackendNames() []string {
+	names := make([]string, 0, len(liveBackends))
+	for name := range liveBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type pcapLive struct {
+	*pcap.Handle
+}
+
+func openPcapLive(cfg liveSourceConfig) ([]liveSource, error) {
+	handle, err := pcap.OpenLive(cfg.device, int32(cfg.snaplen), cfg.promisc, 500*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	if err = handle.SetBPFFilter(cfg.filter); err != nil {
+		handle.Close()
+		return nil, errors.Annotate(err, "set filter")
+	}
+	return []liveSource{pcapLive{handle}}, nil
+}
+
+func (h pcapLive) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := h.Handle.ReadPacketData()
+	if err == pcap.NextErrorTimeoutExpired {
+		err = errLiveTimeout
+	}
+	return data, ci, err
+}
+
+func (h pcapLive) Dropped() int {
+	st, err := h.Stats()
+	if err != nil {
+		return 0
+	}
+	return st.PacketsDropped
+}
+
+type liveCapture struct {
+	sources   []liveSource
+	roller    *pcapRoller
+	assembler *dumpAssembler
+
+	dropped int
+}
+
+// Run reads packets until ctx is done, sources are read and packets are
+// decoded concurrently, then each packet is written to the current pcap
+// segment and passed to the assembler in turn.
+func (c *liveCapture) Run(ctx context.Context, reportInterval time.Duration) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		ch   = make(chan gopacket.Packet, 4096)
+		errs = make(chan error, len(c.sources)+1)
+		wg   sync.WaitGroup
+	)
+	for _, src := range c.sources {
+		wg.Add(1)
+		go func(src liveSource) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				data, ci, err := src.ReadPacketData()
+				if err == errLiveTimeout {
+					continue
+				} else if err == io.EOF {
+					// the source ends, e.g. tcpdump of a remote capture exits
+					cancel()
+					return
+				} else if err != nil {
+					errs <- errors.Annotate(err, "read packet")
+					cancel()
+					return
+				}
+				pkt := gopacket.NewPacket(data, src.LinkType(), gopacket.NoCopy)
+				pkt.Metadata().CaptureInfo = ci
+				select {
+				case ch <- pkt:
+				case <-ctx.Done():
+				}
+			}
+		}(src)
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	ticker := time.NewTicker(reportInterval)
+	defer ticker.Stop()
+	failed := false
+	for {
+		var pkt gopacket.Packet
+		select {
+		case <-ticker.C:
+			c.report()
+			continue
+		case pkt = <-ch:
+		}
+		if pkt == nil {
+			// all sources are stopped
+			break
+		}
+		if c.roller != nil && !failed {
+			if err := c.roller.Write(pkt.Metadata().CaptureInfo, pkt.Data()); err != nil {
+				// packets queued are still assembled before exiting
+				errs <- err
+				failed = true
+				cancel()
+			}
+		}
+		if c.assembler != nil {
+			c.assembler.Assemble(pkt)
+		}
+	}
+	c.report()
+	zap.L().Info("stop capturing")
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func (c *liveCapture) report() {
+	dropped := 0
+	for _, src := range c.sources {
+		dropped += src.Dropped()
+	}
+	stats.Add(stats.DroppedPackets, int64(dropped-c.dropped))
+	c.dropped = dropped
+	zap.L().Info("stats",
+		zap.Int64(stats.DataIn, stats.Get(stats.DataIn)),
+		zap.Int64(stats.DataOut, stats.Get(stats.DataOut)),
+		zap.Int64(stats.Packets, stats.Get(stats.Packets)),
+		zap.Int64(stats.DroppedPackets, stats.Get(stats.DroppedPackets)),
+		zap.Int64(stats.Gaps, stats.Get(stats.Gaps)))
+}
+
+// pcapRoller writes packets into pcap segments named like capture-<ms>.pcap
+// under dir, a new segment is started once the current one reaches maxSize or
+// spans maxDuration, and old segments are removed by the retention then.
+type pcapRoller struct {
+	dir         string
+	snaplen     uint32
+	linkType    layers.LinkType
+	maxSize     int64
+	maxDuration time.Duration
+	retainSize  int64
+	retainAge   time.Duration
+	log         *zap.Logger
+
+	f     *os.File
+	bw    *bufio.Writer
+	w     *pcapgo.Writer
+	size  int64
+	start time.Time
+}
+
+func (r *pcapRoller) Write(ci gopacket.CaptureInfo, data []byte) error {
+	if r.f == nil || (r.maxSize > 0 && r.size >= r.maxSize) || (r.maxDuration > 0 && ci.Timestamp.Sub(r.start) >= r.maxDuration) {
+		if err := r.rotate(ci.Timestamp); err != nil {
+			return err
+		}
+	}
+	if err := r.w.WritePacket(ci, data); err != nil {
+		return errors.Annotate(err, "write "+r.f.Name())
+	}
+	// each record has a 16 bytes header
+	r.size += int64(len(data)) + 16
+	return nil
+}
+
+func (r *pcapRoller) rotate(t time.Time) error {
+	if err := r.Close(); err != nil {
+		return err
+	}
+	name := filepath.Join(r.dir, fmt.Sprintf("capture-%d.pcap", t.UnixNano()/int64(time.Millisecond)))
+	f, err := os.Create(name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	r.f, r.bw, r.start = f, bufio.NewWriterSize(f, 65536), t
+	r.w = pcapgo.NewWriter(r.bw)
+	if err = r.w.WriteFileHeader(r.snaplen, r.linkType); err != nil {
+		return errors.Annotate(err, "write "+name)
+	}
+	r.size = 24
+	r.log.Info("start a new segment", zap.String("name", name))
+	r.retain(t)
+	return nil
+}
+
+// retain removes the oldest segments except the current one until the rest
+// fit in the retention.
+func (r *pcapRoller) retain(now time.Time) {
+	if r.retainSize <= 0 && r.retainAge <= 0 {
+		return
+	}
+	names, err := filepath.Glob(filepath.Join(r.dir, "capture-*.pcap"))
+	if err != nil {
+		return
+	}
+	type segment struct {
+		name  string
+		size  int64
+		mtime time.Time
+	}
+	segments := make([]segment, 0, len(names))
+	total := int64(0)
+	for _, name := range names {
+		if name == r.f.Name() {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil {
+			segments = append(segments, segment{name, fi.Size(), fi.ModTime()})
+			total += fi.Size()
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].mtime.Before(segments[j].mtime) })
+	for _, s := range segments {
+		if (r.retainSize <= 0 || total <= r.retainSize) && (r.retainAge <= 0 || now.Sub(s.mtime) <= r.retainAge) {
+			break
+		}
+		if err := os.Remove(s.name); err != nil {
+			r.log.Warn("failed to remove "+s.name, zap.Error(err))
+			continue
+		}
+		r.log.Info("remove an expired segment", zap.String("name", s.name))
+		total -= s.size
+	}
+}
+
+// Close flushes and closes the current segment.
+func (r *pcapRoller) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	err := r.bw.Flush()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	r.f = nil
+	return errors.Trace(err)
+}
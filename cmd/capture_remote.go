@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/pingcap/errors"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	registerCapability(capSource, "ssh")
+}
+
+// remoteCapture runs tcpdump on a remote host over ssh, the pcap stream it
+// writes to stdout is read locally, so nothing but tcpdump is needed on the
+// host.
+type remoteCapture struct {
+	Host    string
+	TCPDump string
+}
+
+func (r *remoteCapture) Register(flags *pflag.FlagSet) {
+	flags.StringVar(&r.Host, "remote", "", "capture by tcpdump on the remote host like user@host over ssh")
+	flags.StringVar(&r.TCPDump, "remote-tcpdump", "tcpdump", "tcpdump command on the remote host (e.g. 'sudo tcpdump')")
+}
+
+func (r remoteCapture) Enabled() bool {
+	return len(r.Host) > 0
+}
+
+// Open starts the remote capture and returns its pcap stream, closing the
+// stream stops the capture.
+func (r remoteCapture) Open(cfg liveSourceConfig) (io.ReadCloser, error) {
+	script := fmt.Sprintf("%s -i %s -s %d -U -w -", r.TCPDump, shellQuote(cfg.device), cfg.snaplen)
+	if !cfg.promisc {
+		script += " -p"
+	}
+	if len(cfg.filter) > 0 {
+		script += " " + shellQuote(cfg.filter)
+	}
+	cmd := exec.Command("ssh", "-o", "BatchMode=yes", r.Host, script)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, errors.Annotate(err, "start ssh")
+	}
+	return &sshStream{ReadCloser: out, cmd: cmd}, nil
+}
+
+type sshStream struct {
+	io.ReadCloser
+	cmd  *exec.Cmd
+	once sync.Once
+}
+
+// Close kills ssh, then tcpdump exits once the connection is closed.
+func (s *sshStream) Close() error {
+	s.once.Do(func() {
+		s.cmd.Process.Kill()
+		s.ReadCloser.Close()
+		s.cmd.Wait()
+	})
+	return nil
+}
+
+// Read passes packets of the remote capture to h until it's interrupted by
+// SIGINT or SIGTERM.
+func (r remoteCapture) Read(cfg liveSourceConfig, h func(pkt gopacket.Packet)) error {
+	in, err := r.Open(cfg)
+	if err != nil {
+		return err
+	}
+	f, err := newPcapFile(in)
+	if err != nil {
+		return errors.Annotate(err, "read remote capture")
+	}
+	defer f.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		in.Close()
+	}()
+	for {
+		data, ci, err := f.ReadPacketData()
+		if err == io.EOF || (err != nil && ctx.Err() != nil) {
+			return nil
+		} else if err != nil {
+			return errors.Annotate(err, "read remote capture")
+		}
+		pkt := gopacket.NewPacket(data, f.linkType, gopacket.NoCopy)
+		pkt.Metadata().CaptureInfo = ci
+		h(pkt)
+	}
+}
+
+// portFilter returns a bpf filter of tcp packets of the ports, or all tcp
+// packets if there is no port.
+func portFilter(ports []uint) string {
+	if len(ports) == 0 {
+		return "tcp"
+	}
+	exprs := make([]string, len(ports))
+	for i, port := range ports {
+		exprs[i] = fmt.Sprintf("tcp port %d", port)
+	}
+	return strings.Join(exprs, " or ")
+}
+
+// shellQuote quotes s as a single word of posix shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteLive is a live source reading the pcap stream of a remote capture.
+type remoteLive struct {
+	f    *pcapFile
+	ch   chan remotePacket
+	done chan struct{}
+}
+
+type remotePacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+	err  error
+}
+
+func openRemoteLive(r remoteCapture, cfg liveSourceConfig) ([]liveSource, error) {
+	in, err := r.Open(cfg)
+	if err != nil {
+		return nil, err
+	}
+	f, err := newPcapFile(in)
+	if err != nil {
+		return nil, errors.Annotate(err, "read remote capture")
+	}
+	src := &remoteLive{f: f, ch: make(chan remotePacket, 1024), done: make(chan struct{})}
+	go func() {
+		for {
+			data, ci, err := f.ReadPacketData()
+			select {
+			case src.ch <- remotePacket{data, ci, err}:
+			case <-src.done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return []liveSource{src}, nil
+}
+
+func (src *remoteLive) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	timer := time.NewTimer(500 * time.Millisecond)
+	defer timer.Stop()
+	select {
+	case pkt := <-src.ch:
+		return pkt.data, pkt.ci, pkt.err
+	case <-timer.C:
+		return nil, gopacket.CaptureInfo{}, errLiveTimeout
+	}
+}
+
+func (src *remoteLive) LinkType() layers.LinkType {
+	return src.f.linkType
+}
+
+// Dropped returns 0 since drops are only reported by tcpdump on exit.
+func (src *remoteLive) Dropped() int {
+	return 0
+}
+
+func (src *remoteLive) Close() {
+	close(src.done)
+	src.f.Close()
+}
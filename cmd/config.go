@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// configArgsKey is the key of positional args of a command in config files.
+const configArgsKey = "args"
+
+// configFile holds values of flags loaded from a yaml (or json) or toml file,
+// like:
+//
+//	log-level: info
+//	text:
+//	  play:
+//	    args: [./dump]
+//	    target-dsn: root:@tcp(127.0.0.1:4000)/
+//	    speed: 2
+//
+// Keys of the top level apply to any command having the flags, keys of the
+// section of a command (nested by the path of the command) must be flags of
+// the command. Flags set in the command line override the ones in the file,
+// and so do positional args.
+type configFile struct {
+	path   string
+	values map[string]interface{}
+	loaded bool
+}
+
+// load loads the file given by --config once.
+func (cf *configFile) load() error {
+	if cf.loaded {
+		return nil
+	}
+	cf.loaded = true
+	if len(cf.path) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(cf.path)
+	if err != nil {
+		return errors.Annotate(err, "read config")
+	}
+	var values map[string]interface{}
+	if strings.EqualFold(filepath.Ext(cf.path), ".toml") {
+		err = toml.Unmarshal(data, &values)
+	} else {
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return errors.Annotate(err, "parse config "+cf.path)
+	}
+	cf.values, _ = normalizeConfig(values).(map[string]interface{})
+	return nil
+}
+
+// sections returns the top level and sections of the command and its parents,
+// own tells whether the last one is the section of the command itself.
+func (cf *configFile) sections(c *cobra.Command) (out []map[string]interface{}, own bool) {
+	var path []string
+	for p := c; p.HasParent(); p = p.Parent() {
+		path = append([]string{p.Name()}, path...)
+	}
+	out = []map[string]interface{}{cf.values}
+	for _, name := range path {
+		section, ok := out[len(out)-1][name].(map[string]interface{})
+		if !ok {
+			return out, false
+		}
+		out = append(out, section)
+	}
+	return out, len(path) > 0
+}
+
+// Args returns args of the command, which are the ones in the file if no
+// positional arg is given.
+func (cf *configFile) Args(c *cobra.Command, args []string) ([]string, error) {
+	if err := cf.load(); err != nil || len(args) > 0 || cf.values == nil {
+		return args, err
+	}
+	sections, _ := cf.sections(c)
+	for _, section := range sections {
+		if v, ok := section[configArgsKey].([]string); ok {
+			args = v
+		} else if v, ok := section[configArgsKey].(string); ok {
+			args = []string{v}
+		}
+	}
+	return args, nil
+}
+
+// Apply sets flags of the command not set in the command line, values of
+// sections of subcommands override the ones of their parents.
+func (cf *configFile) Apply(c *cobra.Command) error {
+	if err := cf.load(); err != nil || cf.values == nil {
+		return err
+	}
+	var (
+		flags         = c.Flags()
+		values        = make(map[string]interface{})
+		sections, own = cf.sections(c)
+	)
+	for i, section := range sections {
+		for name, v := range section {
+			if name == configArgsKey {
+				continue
+			}
+			if _, ok := v.(map[string]interface{}); ok {
+				continue
+			}
+			if flags.Lookup(name) == nil {
+				if own && i == len(sections)-1 {
+					return errors.Errorf("unknown flag in config %s: %s", cf.path, name)
+				}
+				continue
+			}
+			values[name] = v
+		}
+	}
+	for name, v := range values {
+		flag := flags.Lookup(name)
+		if flag.Changed {
+			continue
+		}
+		items, ok := v.([]string)
+		if !ok {
+			items = []string{v.(string)}
+		}
+		for _, item := range items {
+			if err := flags.Set(name, item); err != nil {
+				return errors.Annotatef(err, "set %s from config", name)
+			}
+		}
+	}
+	return nil
+}
+
+// withConfig makes commands (and their subcommands) take args and flags from
+// the config file.
+func withConfig(c *cobra.Command, cf *configFile) {
+	for _, sub := range c.Commands() {
+		withConfig(sub, cf)
+	}
+	if !c.Runnable() {
+		return
+	}
+	validate := c.Args
+	c.Args = func(c *cobra.Command, args []string) error {
+		args, err := cf.Args(c, args)
+		if err != nil || validate == nil {
+			return err
+		}
+		return validate(c, args)
+	}
+	if run := c.RunE; run != nil {
+		c.RunE = func(c *cobra.Command, args []string) error {
+			args, _ = cf.Args(c, args)
+			return run(c, args)
+		}
+	} else if run := c.Run; run != nil {
+		c.Run = func(c *cobra.Command, args []string) {
+			args, _ = cf.Args(c, args)
+			run(c, args)
+		}
+	}
+}
+
+// normalizeConfig converts values decoded from yaml or toml to maps of strings
+// and lists of strings.
+func normalizeConfig(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, x := range v {
+			out[k] = normalizeConfig(x)
+		}
+		return out
+	case []interface{}:
+		out := make([]string, len(v))
+		for i, x := range v {
+			out[i] = fmt.Sprint(normalizeConfig(x))
+		}
+		return out
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
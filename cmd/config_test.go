@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+// newConfigTestCommands returns a command tree like `root text play` and
+// `root text dump` with a few flags.
+func newConfigTestCommands() (*cobra.Command, *cobra.Command, *cobra.Command) {
+	root := &cobra.Command{Use: "root"}
+	root.PersistentFlags().String("log-level", "info", "")
+	text := &cobra.Command{Use: "text"}
+	play := &cobra.Command{Use: "play", Run: func(*cobra.Command, []string) {}}
+	play.Flags().String("target-dsn", "", "")
+	play.Flags().Float64("speed", 1, "")
+	play.Flags().Bool("dry-run", false, "")
+	play.Flags().StringSlice("agents", nil, "")
+	dump := &cobra.Command{Use: "dump", Run: func(*cobra.Command, []string) {}}
+	dump.Flags().String("output", "", "")
+	dump.Flags().Float64("speed", 1, "")
+	text.AddCommand(play, dump)
+	root.AddCommand(text)
+	return root, play, dump
+}
+
+func TestConfigFile(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		file    string
+		content string
+		flags   []string
+		args    []string
+		// expect are values of flags of `text play`, expectArgs are its args
+		expect     map[string]string
+		expectArgs []string
+		err        string
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			content: `log-level: debug
+speed: 3
+text:
+  play:
+    args: [./dump]
+    target-dsn: root:@tcp(127.0.0.1:4000)/
+    dry-run: true
+    agents: [a1, a2]
+`,
+			expect: map[string]string{
+				"log-level":  "debug",
+				"target-dsn": "root:@tcp(127.0.0.1:4000)/",
+				"speed":      "3",
+				"dry-run":    "true",
+				"agents":     "[a1,a2]",
+			},
+			expectArgs: []string{"./dump"},
+		},
+		{
+			name: "toml",
+			file: "config.toml",
+			content: `log-level = "debug" # comment
+speed = 3
+
+[text.play]
+args = "./dump"
+target-dsn = 'root:@tcp(127.0.0.1:4000)/'
+dry-run = true
+agents = ["a1", "a#2"]
+`,
+			expect: map[string]string{
+				"log-level":  "debug",
+				"target-dsn": "root:@tcp(127.0.0.1:4000)/",
+				"speed":      "3",
+				"dry-run":    "true",
+				"agents":     "[a1,a#2]",
+			},
+			expectArgs: []string{"./dump"},
+		},
+		{
+			name: "command line overrides",
+			file: "config.yaml",
+			content: `speed: 3
+text:
+  play:
+    args: [./dump]
+    speed: 2
+    target-dsn: root:@tcp(127.0.0.1:4000)/
+`,
+			flags: []string{"--speed=5"},
+			args:  []string{"./other"},
+			expect: map[string]string{
+				"log-level":  "info",
+				"target-dsn": "root:@tcp(127.0.0.1:4000)/",
+				"speed":      "5",
+			},
+			expectArgs: []string{"./other"},
+		},
+		{
+			name: "sections override parents",
+			file: "config.toml",
+			content: `speed = 3
+
+[text]
+speed = 2
+
+[text.dump]
+speed = 4
+output = "./out"
+
+[text.play]
+dry-run = true
+`,
+			expect: map[string]string{
+				"speed":   "2",
+				"dry-run": "true",
+			},
+		},
+		{
+			name: "unknown flag of the command",
+			file: "config.yaml",
+			content: `text:
+  play:
+    output: ./out
+`,
+			err: "unknown flag in config",
+		},
+		{
+			name:    "invalid toml",
+			file:    "config.toml",
+			content: "speed = \n",
+			err:     "parse config",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0644))
+			_, play, _ := newConfigTestCommands()
+			require.NoError(t, play.ParseFlags(tt.flags))
+			cf := &configFile{path: path}
+			err := cf.Apply(play)
+			if len(tt.err) > 0 {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.err)
+				return
+			}
+			require.NoError(t, err)
+			for name, value := range tt.expect {
+				require.Equal(t, value, play.Flags().Lookup(name).Value.String(), name)
+			}
+			args, err := cf.Args(play, tt.args)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectArgs, args)
+		})
+	}
+}
+
+func TestConfigFileSubcommand(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	require.NoError(t, os.WriteFile(path, []byte(`speed = 3
+
+[text.play]
+args = ["./dump"]
+dry-run = true
+
+[text.dump]
+output = "./out"
+`), 0644))
+	_, play, dump := newConfigTestCommands()
+	cf := &configFile{path: path}
+
+	// sections of other commands are not applied
+	require.NoError(t, cf.Apply(dump))
+	require.Equal(t, "./out", dump.Flags().Lookup("output").Value.String())
+	require.Equal(t, "3", dump.Flags().Lookup("speed").Value.String())
+	args, err := cf.Args(dump, nil)
+	require.NoError(t, err)
+	require.Empty(t, args)
+
+	require.NoError(t, cf.Apply(play))
+	require.Equal(t, "true", play.Flags().Lookup("dry-run").Value.String())
+	args, err = cf.Args(play, nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{"./dump"}, args)
+}
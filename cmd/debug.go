@@ -0,0 +1,24 @@
+package cmd
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+var publishStats sync.Once
+
+// serveDebug serves pprof (/debug/pprof/) and expvar (/debug/vars) in
+// background, expvar includes counters and the lagging (in ms) of stats.
+func serveDebug(addr string) {
+	publishStats.Do(func() {
+		expvar.Publish("stats", expvar.Func(func() interface{} { return stats.Dump() }))
+		expvar.Publish("lagging", expvar.Func(func() interface{} { return stats.GetLagging().Milliseconds() }))
+	})
+	go func() {
+		zap.L().Info("serve debug endpoints", zap.String("addr", addr), zap.Error(http.ListenAndServe(addr, nil)))
+	}()
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	registerCapability(capSource, "genlog")
+}
+
+func NewGenLogCommand() *cobra.Command {
+	return newImportCommand("genlog", "Replay MySQL general query logs", parseGenLog)
+}
+
+type genLogEntry struct {
+	time    int64
+	conn    uint64
+	command string
+	args    []string
+}
+
+func (e *genLogEntry) flush(out *sessionDumper) error {
+	if len(e.command) == 0 {
+		return nil
+	}
+	defer func() { e.command, e.args = "", e.args[:0] }()
+	arg := strings.Join(e.args, "\n")
+	switch e.command {
+	case "Connect":
+		db := ""
+		if i := strings.Index(arg, " on "); i >= 0 {
+			db = arg[i+4:]
+			if j := strings.Index(db, " using "); j >= 0 {
+				db = db[:j]
+			}
+			db = strings.TrimSpace(db)
+		}
+		return out.Connect(e.conn, e.time, db)
+	case "Init DB":
+		return out.Use(e.conn, e.time, strings.TrimSpace(arg))
+	case "Query", "Execute":
+		if query := strings.TrimSpace(arg); len(query) > 0 {
+			return out.Query(e.conn, e.time, "", query)
+		}
+	case "Quit":
+		out.Quit(e.conn, e.time)
+	}
+	return nil
+}
+
+// parseGenLog parses general query logs, whose lines look like:
+//
+//	2021-06-01T10:00:00.123456Z	   12 Connect	root@localhost on test using Socket
+//	2021-06-01T10:00:00.234567Z	   12 Query	select 1
+//
+// Old versions of MySQL only print the time when it changes, and statements
+// spanning multiple lines are continued without any prefix. Prepared
+// statements are replayed by the interpolated text logged as `Execute`.
+func parseGenLog(in io.Reader, out *sessionDumper) error {
+	var (
+		r     = bufio.NewReaderSize(in, 1048576)
+		entry genLogEntry
+		last  int64
+	)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return errors.Trace(err)
+		}
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if t, conn, command, arg, ok := parseGenLogLine(line); ok {
+			if ferr := entry.flush(out); ferr != nil {
+				return ferr
+			}
+			if t > 0 {
+				last = t
+			}
+			entry.time, entry.conn, entry.command = last, conn, command
+			entry.args = append(entry.args, arg)
+		} else if len(entry.command) > 0 {
+			if strings.Contains(line, ", Version: ") && strings.Contains(line, "started with:") {
+				if ferr := entry.flush(out); ferr != nil {
+					return ferr
+				}
+			} else {
+				entry.args = append(entry.args, line)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return entry.flush(out)
+}
+
+var genLogCommands = map[string]bool{
+	"Connect": true, "Quit": true, "Query": true, "Init DB": true, "Prepare": true, "Execute": true,
+	"Close stmt": true, "Reset stmt": true, "Long Data": true, "Field List": true, "Statistics": true,
+	"Ping": true, "Change user": true, "Set option": true, "Fetch": true, "Processlist": true,
+	"Refresh": true, "Shutdown": true, "Kill": true, "Debug": true, "Binlog Dump": true,
+	"Binlog Dump GTID": true, "Register Slave": true, "Reset Connection": true,
+}
+
+func parseGenLogLine(line string) (t int64, conn uint64, command string, arg string, ok bool) {
+	i := strings.IndexByte(line, '\t')
+	if i < 0 {
+		return
+	}
+	if head := strings.TrimSpace(line[:i]); len(head) > 0 {
+		ts := parseSlowLogTime(head)
+		if ts.IsZero() {
+			return
+		}
+		t = ts.UnixNano() / int64(time.Millisecond)
+	}
+	rest := strings.TrimLeft(line[i+1:], " \t")
+	j := 0
+	for j < len(rest) && rest[j] >= '0' && rest[j] <= '9' {
+		j++
+	}
+	if j == 0 || j >= len(rest) || rest[j] != ' ' {
+		return
+	}
+	conn, _ = strconv.ParseUint(rest[:j], 10, 64)
+	rest = rest[j+1:]
+	if k := strings.IndexByte(rest, '\t'); k >= 0 {
+		command, arg = rest[:k], rest[k+1:]
+	} else {
+		command = rest
+	}
+	command = strings.TrimSpace(command)
+	ok = genLogCommands[command]
+	return
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/zyguan/mysql-replay/event"
+)
+
+func TestParseGenLog(t *testing.T) {
+	var (
+		t1 = localMillis("060102 15:04:05", "210601 10:00:01")
+		t2 = localMillis("060102 15:04:05", "210601 10:00:02")
+	)
+	testImport(t, parseGenLog, []importCase{
+		{
+			name: "mysql8",
+			input: "/usr/sbin/mysqld, Version: 8.0.26 (MySQL Community Server - GPL). started with:\n" +
+				"Tcp port: 3306  Unix socket: /var/run/mysqld/mysqld.sock\n" +
+				"Time                 Id Command    Argument\n" +
+				"2021-06-01T10:00:00.000000Z\t   12 Connect\troot@localhost on test using Socket\n" +
+				"2021-06-01T10:00:00.100000Z\t   12 Query\tselect 1\n" +
+				"2021-06-01T10:00:00.200000Z\t   12 Query\tselect *\n" +
+				"from t\n" +
+				"where a = 1\n" +
+				"2021-06-01T10:00:00.300000Z\t   12 Init DB\tdb2\n" +
+				"2021-06-01T10:00:00.400000Z\t   12 Prepare\tselect ?\n" +
+				"2021-06-01T10:00:00.500000Z\t   12 Execute\tselect 2\n" +
+				"2021-06-01T10:00:00.600000Z\t   12 Quit\t\n",
+			expect: map[uint64][]event.MySQLEvent{
+				12: {
+					{Time: 1622541600000, Type: event.EventHandshake, DB: "test"},
+					{Time: 1622541600100, Type: event.EventQuery, Query: "select 1"},
+					{Time: 1622541600200, Type: event.EventQuery, Query: "select *\nfrom t\nwhere a = 1"},
+					{Time: 1622541600300, Type: event.EventQuery, Query: "use `db2`"},
+					{Time: 1622541600500, Type: event.EventQuery, Query: "select 2"},
+					{Time: 1622541600600, Type: event.EventQuit},
+				},
+			},
+		},
+		{
+			name: "mysql5 without times of lines in the same second",
+			input: "210601 10:00:01\t    3 Connect\tu@localhost on \n" +
+				"\t\t    3 Query\tselect 1\n" +
+				"\t\t    4 Connect\tu@localhost on db3\n" +
+				"210601 10:00:02\t    4 Query\tselect 2\n" +
+				"\t\t    4 Quit\t\n",
+			expect: map[uint64][]event.MySQLEvent{
+				3: {
+					{Time: t1, Type: event.EventHandshake},
+					{Time: t1, Type: event.EventQuery, Query: "select 1"},
+				},
+				4: {
+					{Time: t1, Type: event.EventHandshake, DB: "db3"},
+					{Time: t2, Type: event.EventQuery, Query: "select 2"},
+					{Time: t2, Type: event.EventQuit},
+				},
+			},
+		},
+		{
+			name: "restarts end multi-line statements",
+			input: "2021-06-01T10:00:00.000000Z\t    5 Query\tselect 1\n" +
+				"/usr/sbin/mysqld, Version: 8.0.26 (MySQL Community Server - GPL). started with:\n" +
+				"Tcp port: 3306  Unix socket: /var/run/mysqld/mysqld.sock\n",
+			expect: map[uint64][]event.MySQLEvent{
+				5: {
+					{Time: 1622541600000, Type: event.EventHandshake},
+					{Time: 1622541600000, Type: event.EventQuery, Query: "select 1"},
+				},
+			},
+		},
+	})
+}
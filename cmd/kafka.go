@@ -0,0 +1,311 @@
+package cmd
+
+import (
+	"context"
+	"hash/fnv"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/segmentio/kafka-go"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+const kafkaScheme = "kafka://"
+
+func init() {
+	registerCapability(capSource, "kafka")
+	registerCapability(capSink, "kafka")
+}
+
+// parseKafkaURL parses urls like kafka://broker1:9092,broker2:9092/topic.
+func parseKafkaURL(s string) ([]string, string, error) {
+	if !strings.HasPrefix(s, kafkaScheme) {
+		return nil, "", errors.New("not a kafka url: " + s)
+	}
+	s = s[len(kafkaScheme):]
+	i := strings.IndexByte(s, '/')
+	if i <= 0 || i == len(s)-1 {
+		return nil, "", errors.New("kafka url should look like kafka://broker[,broker...]/topic")
+	}
+	return strings.Split(s[:i], ","), s[i+1:], nil
+}
+
+func isKafkaURL(s string) bool {
+	return strings.HasPrefix(s, kafkaScheme)
+}
+
+// newKafkaWriter returns an async writer which keys messages by session, thus
+// events of a session always go to the same partition in order.
+func newKafkaWriter(url string) (*kafka.Writer, error) {
+	brokers, topic, err := parseKafkaURL(url)
+	if err != nil {
+		return nil, err
+	}
+	log := zap.L().Named("kafka")
+	return &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: 100 * time.Millisecond,
+		RequiredAcks: kafka.RequireAll,
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				log.Error("failed to publish events", zap.Int("count", len(messages)), zap.Error(err))
+			}
+		},
+	}, nil
+}
+
+// kafkaDumpHandler publishes events of a session to kafka. Each message holds
+// one event in the text format and is keyed by the session name, a message
+// with an empty value marks the end of the session.
+type kafkaDumpHandler struct {
+	key  []byte
+	buf  []byte
+	log  *zap.Logger
+	w    *kafka.Writer
+	mask *event.Masker
+}
+
+func newKafkaDumpHandler(name string, w *kafka.Writer, log *zap.Logger) *kafkaDumpHandler {
+	return &kafkaDumpHandler{key: []byte(name), buf: make([]byte, 0, 4096), log: log, w: w}
+}
+
+func (h *kafkaDumpHandler) OnEvent(e event.MySQLEvent) {
+	var err error
+	if h.mask != nil {
+		h.mask.Event(&e)
+	}
+	h.buf, err = event.AppendEvent(h.buf[:0], e)
+	if err != nil {
+		h.log.Error("failed to dump event", zap.Any("value", e), zap.Error(err))
+		return
+	}
+	stats.Add(stats.DataOut, int64(len(h.buf)))
+	h.publish(append([]byte{}, h.buf...))
+}
+
+func (h *kafkaDumpHandler) OnClose() {
+	h.publish(nil)
+}
+
+func (h *kafkaDumpHandler) publish(value []byte) {
+	if err := h.w.WriteMessages(context.Background(), kafka.Message{Key: h.key, Value: value}); err != nil {
+		h.log.Error("failed to publish event", zap.Error(err))
+	}
+}
+
+func NewKafkaCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "kafka",
+		Short: "Kafka utilities",
+	}
+	cmd.AddCommand(NewKafkaPlayCommand())
+	return cmd
+}
+
+func NewKafkaPlayCommand() *cobra.Command {
+	var (
+		cfg            playConfig
+		source         string
+		group          string
+		targetDSN      string
+		reportInterval time.Duration
+	)
+	cmd := &cobra.Command{
+		Use:   "play",
+		Short: "Play mysql events consumed from kafka",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			brokers, topic, err := parseKafkaURL(source)
+			if err != nil {
+				return err
+			}
+			if !cfg.DryRun {
+				if cfg.MySQLConfig, err = mysql.ParseDSN(targetDSN); err != nil {
+					return errors.Annotate(err, "parse target dsn")
+				}
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			r := kafka.NewReader(kafka.ReaderConfig{Brokers: brokers, Topic: topic, GroupID: group})
+			defer r.Close()
+			kp := &kafkaPlayer{
+				playConfig: cfg,
+				log:        zap.L().Named("kafka"),
+				wg:         new(sync.WaitGroup),
+				feeds:      make(map[string]*sessionFeed),
+			}
+			go func() {
+				ticker := time.NewTicker(reportInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ctx.Done():
+						return
+					case <-ticker.C:
+						kp.log.Info("stats",
+							zap.Int("sessions", kp.Sessions()),
+							zap.Int64(stats.Connections, stats.Get(stats.Connections)),
+							zap.Int64(stats.Queries, stats.Get(stats.Queries)),
+							zap.Int64(stats.StmtExecutes, stats.Get(stats.StmtExecutes)),
+							zap.Int64(stats.FailedQueries, stats.Get(stats.FailedQueries)),
+							zap.Int64(stats.FailedStmtExecutes, stats.Get(stats.FailedStmtExecutes)),
+							zap.Duration("lagging", stats.GetLagging()))
+					}
+				}
+			}()
+			return kp.Consume(ctx, r)
+		},
+	}
+	cmd.Flags().StringVar(&source, "source", "", "kafka source (kafka://broker[,broker...]/topic)")
+	cmd.Flags().StringVar(&group, "group", "mysql-replay", "consumer group, consumers of the same group share partitions of the topic")
+	cmd.Flags().StringVar(&targetDSN, "target-dsn", "", "target dsn")
+	cmd.Flags().Float64Var(&cfg.Speed, "speed", 1, "speed ratio")
+	cmd.Flags().BoolVar(&cfg.DryRun, "dry-run", false, "dry run mode (just print events)")
+	cmd.Flags().IntVar(&cfg.MaxLineSize, "max-line-size", 16777216, "max line size")
+	cmd.Flags().DurationVar(&cfg.QueryTimeout, "query-timeout", time.Minute, "timeout for a single query")
+	cmd.Flags().DurationVar(&reportInterval, "report-interval", 5*time.Second, "report interval")
+	return cmd
+}
+
+// kafkaPlayer dispatches consumed events to play workers by session. Timing of
+// the replay is anchored at the first event consumed.
+type kafkaPlayer struct {
+	playConfig
+
+	log *zap.Logger
+	wg  *sync.WaitGroup
+
+	mu    sync.Mutex
+	feeds map[string]*sessionFeed
+}
+
+func (kp *kafkaPlayer) Sessions() int {
+	kp.mu.Lock()
+	defer kp.mu.Unlock()
+	return len(kp.feeds)
+}
+
+func (kp *kafkaPlayer) Consume(ctx context.Context, r *kafka.Reader) error {
+	defer func() {
+		kp.mu.Lock()
+		for key, feed := range kp.feeds {
+			feed.End()
+			delete(kp.feeds, key)
+		}
+		kp.mu.Unlock()
+		kp.wg.Wait()
+	}()
+	for {
+		msg, err := r.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Annotate(err, "consume events")
+		}
+		key := string(msg.Key)
+		kp.mu.Lock()
+		feed, ok := kp.feeds[key]
+		if len(msg.Value) == 0 {
+			if ok {
+				feed.End()
+				delete(kp.feeds, key)
+			}
+			kp.mu.Unlock()
+			continue
+		}
+		if !ok {
+			if kp.PlayStartTime == 0 {
+				var e event.MySQLEvent
+				if _, err = event.ScanEvent(string(msg.Value), 0, &e); err != nil {
+					kp.mu.Unlock()
+					kp.log.Warn("skip malformed event", zap.String("session", key), zap.Error(err))
+					continue
+				}
+				kp.PlayStartTime = time.Now().UnixNano() / int64(time.Millisecond)
+				kp.OrigStartTime = e.Time
+			}
+			feed = newSessionFeed()
+			kp.feeds[key] = feed
+			kp.startWorker(ctx, key, feed)
+		}
+		kp.mu.Unlock()
+		line := append(append(make([]byte, 0, len(msg.Value)+1), msg.Value...), '\n')
+		stats.Add(stats.DataIn, int64(len(line)))
+		feed.Push(ctx, line)
+	}
+}
+
+func (kp *kafkaPlayer) startWorker(ctx context.Context, key string, feed *sessionFeed) {
+	id, err := strconv.ParseUint(key, 16, 64)
+	if err != nil {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		id = h.Sum64()
+	}
+	pw := &playWorker{
+		playConfig: kp.playConfig,
+		src:        key,
+		log:        kp.log.Named(key),
+		wg:         kp.wg,
+		id:         id,
+	}
+	kp.wg.Add(1)
+	go pw.start(ctx, feed)
+}
+
+// sessionFeed is a reader over lines pushed by the consumer, it decouples the
+// consumer from the pace of a single play worker.
+type sessionFeed struct {
+	ch   chan []byte
+	done chan struct{}
+	once sync.Once
+	cur  []byte
+}
+
+func newSessionFeed() *sessionFeed {
+	return &sessionFeed{ch: make(chan []byte, 4096), done: make(chan struct{})}
+}
+
+func (f *sessionFeed) Push(ctx context.Context, line []byte) {
+	select {
+	case f.ch <- line:
+	case <-f.done:
+	case <-ctx.Done():
+	}
+}
+
+func (f *sessionFeed) End() {
+	close(f.ch)
+}
+
+func (f *sessionFeed) Read(p []byte) (int, error) {
+	if len(f.cur) == 0 {
+		line, ok := <-f.ch
+		if !ok {
+			return 0, io.EOF
+		}
+		f.cur = line
+	}
+	n := copy(p, f.cur)
+	f.cur = f.cur[n:]
+	return n, nil
+}
+
+func (f *sessionFeed) Close() error {
+	f.once.Do(func() { close(f.done) })
+	return nil
+}
@@ -0,0 +1,226 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	logFormatConsole = "console"
+	logFormatJSON    = "json"
+)
+
+// logOptions configures the global logger.
+type logOptions struct {
+	level      LogLevel
+	output     []string
+	format     string
+	file       string
+	maxSize    int
+	maxBackups int
+	modules    []string
+}
+
+func (o *logOptions) Register(flags *pflag.FlagSet) {
+	o.level = LogLevel{zapcore.InfoLevel}
+	flags.Var(&o.level, "log-level", "log level")
+	flags.StringSliceVar(&o.output, "log-output", []string{"stderr"}, "log output")
+	flags.StringVar(&o.format, "log-format", logFormatConsole, "log format (console|json)")
+	flags.StringVar(&o.file, "log-file", "", "write logs to the file (instead of --log-output if it's not set explicitly), which is rotated by --log-max-size")
+	flags.IntVar(&o.maxSize, "log-max-size", 100, "max size (in MB) of the log file before it's rotated")
+	flags.IntVar(&o.maxBackups, "log-max-backups", 5, "max number of rotated log files to keep")
+	flags.StringSliceVar(&o.modules, "log-module-level", nil, "override the log level of modules (loggers and their children by name) like mysql-stream=debug,worker=warn")
+}
+
+// Build builds the logger, outputs are changed to the log file unless they're
+// set explicitly.
+func (o *logOptions) Build(flags *pflag.FlagSet) (*zap.Logger, error) {
+	cfg := zap.NewDevelopmentConfig()
+	switch o.format {
+	case logFormatConsole:
+	case logFormatJSON:
+		cfg.Encoding = logFormatJSON
+		cfg.EncoderConfig = zap.NewProductionEncoderConfig()
+		cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	default:
+		return nil, errors.New("unknown log format: " + o.format)
+	}
+	modules, err := parseModuleLevels(o.modules)
+	if err != nil {
+		return nil, err
+	}
+	min := o.level.Level
+	for _, m := range modules {
+		if m.level < min {
+			min = m.level
+		}
+	}
+	cfg.Level = zap.NewAtomicLevelAt(min)
+	cfg.OutputPaths = o.output
+	cfg.ErrorOutputPaths = o.output
+	cfg.DisableStacktrace = !o.level.Enabled(zap.DebugLevel)
+	var file *rotatingFile
+	if len(o.file) > 0 {
+		if o.maxSize <= 0 {
+			return nil, errors.New("log max size should be positive")
+		}
+		if file, err = openRotatingFile(o.file, int64(o.maxSize)<<20, o.maxBackups); err != nil {
+			return nil, errors.Annotate(err, "open log file")
+		}
+		if !flags.Changed("log-output") {
+			cfg.OutputPaths, cfg.ErrorOutputPaths = nil, []string{"stderr"}
+		}
+	}
+	enc := cfg.EncoderConfig
+	return cfg.Build(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		if file != nil {
+			var fileEnc zapcore.Encoder
+			if cfg.Encoding == logFormatJSON {
+				fileEnc = zapcore.NewJSONEncoder(enc)
+			} else {
+				fileEnc = zapcore.NewConsoleEncoder(enc)
+			}
+			core = zapcore.NewTee(core, zapcore.NewCore(fileEnc, file, cfg.Level))
+		}
+		if len(modules) == 0 && min == o.level.Level {
+			return core
+		}
+		return &moduleCore{Core: core, level: o.level.Level, min: min, modules: modules}
+	}))
+}
+
+type moduleLevel struct {
+	name  string
+	level zapcore.Level
+}
+
+// parseModuleLevels parses levels like name=level, longer names go first thus
+// they take precedence over their parents.
+func parseModuleLevels(items []string) ([]moduleLevel, error) {
+	out := make([]moduleLevel, 0, len(items))
+	for _, item := range items {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+			return nil, errors.New("invalid module log level: " + item)
+		}
+		m := moduleLevel{name: strings.TrimSpace(kv[0])}
+		if err := m.level.Set(strings.TrimSpace(kv[1])); err != nil {
+			return nil, errors.Annotate(err, "invalid module log level: "+item)
+		}
+		out = append(out, m)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return len(out[i].name) > len(out[j].name) })
+	return out, nil
+}
+
+// moduleCore filters entries by the level of their modules, the wrapped core
+// should enable the min level of all modules.
+type moduleCore struct {
+	zapcore.Core
+	level   zapcore.Level
+	min     zapcore.Level
+	modules []moduleLevel
+}
+
+func (c *moduleCore) levelOf(name string) zapcore.Level {
+	for _, m := range c.modules {
+		if name == m.name || strings.HasPrefix(name, m.name+".") {
+			return m.level
+		}
+	}
+	return c.level
+}
+
+func (c *moduleCore) Enabled(lvl zapcore.Level) bool {
+	return lvl >= c.min
+}
+
+func (c *moduleCore) With(fields []zapcore.Field) zapcore.Core {
+	return &moduleCore{Core: c.Core.With(fields), level: c.level, min: c.min, modules: c.modules}
+}
+
+func (c *moduleCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if ent.Level < c.levelOf(ent.LoggerName) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// rotatingFile is a log file rotated once it exceeds maxSize, rotated files
+// are named like path.1 (the latest), path.2 and so on.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return errors.Trace(err)
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	if rf.maxBackups <= 0 {
+		os.Remove(rf.path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) Sync() error {
+	rf.lock.Lock()
+	defer rf.lock.Unlock()
+	return rf.f.Sync()
+}
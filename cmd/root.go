@@ -6,6 +6,7 @@ import (
 	_ "net/http/pprof"
 	"time"
 
+	"github.com/pingcap/errors"
 	"github.com/pkg/profile"
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
@@ -14,22 +15,27 @@ import (
 
 func NewRootCmd() *cobra.Command {
 	var opts struct {
-		logLevel  LogLevel
-		logOutput []string
+		log       logOptions
 		pprof     string
+		debugAddr string
+		config    configFile
 	}
 	var profiler interface{ Stop() }
 	cmd := &cobra.Command{
 		Use: "mysql-replay",
-		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := opts.config.Apply(cmd); err != nil {
+				return err
+			}
 			rand.Seed(time.Now().UnixNano())
-			cfg := zap.NewDevelopmentConfig()
-			cfg.Level = zap.NewAtomicLevelAt(opts.logLevel.Level)
-			cfg.OutputPaths = opts.logOutput
-			cfg.ErrorOutputPaths = opts.logOutput
-			cfg.DisableStacktrace = !cfg.Level.Enabled(zap.DebugLevel)
-			logger, _ := cfg.Build()
+			logger, err := opts.log.Build(cmd.Flags())
+			if err != nil {
+				return errors.Annotate(err, "build logger")
+			}
 			zap.ReplaceGlobals(logger)
+			if len(opts.debugAddr) > 0 {
+				serveDebug(opts.debugAddr)
+			}
 			if len(opts.pprof) > 0 {
 				switch opts.pprof {
 				case "cpu":
@@ -48,6 +54,7 @@ func NewRootCmd() *cobra.Command {
 					}()
 				}
 			}
+			return nil
 		},
 		PersistentPostRun: func(cmd *cobra.Command, args []string) {
 			if profiler != nil {
@@ -55,14 +62,23 @@ func NewRootCmd() *cobra.Command {
 			}
 		},
 	}
-	opts.logLevel = LogLevel{zapcore.InfoLevel}
-	cmd.PersistentFlags().Var(&opts.logLevel, "log-level", "log level")
-	cmd.PersistentFlags().StringSliceVar(&opts.logOutput, "log-output", []string{"stderr"}, "log output")
+	opts.log.Register(cmd.PersistentFlags())
 	cmd.PersistentFlags().StringVar(&opts.pprof, "pprof", "", "enable pprof")
+	cmd.PersistentFlags().StringVar(&opts.config.path, "config", "", "load flags and positional args from a yaml (or json) or toml config file, flags given in the command line take precedence")
+	cmd.PersistentFlags().StringVar(&opts.debugAddr, "debug-addr", "", "serve pprof and expvar (including stats counters) on the given address, e.g. 127.0.0.1:6060")
+	cmd.AddCommand(NewAuditLogCommand())
+	cmd.AddCommand(NewCapabilitiesCmd())
+	cmd.AddCommand(NewCaptureCmd())
+	cmd.AddCommand(NewGenLogCommand())
+	cmd.AddCommand(NewKafkaCommand())
 	cmd.AddCommand(NewNotifyCmd())
+	cmd.AddCommand(NewPgCommand())
 	cmd.AddCommand(NewReplayCmd())
 	cmd.AddCommand(NewServeCmd())
+	cmd.AddCommand(NewSlowLogCommand())
 	cmd.AddCommand(NewTextCommand())
+	cmd.AddCommand(NewVerifyCommand())
+	withConfig(cmd, &opts.config)
 	return cmd
 }
 
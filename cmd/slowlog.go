@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	registerCapability(capSource, "slowlog")
+}
+
+func NewSlowLogCommand() *cobra.Command {
+	return newImportCommand("slowlog", "Replay MySQL/TiDB slow query logs", parseSlowLog)
+}
+
+type slowLogEntry struct {
+	started   bool
+	time      time.Time
+	queryTime time.Duration
+	timestamp int64
+	conn      uint64
+	db        string
+	quit      bool
+	lines     []string
+}
+
+func (e *slowLogEntry) startTime() int64 {
+	if !e.time.IsZero() {
+		return e.time.Add(-e.queryTime).UnixNano() / int64(time.Millisecond)
+	}
+	return e.timestamp * 1000
+}
+
+func (e *slowLogEntry) reset() {
+	e.started = true
+	e.queryTime = 0
+	e.timestamp = 0
+	e.quit = false
+	e.lines = e.lines[:0]
+}
+
+func (e *slowLogEntry) flush(out *sessionDumper) error {
+	if !e.started {
+		return nil
+	}
+	defer e.reset()
+	if e.quit {
+		out.Quit(e.conn, e.startTime())
+		return nil
+	}
+	if len(e.lines) == 0 {
+		return nil
+	}
+	query := strings.TrimSpace(strings.Join(e.lines, "\n"))
+	query = strings.TrimSpace(strings.TrimSuffix(query, ";"))
+	if len(query) == 0 {
+		return nil
+	}
+	return out.Query(e.conn, e.startTime(), e.db, query)
+}
+
+// parseSlowLog parses slow logs of MySQL (5.x and 8.x) and TiDB. Each entry
+// looks like:
+//
+//	# Time: 2021-06-01T10:00:00.123456Z
+//	# User@Host: root[root] @ localhost []  Id:    12
+//	# Query_time: 0.000123  Lock_time: 0.000000 Rows_sent: 1  Rows_examined: 1
+//	use test;
+//	SET timestamp=1622541600;
+//	select * from t;
+//
+// TiDB puts the connection id and the current database in `# Conn_ID:` and
+// `# DB:` lines respectively.
+func parseSlowLog(in io.Reader, out *sessionDumper) error {
+	var (
+		r     = bufio.NewReaderSize(in, 1048576)
+		entry slowLogEntry
+	)
+	dbs := make(map[uint64]string)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return errors.Trace(err)
+		}
+		if len(line) == 0 && err == io.EOF {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case strings.HasPrefix(line, "# Time:"):
+			if ferr := entry.flush(out); ferr != nil {
+				return ferr
+			}
+			entry.reset()
+			entry.time = parseSlowLogTime(strings.TrimSpace(line[len("# Time:"):]))
+		case strings.HasPrefix(line, "# User@Host:"):
+			if len(entry.lines) > 0 || entry.quit {
+				if ferr := entry.flush(out); ferr != nil {
+					return ferr
+				}
+			}
+			entry.started = true
+			if i := strings.Index(line, "Id:"); i > 0 {
+				entry.conn, _ = strconv.ParseUint(strings.TrimSpace(line[i+3:]), 10, 64)
+				entry.db = dbs[entry.conn]
+			}
+		case strings.HasPrefix(line, "# Conn_ID:"):
+			entry.conn, _ = strconv.ParseUint(strings.TrimSpace(line[len("# Conn_ID:"):]), 10, 64)
+			entry.db = dbs[entry.conn]
+		case strings.HasPrefix(line, "# DB:"):
+			entry.db = strings.TrimSpace(line[len("# DB:"):])
+			dbs[entry.conn] = entry.db
+		case strings.HasPrefix(line, "# Query_time:"):
+			fields := strings.Fields(line[len("# Query_time:"):])
+			if len(fields) > 0 {
+				if secs, err := strconv.ParseFloat(fields[0], 64); err == nil {
+					entry.queryTime = time.Duration(secs * float64(time.Second))
+				}
+			}
+		case strings.HasPrefix(line, "# administrator command: Quit"):
+			entry.quit = true
+		case strings.HasPrefix(line, "#"):
+		case !entry.started:
+		case strings.Contains(line, ", Version: ") && strings.Contains(line, "started with:"):
+			if ferr := entry.flush(out); ferr != nil {
+				return ferr
+			}
+			entry.started = false
+		case len(entry.lines) == 0 && isSlowLogUse(line):
+			entry.db = strings.Trim(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(line[4:]), ";")), "`")
+			dbs[entry.conn] = entry.db
+		case len(entry.lines) == 0 && strings.HasPrefix(strings.ToUpper(line), "SET TIMESTAMP="):
+			entry.timestamp, _ = strconv.ParseInt(strings.TrimSuffix(line[len("SET timestamp="):], ";"), 10, 64)
+		default:
+			entry.lines = append(entry.lines, line)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return entry.flush(out)
+}
+
+func isSlowLogUse(line string) bool {
+	return len(line) > 4 && strings.EqualFold(line[:4], "use ") && strings.HasSuffix(line, ";") && !strings.ContainsAny(strings.TrimSuffix(line[4:], ";"), " \t")
+}
+
+func parseSlowLogTime(s string) time.Time {
+	for _, layout := range []string{time.RFC3339Nano, "060102 15:04:05", "060102  15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
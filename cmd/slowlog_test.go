@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/zyguan/mysql-replay/event"
+)
+
+func TestParseSlowLog(t *testing.T) {
+	old := localMillis("060102 15:04:05", "210601 10:00:06")
+	testImport(t, parseSlowLog, []importCase{
+		{
+			name: "mysql8",
+			input: `/usr/sbin/mysqld, Version: 8.0.26 (MySQL Community Server - GPL). started with:
+Tcp port: 3306  Unix socket: /var/run/mysqld/mysqld.sock
+Time                 Id Command    Argument
+# Time: 2021-06-01T10:00:01.000000Z
+# User@Host: root[root] @ localhost []  Id:    12
+# Query_time: 1.000000  Lock_time: 0.000000 Rows_sent: 1  Rows_examined: 1
+use test;
+SET timestamp=1622541600;
+select sleep(1);
+# Time: 2021-06-01T10:00:02.500000Z
+# User@Host: root[root] @ localhost []  Id:    12
+# Query_time: 0.500000  Lock_time: 0.000000 Rows_sent: 1  Rows_examined: 10
+SET timestamp=1622541602;
+select *
+from t
+where a = 1;
+# Time: 2021-06-01T10:00:03.000000Z
+# User@Host: root[root] @ localhost []  Id:    12
+# Query_time: 0.000000  Lock_time: 0.000000 Rows_sent: 0  Rows_examined: 0
+SET timestamp=1622541603;
+# administrator command: Quit;
+`,
+			expect: map[uint64][]event.MySQLEvent{
+				12: {
+					{Time: 1622541600000, Type: event.EventHandshake, DB: "test"},
+					{Time: 1622541600000, Type: event.EventQuery, Query: "select sleep(1)"},
+					{Time: 1622541602000, Type: event.EventQuery, Query: "select *\nfrom t\nwhere a = 1"},
+					{Time: 1622541603000, Type: event.EventQuit},
+				},
+			},
+		},
+		{
+			name: "tidb",
+			input: `# Time: 2021-06-01T10:00:05.000000Z
+# Txn_start_ts: 425478224723460097
+# User@Host: root[root] @ 127.0.0.1 [127.0.0.1]
+# Conn_ID: 7
+# Query_time: 0.25
+# DB: db1
+# Is_internal: false
+select 2;
+# Time: 2021-06-01T10:00:06.000000Z
+# User@Host: root[root] @ 127.0.0.1 [127.0.0.1]
+# Conn_ID: 7
+# Query_time: 0
+select 3;
+`,
+			expect: map[uint64][]event.MySQLEvent{
+				7: {
+					{Time: 1622541604750, Type: event.EventHandshake, DB: "db1"},
+					{Time: 1622541604750, Type: event.EventQuery, Query: "select 2"},
+					{Time: 1622541606000, Type: event.EventQuery, Query: "select 3"},
+				},
+			},
+		},
+		{
+			name: "mysql5 without times of entries in the same second",
+			input: `# Time: 210601 10:00:06
+# User@Host: u[u] @ localhost []  Id:     3
+# Query_time: 0.000000  Lock_time: 0.000000 Rows_sent: 0  Rows_examined: 0
+SET timestamp=1622541606;
+insert into t values (1);
+# User@Host: u[u] @ localhost []  Id:     4
+# Query_time: 0.000000  Lock_time: 0.000000 Rows_sent: 1  Rows_examined: 0
+SET timestamp=1622541606;
+select 3;
+`,
+			expect: map[uint64][]event.MySQLEvent{
+				3: {
+					{Time: old, Type: event.EventHandshake},
+					{Time: old, Type: event.EventQuery, Query: "insert into t values (1)"},
+				},
+				4: {
+					{Time: old, Type: event.EventHandshake},
+					{Time: old, Type: event.EventQuery, Query: "select 3"},
+				},
+			},
+		},
+	})
+}
@@ -3,93 +3,142 @@ package cmd
 import (
 	"bufio"
 	"context"
-	"database/sql"
-	"encoding/json"
+	"encoding/base64"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/rand"
-	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
-	"github.com/google/gopacket/reassembly"
 	"github.com/pingcap/errors"
+	"github.com/segmentio/kafka-go"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
 	"github.com/zyguan/mysql-replay/stats"
+	"github.com/zyguan/mysql-replay/storage"
 	"github.com/zyguan/mysql-replay/stream"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
 func NewTextDumpCommand() *cobra.Command {
+	return newDumpCommand(stream.MySQL)
+}
+
+// newDumpCommand returns a command dumping sessions of the protocol.
+func newDumpCommand(proto stream.Protocol) *cobra.Command {
 	var (
 		options        = stream.FactoryOptions{Synchronized: true}
 		output         string
+		sink           string
 		reportInterval time.Duration
 		flushInterval  time.Duration
+		maskMode       string
+		maskSalt       string
+		handlers       []string
+		maxMemory      int64
+		chunkSize      int
+		parallelism    int
+		serverPorts    []uint
+		portMap        []string
+		remote         remoteCapture
+		remoteSource   = liveSourceConfig{snaplen: 65535}
+		watch          bool
+		watcher        pcapWatcher
 	)
 	cmd := &cobra.Command{
 		Use:   "dump",
-		Short: "Dump pcap files",
+		Short: "Dump " + proto.Name() + " sessions from pcap files",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if len(args) == 0 {
+			if len(args) == 0 && !remote.Enabled() {
 				return cmd.Help()
+			} else if watch && len(args) != 1 {
+				return errors.New("watch mode requires exactly one directory")
+			} else if err := checkChunkSize(chunkSize); err != nil {
+				return err
+			}
+			var mask *event.Masker
+			if len(maskMode) > 0 {
+				var err error
+				if mask, err = event.NewMasker(maskMode, maskSalt); err != nil {
+					return err
+				}
 			}
-			if len(output) > 0 {
+			var store storage.Storage
+			if storage.IsRemote(output) {
+				var err error
+				if store, err = storage.Open(output); err != nil {
+					return err
+				}
+				// sessions are staged locally and uploaded once closed
+				if output, err = os.MkdirTemp("", "mysql-replay-dump-"); err != nil {
+					return errors.Trace(err)
+				}
+				defer os.RemoveAll(output)
+			} else if len(output) > 0 {
 				os.MkdirAll(output, 0755)
 			}
+			var kw *kafka.Writer
+			if len(sink) > 0 {
+				if !isKafkaURL(sink) {
+					return errors.New("unsupported sink: " + sink)
+				}
+				w, err := newKafkaWriter(sink)
+				if err != nil {
+					return err
+				}
+				kw = w
+			}
+			extras, err := stream.LookupEventHandlers(handlers)
+			if err != nil {
+				return err
+			}
+			budget := stream.NewMemoryBudget(maxMemory)
+			options.Budget = budget
+			if options.Ports, err = parsePortMap(portMap, serverPorts, proto); err != nil {
+				return err
+			}
 
-			factory := stream.NewFactoryFromEventHandler(func(conn stream.ConnID) stream.MySQLEventHandler {
+			newDumpHandler := func(conn stream.ConnID) stream.MySQLEventHandler {
 				log := conn.Logger("dump")
+				if kw != nil {
+					h := newKafkaDumpHandler(conn.HashStr(), kw, log)
+					h.mask = mask
+					return h
+				}
 				out, err := os.CreateTemp(output, "."+conn.HashStr()+".*")
 				if err != nil {
 					log.Error("failed to create file for dumping events", zap.Error(err))
 					return nil
 				}
-				return &textDumpHandler{
-					conn: conn,
-					buf:  make([]byte, 0, 4096),
-					log:  log,
-					out:  out,
-					w:    bufio.NewWriterSize(out, 1048576),
+				h := newTextDumpHandler(conn.HashStr(), out, log, budget)
+				h.header.Source, h.header.Server = conn.SrcAddr(), conn.DstAddr()
+				if proto != stream.MySQL {
+					h.header.Protocol = proto.Name()
 				}
-			}, options)
-			pool := reassembly.NewStreamPool(factory)
-			assembler := reassembly.NewAssembler(pool)
-
-			lastFlushTime := time.Time{}
-			handle := func(name string) error {
-				f, err := pcap.OpenOffline(name)
-				if err != nil {
-					return errors.Annotate(err, "open "+name)
-				}
-				defer f.Close()
-				src := gopacket.NewPacketSource(f, f.LinkType())
-				for pkt := range src.Packets() {
-					if meta := pkt.Metadata(); meta != nil && meta.Timestamp.Sub(lastFlushTime) > flushInterval {
-						assembler.FlushCloseOlderThan(lastFlushTime)
-						lastFlushTime = meta.Timestamp
-					}
-					layer := pkt.Layer(layers.LayerTypeTCP)
-					if layer == nil {
-						continue
-					}
-					tcp := layer.(*layers.TCP)
-					assembler.AssembleWithContext(pkt.NetworkLayer().NetworkFlow(), tcp, captureContext(pkt.Metadata().CaptureInfo))
+				if chunkSize > 0 {
+					h.header.Version, h.header.Chunk = event.FormatV3, chunkSize
 				}
-				return nil
+				h.store = store
+				h.mask = mask
+				return h
+			}
+			factories := extras
+			if len(extras) == 0 || len(output) > 0 || kw != nil {
+				factories = append([]stream.EventHandlerFactory{newDumpHandler}, extras...)
 			}
+			factory := stream.NewFactoryFromProtocol(proto, stream.MultiEventHandlerFactory(factories...), options)
 
 			startTime := time.Now()
 			go func() {
@@ -107,55 +156,178 @@ func NewTextDumpCommand() *cobra.Command {
 						zap.Int64("speed", int64(float64(curDataIn-prvDataIn)*float64(time.Second)/float64(reportInterval))),
 						zap.Int64(stats.DataIn, curDataIn),
 						zap.Int64(stats.DataOut, stats.Get(stats.DataOut)),
-						zap.Int64(stats.Packets, stats.Get(stats.Packets)))
+						zap.Int64(stats.Packets, stats.Get(stats.Packets)),
+						zap.Int64(stats.Gaps, stats.Get(stats.Gaps)),
+						zap.Int64("buffered", budget.Used()))
 				}
 			}()
 
-			for _, in := range args {
-				zap.L().Info("processing " + in)
-				err := handle(in)
-				if err != nil {
-					return err
+			assembler := newDumpAssembler(factory, parallelism, flushInterval, budget)
+			if remote.Enabled() {
+				if len(remoteSource.filter) == 0 {
+					var ports []uint
+					for port, name := range options.Ports {
+						if name == proto.Name() {
+							ports = append(ports, uint(port))
+						}
+					}
+					sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+					remoteSource.filter = portFilter(ports)
+				}
+				zap.L().Info("capturing on "+remote.Host, zap.String("filter", remoteSource.filter))
+				err = remote.Read(remoteSource, assembler.Assemble)
+			} else if watch {
+				watcher.dir = args[0]
+				err = watcher.Run(assembler.Assemble)
+			} else {
+				err = readPcaps(args, parallelism > 1, assembler.Assemble)
+			}
+			assembler.Close()
+			if err != nil {
+				return err
+			}
+			if kw != nil {
+				if err := kw.Close(); err != nil {
+					return errors.Annotate(err, "close kafka writer")
 				}
 			}
-			assembler.FlushAll()
 
 			zap.L().Info("done",
 				zap.Int64("speed", int64(float64(stats.Get(stats.DataIn))*float64(time.Second)/float64(time.Since(startTime)))),
 				zap.Int64(stats.DataIn, stats.Get(stats.DataIn)),
 				zap.Int64(stats.DataOut, stats.Get(stats.DataOut)),
-				zap.Int64(stats.Packets, stats.Get(stats.Packets)))
+				zap.Int64(stats.Packets, stats.Get(stats.Packets)),
+				zap.Int64(stats.Gaps, stats.Get(stats.Gaps)),
+				zap.Int64(stats.GapBytes, stats.Get(stats.GapBytes)),
+				zap.Int64(stats.OutOfOrderPackets, stats.Get(stats.OutOfOrderPackets)),
+				zap.Int64(stats.TruncatedPackets, stats.Get(stats.TruncatedPackets)))
+			if fields := eventFields(stats.Dump()); len(fields) > 0 {
+				zap.L().Info("events", fields...)
+			}
+			if n := stats.Get(stats.Gaps); n > 0 {
+				zap.L().Warn("data of some connections is lost in the capture, their sessions are marked by gap events", zap.Int64("gaps", n))
+			}
 
 			return nil
 		},
 	}
-	cmd.Flags().StringVarP(&output, "output", "o", "", "output directory")
+	cmd.Flags().StringVarP(&output, "output", "o", "", "output directory (or s3://, gs://, oss:// urls)")
+	cmd.Flags().StringVar(&sink, "sink", "", "publish events to the sink instead of files (kafka://broker[,broker...]/topic)")
 	cmd.Flags().BoolVar(&options.ForceStart, "force-start", false, "accept streams even if no SYN have been seen")
+	cmd.Flags().BoolVar(&options.Results, "affected-rows", false, "dump rows affected (and latencies) of statements responded with ok packets, which are compared by play")
+	cmd.Flags().UintSliceVar(&serverPorts, proto.Name()+"-port", nil, "tcp ports of "+proto.Name()+" servers, only connections to them are dumped if any port is given (can be repeated)")
+	cmd.Flags().StringSliceVar(&portMap, "port-map", nil, "map tcp ports of servers to protocols like 4000=mysql, only connections to ports of "+proto.Name()+" are dumped if any port is given")
 	cmd.Flags().DurationVar(&reportInterval, "report-interval", 5*time.Second, "report interval")
 	cmd.Flags().DurationVar(&flushInterval, "flush-interval", time.Minute, "flush interval")
+	cmd.Flags().StringVar(&maskMode, "mask", "", "mask literals of queries and values of params (hash|const)")
+	cmd.Flags().StringVar(&maskSalt, "mask-salt", "", "salt of hashes when masking literals by hash")
+	cmd.Flags().IntVar(&parallelism, "parallelism", 1, "number of assemblers which connections are sharded to, input files are also read concurrently if it's greater than 1")
+	cmd.Flags().IntVar(&chunkSize, "chunk-size", 0, "split events longer than the size into lines of chunks (format v3), thus lines of session files stay bounded in size (0 means never)")
+	cmd.Flags().Int64Var(&maxMemory, "max-memory", 0, "bound bytes buffered for reassembly and writing, streams idle for the longest time are closed once it's exceeded (0 means unlimited)")
+	cmd.Flags().BoolVar(&watch, "watch", false, "watch the directory given where pcap files are rotated, read each completed file in order and delete it afterwards")
+	cmd.Flags().DurationVar(&watcher.interval, "watch-interval", 5*time.Second, "interval of polling the watched directory")
+	cmd.Flags().DurationVar(&watcher.settle, "watch-settle", 0, "consider the newest file completed once it's not modified for the duration (0 means waiting for a newer file)")
+	cmd.Flags().StringVar(&watcher.archive, "archive", "", "move completed files into the directory instead of deleting them in watch mode")
+	remote.Register(cmd.Flags())
+	cmd.Flags().StringVar(&remoteSource.device, "remote-interface", "any", "network interface to capture from on the remote host")
+	cmd.Flags().StringVar(&remoteSource.filter, "remote-filter", "", "bpf filter of the remote capture (defaults to tcp packets of the server ports if any)")
+	cmd.Flags().StringSliceVar(&handlers, "handler", nil, "also pass events to the registered handlers (events are only passed to them if neither output nor sink is set)")
 
 	return cmd
 }
 
+// parsePortMap returns server ports to protocols by items like 4000=mysql and
+// ports of proto, it returns nil if there is none.
+func parsePortMap(items []string, ports []uint, proto stream.Protocol) (map[uint16]string, error) {
+	if len(items) == 0 && len(ports) == 0 {
+		return nil, nil
+	}
+	known := make(map[string]bool)
+	for _, p := range stream.Protocols() {
+		known[p.Name()] = true
+	}
+	m := make(map[uint16]string, len(items)+len(ports))
+	for _, item := range items {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 || !known[kv[1]] {
+			return nil, errors.Errorf("invalid port map: %s", item)
+		}
+		port, err := strconv.ParseUint(kv[0], 10, 16)
+		if err != nil {
+			return nil, errors.Annotatef(err, "invalid port map: %s", item)
+		}
+		m[uint16(port)] = kv[1]
+	}
+	for _, port := range ports {
+		if port == 0 || port > 65535 {
+			return nil, errors.Errorf("invalid port: %d", port)
+		}
+		m[uint16(port)] = proto.Name()
+	}
+	return m, nil
+}
+
 type textDumpHandler struct {
-	conn stream.ConnID
-	buf  []byte
-	log  *zap.Logger
-	out  *os.File
-	w    *bufio.Writer
+	name   string
+	buf    []byte
+	line   []byte
+	log    *zap.Logger
+	out    *os.File
+	w      *bufio.Writer
+	store  storage.Storage
+	header event.Header
+	mask   *event.Masker
+	budget *stream.MemoryBudget
 
 	fst int64
 	lst int64
 }
 
+const (
+	dumpBufferSize    = 1048576
+	minDumpBufferSize = 4096
+)
+
+// newTextDumpHandler returns a handler writing events to out, its write buffer
+// is shrunk if it doesn't fit in the budget (if any).
+func newTextDumpHandler(name string, out *os.File, log *zap.Logger, budget *stream.MemoryBudget) *textDumpHandler {
+	host, _ := os.Hostname()
+	size := dumpBufferSize
+	if !budget.TryAcquire(dumpBufferSize) {
+		size = minDumpBufferSize
+		budget.Acquire(minDumpBufferSize)
+	}
+	return &textDumpHandler{
+		name:   name,
+		buf:    make([]byte, 0, 4096),
+		log:    log,
+		out:    out,
+		w:      bufio.NewWriterSize(out, size),
+		header: event.Header{Version: event.FormatVersion, Host: host, Columns: event.Columns},
+		budget: budget,
+	}
+}
+
 func (h *textDumpHandler) OnEvent(e event.MySQLEvent) {
 	var err error
+	if h.mask != nil {
+		h.mask.Event(&e)
+	}
 	h.buf = h.buf[:0]
-	h.buf, err = event.AppendEvent(h.buf, e)
+	if h.fst == 0 {
+		h.header.Time = e.Time
+		if h.buf, err = event.AppendHeader(h.buf, h.header); err != nil {
+			h.log.Error("failed to dump header", zap.Error(err))
+			return
+		}
+		h.buf = append(h.buf, '\n')
+	}
+	h.line, err = event.AppendEvent(h.line[:0], e)
 	if err != nil {
 		h.log.Error("failed to dump event", zap.Any("value", e), zap.Error(err))
 		return
 	}
+	h.buf = event.AppendChunks(h.buf, h.line, h.header.Chunk)
 	stats.Add(stats.DataOut, int64(len(h.buf))+1)
 	h.w.Write(h.buf)
 	h.w.WriteString("\n")
@@ -167,81 +339,586 @@ func (h *textDumpHandler) OnEvent(e event.MySQLEvent) {
 
 func (h *textDumpHandler) OnClose() {
 	h.w.Flush()
+	h.budget.Release(int64(h.w.Size()))
 	h.out.Close()
 	path := h.out.Name()
+	name := fmt.Sprintf("%d.%d.%s.tsv", h.fst, h.lst, h.name)
 	if h.fst == 0 {
 		os.Remove(path)
+	} else if h.store != nil {
+		if err := h.store.Put(context.Background(), name, path); err != nil {
+			h.log.Error("failed to upload "+name, zap.String("storage", h.store.String()), zap.Error(err))
+		}
+		os.Remove(path)
 	} else {
-		os.Rename(path, filepath.Join(filepath.Dir(path), fmt.Sprintf("%d.%d.%s.tsv", h.fst, h.lst, h.conn.HashStr())))
+		os.Rename(path, filepath.Join(filepath.Dir(path), name))
 	}
 }
 
-func NewTextPlayCommand() *cobra.Command {
+type textPlayOptions struct {
+	agents         []string
+	agentSecurity  agentSecurity
+	agentProtocol  string
+	config         playConfig
+	bgConfig       bgLoadConfig
+	target         dsnSource
+	reportInterval time.Duration
+	topSlow        int
+	reportJSON     string
+	reportHTML     string
+	webAddr        string
+	tui            bool
+	adaptive       time.Duration
+	targetQPS      float64
+	includeDigests string
+	excludeDigests string
+	filterDBs      []string
+	filterUsers    []string
+	filterClients  []string
+	order          string
+	hook           string
+	tidbSet        []string
+	drainTimeout   time.Duration
+	maxDuration    time.Duration
+	startAt        string
+	follow         bool
+	followInterval time.Duration
+	thinkTime      string
+	warmup         string
+	warmupStmts    int
+	breaker        int
+	breakerProbe   time.Duration
+	failuresDir    string
+	failuresLimit  int64
+	failedDir      string
+	redrive        string
+	redriveContext bool
+	check          bool
+	checkSample    int
+	beforeScript   string
+	afterScript    string
+	mirrorDSN      string
+	mirrorMaxDiffs int64
+	otlpEndpoint   string
+	otlpHeaders    []string
+	otlpService    string
+	statsdAddr     string
+	statsdPrefix   string
+	statsdTags     []string
+	statsdInterval time.Duration
+	statsdRate     float64
+	statsFile      string
+}
+
+func (opts *textPlayOptions) Register(flags *pflag.FlagSet) {
+	flags.StringSliceVar(&opts.agents, "agents", []string{}, "agents list")
+	opts.agentSecurity.Register(flags, "agent-")
+	flags.DurationVar(&opts.config.StartBarrier, "start-barrier", 0, "synchronize the start of all agents to a shared clock which is the duration later (0 means disabled)")
+	flags.StringVar(&opts.agentProtocol, "agent-protocol", agentProtocolHTTP, "protocol for talking to agents (http|grpc)")
+	flags.DurationVar(&opts.config.AgentTimeout, "agent-timeout", 30*time.Second, "consider an agent lost and reassign its sessions if it doesn't respond for the duration")
+	flags.BoolVar(&opts.config.SharedStorage, "shared-storage", false, "let agents fetch session files from the input location (a shared path or an object storage) instead of uploading them")
+	flags.StringVar(&opts.config.SharedPath, "shared-path", "", "path of a local input relative to --data-dir of agents with --shared-storage (the base name of the input by default)")
+	opts.target.Register(flags, "target-", "target dsn")
+	flags.StringVar(&opts.order, "order", orderSession, "keep the order of events per session, or across all sessions in a single stream (session|global)")
+	flags.Float64Var(&opts.config.Speed, "speed", 1, "speed ratio")
+	flags.BoolVar(&opts.config.NoSessionDelay, "no-session-delay", false, "start all sessions immediately instead of at their original offsets")
+	flags.DurationVar(&opts.config.SessionSpread, "session-spread", 0, "spread starts of sessions uniformly over the duration of wall-clock time instead of at their original offsets (0 means disabled)")
+	flags.StringVar(&opts.warmup, "warmup", "", "establish connections of the first n sessions, or sessions starting in the first duration of the capture (like 30s), before the timed replay starts (local replay only)")
+	flags.IntVar(&opts.warmupStmts, "warmup-stmts", 0, "prepare up to n statements most prepared by each session of --warmup as well")
+	flags.StringVar(&opts.thinkTime, "think-time", thinkTimePreserve, "idle time between events of a session, which is preserved, capped like cap=100ms, or none to run events back-to-back (preserve|cap=<duration>|none)")
+	flags.DurationVar(&opts.maxDuration, "max-duration", 0, "stop the replay cleanly after the duration of wall-clock time (0 means unlimited)")
+	flags.StringVar(&opts.startAt, "start-at", "", "begin the replay at the given time (unix ms or rfc3339)")
+	flags.BoolVar(&opts.follow, "follow", false, "keep replaying sessions appearing in the input (e.g. written by a concurrent dump --watch) until interrupted")
+	flags.DurationVar(&opts.followInterval, "follow-interval", 5*time.Second, "interval of listing the input for new sessions in follow mode")
+	flags.StringArrayVar(&opts.config.SessionInit, "session-init", nil, "statements to run on every new replay connection (can be repeated)")
+	flags.BoolVar(&opts.config.DryRun, "dry-run", false, "dry run mode (just print events)")
+	flags.BoolVar(&opts.check, "check", false, "check the target (connectivity, databases, privileges and max_connections) and sample files of the input, then exit with a report instead of replaying")
+	flags.IntVar(&opts.checkSample, "check-sample", 100, "number of session files scanned by --check (0 means all)")
+	flags.StringVar(&opts.config.SQLOut, "sql-out", "", "write events as sql scripts into the given directory in dry run mode")
+	flags.StringVar(&opts.config.SQLStyle, "sql-style", sqlStylePrepare, "style of sql scripts (prepare|interpolate)")
+	flags.IntVar(&opts.config.MaxLineSize, "max-line-size", 16777216, "max line size of session files, which also limits events joined from chunks (0 means unlimited)")
+	flags.DurationVar(&opts.config.QueryTimeout, "query-timeout", time.Minute, "timeout for a single query")
+	flags.StringVar(&opts.config.Driver, "driver", replay.DefaultDriver, "driver of connecting to the target ("+strings.Join(replay.Drivers(), "|")+")")
+	flags.StringSliceVar(&opts.filterDBs, "filter-db", nil, "replay statements running on the databases only")
+	flags.StringSliceVar(&opts.filterUsers, "filter-user", nil, "replay sessions of the users only (requires dumps of format v2)")
+	flags.StringSliceVar(&opts.filterClients, "filter-client-ip", nil, "replay sessions from the client ips or cidrs only (requires dumps of format v2)")
+	flags.StringVar(&opts.includeDigests, "include-digest-file", "", "replay statements of the digests in the file only (a digest per line, e.g. from a previous report)")
+	flags.StringVar(&opts.excludeDigests, "exclude-digest-file", "", "skip statements of the digests in the file (a digest per line)")
+	opts.config.Stabilize.Register(flags)
+	flags.BoolVar(&opts.config.SkipGaps, "skip-gaps", false, "stop replaying a session at its first gap of data lost in the capture instead of warning about it")
+	flags.StringVar(&opts.failuresDir, "failures-dir", "", "write a self-contained sql script to reproduce each statement failed on the target into the given directory (local replay only)")
+	flags.Int64Var(&opts.failuresLimit, "failures-limit", 1000, "max scripts written into --failures-dir (0 means unlimited)")
+	flags.StringVar(&opts.failedDir, "failed-dir", "", "write failed events into the given directory in the format of dumps (with failed.tsv listing them and their errors), thus they can be replayed again by text play (local replay only)")
+	flags.StringVar(&opts.redrive, "replay-failures", "", "replay only failed events listed by the failed.tsv (or the dir of it) written by --failed-dir of a previous replay of the input")
+	flags.BoolVar(&opts.redriveContext, "failures-context", true, "replay events changing the state (schema, session variables and prepared statements) of sessions of --replay-failures as well, otherwise only their connections and prepared statements needed are")
+	flags.StringVar(&opts.mirrorDSN, "mirror-dsn", "", "send every event to the mirror (e.g. the original server) as well as the target, and compare outcomes of both on the fly (local replay only)")
+	flags.Int64Var(&opts.mirrorMaxDiffs, "mirror-max-diffs", 100, "max number of differences from the mirror to log (0 means unlimited)")
+	flags.StringVar(&opts.otlpEndpoint, "otlp-endpoint", "", "export a span per session and per statement to the OpenTelemetry collector (OTLP/HTTP) like http://localhost:4318 (local replay only)")
+	flags.StringArrayVar(&opts.otlpHeaders, "otlp-header", nil, "header of requests to the collector like key=value (can be repeated)")
+	flags.StringVar(&opts.otlpService, "otlp-service", "mysql-replay", "service name of spans exported")
+	flags.StringVar(&opts.statsdAddr, "statsd-addr", "", "push stats counters and latencies of statements to the statsd (or dogstatsd) server like 127.0.0.1:8125")
+	flags.StringVar(&opts.statsdPrefix, "statsd-prefix", "mysql_replay", "prefix of metric names pushed to statsd")
+	flags.StringArrayVar(&opts.statsdTags, "statsd-tag", nil, "tag of metrics pushed to statsd like key:value, which overrides the default job (base name of the input) and target tags (can be repeated)")
+	flags.DurationVar(&opts.statsdInterval, "statsd-interval", 10*time.Second, "interval of pushing stats counters to statsd")
+	flags.Float64Var(&opts.statsdRate, "statsd-sample-rate", 1, "sample rate of latencies of statements pushed to statsd")
+	flags.StringVar(&opts.config.Responses, "responses", "", "write server responses received by the raw driver into the given directory (local replay only)")
+	flags.DurationVar(&opts.drainTimeout, "drain-timeout", 30*time.Second, "on SIGINT or SIGTERM, stop reading new events and wait at most the duration for in-flight statements before closing connections")
+	flags.DurationVar(&opts.reportInterval, "report-interval", 5*time.Second, "report interval")
+	flags.IntVar(&opts.topSlow, "top-slow", 10, "report top n slowest (and regressed vs. captured) statements grouped by digest at the end")
+	flags.StringVar(&opts.statsFile, "stats-file", "", "write a row of all counters and derived rates per report interval to the given path, as csv if it ends with .csv or json lines otherwise")
+	flags.StringVar(&opts.config.JobName, "job-name", "", "name of the replay, which labels stats per target and schema in reports and is the default job tag of statsd")
+	flags.StringVar(&opts.reportJSON, "report", "", "write a json summary report to the given path")
+	flags.StringVar(&opts.reportHTML, "report-html", "", "write a html summary report to the given path")
+	flags.DurationVar(&opts.adaptive, "adaptive", 0, "lower the speed automatically (and hold new sessions at the min speed) while lagging exceeds the duration or statements pile up on connections, and recover it afterwards (0 means disabled)")
+	flags.Float64Var(&opts.targetQPS, "target-qps", 0, "adjust the speed continuously (starting from --speed) so that the replayed qps tracks the rate, it's not raised while lagging exceeds --adaptive if set (0 means disabled)")
+	flags.BoolVar(&opts.tui, "tui", false, "display live stats in the terminal instead of periodic log lines")
+	flags.BoolVar(&opts.config.Quiet, "quiet", false, "suppress logs of sessions (e.g. warnings of failed statements) below errors, failures are still counted and sampled into the periodic stats and the final summary")
+	flags.StringVar(&opts.webAddr, "web-addr", "", "serve a web dashboard of the replay on the given address")
+	flags.BoolVar(&opts.config.TiDB, "tidb", false, "replay against TiDB: retry statements on transient TiDB errors and report statements failed due to unsupported syntax or features")
+	flags.IntVar(&opts.config.TiDBRetries, "tidb-retries", 3, "max retries of a statement failed with a retryable TiDB error (e.g. 8022, 9007)")
+	flags.IntVar(&opts.config.MaxStmts, "max-stmts", 1024, "max statements prepared on the target per connection, the least recently used one is closed on preparing more (and prepared again once executed) thus sessions never closing their statements don't leak them (0 means unlimited)")
+	flags.BoolVar(&opts.config.FetchRows, "fetch-rows", false, "read result sets of queries (e.g. SELECT) fully like clients do instead of discarding them, and report rows and bytes fetched and latencies of the first rows")
+	flags.Int64Var(&opts.config.FetchLimit.Rows, "max-rows-per-query", 0, "stop reading a result set past this number of rows (with --fetch-rows), the connection is re-established then (0 means no limit)")
+	flags.Int64Var(&opts.config.FetchLimit.Bytes, "max-result-bytes", 0, "stop reading a result set past this number of bytes (with --fetch-rows), the connection is re-established then (0 means no limit)")
+	flags.BoolVar(&opts.config.PrepareAsText, "prepare-as-text", false, "execute prepared statements as text queries with their captured params interpolated, for targets or proxies handling prepared statements poorly")
+	flags.DurationVar(&opts.config.KeepAlive, "keepalive", 0, "ping connections of sessions every the duration while they're idle (e.g. in long think time), thus they're not closed by wait_timeout of the target (0 means disabled)")
+	flags.IntVar(&opts.config.Reconnect.Attempts, "reconnect-attempts", 5, "max attempts of re-establishing a lost connection before failing events of the session")
+	flags.DurationVar(&opts.config.Reconnect.Base, "reconnect-backoff", 100*time.Millisecond, "backoff after the first failed attempt of reconnecting, which doubles after each attempt")
+	flags.DurationVar(&opts.config.Reconnect.Max, "reconnect-max-backoff", 5*time.Second, "max backoff between attempts of reconnecting")
+	flags.Float64Var(&opts.config.Reconnect.Jitter, "reconnect-jitter", 0.2, "randomize backoffs of reconnecting by up to the fraction of them, thus sessions don't reconnect in lockstep")
+	flags.IntVar(&opts.breaker, "breaker-threshold", 0, "pause the replay once connection failures in a row (across sessions) reach the threshold, and resume it once the target recovers (0 means disabled, local replay only)")
+	flags.DurationVar(&opts.breakerProbe, "breaker-probe", 5*time.Second, "interval of probing the target while the replay is paused by --breaker-threshold")
+	flags.BoolVar(&opts.config.ExactLifetimes, "exact-lifetimes", false, "reproduce lifetimes of captured connections exactly: connections are only established by captured handshakes, those closed or lost are never re-established implicitly")
+	flags.StringArrayVar(&opts.tidbSet, "tidb-set", nil, "set the tidb_ session variable like name=value on every new replay connection in tidb mode (can be repeated)")
+	flags.StringVar(&opts.beforeScript, "before-script", "", "run the sql file (*.sql) on the target or the shell command before starting the replay, e.g. to restore a snapshot")
+	flags.StringVar(&opts.afterScript, "after-script", "", "run the sql file (*.sql) on the target or the shell command after finishing the replay, e.g. to run ANALYZE or purge test data")
+	flags.StringVar(&opts.hook, "hook", "", "intercept events by the command which talks json lines over stdin and stdout (local replay only)")
+	opts.bgConfig.Register(flags)
+}
+
+func (opts *textPlayOptions) Run(input string) error {
 	var (
-		agents         []string
-		config         playConfig
-		targetDSN      string
-		reportInterval time.Duration
+		done   = make(chan struct{})
+		err    error
+		ctl    *playControl
+		config = opts.config
 	)
-	cmd := &cobra.Command{
-		Use:   "play",
-		Short: "PlayLocal mysql events from text files",
-		Args:  cobra.ExactArgs(1),
-		RunE: func(cmd *cobra.Command, args []string) error {
-			var (
-				done = make(chan struct{})
-				err  error
-				ctl  *playControl
-			)
-			ctl, err = newPlayControl(config, args[0], targetDSN)
-			if err != nil {
-				return err
+	startAt, err := parseTimeMillis(opts.startAt)
+	if err != nil {
+		return errors.Annotate(err, "parse start time")
+	}
+	switch opts.order {
+	case orderSession:
+	case orderGlobal:
+		if len(opts.agents) > 0 {
+			return errors.New("global order is not supported by remote replay")
+		}
+		if opts.follow {
+			return errors.New("global order is not supported in follow mode")
+		}
+	default:
+		return errors.New("unknown order: " + opts.order)
+	}
+	if opts.targetQPS > 0 && (config.Speed <= 0 || config.DryRun) {
+		return errors.New("--target-qps requires a positive speed and a real replay")
+	}
+	if config.ThinkTime, err = parseThinkTime(opts.thinkTime); err != nil {
+		return err
+	}
+	if config.Warmup, err = parseWarmup(opts.warmup); err != nil {
+		return err
+	}
+	config.Warmup.Stmts = opts.warmupStmts
+	if config.Warmup.Enabled() && len(opts.agents) > 0 {
+		return errors.New("connections are only warmed up in local replay")
+	}
+	if config.ThinkTime.compress && opts.order == orderGlobal {
+		return errors.New("think time can only be adjusted in session order")
+	}
+	if config.NoSessionDelay || config.SessionSpread > 0 {
+		if config.NoSessionDelay && config.SessionSpread > 0 {
+			return errors.New("--no-session-delay and --session-spread are mutually exclusive")
+		}
+		if opts.order == orderGlobal {
+			return errors.New("session starts can only be rescheduled in session order")
+		}
+		if config.SessionSpread > 0 && opts.follow {
+			return errors.New("--session-spread is not supported in follow mode")
+		}
+	}
+	if _, err = replay.LookupDriver(config.Driver); err != nil {
+		return err
+	}
+	if config.DryRun && (isSQLScript(opts.beforeScript) || isSQLScript(opts.afterScript)) {
+		return errors.New("sql scripts can not be run in dry run mode")
+	}
+	if opts.follow {
+		if len(opts.agents) > 0 {
+			return errors.New("follow mode is not supported by remote replay")
+		}
+		config.Follow = opts.followInterval
+	}
+	if len(opts.includeDigests) > 0 || len(opts.excludeDigests) > 0 || len(opts.filterDBs) > 0 || len(opts.filterUsers) > 0 || len(opts.filterClients) > 0 {
+		filter := &eventFilter{dbs: opts.filterDBs, users: opts.filterUsers, clients: opts.filterClients, sample: 1}
+		if len(opts.includeDigests) > 0 {
+			filter.digestAllow = []string{"@" + opts.includeDigests}
+		}
+		if len(opts.excludeDigests) > 0 {
+			filter.digestDeny = []string{"@" + opts.excludeDigests}
+		}
+		if err = filter.Init(); err != nil {
+			return errors.Annotate(err, "init filter")
+		}
+		config.Statements = filter
+	}
+	if len(opts.failuresDir) > 0 {
+		if len(opts.agents) > 0 || config.DryRun {
+			return errors.New("failures are only written in local replay")
+		}
+		if err = os.MkdirAll(opts.failuresDir, 0755); err != nil {
+			return errors.Trace(err)
+		}
+		config.Failures = newFailureRepros(opts.failuresDir, opts.failuresLimit)
+	}
+	if len(opts.failedDir) > 0 {
+		if len(opts.agents) > 0 || config.DryRun {
+			return errors.New("failed events are only written in local replay")
+		}
+		if config.DeadLetters, err = newDeadLetters(opts.failedDir, config.Format); err != nil {
+			return errors.Annotate(err, "create failed dir")
+		}
+	}
+	if opts.breaker > 0 {
+		if len(opts.agents) > 0 || config.DryRun {
+			return errors.New("the circuit breaker only works in local replay")
+		} else if opts.breakerProbe <= 0 {
+			return errors.New("--breaker-probe must be positive")
+		}
+		config.Breaker = newCircuitBreaker(opts.breaker, opts.breakerProbe)
+	}
+	if len(opts.redrive) > 0 {
+		if len(opts.agents) > 0 {
+			return errors.New("failures are only replayed again in local replay")
+		}
+		if config.Redrive, err = loadFailureSet(opts.redrive, opts.redriveContext); err != nil {
+			return errors.Annotate(err, "load failures")
+		}
+		zap.L().Info("replay failures only", zap.String("path", opts.redrive), zap.Int("sessions", len(config.Redrive.events)), zap.Int("events", config.Redrive.total))
+	}
+	if len(opts.mirrorDSN) > 0 {
+		if len(opts.agents) > 0 || config.DryRun {
+			return errors.New("mirrors are only compared in local replay")
+		}
+		mirror, err := mysql.ParseDSN(opts.mirrorDSN)
+		if err != nil {
+			return errors.Annotate(err, "parse mirror dsn")
+		}
+		config.Mirror = &mirrorConfig{Target: mirror, MaxDiffs: opts.mirrorMaxDiffs}
+	}
+	if len(opts.otlpEndpoint) > 0 {
+		if len(opts.agents) > 0 || config.DryRun {
+			return errors.New("spans are only exported in local replay")
+		}
+		if config.Tracer, err = newTracer(opts.otlpEndpoint, opts.otlpHeaders, opts.otlpService); err != nil {
+			return err
+		}
+		defer config.Tracer.Close()
+	}
+	if len(config.Responses) > 0 {
+		if config.Driver != replay.RawDriverName || len(opts.agents) > 0 {
+			return errors.New("responses are only captured by the raw driver in local replay")
+		}
+		if err = os.MkdirAll(config.Responses, 0755); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	if len(opts.tidbSet) > 0 {
+		if !config.TiDB {
+			return errors.New("tidb session variables are only set in tidb mode")
+		}
+		init := append([]string{}, config.SessionInit...)
+		for _, kv := range opts.tidbSet {
+			kv := strings.SplitN(kv, "=", 2)
+			name := strings.TrimSpace(kv[0])
+			if len(kv) != 2 || !strings.HasPrefix(strings.ToLower(name), "tidb_") {
+				return errors.Errorf("invalid tidb session variable: %s", strings.Join(kv, "="))
+			}
+			init = append(init, "SET @@SESSION."+name+" = "+strings.TrimSpace(kv[1]))
+		}
+		config.SessionInit = init
+	}
+	if err = config.Stabilize.Validate(); err != nil {
+		return err
+	} else if config.Stabilize.Mode == nondeterministicFlag {
+		return errors.New("nondeterministic functions can only be flagged by audit")
+	}
+	config.Interceptor = config.Stabilize.Interceptor()
+	if args := strings.Fields(opts.hook); len(args) > 0 {
+		if len(opts.agents) > 0 {
+			return errors.New("hooks are not supported by remote replay")
+		}
+		hook, err := replay.NewCommandInterceptor(args[0], args[1:]...)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := hook.Close(); err != nil {
+				zap.L().Warn("hook exited abnormally", zap.Error(err))
 			}
+		}()
+		config.Interceptor = replay.Chain(config.Interceptor, hook)
+	}
+	if opts.topSlow > 0 || len(opts.reportJSON) > 0 || len(opts.reportHTML) > 0 || opts.tui {
+		config.Digests = newDigestStats()
+	}
+	if len(opts.reportJSON) > 0 || len(opts.reportHTML) > 0 || len(opts.webAddr) > 0 || opts.tui || config.TiDB {
+		config.Report = newReportCollector(config.Stats)
+	}
+	config.Throttle = newPlayThrottle()
+	targetDSN, err := opts.target.Resolve()
+	if err != nil {
+		return err
+	}
+	ctl, err = newPlayControl(config, input, targetDSN)
+	if err != nil {
+		return err
+	}
+	if opts.check {
+		check := ctl.Check(context.Background(), opts.checkSample)
+		check.Print(os.Stdout)
+		if check.Failed() {
+			return errors.New("pre-replay check failed")
+		}
+		return nil
+	}
+	if len(opts.statsdAddr) > 0 {
+		job := ctl.JobName
+		if len(job) == 0 {
+			job = filepath.Base(ctl.source)
+		}
+		tags := []string{"job:" + job}
+		if ctl.MySQLConfig != nil {
+			tags = append(tags, "target:"+ctl.MySQLConfig.Addr)
+		}
+		if ctl.StatsD, err = newStatsdClient(ctl.Stats, opts.statsdAddr, opts.statsdPrefix, statsdTags(append(tags, opts.statsdTags...)...), opts.statsdRate); err != nil {
+			return err
+		}
+		defer ctl.StatsD.Close()
+		go ctl.StatsD.Run(done, opts.statsdInterval)
+	}
+	if ctl.transport, err = newAgentTransport(opts.agentProtocol, opts.agentSecurity); err != nil {
+		return err
+	}
+	defer ctl.transport.Close()
+	if ctl.DryRun && len(ctl.SQLOut) > 0 {
+		if err = os.MkdirAll(ctl.SQLOut, 0755); err != nil {
+			return err
+		}
+	}
+	if len(opts.webAddr) > 0 {
+		dashboard := newWebDashboard("mysql-replay: "+input, ctl.Stats, ctl.Report, ctl.Progress)
+		dashboard.control = ctl.Control
+		dashboard.Serve(opts.webAddr)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	exec, abort := context.WithCancel(context.Background())
+	defer abort()
+	ctl.exec = exec
+	go ctl.handleSignals(done, stop, abort, opts.drainTimeout)
+	if ctl.Breaker != nil {
+		go ctl.runBreaker(done)
+	}
+	if opts.targetQPS > 0 {
+		go ctl.trackQPS(done, opts.targetQPS, opts.adaptive)
+	} else if opts.adaptive > 0 && ctl.Speed > 0 {
+		go ctl.adapt(done, opts.adaptive)
+	}
 
-			fields := make([]zap.Field, 0, 10)
-			loadFields := func() {
-				metrics := stats.Dump()
-				fields = fields[:0]
-				for _, name := range []string{
-					stats.Connections, stats.ConnRunning, stats.ConnWaiting,
-					stats.Queries, stats.StmtExecutes, stats.StmtPrepares,
-					stats.FailedQueries, stats.FailedStmtExecutes, stats.FailedStmtPrepares,
-				} {
-					fields = append(fields, zap.Int64(name, metrics[name]))
-				}
-				if lagging := stats.GetLagging(); lagging > 0 {
-					fields = append(fields, zap.Duration("lagging", stats.GetLagging()))
-				}
+	fields := make([]zap.Field, 0, 10)
+	loadFields := func() {
+		metrics := ctl.Stats.Dump()
+		fields = fields[:0]
+		for _, name := range []string{
+			stats.Connections, stats.ConnRunning, stats.ConnWaiting,
+			stats.Queries, stats.StmtExecutes, stats.StmtPrepares,
+			stats.FailedQueries, stats.FailedStmtExecutes, stats.FailedStmtPrepares,
+		} {
+			fields = append(fields, zap.Int64(name, metrics[name]))
+		}
+		if n := metrics[stats.AffectedRowsMismatches]; n > 0 {
+			fields = append(fields, zap.Int64(stats.AffectedRowsMismatches, n))
+		}
+		if n := metrics[stats.StmtEvictions]; n > 0 {
+			fields = append(fields, zap.Int64(stats.StmtEvictions, n))
+		}
+		if n := metrics[stats.Reconnects]; n > 0 {
+			fields = append(fields, zap.Int64(stats.Reconnects, n))
+		}
+		if n := metrics[stats.TruncatedFetches]; n > 0 {
+			fields = append(fields, zap.Int64(stats.TruncatedFetches, n))
+		}
+		if ctl.Mirror != nil {
+			fields = append(fields,
+				zap.Int64(stats.MirrorCompared, metrics[stats.MirrorCompared]),
+				zap.Int64(stats.MirrorDiffs, metrics[stats.MirrorDiffs]))
+		}
+		if top := ctl.Stats.Failures(topFailureGroups); len(top) > 0 {
+			fields = append(fields, zap.Strings("top_failures", formatFailureGroups(top)))
+		}
+		if lagging := ctl.Stats.GetLagging(); lagging > 0 {
+			fields = append(fields, zap.Duration("lagging", ctl.Stats.GetLagging()))
+		}
+		if opts.bgConfig.Enabled() {
+			fields = append(fields,
+				zap.Int64(stats.BgQueries, metrics[stats.BgQueries]),
+				zap.Int64(stats.FailedBgQueries, metrics[stats.FailedBgQueries]))
+		}
+	}
+
+	if len(opts.beforeScript) > 0 {
+		if err = ctl.RunScript(ctx, scriptBefore, opts.beforeScript); err != nil {
+			return err
+		}
+	}
+	if startAt > 0 {
+		if d := time.Until(time.Unix(0, startAt*int64(time.Millisecond))); d > 0 {
+			ctl.log.Info("wait to start", zap.Duration("delay", d))
+			select {
+			case <-time.After(d):
+			case <-ctx.Done():
 			}
+		} else {
+			ctl.log.Warn("start time has passed, start now", zap.Duration("delay", d))
+		}
+	}
+	if opts.maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.maxDuration)
+		defer cancel()
+		// in-flight statements are drained like being interrupted
+		timer := time.AfterFunc(opts.maxDuration+opts.drainTimeout, abort)
+		defer timer.Stop()
+	}
 
-			go func() {
-				ticker := time.NewTicker(reportInterval)
-				defer ticker.Stop()
-				for {
-					select {
-					case <-done:
-						return
-					case <-ticker.C:
-						loadFields()
-						ctl.log.Info("stats", fields...)
-					}
+	var bg *bgLoad
+	bgCtx, stopBg := context.WithCancel(context.Background())
+	defer stopBg()
+	if opts.bgConfig.Enabled() && !ctl.DryRun {
+		bg, err = startBgLoad(bgCtx, opts.bgConfig, ctl.MySQLConfig, ctl.Stats)
+		if err != nil {
+			return err
+		}
+	}
+
+	var tui *tuiMonitor
+	interval := opts.reportInterval
+	if opts.tui {
+		tui, interval = newTUIMonitor(os.Stdout, "mysql-replay: "+input, ctl), time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case t := <-ticker.C:
+				if tui != nil {
+					tui.Render(t)
+				} else {
+					loadFields()
+					ctl.log.Info("stats", fields...)
 				}
-			}()
+				ctl.Report.SampleLagging(t, ctl.Stats.GetLagging())
+			}
+		}
+	}()
 
-			ctl.Play(context.Background(), agents)
-			close(done)
-			loadFields()
-			ctl.log.Info("done", fields...)
-			return nil
+	var statsWritten chan struct{}
+	if len(opts.statsFile) > 0 {
+		sf, err := newStatsFile(ctl.Stats, opts.statsFile)
+		if err != nil {
+			return errors.Annotate(err, "create stats file")
+		}
+		statsWritten = make(chan struct{})
+		go func() {
+			defer close(statsWritten)
+			sf.Run(done, opts.reportInterval, ctl.log)
+		}()
+	}
+
+	if opts.order == orderGlobal {
+		ctl.PlayGlobal(ctx)
+	} else {
+		ctl.Play(ctx, opts.agents)
+	}
+	close(done)
+	if statsWritten != nil {
+		<-statsWritten
+	}
+	if ctl.DeadLetters != nil {
+		if n, err := ctl.DeadLetters.Close(); err != nil {
+			ctl.log.Error("failed to write failed events", zap.Error(err))
+		} else if n > 0 {
+			ctl.log.Info("failed events are written", zap.String("dir", opts.failedDir), zap.Int64("events", n))
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		ctl.log.Warn("replay is stopped due to max duration", zap.Int64("finished", atomic.LoadInt64(&ctl.finished)), zap.Int("total", ctl.total()))
+	} else if ctx.Err() != nil {
+		ctl.log.Warn("replay is interrupted", zap.Int64("finished", atomic.LoadInt64(&ctl.finished)), zap.Int("total", ctl.total()))
+	}
+	if tui != nil {
+		tui.Render(time.Now())
+	}
+	if bg != nil {
+		stopBg()
+		bg.Wait()
+	}
+	loadFields()
+	ctl.log.Info("done", append(fields, eventFields(ctl.Stats.Dump())...)...)
+	if ctl.StatsD != nil {
+		ctl.StatsD.Push()
+	}
+	ctl.Digests.Report(ctl.log, opts.topSlow)
+	reportFailures(ctl.log, ctl.Stats, opts.topSlow)
+	reportStragglers(ctl.log, ctl.Stats, opts.topSlow)
+	reportLabeled(ctl.log, ctl.Stats)
+	reportPacing(ctl.log, ctl.Stats)
+	reportFetches(ctl.log, ctl.Stats)
+	if ctl.Report != nil {
+		report := ctl.Report.Build(ctl.Digests)
+		report.LogIncompatible(ctl.log)
+		if len(opts.reportJSON) > 0 {
+			if err = report.WriteJSON(opts.reportJSON); err != nil {
+				return errors.Annotate(err, "write json report")
+			}
+		}
+		if len(opts.reportHTML) > 0 {
+			if err = report.WriteHTML(opts.reportHTML); err != nil {
+				return errors.Annotate(err, "write html report")
+			}
+		}
+	}
+	if len(opts.afterScript) > 0 {
+		// the replay may be stopped by ctx, but the script is still run
+		return ctl.RunScript(context.Background(), scriptAfter, opts.afterScript)
+	}
+	return nil
+}
+
+func NewTextPlayCommand() *cobra.Command {
+	var opts textPlayOptions
+	cmd := &cobra.Command{
+		Use:   "play",
+		Short: "PlayLocal mysql events from text files",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return opts.Run(args[0])
 		},
 	}
-	cmd.Flags().StringSliceVar(&agents, "agents", []string{}, "agents list")
-	cmd.Flags().StringVar(&targetDSN, "target-dsn", "", "target dsn")
-	cmd.Flags().Float64Var(&config.Speed, "speed", 1, "speed ratio")
-	cmd.Flags().BoolVar(&config.DryRun, "dry-run", false, "dry run mode (just print events)")
-	cmd.Flags().IntVar(&config.MaxLineSize, "max-line-size", 16777216, "max line size")
-	cmd.Flags().DurationVar(&config.QueryTimeout, "query-timeout", time.Minute, "timeout for a single query")
-	cmd.Flags().DurationVar(&reportInterval, "report-interval", 5*time.Second, "report interval")
+	opts.Register(cmd.Flags())
 	return cmd
 }
 
@@ -252,13 +929,147 @@ type playConfig struct {
 	OrigStartTime int64
 	MaxLineSize   int
 	QueryTimeout  time.Duration
+	SQLOut        string
+	SQLStyle      string
+	SharedStorage bool
+	SharedPath    string
+	AgentTimeout  time.Duration
+	StartBarrier  time.Duration
 	MySQLConfig   *mysql.Config
+	Digests       *digestStats
+	Report        *reportCollector
+	Throttle      *playThrottle
+	SessionInit   []string
+	Format        string
+	Interceptor   replay.Interceptor
+	Driver        string
+	Responses     string
+	TiDB          bool
+	TiDBRetries   int
+	MaxStmts      int
+	PrepareAsText bool
+	FetchRows     bool
+	FetchLimit    replay.FetchLimit
+	// KeepAlive (if positive) is the interval of pinging connections of idle
+	// sessions, and ExactLifetimes never re-establishes connections implicitly.
+	KeepAlive      time.Duration
+	ExactLifetimes bool
+	// Reconnect is the backoff policy of re-establishing lost connections.
+	Reconnect replay.Backoff
+	// Breaker (if any) pauses the replay while the target is down.
+	Breaker *circuitBreaker
+	// SkipGaps stops replaying a session at its first gap of data lost in the
+	// capture instead of warning about it.
+	SkipGaps bool
+	// Follow (if positive) is the interval of listing the input for sessions
+	// appearing during the replay.
+	Follow time.Duration
+	// Statements (if any) selects sessions and statements to replay, events
+	// changing the state of selected sessions are always replayed.
+	Statements *eventFilter
+	// Stabilize tells how to deal with nondeterministic functions, the
+	// interceptor of which is installed as a part of Interceptor.
+	Stabilize stabilizeConfig
+	// ThinkTime is the policy of idle time between events of a session.
+	ThinkTime thinkTime
+	// Warmup selects sessions of which connections are established before
+	// the replay starts.
+	Warmup warmupPolicy
+	// NoSessionDelay starts all sessions immediately, and SessionSpread (if
+	// positive) spreads starts of sessions uniformly over the duration, instead
+	// of keeping their original offsets.
+	NoSessionDelay bool
+	SessionSpread  time.Duration
+	// Failures (if any) writes scripts to reproduce failed statements.
+	Failures *failureRepros
+	// DeadLetters (if any) writes failed events to be replayed again.
+	DeadLetters *deadLetters
+	// Redrive (if any) selects failed events of a previous replay to replay.
+	Redrive *failureSet
+	// Mirror (if any) compares outcomes of the target with the mirror.
+	Mirror *mirrorConfig
+	// Tracer (if any) exports spans of sessions and statements.
+	Tracer *tracer
+	// StatsD (if any) pushes latencies of statements.
+	StatsD *statsdClient
+	// Stats is the registry of stats of the replay, which is the default one
+	// if nil.
+	Stats *stats.Registry
+	// JobName (if any) labels stats of the replay, see stats.Labels.
+	JobName string
+	// Quiet suppresses logs of workers below errors.
+	Quiet bool
+}
+
+const (
+	thinkTimePreserve = "preserve"
+	thinkTimeNone     = "none"
+	thinkTimeCap      = "cap="
+)
+
+// thinkTime compresses idle time between consecutive events of a session to at
+// most max (in captured time, thus it's still scaled by the speed), the start
+// of sessions is not affected. The zero value preserves idle time.
+type thinkTime struct {
+	compress bool
+	max      time.Duration
+}
+
+func parseThinkTime(s string) (thinkTime, error) {
+	switch {
+	case s == thinkTimePreserve || len(s) == 0:
+		return thinkTime{}, nil
+	case s == thinkTimeNone:
+		return thinkTime{compress: true}, nil
+	case strings.HasPrefix(s, thinkTimeCap):
+		d, err := time.ParseDuration(strings.TrimPrefix(s, thinkTimeCap))
+		if err != nil || d < 0 {
+			return thinkTime{}, errors.New("invalid think time: " + s)
+		}
+		return thinkTime{compress: true, max: d}, nil
+	default:
+		return thinkTime{}, errors.New("unknown think time: " + s)
+	}
+}
+
+func (tt thinkTime) String() string {
+	if !tt.compress {
+		return thinkTimePreserve
+	} else if tt.max == 0 {
+		return thinkTimeNone
+	}
+	return thinkTimeCap + tt.max.String()
+}
+
+// sessionClock maps times of events of a session to when they're due under
+// the think time policy, by accumulating idle time cut off so far.
+type sessionClock struct {
+	thinkTime
+	started bool
+	last    int64
+	shift   int64
+}
+
+func (c *sessionClock) Due(t int64) int64 {
+	if !c.compress {
+		return t
+	}
+	if c.started {
+		if idle := t - c.last - c.max.Milliseconds(); idle > 0 {
+			c.shift += idle
+		}
+	}
+	c.started, c.last = true, t
+	return t - c.shift
 }
 
 func (opts playConfig) Ready(t int64) bool {
 	if opts.Speed <= 0 {
 		return true
 	}
+	if opts.Throttle != nil {
+		return opts.WaitTime(t) <= 0
+	}
 	return opts.Speed*float64(time.Now().UnixNano()/int64(time.Millisecond)-opts.PlayStartTime) >= float64(t-opts.OrigStartTime)
 }
 
@@ -266,194 +1077,557 @@ func (opts playConfig) WaitTime(t int64) time.Duration {
 	if opts.Speed <= 0 {
 		return 0
 	}
+	if opts.Throttle != nil {
+		return opts.Throttle.WaitTime(opts.PlayStartTime, opts.OrigStartTime, opts.Speed, t)
+	}
 	return time.Duration((float64(t-opts.OrigStartTime)/opts.Speed+float64(opts.PlayStartTime))*float64(time.Millisecond) - float64(time.Now().UnixNano()))
 }
 
+// Sleep waits until lead before the event at t is due, the wait is recalculated
+// once the replay is paused or resumed. It returns false if ctx is done.
+func (opts playConfig) Sleep(ctx context.Context, t int64, lead time.Duration) bool {
+	for {
+		var changed <-chan struct{}
+		if opts.Throttle != nil {
+			if !opts.Throttle.Wait(ctx) {
+				return false
+			}
+			changed = opts.Throttle.Changed()
+		}
+		d := opts.WaitTime(t) - lead
+		if d <= 0 {
+			return true
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+			return true
+		case <-changed:
+			timer.Stop()
+		}
+	}
+}
+
 type playControl struct {
 	playConfig
 
-	log     *zap.Logger
-	wg      *sync.WaitGroup
-	workers []*playWorker
+	source    string
+	store     storage.Storage
+	transport agentTransport
+	log       *zap.Logger
+	wg        *sync.WaitGroup
+	workers   []*playWorker
+	// known are names of files listed, see addWorkers.
+	known map[string]bool
+	lock  sync.Mutex
+
+	finished int64
+	job      string
+	sched    atomic.Value
+	// exec is the context of executing statements, which outlives the context
+	// of playing while draining.
+	exec context.Context
+	// remoteFailures are the last failure counts of agents.
+	remoteFailures map[string]agentFailureCounts
 }
 
 func newPlayControl(cfg playConfig, input string, target string) (*playControl, error) {
-	files, err := ioutil.ReadDir(input)
+	store, err := storage.Open(input)
 	if err != nil {
 		return nil, err
 	}
-	ctl := &playControl{playConfig: cfg, log: zap.L(), wg: new(sync.WaitGroup), workers: make([]*playWorker, 0, len(files))}
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	files, err := store.List(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	ctl := &playControl{playConfig: cfg, source: input, log: zap.L(), wg: new(sync.WaitGroup), workers: make([]*playWorker, 0, len(files))}
+	if !storage.IsRemote(input) {
+		if ctl.source, err = filepath.Abs(input); err != nil {
+			return nil, errors.Trace(err)
 		}
-		info := strings.Split(filepath.Base(file.Name()), ".")
-		if len(info) != 4 || info[3] != "tsv" {
-			continue
+	}
+	if hasMergedIndex(files) {
+		if err = ctl.loadMergedIndex(store, input); err != nil {
+			return nil, err
+		}
+		// sessions are listed by the index instead of file names
+		files = nil
+	}
+	ctl.store, ctl.known = store, make(map[string]bool, len(files))
+	ctl.workers = ctl.addWorkers(files)
+	if !ctl.DryRun {
+		if ctl.Driver == replay.PostgresDriverName {
+			ctl.MySQLConfig, err = replay.ParsePostgresDSN(target)
+		} else {
+			ctl.MySQLConfig, err = mysql.ParseDSN(target)
 		}
-		ts, err := strconv.ParseInt(info[0], 10, 64)
 		if err != nil {
-			ctl.log.Warn("skip input file", zap.String("name", file.Name()), zap.Error(err))
+			return nil, err
+		}
+	}
+	return ctl, nil
+}
+
+// addWorkers appends workers of session files not seen before to the workers
+// of the replay, and returns the new ones in the order of start time.
+func (pc *playControl) addWorkers(files []storage.File) []*playWorker {
+	format := pc.Format
+	if len(format) == 0 {
+		format = event.FormatTSV
+	}
+	workers := make([]*playWorker, 0, len(files))
+	for _, file := range files {
+		if pc.known[file.Name] {
 			continue
 		}
-		id, err := strconv.ParseUint(info[2], 16, 64)
-		if err != nil {
-			ctl.log.Warn("skip input file", zap.String("name", file.Name()), zap.Error(err))
+		pc.known[file.Name] = true
+		session, err := replay.ParseSessionName(file.Name, format)
+		if err == replay.ErrNotSession {
+			continue
+		} else if err != nil {
+			pc.log.Warn("skip input file", zap.String("name", file.Name), zap.Error(err))
+			continue
+		} else if pc.Redrive != nil && !pc.Redrive.Has(session.ID) {
 			continue
 		}
-		ctl.workers = append(ctl.workers, &playWorker{
-			playConfig: ctl.playConfig,
-			src:        filepath.Join(input, file.Name()),
-			log:        ctl.log.Named(info[2]),
-			wg:         ctl.wg,
-			ts:         ts,
-			id:         id,
-			stmts:      make(map[uint64]statement),
+		src := filepath.Join(pc.source, file.Name)
+		if storage.IsRemote(pc.source) {
+			src = pc.store.String() + file.Name
+		}
+		workers = append(workers, &playWorker{
+			playConfig: pc.playConfig,
+			src:        src,
+			store:      pc.store,
+			file:       file.Name,
+			log:        pc.workerLogger(session.ID),
+			wg:         pc.wg,
+			ts:         session.Start,
+			end:        session.End,
+			id:         session.ID,
 		})
 	}
-	sort.Slice(ctl.workers, func(i, j int) bool { return ctl.workers[i].ts < ctl.workers[j].ts })
-	if !ctl.DryRun {
-		ctl.MySQLConfig, err = mysql.ParseDSN(target)
-		if err != nil {
-			return nil, err
+	sort.Slice(workers, func(i, j int) bool { return workers[i].ts < workers[j].ts })
+	pc.lock.Lock()
+	pc.workers = append(pc.workers, workers...)
+	pc.lock.Unlock()
+	return workers
+}
+
+// schedule shifts sessions of workers (in the order of start time) to start
+// immediately or spread over SessionSpread, events of a session keep their
+// offsets from its start.
+func (pc *playControl) schedule(workers []*playWorker) {
+	for i, worker := range workers {
+		if pc.NoSessionDelay {
+			worker.shift = worker.ts - pc.OrigStartTime
+		} else if pc.SessionSpread > 0 && pc.Speed > 0 {
+			offset := float64(pc.SessionSpread.Milliseconds()) * pc.Speed * float64(i) / float64(len(workers))
+			worker.shift = worker.ts - pc.OrigStartTime - int64(offset)
 		}
 	}
-	return ctl, nil
 }
 
 func (pc *playControl) PlayLocal(ctx context.Context) {
+	pc.warmup(ctx)
 	pc.PlayStartTime = time.Now().UnixNano() / int64(time.Millisecond)
 	if len(pc.workers) > 0 {
 		pc.OrigStartTime = pc.workers[0].ts
 	}
+	pc.schedule(pc.workers)
+	ok := true
 	for _, worker := range pc.workers {
-		worker.playConfig = pc.playConfig
-		d := worker.WaitTime(worker.ts)
-		if d > 0 {
-			<-time.After(d)
-		}
-		pc.wg.Add(1)
-		go func(pw *playWorker) {
-			f, err := os.Open(pw.src)
-			if err != nil {
-				pw.log.Error("failed to open source file of the stream", zap.Error(err))
-				return
-			}
-			pw.start(ctx, f)
-		}(worker)
+		if ok = pc.launch(ctx, worker); !ok {
+			break
+		}
+	}
+	if ok && pc.Follow > 0 {
+		pc.follow(ctx)
 	}
 	pc.wg.Wait()
 	return
 }
 
+// launch starts the worker once its session is due, it returns false if ctx is
+// done before that.
+func (pc *playControl) launch(ctx context.Context, worker *playWorker) bool {
+	worker.playConfig = pc.playConfig
+	worker.exec = pc.exec
+	if !worker.Sleep(ctx, worker.ts-worker.shift, 0) || !pc.Throttle.WaitHeld(ctx) {
+		return false
+	}
+	pc.wg.Add(1)
+	go func(pw *playWorker) {
+		f, err := pw.openSource(ctx)
+		defer atomic.AddInt64(&pc.finished, 1)
+		if err != nil {
+			pw.log.Error("failed to open source file of the stream", zap.Error(err))
+			pw.wg.Done()
+			return
+		}
+		pw.start(ctx, f)
+	}(worker)
+	return true
+}
+
+// follow lists the input every Follow interval and launches sessions appearing
+// since then, until ctx is done.
+func (pc *playControl) follow(ctx context.Context) {
+	pc.log.Info("follow new sessions of "+pc.source, zap.Duration("interval", pc.Follow))
+	ticker := time.NewTicker(pc.Follow)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		files, err := pc.store.List(ctx)
+		if err != nil {
+			pc.log.Warn("failed to list new sessions", zap.Error(err))
+			continue
+		}
+		workers := pc.addWorkers(files)
+		if len(workers) == 0 {
+			continue
+		}
+		if pc.OrigStartTime == 0 {
+			// the input was empty at the start
+			pc.PlayStartTime, pc.OrigStartTime = time.Now().UnixNano()/int64(time.Millisecond), workers[0].ts
+		}
+		pc.schedule(workers)
+		pc.log.Info("found new sessions", zap.Int("count", len(workers)))
+		for _, worker := range workers {
+			if !pc.launch(ctx, worker) {
+				return
+			}
+		}
+	}
+}
+
+// total returns the number of sessions, which grows in follow mode.
+func (pc *playControl) total() int {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	return len(pc.workers)
+}
+
+// Progress returns progress of the replay, which is per agent when playing
+// remotely.
+func (pc *playControl) Progress() []progressRow {
+	if sched, ok := pc.sched.Load().(*remoteScheduler); ok {
+		return sched.Progress()
+	}
+	return []progressRow{{
+		Name:     "local",
+		Alive:    true,
+		Total:    pc.total(),
+		Finished: int(atomic.LoadInt64(&pc.finished)),
+		Lagging:  pc.Stats.GetLagging().Seconds(),
+	}}
+}
+
+// handleSignals pauses the replay on SIGUSR1 and resumes it on SIGUSR2. On
+// SIGINT or SIGTERM, it stops the replay by stop and aborts in-flight statements
+// by abort once they are not finished in the drain timeout or on a second one.
+func (pc *playControl) handleSignals(done <-chan struct{}, stop func(), abort func(), drain time.Duration) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGUSR2, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(ch)
+	var (
+		stopped bool
+		timeout <-chan time.Time
+	)
+	for {
+		select {
+		case <-done:
+			return
+		case <-timeout:
+			pc.log.Warn("drain timeout, abort in-flight statements")
+			abort()
+		case sig := <-ch:
+			if sig == os.Interrupt || sig == syscall.SIGTERM {
+				if stopped {
+					pc.log.Warn("abort in-flight statements", zap.Stringer("signal", sig))
+					abort()
+					continue
+				}
+				pc.log.Info("stop replaying and drain in-flight statements", zap.Stringer("signal", sig), zap.Duration("timeout", drain))
+				stopped = true
+				stop()
+				timeout = time.After(drain)
+				continue
+			}
+			paused := sig == syscall.SIGUSR1
+			if err := pc.Control(playJobControl{Paused: &paused}); err != nil {
+				pc.log.Error("handle signal", zap.Stringer("signal", sig), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Control applies c to the replay, which is forwarded to agents when playing
+// remotely.
+func (pc *playControl) Control(c playJobControl) error {
+	if c.Speed != nil {
+		if *c.Speed <= 0 || pc.Speed <= 0 {
+			return errors.New("speed can only be changed to a positive value for a paced replay")
+		}
+		rate := *c.Speed / pc.Speed
+		c.Speed, c.Rate = nil, &rate
+	}
+	if c.Paused != nil && pc.Throttle.SetPaused(*c.Paused) {
+		pc.log.Info("replay paused or resumed", zap.Bool("paused", *c.Paused))
+	}
+	if c.Rate != nil {
+		if *c.Rate <= 0 {
+			return errors.New("rate must be positive")
+		}
+		pc.Throttle.SetRate(*c.Rate)
+		pc.log.Info("replay speed changed", zap.Float64("speed", *c.Rate*pc.Speed))
+	}
+	sched, ok := pc.sched.Load().(*remoteScheduler)
+	if !ok {
+		return nil
+	}
+	failed := 0
+	for _, agent := range sched.Alive() {
+		if err := pc.transport.Control(agent.url, pc.job, c); err != nil {
+			pc.log.Error("control job on agent", zap.String("agent", agent.url), zap.Error(err))
+			failed += 1
+		}
+	}
+	if failed > 0 {
+		return errors.Errorf("failed to control job on %d agent(s)", failed)
+	}
+	return nil
+}
+
 func (pc *playControl) PlayRemote(ctx context.Context, agents []string) {
 	pc.PlayStartTime = time.Now().UnixNano() / int64(time.Millisecond)
 	if len(pc.workers) > 0 {
 		pc.OrigStartTime = pc.workers[0].ts
 	}
+	pc.schedule(pc.workers)
 	allSubmitted := int32(0)
 	name := fmt.Sprintf("job-%d-%d", pc.PlayStartTime, rand.Int63())
+	sched := newRemoteScheduler(agents, pc.AgentTimeout)
+	sched.Probe(pc.transport)
+	pc.job = name
+	pc.sched.Store(sched)
+	var lead time.Duration
+	if pc.StartBarrier > 0 {
+		start, err := sched.Barrier(pc.transport, name, pc.OrigStartTime, pc.StartBarrier)
+		if err != nil {
+			pc.log.Error("start barrier failed", zap.Error(err))
+			return
+		}
+		// agents pace events by the shared clock, thus sessions can be submitted ahead
+		pc.PlayStartTime, lead = start, pc.StartBarrier
+		pc.log.Info("start barrier passed", zap.Int("agents", len(sched.Alive())), zap.Duration("delay", time.Duration(start*int64(time.Millisecond)-time.Now().UnixNano())))
+	}
+
+	submit := func(worker *playWorker) {
+		agent := sched.Assign(worker)
+		go func() {
+			for agent != nil {
+				logger := pc.log.With(zap.String("src", worker.src), zap.String("agent", agent.url))
+				err := pc.submitTask(agent.url, name, worker)
+				if err == nil {
+					logger.Info("task submitted")
+					return
+				}
+				logger.Error("submit task", zap.Error(err))
+				agent = sched.Fail(agent, worker)
+			}
+			pc.log.Error("no alive agent for session", zap.String("src", worker.src))
+		}()
+	}
 
 	go func() {
 		defer atomic.StoreInt32(&allSubmitted, 1)
-		for i, worker := range pc.workers {
+		for _, worker := range pc.workers {
 			worker.playConfig = pc.playConfig
-			d := worker.WaitTime(worker.ts)
-			if d > 0 {
-				<-time.After(d)
+			if !worker.Sleep(ctx, worker.ts-worker.shift, lead) {
+				break
 			}
-			agent := agents[i%len(agents)]
-			task := &playTask{worker: worker}
-			f, err := os.Open(worker.src)
-			if err != nil {
-				pc.log.Error("open session file", zap.Error(err))
-				continue
-			}
-			req, err := task.buildRequest(fmt.Sprintf("%s/%s", agent, name), f)
-			if err != nil {
-				pc.log.Error("build remote request", zap.Error(err))
-				continue
-			}
-			go func() {
-				logger := pc.log.With(zap.String("src", f.Name()), zap.String("url", req.URL.String()))
-				logger.Info("submit task")
-				resp, err := http.DefaultClient.Do(req)
-				if err != nil {
-					logger.Error("send remote request", zap.Error(err))
-					return
-				}
-				defer resp.Body.Close()
-				if resp.StatusCode != http.StatusOK {
-					fields := []zap.Field{zap.Int("status", resp.StatusCode)}
-					if msg, err := ioutil.ReadAll(resp.Body); err == nil {
-						fields = append(fields, zap.String("body", string(msg)))
-					}
-					logger.Error("unexpected response", fields...)
-				}
-			}()
+			submit(worker)
 		}
 	}()
 
-	ticker := time.NewTicker(5 * time.Second)
+	// status is pushed by agents if the transport supports it, the ticker then
+	// only restarts broken streams and detects lost agents
+	var updates <-chan string
+	if pusher, ok := pc.transport.(statusPusher); ok {
+		updates = pusher.Updates()
+	}
+	var (
+		statuses = make(map[string]*playJobStatus)
+		counted  = []string{
+			stats.Connections, stats.ConnRunning, stats.ConnWaiting,
+			stats.Queries, stats.StmtExecutes, stats.StmtPrepares,
+			stats.FailedQueries, stats.FailedStmtExecutes, stats.FailedStmtPrepares,
+		}
+	)
+	refresh := func(agent *remoteAgent) {
+		status, err := pc.transport.Status(agent.url, name)
+		if err != nil {
+			pc.log.Error("query job status", zap.String("agent", agent.url), zap.Error(err))
+			if lost := sched.Miss(agent); len(lost) > 0 {
+				pc.log.Warn("agent is lost, reassign its unfinished sessions", zap.String("agent", agent.url), zap.Int("sessions", len(lost)))
+				delete(statuses, agent.url)
+				for _, worker := range lost {
+					submit(worker)
+				}
+			}
+			return
+		}
+		sched.Heartbeat(agent, status)
+		pc.collectFailures(agent.url, status)
+		for _, s := range status.Labeled {
+			s.Agent, s.Job = agent.url, pc.JobName
+			pc.Stats.SetLabeled(s)
+		}
+		statuses[agent.url] = status
+	}
+	ticker := time.NewTicker(remoteStatusInterval)
 	for {
-		<-ticker.C
+		select {
+		case <-ticker.C:
+			for _, agent := range sched.Alive() {
+				refresh(agent)
+			}
+		case url := <-updates:
+			if agent := sched.Agent(url); agent != nil {
+				refresh(agent)
+			}
+		case <-ctx.Done():
+			// agents abort the job at once, in-flight statements there are not drained
+			for _, agent := range sched.Alive() {
+				if err := pc.transport.Cancel(agent.url, name); err != nil {
+					pc.log.Error("cancel job", zap.String("agent", agent.url), zap.Error(err))
+				}
+			}
+			ticker.Stop()
+			pc.Stats.SetLagging(0, 0)
+			return
+		}
 		var (
-			total    = 0
-			finished = 0
 			lagging  = .0
 			counters = map[string]int64{}
 		)
-		for _, agent := range agents {
-			resp, err := http.Get(fmt.Sprintf("%s/%s", agent, name))
-			if err != nil {
-				pc.log.Error("query job status", zap.String("agent", agent), zap.Error(err))
-				continue
-			}
-			if resp.StatusCode != http.StatusOK {
-				fields := []zap.Field{zap.String("agent", agent), zap.Int("status", resp.StatusCode)}
-				if msg, err := ioutil.ReadAll(resp.Body); err == nil {
-					fields = append(fields, zap.String("body", string(msg)))
-				}
-				pc.log.Error("unexpected response", fields...)
-				continue
-			}
-			var status playJobStatus
-			err = json.NewDecoder(resp.Body).Decode(&status)
-			if err != nil {
-				pc.log.Error("decode response", zap.String("agent", agent), zap.Error(err))
+		for _, agent := range sched.Alive() {
+			status, ok := statuses[agent.url]
+			if !ok {
 				continue
 			}
-			total += status.Total
-			finished += status.Finished
 			if lagging < status.Lagging {
 				lagging = status.Lagging
 			}
-			for _, name := range []string{
-				stats.Connections, stats.ConnRunning, stats.ConnWaiting,
-				stats.Queries, stats.StmtExecutes, stats.StmtPrepares,
-				stats.FailedQueries, stats.FailedStmtExecutes, stats.FailedStmtPrepares,
-			} {
+			for _, name := range counted {
 				counters[name] += status.Stats[name]
 			}
 		}
-		stats.SetLagging(0, time.Duration(lagging*float64(time.Second)))
-		for _, name := range []string{
-			stats.Connections, stats.ConnRunning, stats.ConnWaiting,
-			stats.Queries, stats.StmtExecutes, stats.StmtPrepares,
-			stats.FailedQueries, stats.FailedStmtExecutes, stats.FailedStmtPrepares,
-		} {
-			stats.Add(name, counters[name]-stats.Get(name))
+		for _, worker := range sched.Orphans() {
+			submit(worker)
 		}
-		if atomic.LoadInt32(&allSubmitted) > 0 && total == finished {
+		pc.Stats.SetLagging(0, time.Duration(lagging*float64(time.Second)))
+		for _, name := range counted {
+			pc.Stats.Add(name, counters[name]-pc.Stats.Get(name))
+		}
+		if len(sched.Alive()) == 0 {
+			pc.log.Error("all agents are lost", zap.Int("unfinished", sched.Unfinished()))
+			break
+		}
+		if atomic.LoadInt32(&allSubmitted) > 0 && sched.Unfinished() == 0 {
 			break
 		}
-		//pc.log.Info("progress", zap.Int("total", total), zap.Int("finished", finished))
 	}
 	ticker.Stop()
-	stats.SetLagging(0, 0)
+	pc.Stats.SetLagging(0, 0)
 	return
 }
 
+// collectFailures logs failures reported by an agent and aggregates them into
+// the final report.
+// collectFailures counts failures of the agent by the increase of its failure
+// counts since the last status, samples are only logged and kept in reports.
+// Failures are counted by samples if the agent doesn't report counts.
+func (pc *playControl) collectFailures(agent string, status *playJobStatus) {
+	failures := status.Failures
+	counts := status.FailureCounts
+	if counts == nil {
+		for _, f := range failures {
+			counts = append(counts, agentFailureCount{Code: f.Code, Digest: f.Digest, Count: 1})
+		}
+	} else {
+		if pc.remoteFailures == nil {
+			pc.remoteFailures = make(map[string]agentFailureCounts)
+		}
+		last, ok := pc.remoteFailures[agent]
+		if !ok {
+			last = make(agentFailureCounts)
+			pc.remoteFailures[agent] = last
+		}
+		deltas := make([]agentFailureCount, 0, len(counts))
+		for _, c := range counts {
+			key := agentFailureKey{c.Code, c.Digest}
+			// counts go back only if the job is restarted on the agent
+			if n := c.Count - last[key]; n > 0 {
+				deltas = append(deltas, agentFailureCount{Code: c.Code, Digest: c.Digest, Count: n})
+			} else if n < 0 {
+				deltas = append(deltas, c)
+			}
+			last[key] = c.Count
+		}
+		counts = deltas
+	}
+	for _, c := range counts {
+		pc.Stats.CountFailures(c.Code, c.Digest, c.Count)
+	}
+	for i := range failures {
+		f := &failures[i]
+		f.Agent = agent
+		sample := f.Sample
+		if len(sample) == 0 {
+			sample = f.Event
+		}
+		if pc.Stats.SampleFailure(f.Code, f.Digest, sample) {
+			pc.log.Warn("remote failure", zap.String("agent", agent), zap.String("session", f.Session),
+				zap.String("event", f.Event), zap.String("code", f.Code), zap.String("digest", f.Digest), zap.String("error", f.Error))
+		}
+	}
+	pc.Report.ObserveRemote(failures, counts)
+}
+
+func (pc *playControl) submitTask(agent string, job string, worker *playWorker) error {
+	task := &playTask{worker: worker}
+	var (
+		f   io.ReadCloser
+		err error
+	)
+	if pc.SharedStorage {
+		task.source = pc.sharedSource()
+	} else if f, err = worker.openSource(context.Background()); err != nil {
+		return errors.Annotate(err, "open session file")
+	}
+	return pc.transport.Submit(agent, job, task, f)
+}
+
+// sharedSource returns the input location for agents, a local input is sent as
+// a path relative to data dirs of agents.
+func (pc *playControl) sharedSource() string {
+	if storage.IsRemote(pc.source) {
+		return pc.source
+	}
+	if len(pc.SharedPath) > 0 {
+		return pc.SharedPath
+	}
+	return filepath.Base(pc.source)
+}
+
 func (pc *playControl) Play(ctx context.Context, agents []string) {
 	if len(agents) == 0 {
 		pc.PlayLocal(ctx)
@@ -462,273 +1636,435 @@ func (pc *playControl) Play(ctx context.Context, agents []string) {
 	}
 }
 
-type statement struct {
-	query  string
-	handle *sql.Stmt
+// workerLogger returns the logger of the worker of the session, which belongs
+// to the worker module (see --log-module-level).
+func workerLogger(log *zap.Logger, id uint64) *zap.Logger {
+	return log.Named("worker").Named(fmt.Sprintf("%016x", id))
+}
+
+// workerLogger returns the logger of the worker of the session, which only
+// logs errors in quiet mode.
+func (pc *playControl) workerLogger(id uint64) *zap.Logger {
+	log := workerLogger(pc.log, id)
+	if pc.Quiet {
+		log = log.WithOptions(zap.IncreaseLevel(zap.ErrorLevel))
+	}
+	return log
 }
 
 type playWorker struct {
 	playConfig
 
-	src string
-	log *zap.Logger
-	wg  *sync.WaitGroup
+	src   string
+	store storage.Storage
+	file  string
+	log   *zap.Logger
+	wg    *sync.WaitGroup
+
+	ts  int64
+	end int64
+	id  uint64
+	// shift (in ms of captured time) moves the session earlier, see schedule.
+	shift int64
 
-	ts     int64
-	id     uint64
-	schema string
-	params []interface{}
+	// sessions of merged dumps are sections of partition files
+	offset int64
+	size   int64
 
-	pool  *sql.DB
-	conn  *sql.Conn
-	stmts map[uint64]statement
+	conn      *replay.Conn
+	responses *responseWriter
+	// mirrorConn applies events to the mirror, see playConfig.Mirror.
+	mirrorConn *replay.Conn
+	// span is the span of the session, see playConfig.Tracer.
+	span trace.Span
+	// filter tracks the state of the session for selecting its statements.
+	filter *sessionFilter
+	// gapped is set once the session is skipped due to a gap, see SkipGaps.
+	gapped bool
+	// repro tracks the state of the session for writing Failures and
+	// DeadLetters.
+	repro reproState
+	// dead is the session file of DeadLetters.
+	dead *deadLetterSession
+	// progress tracks events applied and lagging of the session.
+	progress *stats.Progress
+	// pending counts events due before the worker caught up, see pace.
+	pending int64
+	// exec (if any) is the context of executing statements, see playControl.
+	exec context.Context
+
+	onResult func(e *event.MySQLEvent, res replay.Result, err error)
 }
 
 func (pw *playWorker) start(ctx context.Context, r io.ReadCloser) {
 	defer func() {
 		r.Close()
-		pw.quit(false)
+		pw.close()
 		pw.wg.Done()
-		stats.SetLagging(pw.id, 0)
+		pw.Stats.SetLagging(pw.id, 0)
+		pw.Stats.SetPending(pw.id, 0)
+		pw.progress.Finish()
 	}()
-	e := event.MySQLEvent{Params: []interface{}{}}
-	in := bufio.NewScanner(r)
-	if pw.MaxLineSize > 0 {
-		buf := make([]byte, 0, 4096)
-		in.Buffer(buf, pw.MaxLineSize)
+	pw.track()
+	var script *sqlScriptWriter
+	if pw.DryRun && len(pw.SQLOut) > 0 {
+		var err error
+		if script, err = newSQLScriptWriter(pw.SQLOut, pw.src, pw.SQLStyle); err != nil {
+			pw.log.Error("failed to create sql script", zap.Error(err))
+			return
+		}
+		defer func() {
+			if err := script.Close(); err != nil {
+				pw.log.Error("failed to close sql script", zap.Error(err))
+			}
+		}()
 	}
+	e := event.MySQLEvent{Params: []interface{}{}}
+	dec := event.NewDecoder(pw.MaxLineSize)
+	in := event.NewLineScanner(r, pw.MaxLineSize)
 	slow := false
+	clock := sessionClock{thinkTime: pw.ThinkTime}
 	for in.Scan() {
-		_, err := event.ScanEvent(in.Text(), 0, e.Reset(e.Params[:0]))
+		ok, err := dec.Decode(in.Text(), e.Reset(e.Params[:0]))
 		if err != nil {
 			pw.log.Error("failed to scan event", zap.Error(err))
 			return
-		}
-
-		if d := pw.WaitTime(e.Time); d > 0 {
-			stats.Add(stats.ConnWaiting, 1)
-			select {
-			case <-ctx.Done():
-				stats.Add(stats.ConnWaiting, -1)
-				pw.log.Debug("exit due to context done")
-				return
-			case <-time.After(d):
-				stats.Add(stats.ConnWaiting, -1)
-			}
-			if slow {
-				stats.SetLagging(pw.id, 0)
-				slow = false
+		} else if !ok {
+			if pw.Statements != nil {
+				pw.sessionFilter().AcceptHeader(dec.Header)
 			}
-		} else {
-			select {
-			case <-ctx.Done():
-				pw.log.Debug("exit due to context done")
-				return
-			default:
-			}
-			stats.SetLagging(pw.id, -d)
-			slow = true
-		}
-		if pw.DryRun {
-			pw.log.Info(e.String())
 			continue
-		} else if pw.log.Core().Enabled(zap.DebugLevel) {
-			pw.log.Debug(e.String())
-		}
-
-		switch e.Type {
-		case event.EventQuery:
-			err = pw.execute(ctx, e.Query)
-		case event.EventStmtExecute:
-			err = pw.stmtExecute(ctx, e.StmtID, e.Params)
-		case event.EventStmtPrepare:
-			err = pw.stmtPrepare(ctx, e.StmtID, e.Query)
-		case event.EventStmtClose:
-			pw.stmtClose(ctx, e.StmtID)
-		case event.EventHandshake:
-			pw.quit(false)
-			err = pw.handshake(ctx, e.DB)
-		case event.EventQuit:
-			pw.quit(false)
-		default:
-			pw.log.Warn("unknown event", zap.Any("value", e))
+		} else if !pw.accept(&e) {
 			continue
 		}
-		if err != nil {
-			if sqlErr := errors.Unwrap(err); sqlErr == context.DeadlineExceeded || sqlErr == sql.ErrConnDone || sqlErr == mysql.ErrInvalidConn {
-				pw.log.Warn("reconnect after "+e.String(), zap.String("cause", sqlErr.Error()))
-				pw.quit(true)
-				err = pw.handshake(ctx, pw.schema)
-				if err != nil {
-					pw.log.Warn("reconnect error", zap.Error(err))
-				}
-			} else {
-				pw.log.Warn("failed to apply "+e.String(), zap.Error(err))
-			}
+		if !pw.pace(ctx, clock.Due(e.Time)-pw.shift, &slow) {
+			pw.log.Debug("exit due to context done")
+			return
 		}
+		pw.apply(pw.execContext(ctx), &e, script)
+		if pw.gapped {
+			return
+		}
+	}
+	if err := in.Err(); err != nil {
+		pw.log.Error("failed to read event", zap.Error(err))
 	}
 }
 
-func (pw *playWorker) open(schema string) (*sql.DB, error) {
-	cfg := pw.MySQLConfig
-	if len(schema) > 0 && cfg.DBName != schema {
-		cfg = cfg.Clone()
-		cfg.DBName = schema
+// track registers the progress of the worker.
+func (pw *playWorker) track() {
+	pw.progress = pw.Stats.TrackProgress(pw.id, filepath.Base(pw.src), pw.ts, pw.end)
+}
+
+// accept tells whether to replay the event, sessions and statements not
+// selected by Statements and events not selected by Redrive are skipped.
+func (pw *playWorker) accept(e *event.MySQLEvent) bool {
+	if pw.Redrive != nil && !pw.Redrive.Accept(pw.id, e) {
+		return false
 	}
-	return sql.Open("mysql", cfg.FormatDSN())
+	if pw.Statements == nil {
+		return true
+	}
+	keep, _ := pw.sessionFilter().Accept(e)
+	return keep
 }
 
-func (pw *playWorker) handshake(ctx context.Context, schema string) error {
-	pool, err := pw.open(schema)
-	if err != nil {
-		return err
+func (pw *playWorker) sessionFilter() *sessionFilter {
+	if pw.filter == nil {
+		pw.filter = pw.Statements.Session()
 	}
-	pw.pool = pool
-	pw.schema = schema
-	_, err = pw.getConn(ctx)
-	return err
+	return pw.filter
 }
 
-func (pw *playWorker) quit(reconnect bool) {
-	for id, stmt := range pw.stmts {
-		if stmt.handle != nil {
-			stmt.handle.Close()
-			stmt.handle = nil
+// execContext returns the context of executing statements, which falls back to
+// ctx if the worker is not bound to one.
+func (pw *playWorker) execContext(ctx context.Context) context.Context {
+	if pw.exec != nil {
+		return pw.exec
+	}
+	return ctx
+}
+
+// pace waits until the event at t is due and tracks the lagging of the worker
+// and how late the event is dispatched, it returns false if ctx is done.
+func (pw *playWorker) pace(ctx context.Context, t int64, slow *bool) bool {
+	if d := pw.WaitTime(t); d > 0 || pw.Throttle.Paused() {
+		pw.Stats.Add(stats.ConnWaiting, 1)
+		ok := pw.keepAlive(ctx, t) && pw.Sleep(ctx, t, 0)
+		pw.Stats.Add(stats.ConnWaiting, -1)
+		if !ok {
+			return false
 		}
-		if reconnect {
-			pw.stmts[id] = stmt
-		} else {
-			delete(pw.stmts, id)
+		if pw.Speed > 0 {
+			pw.Stats.ObservePacing(-pw.WaitTime(t))
 		}
+		if *slow {
+			pw.Stats.SetLagging(pw.id, 0)
+			pw.Stats.SetPending(pw.id, 0)
+			pw.progress.SetLagging(0)
+			pw.pending = 0
+			*slow = false
+		}
+	} else {
+		select {
+		case <-ctx.Done():
+			return false
+		default:
+		}
+		if pw.Speed > 0 {
+			pw.Stats.ObservePacing(-d)
+		}
+		pw.pending += 1
+		pw.Stats.SetLagging(pw.id, -d)
+		pw.Stats.SetPending(pw.id, pw.pending)
+		pw.progress.SetLagging(-d)
+		*slow = true
 	}
-	if pw.conn != nil {
-		pw.conn.Raw(func(driverConn interface{}) error {
-			if dc, ok := driverConn.(io.Closer); ok {
-				dc.Close()
-			}
-			return nil
-		})
-		pw.conn.Close()
-		pw.conn = nil
-		stats.Add(stats.Connections, -1)
-	}
-	if pw.pool != nil {
-		pw.pool.Close()
-		pw.pool = nil
-	}
+	return true
 }
 
-func (pw *playWorker) execute(ctx context.Context, query string) error {
-	conn, err := pw.getConn(ctx)
+// newConn returns the connection of the session to the target.
+func (pw *playWorker) newConn() (*replay.Conn, error) {
+	driver, err := replay.LookupDriver(pw.Driver)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if pw.QueryTimeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, pw.QueryTimeout)
-		defer cancel()
+	if len(pw.Responses) > 0 && pw.Driver == replay.RawDriverName {
+		driver = replay.RawDriver{Capture: true}
 	}
-	stats.Add(stats.Queries, 1)
-	stats.Add(stats.ConnRunning, 1)
-	_, err = conn.ExecContext(ctx, query)
-	stats.Add(stats.ConnRunning, -1)
-	if err != nil {
-		stats.Add(stats.FailedQueries, 1)
-		return errors.Trace(err)
+	conn := replay.NewConn(replay.ConnConfig{
+		Target:        pw.MySQLConfig,
+		QueryTimeout:  pw.QueryTimeout,
+		SessionInit:   pw.SessionInit,
+		Digests:       pw.Digests != nil,
+		Interceptor:   pw.Interceptor,
+		Driver:        driver,
+		MaxStmts:      pw.MaxStmts,
+		PrepareAsText: pw.PrepareAsText,
+		FetchRows:     pw.FetchRows,
+		FetchLimit:    pw.FetchLimit,
+		ExactLifetime: pw.ExactLifetimes,
+		Reconnect:     pw.Reconnect,
+		Stats:         pw.Stats,
+	}, pw.id, pw.log)
+	if pw.TiDB {
+		conn.Retry, conn.Retries = replay.IsTiDBRetryable, pw.TiDBRetries
 	}
-	return nil
+	return conn, nil
 }
 
-func (pw *playWorker) stmtPrepare(ctx context.Context, id uint64, query string) error {
-	stmt := pw.stmts[id]
-	stmt.query = query
-	if stmt.handle != nil {
-		stmt.handle.Close()
-		stmt.handle = nil
-	}
-	delete(pw.stmts, id)
-	conn, err := pw.getConn(ctx)
-	if err != nil {
-		return err
+// keepAlive pings the connection every KeepAlive while waiting for the event at
+// t, it returns false if ctx is done.
+func (pw *playWorker) keepAlive(ctx context.Context, t int64) bool {
+	if pw.KeepAlive <= 0 {
+		return true
 	}
-	stats.Add(stats.StmtPrepares, 1)
-	stmt.handle, err = conn.PrepareContext(ctx, stmt.query)
-	if err != nil {
-		stats.Add(stats.FailedStmtPrepares, 1)
-		return errors.Trace(err)
+	for pw.conn != nil {
+		d := pw.WaitTime(t)
+		if d <= pw.KeepAlive {
+			return true
+		}
+		if !pw.Sleep(ctx, t, d-pw.KeepAlive) {
+			return false
+		}
+		if err := pw.conn.Ping(pw.execContext(ctx)); err != nil {
+			pw.log.Warn("failed to ping", zap.Error(err))
+		}
 	}
-	pw.stmts[id] = stmt
-	return nil
+	return true
 }
 
-func (pw *playWorker) stmtExecute(ctx context.Context, id uint64, params []interface{}) error {
-	stmt, err := pw.getStmt(ctx, id)
-	if err != nil {
-		return err
+// apply applies the event to the target, or writes it to the script in dry
+// run mode.
+func (pw *playWorker) apply(ctx context.Context, e *event.MySQLEvent, script *sqlScriptWriter) {
+	var err error
+	if pw.gapped {
+		return
+	} else if e.Type == event.EventGap && pw.SkipGaps {
+		pw.log.Warn("skip the rest of the session due to data lost in capture", zap.Uint64("bytes", e.Gap))
+		pw.gapped = true
+		return
 	}
-	if pw.QueryTimeout > 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, pw.QueryTimeout)
-		defer cancel()
+	pw.progress.Observe(e.Time)
+	pw.Stats.Add(stats.EventCounter(event.TypeName(e.Type)), 1)
+	if script != nil {
+		if err = script.Write(e); err != nil {
+			pw.log.Warn("failed to write "+e.String(), zap.Error(err))
+		}
+		return
+	} else if pw.DryRun {
+		pw.log.Info(e.String())
+		return
+	} else if pw.log.Core().Enabled(zap.DebugLevel) {
+		pw.log.Debug(e.String())
 	}
-	stats.Add(stats.StmtExecutes, 1)
-	stats.Add(stats.ConnRunning, 1)
-	_, err = stmt.ExecContext(ctx, params...)
-	stats.Add(stats.ConnRunning, -1)
-	if err != nil {
-		stats.Add(stats.FailedStmtExecutes, 1)
-		return errors.Trace(err)
+
+	if pw.conn == nil {
+		if pw.conn, err = pw.newConn(); err != nil {
+			pw.log.Error("failed to create connection", zap.Error(err))
+			return
+		}
+	}
+	var mirror <-chan mirrorResult
+	if pw.Mirror != nil && mirrored(e) {
+		mirror = pw.mirror(ctx, e)
+	}
+	res, err := pw.conn.Apply(ctx, e)
+	if mirror != nil {
+		pw.compareMirror(<-mirror, res, err)
+	}
+	if pw.Breaker != nil {
+		pw.Breaker.Observe(res, err)
+	}
+	if err == replay.ErrUnknownEvent {
+		pw.log.Warn("unknown event", zap.Any("value", e))
+		return
+	} else if err == replay.ErrGap {
+		pw.log.Warn("data lost in capture, events around it may be corrupted", zap.Uint64("bytes", e.Gap))
+		return
+	}
+	mismatch, mismatched := err.(*replay.AffectedRowsError)
+	if mismatched {
+		pw.Digests.ObserveMismatch(res.Digest, res.Query)
+		pw.log.Debug("affected rows mismatch", zap.String("query", formatSample(res.Query)), zap.Uint64("expected", mismatch.Expected), zap.Int64("actual", mismatch.Actual))
+	}
+	// a mismatch of rows affected is reported on the result of a succeeded statement
+	if e.Type == event.EventResult && e.Latency > 0 && len(res.Query) > 0 && (err == nil || mismatched) {
+		pw.Digests.ObserveCaptured(res.Digest, res.Query, time.Duration(e.Latency)*time.Microsecond, res.Duration)
+	}
+	if res.Executed {
+		pw.Digests.Observe(res.Digest, res.Query, res.Duration, err)
+		pw.Report.Observe(res.Duration, err)
+		if pw.StatsD != nil {
+			pw.StatsD.Timing("latency", res.Duration)
+		}
+		pw.Stats.ObserveLabeled(pw.labels(), res.Duration, err != nil)
+		if res.Fetched != nil && err == nil {
+			pw.Stats.ObserveFetch(res.Fetched.Rows, res.Fetched.Bytes, res.Fetched.FirstRow, res.Duration)
+		}
+		if pw.TiDB && replay.IsTiDBIncompatible(err) {
+			pw.Report.ObserveIncompatible(res.Digest, res.Query, err)
+		}
+	}
+	if raw, ok := res.Result.(replay.RawResponse); ok && len(pw.Responses) > 0 {
+		if pw.responses == nil {
+			var werr error
+			if pw.responses, werr = newResponseWriter(pw.Responses, pw.id); werr != nil {
+				pw.log.Error("failed to create response file", zap.Error(werr))
+				pw.Responses = ""
+			}
+		}
+		if pw.responses != nil {
+			pw.responses.Write(e, raw.Response())
+		}
+	}
+	if pw.onResult != nil {
+		pw.onResult(e, res, err)
+	}
+	if pw.Tracer != nil {
+		pw.trace(e, res, err)
+	}
+	if err != nil && !replay.IsConnError(err) {
+		code, digest, sample := describeFailure(e, res, err)
+		if pw.Stats.AddFailure(code, digest, sample) {
+			pw.log.Warn("failed to apply "+e.String(), zap.String("code", code), zap.String("digest", digest), zap.Error(err))
+		} else {
+			pw.log.Debug("failed to apply "+e.String(), zap.Error(err))
+		}
+	}
+	if pw.Failures != nil || pw.DeadLetters != nil {
+		if err == nil {
+			pw.repro.Observe(e)
+		} else if pw.Failures != nil && (res.Executed || e.Type == event.EventStmtPrepare || e.Type == event.EventResult) && !replay.IsConnError(err) {
+			pw.Failures.Write(pw, e, err)
+		}
+		if err != nil && pw.DeadLetters != nil && isStatement(e) {
+			pw.DeadLetters.Write(pw, e, err)
+		}
 	}
-	return nil
 }
 
-func (pw *playWorker) stmtClose(ctx context.Context, id uint64) {
-	stmt, ok := pw.stmts[id]
-	if !ok {
-		return
+// labels returns labels of stats of the statement being applied.
+func (pw *playWorker) labels() stats.Labels {
+	l := stats.Labels{Job: pw.JobName}
+	if pw.MySQLConfig != nil {
+		l.Target = pw.MySQLConfig.Addr
 	}
-	if stmt.handle != nil {
-		stmt.handle.Close()
-		stmt.handle = nil
+	if pw.conn != nil {
+		l.Schema = pw.conn.Schema()
 	}
-	delete(pw.stmts, id)
+	return l
 }
 
-func (pw *playWorker) getConn(ctx context.Context) (*sql.Conn, error) {
-	var err error
-	if pw.pool == nil {
-		pw.pool, err = pw.open(pw.schema)
-		if err != nil {
-			return nil, err
-		}
+// openSource opens the session file, which falls back to src if the worker is
+// not bound to a storage.
+func (pw *playWorker) openSource(ctx context.Context) (io.ReadCloser, error) {
+	var (
+		r   io.ReadCloser
+		err error
+	)
+	if pw.store == nil {
+		r, err = os.Open(pw.src)
+	} else {
+		r, err = pw.store.Open(ctx, pw.file)
 	}
-	if pw.conn == nil {
-		pw.conn, err = pw.pool.Conn(ctx)
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-		stats.Add(stats.Connections, 1)
+	if err != nil || pw.size <= 0 {
+		return r, err
 	}
-	return pw.conn, nil
+	return openSection(r, pw.offset, pw.size)
 }
 
-func (pw *playWorker) getStmt(ctx context.Context, id uint64) (*sql.Stmt, error) {
-	stmt, ok := pw.stmts[id]
-	if ok && stmt.handle != nil {
-		return stmt.handle, nil
-	} else if !ok {
-		return nil, errors.Errorf("no such statement #%d", id)
+// close closes the connection of the session.
+func (pw *playWorker) close() {
+	if pw.conn != nil {
+		pw.conn.Close()
+		pw.conn = nil
 	}
-	conn, err := pw.getConn(ctx)
-	if err != nil {
-		return nil, err
+	if pw.mirrorConn != nil {
+		pw.mirrorConn.Close()
+		pw.mirrorConn = nil
+	}
+	if pw.Tracer != nil {
+		pw.endTrace()
+	}
+	if pw.responses != nil {
+		if err := pw.responses.Close(); err != nil {
+			pw.log.Error("failed to close response file", zap.Error(err))
+		}
+		pw.responses = nil
+	}
+	if pw.dead != nil {
+		if err := pw.DeadLetters.closeSession(pw); err != nil {
+			pw.log.Error("failed to close failed events", zap.Error(err))
+		}
 	}
-	stmt.handle, err = conn.PrepareContext(ctx, stmt.query)
+}
+
+// responseWriter writes server responses of a session as lines of the time
+// and type of the event followed by the response packets in base64.
+type responseWriter struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func newResponseWriter(dir string, id uint64) (*responseWriter, error) {
+	f, err := os.Create(filepath.Join(dir, fmt.Sprintf("%016x.resp", id)))
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	pw.stmts[id] = stmt
-	return stmt.handle, nil
+	return &responseWriter{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (rw *responseWriter) Write(e *event.MySQLEvent, resp []byte) {
+	fmt.Fprintf(rw.w, "%d\t%d\t%s\n", e.Time, e.Type, base64.StdEncoding.EncodeToString(resp))
+}
+
+func (rw *responseWriter) Close() error {
+	err := rw.w.Flush()
+	if cerr := rw.f.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Trace(err)
 }
 
 func NewTextCommand() *cobra.Command {
@@ -739,5 +2075,14 @@ func NewTextCommand() *cobra.Command {
 	cmd.AddCommand(NewTextDumpCommand())
 	cmd.AddCommand(NewTextPlayCommand())
 	cmd.AddCommand(NewTextAgentCommand())
+	cmd.AddCommand(NewTextJobCommand())
+	cmd.AddCommand(NewTextAuditCommand())
+	cmd.AddCommand(NewTextInspectCommand())
+	cmd.AddCommand(NewTextMergeCommand())
+	cmd.AddCommand(NewTextFilterCommand())
+	cmd.AddCommand(NewTextAnonymizeCommand())
+	cmd.AddCommand(NewTextConvertCommand())
+	cmd.AddCommand(NewTextEstimateCommand())
+	cmd.AddCommand(NewTextProfileCommand())
 	return cmd
 }
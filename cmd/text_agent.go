@@ -9,6 +9,11 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,26 +21,120 @@ import (
 	"github.com/go-sql-driver/mysql"
 	"github.com/pingcap/errors"
 	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
 	"github.com/zyguan/mysql-replay/stats"
+	"github.com/zyguan/mysql-replay/storage"
 	"go.uber.org/zap"
 )
 
 type playTaskMeta struct {
-	DSN          string  `json:"dsn"`
-	ID           uint64  `json:"id"`
-	TS           int64   `json:"ts"`
-	MaxLineSize  int64   `json:"max_line_size"`
-	QueryTimeout int64   `json:"query_timeout"`
-	Speed        float64 `json:"speed"`
+	DSN          string   `json:"dsn"`
+	ID           uint64   `json:"id"`
+	TS           int64    `json:"ts"`
+	MaxLineSize  int64    `json:"max_line_size"`
+	QueryTimeout int64    `json:"query_timeout"`
+	Speed        float64  `json:"speed"`
+	Source       string   `json:"source,omitempty"`
+	File         string   `json:"file,omitempty"`
+	SessionInit  []string `json:"session_init,omitempty"`
+	Offset       int64    `json:"offset,omitempty"`
+	Size         int64    `json:"size,omitempty"`
+	Driver       string   `json:"driver,omitempty"`
+	TiDB         bool     `json:"tidb,omitempty"`
+	TiDBRetries  int      `json:"tidb_retries,omitempty"`
+	MaxStmts     int      `json:"max_stmts,omitempty"`
+	PrepareText  bool     `json:"prepare_as_text,omitempty"`
+	KeepAlive    int64    `json:"keepalive,omitempty"`
+	ExactLife    bool     `json:"exact_lifetimes,omitempty"`
+	SkipGaps     bool     `json:"skip_gaps,omitempty"`
+	ThinkTime    string   `json:"think_time,omitempty"`
+	Shift        int64    `json:"shift,omitempty"`
+	DigestAllow  []string `json:"digest_allow,omitempty"`
+	DigestDeny   []string `json:"digest_deny,omitempty"`
+	DBs          []string `json:"dbs,omitempty"`
+	Users        []string `json:"users,omitempty"`
+	Clients      []string `json:"clients,omitempty"`
+	Stabilize    string   `json:"stabilize,omitempty"`
+	StabilizeNow bool     `json:"stabilize_now,omitempty"`
+
+	Reconnect  replay.Backoff    `json:"reconnect"`
+	FetchRows  bool              `json:"fetch_rows,omitempty"`
+	FetchLimit replay.FetchLimit `json:"fetch_limit"`
 }
 
 type playTask struct {
 	worker   *playWorker
 	form     *multipart.Form
+	data     string
+	source   string
 	finished uint32
+
+	events    int64
+	errors    int64
+	lastError atomic.Value
+	onFailure func(f agentFailure)
+}
+
+// agentFailure is a failed statement (or a task failed to start) recorded by
+// agents, which is forwarded to the controller via job status.
+type agentFailure struct {
+	Seq     int64     `json:"seq"`
+	Time    time.Time `json:"time"`
+	Agent   string    `json:"agent,omitempty"`
+	Session string    `json:"session"`
+	Event   string    `json:"event"`
+	Code    string    `json:"code"`
+	Error   string    `json:"error"`
+	Digest  string    `json:"digest,omitempty"`
+	Sample  string    `json:"sample,omitempty"`
 }
 
-func taskFromRequest(req *http.Request) (*playTask, error) {
+// maxJobFailures bounds failures kept as samples per job, failures are
+// counted by agentFailureCounts regardless.
+const maxJobFailures = 1000
+
+// agentFailureCount is the number of failures of an error code and a digest
+// in a job since it started.
+type agentFailureCount struct {
+	Code   string `json:"code"`
+	Digest string `json:"digest,omitempty"`
+	Count  int64  `json:"count"`
+}
+
+type agentFailureKey struct {
+	code   string
+	digest string
+}
+
+// agentFailureCounts counts failures of a job, groups are bounded like the
+// ones of stats.Registry, failures of new digests are then counted by their
+// codes only.
+type agentFailureCounts map[agentFailureKey]int64
+
+func (m agentFailureCounts) add(code string, digest string, n int64) {
+	key := agentFailureKey{code, digest}
+	if _, ok := m[key]; !ok && len(m) >= stats.MaxFailureGroups {
+		key.digest = ""
+	}
+	m[key] += n
+}
+
+func (m agentFailureCounts) list() []agentFailureCount {
+	out := make([]agentFailureCount, 0, len(m))
+	for k, n := range m {
+		out = append(out, agentFailureCount{Code: k.code, Digest: k.digest, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Code != out[j].Code {
+			return out[i].Code < out[j].Code
+		}
+		return out[i].Digest < out[j].Digest
+	})
+	return out
+}
+
+func taskFromRequest(req *http.Request, dataDir string) (*playTask, error) {
 	defer req.Body.Close()
 
 	_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
@@ -48,11 +147,7 @@ func taskFromRequest(req *http.Request) (*playTask, error) {
 		return nil, errors.Trace(err)
 	}
 
-	var (
-		task playTask
-		meta playTaskMeta
-	)
-
+	var meta playTaskMeta
 	as := form.Value["meta"]
 	if len(as) < 1 {
 		return nil, errors.New("meta field is missing")
@@ -61,33 +156,124 @@ func taskFromRequest(req *http.Request) (*playTask, error) {
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	var wg sync.WaitGroup
+	task, err := newPlayTask(meta, dataDir)
+	if err != nil {
+		return nil, err
+	}
+	task.form = form
+	return task, nil
+}
+
+func newPlayTask(meta playTaskMeta, dataDir string) (*playTask, error) {
+	var (
+		task playTask
+		err  error
+		wg   sync.WaitGroup
+	)
 	wg.Add(1)
 	task.worker = &playWorker{
 		playConfig: playConfig{
-			Speed:         meta.Speed,
-			MaxLineSize:   int(meta.MaxLineSize),
-			QueryTimeout:  time.Duration(meta.QueryTimeout) * time.Millisecond,
-			PlayStartTime: time.Now().UnixNano() / int64(time.Millisecond),
-			OrigStartTime: meta.TS,
+			Speed:          meta.Speed,
+			MaxLineSize:    int(meta.MaxLineSize),
+			QueryTimeout:   time.Duration(meta.QueryTimeout) * time.Millisecond,
+			PlayStartTime:  time.Now().UnixNano() / int64(time.Millisecond),
+			OrigStartTime:  meta.TS - meta.Shift,
+			SessionInit:    meta.SessionInit,
+			Driver:         meta.Driver,
+			TiDB:           meta.TiDB,
+			TiDBRetries:    meta.TiDBRetries,
+			MaxStmts:       meta.MaxStmts,
+			PrepareAsText:  meta.PrepareText,
+			KeepAlive:      time.Duration(meta.KeepAlive) * time.Millisecond,
+			ExactLifetimes: meta.ExactLife,
+			Reconnect:      meta.Reconnect,
+			FetchRows:      meta.FetchRows,
+			FetchLimit:     meta.FetchLimit,
+			SkipGaps:       meta.SkipGaps,
 		},
-		log:   zap.L().Named(fmt.Sprintf("%016x", meta.ID)),
+		log:   workerLogger(zap.L(), meta.ID),
 		wg:    &wg,
 		ts:    meta.TS,
 		id:    meta.ID,
-		stmts: make(map[uint64]statement),
+		shift: meta.Shift,
+	}
+	if _, err = replay.LookupDriver(meta.Driver); err != nil {
+		return nil, err
+	}
+	if task.worker.ThinkTime, err = parseThinkTime(meta.ThinkTime); err != nil {
+		return nil, err
+	}
+	task.worker.Stabilize = stabilizeConfig{Mode: meta.Stabilize, Now: meta.StabilizeNow}
+	task.worker.Interceptor = task.worker.Stabilize.Interceptor()
+	if len(meta.DigestAllow) > 0 || len(meta.DigestDeny) > 0 || len(meta.DBs) > 0 || len(meta.Users) > 0 || len(meta.Clients) > 0 {
+		filter := &eventFilter{digestAllow: meta.DigestAllow, digestDeny: meta.DigestDeny, dbs: meta.DBs, users: meta.Users, clients: meta.Clients, sample: 1}
+		if err = filter.Init(); err != nil {
+			return nil, err
+		}
+		task.worker.Statements = filter
 	}
 	task.worker.MySQLConfig, err = mysql.ParseDSN(meta.DSN)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	task.form = form
+	if len(meta.Source) > 0 {
+		// the session file is fetched from a shared storage by the agent itself
+		source, err := sharedSource(meta.Source, meta.File, dataDir)
+		if err != nil {
+			return nil, err
+		}
+		task.worker.store, err = storage.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		task.worker.src = task.worker.store.String() + meta.File
+	}
+	// the file and offset also identify the session to the controller, see sessionKey
+	task.worker.file = meta.File
+	task.worker.offset, task.worker.size = meta.Offset, meta.Size
 	return &task, nil
 }
 
+// sharedSource resolves the source sent by the controller, a local source must
+// be a relative path under the data dir of the agent, so that the controller
+// can't make the agent read arbitrary files.
+func sharedSource(source string, file string, dataDir string) (string, error) {
+	if !isRelativePath(file) {
+		return "", errors.Errorf("invalid session file %q", file)
+	}
+	if storage.IsRemote(source) {
+		return source, nil
+	}
+	if len(dataDir) == 0 {
+		return "", errors.New("no data dir is configured for shared sessions")
+	}
+	source = strings.TrimPrefix(source, "file://")
+	if !isRelativePath(source) {
+		return "", errors.Errorf("source %q is not a relative path under the data dir", source)
+	}
+	return filepath.Join(dataDir, source), nil
+}
+
+// isRelativePath returns whether the path is relative and never steps out of
+// its base by "..".
+func isRelativePath(path string) bool {
+	if len(path) == 0 || filepath.IsAbs(path) || strings.HasPrefix(path, "/") {
+		return false
+	}
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	return true
+}
+
 func (task *playTask) openData() (io.ReadCloser, error) {
-	if task.form == nil {
-		return os.Open(task.worker.src)
+	if len(task.data) > 0 {
+		return os.Open(task.data)
+	}
+	if task.form == nil || task.worker.store != nil {
+		return task.worker.openSource(context.Background())
 	}
 	fhs := task.form.File["data"]
 	if len(fhs) == 0 {
@@ -96,30 +282,68 @@ func (task *playTask) openData() (io.ReadCloser, error) {
 	return fhs[0].Open()
 }
 
+func (task *playTask) meta() playTaskMeta {
+	meta := playTaskMeta{
+		DSN:          task.worker.MySQLConfig.FormatDSN(),
+		ID:           task.worker.id,
+		TS:           task.worker.ts,
+		MaxLineSize:  int64(task.worker.MaxLineSize),
+		QueryTimeout: int64(task.worker.QueryTimeout / time.Millisecond),
+		Speed:        task.worker.Speed,
+		Source:       task.source,
+		File:         task.worker.file,
+		SessionInit:  task.worker.SessionInit,
+		Offset:       task.worker.offset,
+		Size:         task.worker.size,
+		Driver:       task.worker.Driver,
+		TiDB:         task.worker.TiDB,
+		TiDBRetries:  task.worker.TiDBRetries,
+		MaxStmts:     task.worker.MaxStmts,
+		PrepareText:  task.worker.PrepareAsText,
+		KeepAlive:    int64(task.worker.KeepAlive / time.Millisecond),
+		ExactLife:    task.worker.ExactLifetimes,
+		SkipGaps:     task.worker.SkipGaps,
+		ThinkTime:    task.worker.ThinkTime.String(),
+		Shift:        task.worker.shift,
+		Stabilize:    task.worker.Stabilize.Mode,
+		StabilizeNow: task.worker.Stabilize.Now,
+		Reconnect:    task.worker.Reconnect,
+		FetchRows:    task.worker.FetchRows,
+		FetchLimit:   task.worker.FetchLimit,
+	}
+	if f := task.worker.Statements; f != nil {
+		meta.DigestAllow, meta.DigestDeny = setKeys(f.allow), setKeys(f.deny)
+		meta.DBs, meta.Users, meta.Clients = f.dbs, f.users, f.clients
+	}
+	return meta
+}
+
+// buildRequest builds a task submission, the session file is only referenced by
+// the meta if in is nil.
 func (task *playTask) buildRequest(url string, in io.ReadCloser) (*http.Request, error) {
 	r, w := io.Pipe()
 	body := multipart.NewWriter(w)
 	go func() {
-		defer in.Close()
+		if in != nil {
+			defer in.Close()
+		}
 		meta, err := body.CreateFormField("meta")
 		if err != nil {
 			zap.L().Error("create meta field", zap.Error(err))
 			w.CloseWithError(err)
 			return
 		}
-		err = json.NewEncoder(meta).Encode(playTaskMeta{
-			DSN:          task.worker.MySQLConfig.FormatDSN(),
-			ID:           task.worker.id,
-			TS:           task.worker.ts,
-			MaxLineSize:  int64(task.worker.MaxLineSize),
-			QueryTimeout: int64(task.worker.QueryTimeout / time.Millisecond),
-			Speed:        task.worker.Speed,
-		})
+		err = json.NewEncoder(meta).Encode(task.meta())
 		if err != nil {
 			zap.L().Error("write meta field", zap.Error(err))
 			w.CloseWithError(err)
 			return
 		}
+		if in == nil {
+			body.Close()
+			w.Close()
+			return
+		}
 		data, err := body.CreateFormFile("data", task.worker.src)
 		if err != nil {
 			zap.L().Error("create data field", zap.Error(err))
@@ -143,88 +367,446 @@ func (task *playTask) buildRequest(url string, in io.ReadCloser) (*http.Request,
 	return req, nil
 }
 
-func (task *playTask) run() {
+func (task *playTask) run(ctx context.Context) {
 	defer func() {
 		atomic.StoreUint32(&task.finished, 1)
-		task.form.RemoveAll()
+		if task.form != nil {
+			task.form.RemoveAll()
+		}
+		if len(task.data) > 0 {
+			os.Remove(task.data)
+		}
 	}()
+	task.worker.onResult = func(e *event.MySQLEvent, res replay.Result, err error) {
+		atomic.AddInt64(&task.events, 1)
+		if err != nil {
+			atomic.AddInt64(&task.errors, 1)
+			task.lastError.Store(err.Error())
+			_, digest, sample := describeFailure(e, res, err)
+			task.fail(e.String(), err, digest, sample)
+		}
+	}
 	r, err := task.openData()
 	if err != nil {
 		zap.L().Error("open event file", zap.Error(err))
+		task.lastError.Store(err.Error())
+		task.fail("open", err, "", "")
 		return
 	}
 	defer r.Close()
-	task.worker.start(context.Background(), r)
+	task.worker.start(ctx, r)
+}
+
+func (task *playTask) fail(e string, err error, digest string, sample string) {
+	if task.onFailure == nil {
+		return
+	}
+	task.onFailure(agentFailure{
+		Time:    time.Now(),
+		Session: fmt.Sprintf("%016x", task.worker.id),
+		Event:   e,
+		Code:    errorCode(err),
+		Error:   err.Error(),
+		Digest:  digest,
+		Sample:  sample,
+	})
+}
+
+func (task *playTask) detail() playTaskDetail {
+	d := playTaskDetail{
+		ID:       fmt.Sprintf("%016x", task.worker.id),
+		File:     task.worker.src,
+		Offset:   task.worker.offset,
+		Events:   atomic.LoadInt64(&task.events),
+		Errors:   atomic.LoadInt64(&task.errors),
+		Finished: atomic.LoadUint32(&task.finished) == 1,
+	}
+	if len(task.worker.file) > 0 {
+		d.File = task.worker.file
+	} else if task.form != nil && len(task.form.File["data"]) > 0 {
+		d.File = task.form.File["data"][0].Filename
+	} else if len(task.data) > 0 {
+		d.File = filepath.Base(task.data)
+	}
+	if msg, ok := task.lastError.Load().(string); ok {
+		d.LastError = msg
+	}
+	return d
+}
+
+type playTaskDetail struct {
+	ID        string `json:"id"`
+	File      string `json:"file"`
+	Offset    int64  `json:"offset,omitempty"`
+	Events    int64  `json:"events"`
+	Errors    int64  `json:"errors"`
+	Finished  bool   `json:"finished"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// agentCapacity is reported by agents for scheduling sessions proportionally.
+type agentCapacity struct {
+	CPUs        int     `json:"cpus"`
+	Weight      float64 `json:"weight"`
+	Connections int64   `json:"connections"`
+	Running     int     `json:"running"`
 }
 
 type playJobStatus struct {
-	Total    int              `json:"total"`
-	Finished int              `json:"finished"`
-	Lagging  float64          `json:"lagging"`
-	Stats    map[string]int64 `json:"stats"`
+	Name      string           `json:"name,omitempty"`
+	Capacity  *agentCapacity   `json:"capacity,omitempty"`
+	Total     int              `json:"total"`
+	Finished  int              `json:"finished"`
+	Cancelled bool             `json:"cancelled,omitempty"`
+	Paused    bool             `json:"paused,omitempty"`
+	Rate      float64          `json:"rate,omitempty"`
+	Lagging   float64          `json:"lagging"`
+	Stats     map[string]int64 `json:"stats,omitempty"`
+	Tasks     []playTaskDetail `json:"tasks,omitempty"`
+	// Failures are samples of failures after the seq requested, while
+	// FailureCounts count all failures of the job.
+	Failures      []agentFailure      `json:"failures,omitempty"`
+	FailureCounts []agentFailureCount `json:"failure_counts,omitempty"`
+	// Labeled are stats of the job per target and schema.
+	Labeled []stats.LabeledStat `json:"labeled,omitempty"`
+}
+
+type playJob struct {
+	name      string
+	tasks     []*playTask
+	failures  []agentFailure
+	counts    agentFailureCounts
+	seq       int64
+	clock     *playJobClock
+	throttle  *playThrottle
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// playJobControl changes a running job. Speed is only accepted by the
+// controller, which forwards it to agents as Rate, the ratio to the speed the
+// job started with.
+type playJobControl struct {
+	Paused *bool    `json:"paused,omitempty"`
+	Speed  *float64 `json:"speed,omitempty"`
+	Rate   *float64 `json:"rate,omitempty"`
+}
+
+// playJobClock is distributed by the controller before a synchronized replay,
+// PlayStart is expressed in the clock of the agent.
+type playJobClock struct {
+	PlayStart int64 `json:"play_start"`
+	OrigStart int64 `json:"orig_start"`
+	// Now is the clock of the agent when acknowledging the clock.
+	Now int64 `json:"now"`
+}
+
+func (job *playJob) status() playJobStatus {
+	status := playJobStatus{Name: job.name, Total: len(job.tasks), Cancelled: job.cancelled, Paused: job.throttle.Paused(), Rate: job.throttle.Rate()}
+	for _, task := range job.tasks {
+		if atomic.LoadUint32(&task.finished) == 1 {
+			status.Finished += 1
+		}
+	}
+	return status
 }
 
 type playTaskStore struct {
-	tasks map[string][]*playTask
-	lock  sync.Mutex
+	jobs   map[string]*playJob
+	lock   sync.Mutex
+	weight float64
+	report *reportCollector
+	// dataDir is where shared session files are read from, see sharedSource.
+	dataDir string
 }
 
-func newTaskStore() *playTaskStore {
-	return &playTaskStore{tasks: make(map[string][]*playTask)}
+func newTaskStore(weight float64, dataDir string) *playTaskStore {
+	return &playTaskStore{jobs: make(map[string]*playJob), weight: weight, dataDir: dataDir}
 }
 
+func (store *playTaskStore) capacity() *agentCapacity {
+	c := &agentCapacity{CPUs: runtime.NumCPU(), Weight: store.weight, Connections: stats.Get(stats.Connections)}
+	store.lock.Lock()
+	for _, job := range store.jobs {
+		status := job.status()
+		c.Running += status.Total - status.Finished
+	}
+	store.lock.Unlock()
+	return c
+}
+
+// progress returns progress of jobs for the web dashboard.
+func (store *playTaskStore) progress() []progressRow {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	rows := make([]progressRow, 0, len(store.jobs))
+	for _, job := range store.jobs {
+		status := job.status()
+		rows = append(rows, progressRow{Name: job.name, Alive: !job.cancelled, Total: status.Total, Finished: status.Finished})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Name < rows[j].Name })
+	return rows
+}
+
+// agentJobsPath prefixes routes of jobs, so that job names never clash with
+// other routes of the agent.
+const agentJobsPath = "/jobs/"
+
 func (store *playTaskStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		store.handleJobStatusQuery(w, r)
+	if r.URL.Path == "/jobs" && r.Method == http.MethodGet {
+		store.handleJobList(w, r)
+	} else if r.URL.Path == "/capacity" && r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(store.capacity())
+	} else if !strings.HasPrefix(r.URL.Path, agentJobsPath) || len(r.URL.Path) == len(agentJobsPath) {
+		http.NotFound(w, r)
+	} else if name := "/" + r.URL.Path[len(agentJobsPath):]; r.Method == http.MethodGet {
+		store.handleJobStatusQuery(w, r, name)
 	} else if r.Method == http.MethodPost {
-		store.handleTaskSubmission(w, r)
+		store.handleTaskSubmission(w, r, name)
+	} else if r.Method == http.MethodPut {
+		store.handleJobPrepare(w, r, name)
+	} else if r.Method == http.MethodPatch {
+		store.handleJobControl(w, r, name)
+	} else if r.Method == http.MethodDelete {
+		store.handleJobCancel(w, r, name)
 	} else {
 		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 	}
 }
 
-func (store *playTaskStore) handleTaskSubmission(w http.ResponseWriter, r *http.Request) {
-	task, err := taskFromRequest(r)
+func (store *playTaskStore) handleTaskSubmission(w http.ResponseWriter, r *http.Request, name string) {
+	task, err := taskFromRequest(r, store.dataDir)
 	if err != nil {
 		zap.L().Error("build task from request", zap.Error(err))
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	go task.run()
+	if err = store.submit(name, task); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+var errJobCancelled = errors.New("job has been cancelled")
+
+func (store *playTaskStore) job(name string) *playJob {
+	job, ok := store.jobs[name]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		job = &playJob{name: name, counts: make(agentFailureCounts), throttle: newPlayThrottle(), ctx: ctx, cancel: cancel}
+		store.jobs[name] = job
+	}
+	return job
+}
+
+func (store *playTaskStore) submit(name string, task *playTask) error {
 	store.lock.Lock()
-	store.tasks[r.URL.Path] = append(store.tasks[r.URL.Path], task)
+	job := store.job(name)
+	if job.cancelled {
+		store.lock.Unlock()
+		return errJobCancelled
+	}
+	if job.clock != nil {
+		task.worker.PlayStartTime = job.clock.PlayStart
+		task.worker.OrigStartTime = job.clock.OrigStart
+	}
+	task.worker.Report = store.report
+	task.worker.Throttle = job.throttle
+	task.worker.JobName = job.name
+	task.onFailure = func(f agentFailure) {
+		store.lock.Lock()
+		job.seq += 1
+		f.Seq = job.seq
+		job.counts.add(f.Code, f.Digest, 1)
+		if len(job.failures) >= maxJobFailures {
+			job.failures = job.failures[1:]
+		}
+		job.failures = append(job.failures, f)
+		store.lock.Unlock()
+	}
+	job.tasks = append(job.tasks, task)
 	store.lock.Unlock()
-	w.WriteHeader(http.StatusOK)
+	go task.run(job.ctx)
+	return nil
+}
+
+// prepare sets the clock of the job if the play start time is given, tasks of
+// the job are then paced by the shared clock instead of their arrival time.
+func (store *playTaskStore) prepare(name string, clock playJobClock) playJobClock {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if clock.PlayStart > 0 {
+		c := clock
+		store.job(name).clock = &c
+		zap.L().Info("job clock prepared", zap.String("job", name), zap.Int64("play_start", clock.PlayStart), zap.Int64("orig_start", clock.OrigStart))
+	}
+	clock.Now = time.Now().UnixNano() / int64(time.Millisecond)
+	return clock
 }
 
-func (store *playTaskStore) handleJobStatusQuery(w http.ResponseWriter, r *http.Request) {
+// jobStatus returns status of the job, failures are included if since >= 0
+// and only samples with a seq number greater than since are returned.
+func (store *playTaskStore) jobStatus(name string, detail bool, since int64) playJobStatus {
 	var status playJobStatus
 	store.lock.Lock()
-	status.Total = len(store.tasks[r.URL.Path])
-	for _, task := range store.tasks[r.URL.Path] {
-		if atomic.LoadUint32(&task.finished) == 1 {
-			status.Finished += 1
+	if job, ok := store.jobs[name]; ok {
+		status = job.status()
+		if detail {
+			for _, task := range job.tasks {
+				status.Tasks = append(status.Tasks, task.detail())
+			}
+		}
+		if since >= 0 {
+			for _, f := range job.failures {
+				if f.Seq > since {
+					status.Failures = append(status.Failures, f)
+				}
+			}
+			status.FailureCounts = job.counts.list()
 		}
 	}
 	store.lock.Unlock()
+	status.Capacity = store.capacity()
 	status.Stats = stats.Dump()
 	status.Lagging = float64(stats.GetLagging()) / float64(time.Second)
+	for _, s := range stats.Labeled() {
+		if s.Job == name {
+			status.Labeled = append(status.Labeled, s)
+		}
+	}
+	return status
+}
+
+func (store *playTaskStore) cancel(name string) bool {
+	store.lock.Lock()
+	job, ok := store.jobs[name]
+	if ok {
+		job.cancelled = true
+		job.cancel()
+	}
+	store.lock.Unlock()
+	if ok {
+		zap.L().Info("job cancelled", zap.String("job", name))
+	}
+	return ok
+}
+
+func (store *playTaskStore) handleJobStatusQuery(w http.ResponseWriter, r *http.Request, name string) {
+	since := int64(-1)
+	if v := r.URL.Query().Get("since"); len(v) > 0 {
+		since, _ = strconv.ParseInt(v, 10, 64)
+	}
+	status := store.jobStatus(name, len(r.URL.Query().Get("detail")) > 0, since)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(status)
 }
 
+func (store *playTaskStore) handleJobList(w http.ResponseWriter, r *http.Request) {
+	store.lock.Lock()
+	jobs := make([]playJobStatus, 0, len(store.jobs))
+	for _, job := range store.jobs {
+		jobs = append(jobs, job.status())
+	}
+	store.lock.Unlock()
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
+
+func (store *playTaskStore) handleJobPrepare(w http.ResponseWriter, r *http.Request, name string) {
+	defer r.Body.Close()
+	var clock playJobClock
+	if err := json.NewDecoder(r.Body).Decode(&clock); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	clock = store.prepare(name, clock)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(clock)
+}
+
+// control applies c to the job, it returns false if there is no such job.
+func (store *playTaskStore) control(name string, c playJobControl) bool {
+	store.lock.Lock()
+	job, ok := store.jobs[name]
+	store.lock.Unlock()
+	if !ok {
+		return false
+	}
+	if c.Paused != nil && job.throttle.SetPaused(*c.Paused) {
+		zap.L().Info("job paused or resumed", zap.String("job", name), zap.Bool("paused", *c.Paused))
+	}
+	if c.Rate != nil && *c.Rate > 0 {
+		job.throttle.SetRate(*c.Rate)
+		zap.L().Info("job rate changed", zap.String("job", name), zap.Float64("rate", *c.Rate))
+	}
+	return true
+}
+
+func (store *playTaskStore) handleJobControl(w http.ResponseWriter, r *http.Request, name string) {
+	var c playJobControl
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !store.control(name, c) {
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (store *playTaskStore) handleJobCancel(w http.ResponseWriter, r *http.Request, name string) {
+	if !store.cancel(name) {
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
 func NewTextAgentCommand() *cobra.Command {
 	var (
-		addr string
+		addr     string
+		grpcAddr string
+		webAddr  string
+		weight   float64
+		dataDir  string
+		security agentSecurity
 	)
 	cmd := &cobra.Command{
 		Use:   "agent",
 		Short: "Start a text play agent",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			http.Handle("/", newTaskStore())
-			return http.ListenAndServe(addr, nil)
+			tlsConfig, err := security.ServerTLSConfig()
+			if err != nil {
+				return err
+			}
+			store := newTaskStore(weight, dataDir)
+			if len(webAddr) > 0 {
+				store.report = newReportCollector(nil)
+				newWebDashboard("mysql-replay agent: "+addr, nil, store.report, store.progress).Serve(webAddr)
+			}
+			if len(grpcAddr) > 0 {
+				go func() {
+					zap.L().Error("grpc server exited", zap.Error(serveAgentGRPC(grpcAddr, store, security)))
+				}()
+			}
+			http.Handle("/", security.Handler(store))
+			srv := &http.Server{Addr: addr, TLSConfig: tlsConfig}
+			if tlsConfig != nil {
+				return srv.ListenAndServeTLS("", "")
+			}
+			return srv.ListenAndServe()
 		},
 	}
 	cmd.Flags().StringVar(&addr, "address", ":9000", "address to listen on")
+	cmd.Flags().StringVar(&grpcAddr, "grpc-address", "", "address to serve the grpc api on (disabled by default)")
+	cmd.Flags().StringVar(&webAddr, "web-addr", "", "serve a web dashboard of running jobs on the given address")
+	cmd.Flags().StringVar(&dataDir, "data-dir", "", "directory of session files shared with the controller, which sends paths relative to it (local shared sessions are rejected if not set)")
+	cmd.Flags().Float64Var(&weight, "weight", 1, "relative capacity of the agent used by the controller for scheduling sessions")
+	security.Register(cmd.Flags(), "")
 	return cmd
 }
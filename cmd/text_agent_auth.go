@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/pflag"
+)
+
+// agentSecurity holds the shared token and certificates used by both agents
+// and the controller talking to them.
+type agentSecurity struct {
+	Token string
+	CA    string
+	Cert  string
+	Key   string
+}
+
+func (s *agentSecurity) Register(flags *pflag.FlagSet, prefix string) {
+	flags.StringVar(&s.Token, prefix+"auth-token", "", "shared token for authenticating agent api requests")
+	flags.StringVar(&s.CA, prefix+"tls-ca", "", "path of ca certificate for verifying the peer")
+	flags.StringVar(&s.Cert, prefix+"tls-cert", "", "path of tls certificate")
+	flags.StringVar(&s.Key, prefix+"tls-key", "", "path of tls private key")
+}
+
+func (s agentSecurity) TLSEnabled() bool {
+	return len(s.Cert) > 0 && len(s.Key) > 0
+}
+
+func (s agentSecurity) certPool() (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(s.CA)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no valid certificate found in " + s.CA)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig returns the tls config of agents, client certificates are
+// required if a ca is given.
+func (s agentSecurity) ServerTLSConfig() (*tls.Config, error) {
+	if !s.TLSEnabled() {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.Cert, s.Key)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if len(s.CA) > 0 {
+		if cfg.ClientCAs, err = s.certPool(); err != nil {
+			return nil, err
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// ClientTLSConfig returns the tls config for talking to agents, nil is
+// returned if neither a ca nor a certificate is given.
+func (s agentSecurity) ClientTLSConfig() (*tls.Config, error) {
+	if len(s.CA) == 0 && !s.TLSEnabled() {
+		return nil, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(s.CA) > 0 {
+		pool, err := s.certPool()
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if s.TLSEnabled() {
+		cert, err := tls.LoadX509KeyPair(s.Cert, s.Key)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Client returns a http client for talking to agents.
+func (s agentSecurity) Client() (*agentClient, error) {
+	c := &agentClient{token: s.Token, Client: http.DefaultClient}
+	cfg, err := s.ClientTLSConfig()
+	if err != nil || cfg == nil {
+		return c, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = cfg
+	c.Client = &http.Client{Transport: transport}
+	return c, nil
+}
+
+// Handler rejects requests without the shared token if one is configured.
+func (s agentSecurity) Handler(h http.Handler) http.Handler {
+	if len(s.Token) == 0 {
+		return h
+	}
+	expected := []byte(s.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if subtle.ConstantTimeCompare(token, expected) != 1 {
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+type agentClient struct {
+	*http.Client
+	token string
+}
+
+func (c *agentClient) Do(req *http.Request) (*http.Response, error) {
+	if len(c.token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.Client.Do(req)
+}
+
+func (c *agentClient) Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.Do(req)
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSharedSource(t *testing.T) {
+	for _, tt := range []struct {
+		source  string
+		file    string
+		dataDir string
+		expect  string
+	}{
+		{"capture", "1-0.tsv", "/data", "/data/capture"},
+		{"file://a/b", "1-0.tsv", "/data", "/data/a/b"},
+		{".", "1-0.tsv", "/data", "/data"},
+		{"s3://bucket/capture", "1-0.tsv", "", "s3://bucket/capture"},
+		{"capture", "1-0.tsv", "", ""},
+		{"/etc", "1-0.tsv", "/data", ""},
+		{"file:///etc", "1-0.tsv", "/data", ""},
+		{"../etc", "1-0.tsv", "/data", ""},
+		{"a/../../etc", "1-0.tsv", "/data", ""},
+		{"capture", "../1-0.tsv", "/data", ""},
+		{"s3://bucket/capture", "/1-0.tsv", "", ""},
+		{"capture", "", "/data", ""},
+	} {
+		source, err := sharedSource(tt.source, tt.file, tt.dataDir)
+		if len(tt.expect) == 0 {
+			require.Error(t, err, "%s %s", tt.source, tt.file)
+			continue
+		}
+		require.NoError(t, err, "%s %s", tt.source, tt.file)
+		require.Equal(t, tt.expect, source)
+	}
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"bufio"
+	"io"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/event"
+	"go.uber.org/zap"
+)
+
+// copyEvents copies all events from r to h, it returns the number of
+// statements.
+func copyEvents(r io.Reader, maxLineSize int, h *textDumpHandler) (int, error) {
+	var (
+		e     = event.MySQLEvent{Params: []interface{}{}}
+		dec   = event.NewDecoder(maxLineSize)
+		in    = bufio.NewScanner(r)
+		count = 0
+	)
+	if maxLineSize > 0 {
+		in.Buffer(make([]byte, 0, 4096), maxLineSize)
+	}
+	for in.Scan() {
+		ok, err := dec.Decode(in.Text(), e.Reset(e.Params[:0]))
+		if err != nil {
+			return count, err
+		} else if !ok {
+			h.header.Host, h.header.Source, h.header.Server = dec.Header.Host, dec.Header.Source, dec.Header.Server
+			continue
+		}
+		switch e.Type {
+		case event.EventQuery, event.EventStmtExecute, event.EventStmtFetch:
+			count += 1
+		}
+		h.OnEvent(e)
+	}
+	return count, errors.Trace(in.Err())
+}
+
+func NewTextAnonymizeCommand() *cobra.Command {
+	var (
+		mode        string
+		salt        string
+		maxLineSize int
+	)
+	cmd := &cobra.Command{
+		Use:   "anonymize <input> <output>",
+		Short: "Write a new dump with literals and param values masked",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			mask, err := event.NewMasker(mode, salt)
+			if err != nil {
+				return err
+			}
+			ctl, err := newPlayControl(playConfig{DryRun: true}, args[0], "")
+			if err != nil {
+				return err
+			}
+			sessions, statements, err := rewriteDump(ctl, args[1], func(w *playWorker) bool { return true }, func(r io.Reader, h *textDumpHandler) (int, error) {
+				h.mask = mask
+				return copyEvents(r, maxLineSize, h)
+			})
+			if err != nil {
+				return err
+			}
+			zap.L().Info("anonymize done", zap.Int("sessions", sessions), zap.Int("statements", statements))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&mode, "mode", event.MaskHash, "replace literals by values derived from their hashes or by constants (hash|const)")
+	cmd.Flags().StringVar(&salt, "salt", "", "salt of hashes")
+	cmd.Flags().IntVar(&maxLineSize, "max-line-size", 16777216, "max line size")
+	return cmd
+}
@@ -0,0 +1,233 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+	"go.uber.org/zap"
+)
+
+type playOutcome struct {
+	event string
+	value string
+	// calls lists nondeterministic functions called by the statement.
+	calls []string
+}
+
+const (
+	nondeterministicReport  = "report"
+	nondeterministicFlag    = "flag"
+	nondeterministicRewrite = "rewrite"
+)
+
+// stabilizeConfig tells how to deal with statements calling nondeterministic
+// functions (e.g. NOW() or UUID()): report their differences as usual, flag
+// them as expected, or rewrite the calls to deterministic equivalents (see
+// event.Stabilizer) and flag the rest.
+type stabilizeConfig struct {
+	Mode string
+	Now  bool
+}
+
+func (c *stabilizeConfig) Register(flags *pflag.FlagSet) {
+	flags.StringVar(&c.Mode, "nondeterministic", nondeterministicReport, "how to deal with statements calling nondeterministic functions like NOW(), UUID() or RAND() (report|flag|rewrite)")
+	flags.BoolVar(&c.Now, "stabilize-now", false, "replace functions of the current time like NOW() with the captured time of statements in rewrite mode")
+}
+
+func (c stabilizeConfig) Validate() error {
+	switch c.Mode {
+	case nondeterministicReport, nondeterministicFlag, nondeterministicRewrite:
+	default:
+		return errors.New("unknown nondeterministic mode: " + c.Mode)
+	}
+	if c.Now && c.Mode != nondeterministicRewrite {
+		return errors.New("--stabilize-now requires the rewrite mode")
+	}
+	return nil
+}
+
+// Interceptor returns the interceptor rewriting events in rewrite mode, or nil.
+func (c stabilizeConfig) Interceptor() replay.Interceptor {
+	if c.Mode != nondeterministicRewrite {
+		return nil
+	}
+	s := event.Stabilizer{Now: c.Now}
+	return replay.InterceptorFuncs{Before: func(ctx context.Context, e *event.MySQLEvent) error {
+		id, _ := replay.SessionID(ctx)
+		s.Event(e, id)
+		return nil
+	}}
+}
+
+func outcomeOf(res sql.Result, err error) string {
+	if err != nil {
+		if myErr, ok := mysqlError(err); ok {
+			return fmt.Sprintf("error %d: %s", myErr.Number, myErr.Message)
+		}
+		return "error: " + err.Error()
+	}
+	if res == nil {
+		return "ok"
+	}
+	if n, err := res.RowsAffected(); err == nil {
+		return fmt.Sprintf("ok (%d rows affected)", n)
+	}
+	return "ok"
+}
+
+// auditOutcome is like outcomeOf but also covers rows returned (by their count
+// and checksum), since result sets are fetched in audits.
+func auditOutcome(res replay.Result, err error) string {
+	if err == nil && res.Fetched != nil {
+		return fmt.Sprintf("ok (%d rows, checksum %016x)", res.Fetched.Rows, res.Fetched.Checksum)
+	}
+	return outcomeOf(res.Result, err)
+}
+
+func NewTextAuditCommand() *cobra.Command {
+	var (
+		config   = playConfig{QueryTimeout: time.Minute}
+		target   dsnSource
+		sample   int
+		maxDiffs int
+		full     fullAudit
+		fullMode bool
+		speed    float64
+	)
+	cmd := &cobra.Command{
+		Use:   "audit",
+		Short: "Replay sampled sessions twice and report statements with different outcomes (errors, rows affected or rows returned)",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config.Speed = 0
+			if err := config.Stabilize.Validate(); err != nil {
+				return err
+			}
+			config.Interceptor = config.Stabilize.Interceptor()
+			targetDSN, err := target.Resolve()
+			if err != nil {
+				return err
+			}
+			if fullMode {
+				if len(full.reset) == 0 && len(full.targets[1]) == 0 {
+					return errors.New("full audits require --reset-script or --second-target-dsn")
+				}
+				if len(full.targets[1]) == 0 {
+					full.targets[1] = targetDSN
+				}
+				config.Speed = speed
+				full.config, full.input, full.targets[0] = config, args[0], targetDSN
+				_, err := full.Run(context.Background(), zap.L(), maxDiffs)
+				return err
+			}
+			// result sets are compared by their row counts and checksums
+			config.FetchRows = true
+			ctl, err := newPlayControl(config, args[0], targetDSN)
+			if err != nil {
+				return err
+			}
+			workers := ctl.workers
+			if sample > 0 && sample < len(workers) {
+				rand.Shuffle(len(workers), func(i, j int) { workers[i], workers[j] = workers[j], workers[i] })
+				workers = workers[:sample]
+			}
+			ctx := context.Background()
+			var sessions, statements, diffs, flagged int
+			for _, w := range workers {
+				fst, err := auditPass(ctx, ctl.playConfig, w)
+				if err != nil {
+					return err
+				}
+				snd, err := auditPass(ctx, ctl.playConfig, w)
+				if err != nil {
+					return err
+				}
+				sessions += 1
+				statements += len(fst)
+				if len(fst) != len(snd) {
+					w.log.Warn("sessions replayed a different number of statements", zap.Int("first", len(fst)), zap.Int("second", len(snd)))
+				}
+				for i := 0; i < len(fst) && i < len(snd); i++ {
+					if fst[i].value == snd[i].value {
+						continue
+					}
+					if config.Stabilize.Mode != nondeterministicReport && len(fst[i].calls) > 0 {
+						flagged += 1
+						w.log.Debug("expected difference due to nondeterministic functions",
+							zap.Int("index", i),
+							zap.String("event", fst[i].event),
+							zap.Strings("calls", fst[i].calls))
+						continue
+					}
+					diffs += 1
+					if maxDiffs <= 0 || diffs <= maxDiffs {
+						w.log.Warn("nondeterministic outcome",
+							zap.Int("index", i),
+							zap.String("event", fst[i].event),
+							zap.String("first", fst[i].value),
+							zap.String("second", snd[i].value))
+					}
+				}
+			}
+			ctl.log.Info("audit done", zap.Int("sessions", sessions), zap.Int("statements", statements), zap.Int("diffs", diffs), zap.Int("flagged", flagged))
+			return nil
+		},
+	}
+	target.Register(cmd.Flags(), "target-", "target dsn")
+	cmd.Flags().IntVar(&sample, "sample", 10, "number of sessions to audit (0 means all)")
+	cmd.Flags().IntVar(&maxDiffs, "max-diffs", 100, "max number of differences to print (0 means unlimited)")
+	cmd.Flags().BoolVar(&fullMode, "full", false, "replay the whole dump twice (sessions run concurrently like play) against freshly restored targets, and compare failed statements and checksums of tables")
+	cmd.Flags().StringVar(&full.targets[1], "second-target-dsn", "", "dsn of the target of the second pass in full mode (default: --target-dsn)")
+	cmd.Flags().StringVar(&full.reset, "reset-script", "", "sql file (*.sql) or shell command restoring the target before each pass in full mode")
+	cmd.Flags().StringSliceVar(&full.dbs, "checksum-db", nil, "databases to checksum after each pass in full mode (default: all but system ones)")
+	cmd.Flags().Float64Var(&speed, "speed", 0, "speed ratio of passes in full mode (0 means as fast as possible)")
+	config.Stabilize.Register(cmd.Flags())
+	cmd.Flags().IntVar(&config.MaxLineSize, "max-line-size", 16777216, "max line size")
+	cmd.Flags().DurationVar(&config.QueryTimeout, "query-timeout", time.Minute, "timeout for a single query")
+	return cmd
+}
+
+func auditPass(ctx context.Context, cfg playConfig, w *playWorker) ([]playOutcome, error) {
+	f, err := w.openSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		outcomes []playOutcome
+		stmts    = make(map[uint64]string)
+	)
+	pw := &playWorker{
+		playConfig: cfg,
+		src:        w.src,
+		store:      w.store,
+		file:       w.file,
+		log:        w.log,
+		wg:         new(sync.WaitGroup),
+		ts:         w.ts,
+		id:         w.id,
+		onResult: func(e *event.MySQLEvent, res replay.Result, err error) {
+			query := e.Query
+			switch e.Type {
+			case event.EventStmtPrepare:
+				stmts[e.StmtID] = e.Query
+			case event.EventStmtClose:
+				delete(stmts, e.StmtID)
+			case event.EventStmtExecute, event.EventStmtFetch:
+				query = stmts[e.StmtID]
+			}
+			outcomes = append(outcomes, playOutcome{event: e.String(), value: auditOutcome(res, err), calls: event.NondeterministicCalls(query)})
+		},
+	}
+	pw.wg.Add(1)
+	pw.start(ctx, f)
+	return outcomes, nil
+}
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+	"go.uber.org/zap"
+)
+
+// scriptReset is the phase of resetting the target before a pass of a full
+// audit.
+const scriptReset = "reset"
+
+// fullAudit replays the whole dump twice (sessions run concurrently as they do
+// in play) against two targets, or a target reset before each pass, and then
+// compares failed statements and checksums of tables of the passes.
+type fullAudit struct {
+	config  playConfig
+	input   string
+	targets [2]string
+	reset   string
+	dbs     []string
+}
+
+// auditFailure is a statement failed in a pass, keyed by the session and the
+// index of the event in the session.
+type auditFailure struct {
+	event string
+	value string
+}
+
+type auditPassResult struct {
+	failures  map[string]auditFailure
+	checksums map[string]string
+}
+
+func (fa *fullAudit) pass(ctx context.Context, i int) (*auditPassResult, error) {
+	ctl, err := newPlayControl(fa.config, fa.input, fa.targets[i])
+	if err != nil {
+		return nil, err
+	}
+	ctl.log = ctl.log.With(zap.Int("pass", i+1))
+	if len(fa.reset) > 0 {
+		if err = ctl.RunScript(ctx, scriptReset, fa.reset); err != nil {
+			return nil, err
+		}
+	}
+	var (
+		res  = &auditPassResult{failures: make(map[string]auditFailure), checksums: make(map[string]string)}
+		lock sync.Mutex
+	)
+	for _, w := range ctl.workers {
+		var (
+			id    = w.id
+			index = 0
+		)
+		w.onResult = func(e *event.MySQLEvent, _ replay.Result, err error) {
+			index += 1
+			if err == nil || replay.IsConnError(err) {
+				return
+			}
+			lock.Lock()
+			res.failures[fmt.Sprintf("%016x#%d", id, index)] = auditFailure{event: e.String(), value: outcomeOf(nil, err)}
+			lock.Unlock()
+		}
+	}
+	ctl.log.Info("replay the dump", zap.Int("sessions", len(ctl.workers)))
+	ctl.PlayLocal(ctx)
+
+	db, err := sql.Open("mysql", ctl.MySQLConfig.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tables, err := listTables(ctx, db, fa.dbs)
+	if err != nil {
+		return nil, err
+	}
+	opts := checksumOptions{method: checksumCRC}
+	for _, t := range tables {
+		layout, err := loadLayout(ctx, db, t[0], t[1])
+		if err != nil {
+			return nil, err
+		}
+		sum, _, err := opts.checksum(ctx, db, t[0], t[1], layout, nil)
+		if err != nil {
+			return nil, err
+		}
+		res.checksums[t[0]+"."+t[1]] = sum
+	}
+	ctl.log.Info("pass done", zap.Int("failures", len(res.failures)), zap.Int("tables", len(tables)))
+	return res, nil
+}
+
+// Run runs both passes and logs their differences, it returns the number of
+// differences.
+func (fa *fullAudit) Run(ctx context.Context, log *zap.Logger, maxDiffs int) (int, error) {
+	var passes [2]*auditPassResult
+	for i := range passes {
+		res, err := fa.pass(ctx, i)
+		if err != nil {
+			return 0, err
+		}
+		passes[i] = res
+	}
+	fst, snd := passes[0], passes[1]
+	keys := make([]string, 0, len(fst.failures)+len(snd.failures))
+	for key := range fst.failures {
+		keys = append(keys, key)
+	}
+	for key := range snd.failures {
+		if _, ok := fst.failures[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	diffs := 0
+	for _, key := range keys {
+		a, b := fst.failures[key], snd.failures[key]
+		if a.value == b.value {
+			continue
+		}
+		diffs += 1
+		if maxDiffs <= 0 || diffs <= maxDiffs {
+			e := a.event
+			if len(e) == 0 {
+				e = b.event
+			}
+			log.Warn("nondeterministic failure", zap.String("statement", key), zap.String("event", e),
+				zap.String("first", orOK(a.value)), zap.String("second", orOK(b.value)))
+		}
+	}
+	failures := diffs
+	tables := make([]string, 0, len(fst.checksums))
+	for table := range fst.checksums {
+		tables = append(tables, table)
+	}
+	for table := range snd.checksums {
+		if _, ok := fst.checksums[table]; !ok {
+			tables = append(tables, table)
+		}
+	}
+	sort.Strings(tables)
+	for _, table := range tables {
+		if a, b := fst.checksums[table], snd.checksums[table]; a != b {
+			diffs += 1
+			log.Warn("nondeterministic table", zap.String("table", table), zap.String("first", a), zap.String("second", b))
+		}
+	}
+	log.Info("full audit done",
+		zap.Int("first_failures", len(fst.failures)), zap.Int("second_failures", len(snd.failures)),
+		zap.Int("nondeterministic_failures", failures), zap.Int("nondeterministic_tables", diffs-failures))
+	return diffs, nil
+}
+
+func orOK(value string) string {
+	if len(value) == 0 {
+		return "ok"
+	}
+	return value
+}
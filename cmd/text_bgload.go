@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/spf13/pflag"
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+const bgTable = "mysql_replay_bg"
+
+var defaultBgQueries = []string{
+	"select k, c from " + bgTable + " where id = ?",
+	"update " + bgTable + " set k = k + 1 where id = ?",
+	"insert into " + bgTable + " (id, k, c) values (?, 0, 'bg') on duplicate key update k = k + 1",
+}
+
+type bgLoadConfig struct {
+	QPS       float64
+	Conns     int
+	Queries   []string
+	TableSize int
+}
+
+func (cfg *bgLoadConfig) Register(flags *pflag.FlagSet) {
+	flags.Float64Var(&cfg.QPS, "bg-qps", 0, "qps of the synthetic background load (0 means disabled)")
+	flags.IntVar(&cfg.Conns, "bg-conns", 4, "number of connections used by the background load")
+	flags.StringSliceVar(&cfg.Queries, "bg-query", nil, "statements of the background load, '?' is bound to a random id (default: a built-in oltp mix)")
+	flags.IntVar(&cfg.TableSize, "bg-table-size", 10000, "id range of the background load")
+}
+
+func (cfg bgLoadConfig) Enabled() bool {
+	return cfg.QPS > 0 && cfg.Conns > 0
+}
+
+type bgLoad struct {
+	bgLoadConfig
+
+	log   *zap.Logger
+	pool  *sql.DB
+	stats *stats.Registry
+	wg    sync.WaitGroup
+}
+
+func startBgLoad(ctx context.Context, cfg bgLoadConfig, target *mysql.Config, reg *stats.Registry) (*bgLoad, error) {
+	bg := &bgLoad{bgLoadConfig: cfg, log: zap.L().Named("bg-load"), stats: reg}
+	if cfg.TableSize <= 0 {
+		bg.TableSize = 1
+	}
+	pool, err := sql.Open("mysql", target.FormatDSN())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	pool.SetMaxOpenConns(cfg.Conns)
+	pool.SetMaxIdleConns(cfg.Conns)
+	bg.pool = pool
+	if len(bg.Queries) == 0 {
+		bg.Queries = defaultBgQueries
+		if _, err = pool.ExecContext(ctx, "create table if not exists "+bgTable+" (id bigint primary key, k bigint not null, c varchar(64) not null)"); err != nil {
+			pool.Close()
+			return nil, errors.Annotate(err, "prepare background table")
+		}
+	}
+	interval := time.Duration(float64(cfg.Conns) * float64(time.Second) / cfg.QPS)
+	bg.log.Info("start background load", zap.Float64("qps", cfg.QPS), zap.Int("conns", cfg.Conns), zap.Duration("interval", interval))
+	for i := 0; i < cfg.Conns; i++ {
+		bg.wg.Add(1)
+		go bg.loop(ctx, interval)
+	}
+	return bg, nil
+}
+
+func (bg *bgLoad) loop(ctx context.Context, interval time.Duration) {
+	defer bg.wg.Done()
+	conn, err := bg.pool.Conn(ctx)
+	if err != nil {
+		bg.log.Warn("open background connection", zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		query := bg.Queries[rand.Intn(len(bg.Queries))]
+		args := make([]interface{}, strings.Count(query, "?"))
+		for i := range args {
+			args[i] = rand.Intn(bg.TableSize) + 1
+		}
+		bg.stats.Add(stats.BgQueries, 1)
+		if _, err = conn.ExecContext(ctx, query, args...); err != nil && ctx.Err() == nil {
+			bg.stats.Add(stats.FailedBgQueries, 1)
+			bg.log.Debug("failed to execute background query", zap.String("query", query), zap.Error(err))
+		}
+	}
+}
+
+func (bg *bgLoad) Wait() {
+	bg.wg.Wait()
+	bg.pool.Close()
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/replay"
+	"go.uber.org/zap"
+)
+
+// circuitBreaker is shared by play workers to pause the replay once connection
+// failures in a row (across workers) reach the threshold, instead of every
+// worker timing out on its own while the target is down. The target is probed
+// every interval then, and the replay is resumed once it's reachable again.
+type circuitBreaker struct {
+	threshold int64
+	interval  time.Duration
+
+	failures int64
+	open     int32
+	tripped  chan struct{}
+}
+
+func newCircuitBreaker(threshold int, interval time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: int64(threshold), interval: interval, tripped: make(chan struct{}, 1)}
+}
+
+// Observe counts the outcome of an event applied on the target.
+func (cb *circuitBreaker) Observe(res replay.Result, err error) {
+	if isTargetDown(err) {
+		if atomic.AddInt64(&cb.failures, 1) >= cb.threshold && atomic.CompareAndSwapInt32(&cb.open, 0, 1) {
+			cb.tripped <- struct{}{}
+		}
+	} else if err == nil && res.Executed {
+		atomic.StoreInt64(&cb.failures, 0)
+	}
+}
+
+// isTargetDown tells whether err is caused by the target being unreachable.
+func isTargetDown(err error) bool {
+	if err == nil {
+		return false
+	} else if replay.IsConnError(err) {
+		return true
+	}
+	_, ok := errors.Cause(err).(net.Error)
+	return ok
+}
+
+// runBreaker pauses the replay each time the breaker trips, and resumes it
+// once probes of the target succeed, until done.
+func (pc *playControl) runBreaker(done <-chan struct{}) {
+	cb := pc.Breaker
+	for {
+		select {
+		case <-done:
+			return
+		case <-cb.tripped:
+		}
+		paused := pc.Throttle.SetPaused(true)
+		pc.log.Warn("target seems down, pause the replay until it recovers",
+			zap.Int64("failures", atomic.LoadInt64(&cb.failures)), zap.Duration("probe", cb.interval))
+		t := time.Now()
+		if !pc.probeUntilUp(done) {
+			return
+		}
+		atomic.StoreInt64(&cb.failures, 0)
+		atomic.StoreInt32(&cb.open, 0)
+		if paused {
+			pc.Throttle.SetPaused(false)
+		}
+		pc.log.Info("target recovers, resume the replay", zap.Duration("downtime", time.Since(t)))
+	}
+}
+
+// probeUntilUp connects to the target every interval until it succeeds, it
+// returns false if done before that.
+func (pc *playControl) probeUntilUp(done <-chan struct{}) bool {
+	ticker := time.NewTicker(pc.Breaker.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return false
+		case <-ticker.C:
+		}
+		err := pc.probe()
+		if err == nil {
+			return true
+		}
+		pc.log.Debug("target is still down", zap.Error(err))
+	}
+}
+
+func (pc *playControl) probe() error {
+	driver, err := replay.LookupDriver(pc.Driver)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pc.Breaker.interval)
+	defer cancel()
+	conn, err := driver.Connect(ctx, pc.MySQLConfig)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
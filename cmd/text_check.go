@@ -0,0 +1,342 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+)
+
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// checkTimeout bounds the time of checking the target.
+const checkTimeout = 10 * time.Second
+
+// checkResult is the result of a pre-replay check.
+type checkResult struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+// replayCheck verifies the target and the dump before committing to a long
+// replay.
+type replayCheck struct {
+	results []checkResult
+	// dbs are databases used by sampled sessions.
+	dbs map[string]bool
+}
+
+func (rc *replayCheck) add(name string, status string, format string, args ...interface{}) {
+	rc.results = append(rc.results, checkResult{Name: name, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+// Failed tells whether any check failed.
+func (rc *replayCheck) Failed() bool {
+	for _, r := range rc.results {
+		if r.Status == checkFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (rc *replayCheck) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	for _, r := range rc.results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", r.Name, r.Status, r.Detail)
+	}
+}
+
+// Check scans sample files of the dump for parse errors and checks the target
+// (unless in dry run mode) for connectivity, databases used by the sessions,
+// privileges and max_connections headroom.
+func (pc *playControl) Check(ctx context.Context, sample int) *replayCheck {
+	rc := &replayCheck{dbs: make(map[string]bool)}
+	pc.checkFiles(ctx, rc, sample)
+	if pc.DryRun {
+		return rc
+	}
+	if pc.Driver == replay.PostgresDriverName {
+		rc.add("target", checkWarn, "skipped for postgres targets")
+		return rc
+	}
+	if len(pc.MySQLConfig.DBName) > 0 {
+		rc.dbs[pc.MySQLConfig.DBName] = true
+	}
+	cfg := pc.MySQLConfig.Clone()
+	cfg.DBName = ""
+	pool, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		rc.add("connectivity", checkFail, "%s", err)
+		return rc
+	}
+	defer pool.Close()
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	if err = pool.PingContext(ctx); err != nil {
+		rc.add("connectivity", checkFail, "%s", err)
+		return rc
+	}
+	var version string
+	if err = pool.QueryRowContext(ctx, "SELECT VERSION()").Scan(&version); err != nil {
+		rc.add("connectivity", checkFail, "%s", err)
+		return rc
+	}
+	rc.add("connectivity", checkOK, "%s (%s)", cfg.Addr, version)
+	pc.checkDatabases(ctx, rc, pool)
+	pc.checkPrivileges(ctx, rc, pool)
+	pc.checkConnections(ctx, rc, pool)
+	return rc
+}
+
+// checkFiles decodes sample files (evenly picked from all sessions) and
+// collects databases used by them.
+func (pc *playControl) checkFiles(ctx context.Context, rc *replayCheck, sample int) {
+	workers := pc.workers
+	if sample > 0 && sample < len(workers) {
+		picked := make([]*playWorker, sample)
+		for i := range picked {
+			picked[i] = workers[i*len(workers)/sample]
+		}
+		workers = picked
+	}
+	var (
+		events int64
+		broken []string
+	)
+	for _, w := range workers {
+		n, err := rc.scan(ctx, w)
+		events += n
+		if err != nil {
+			broken = append(broken, fmt.Sprintf("%s: %s", w.file, err))
+		}
+	}
+	if len(broken) > 0 {
+		rc.add("files", checkFail, "%d of %d sampled files are broken, e.g. %s", len(broken), len(workers), broken[0])
+	} else {
+		rc.add("files", checkOK, "%d events in %d sampled files of %d sessions", events, len(workers), len(pc.workers))
+	}
+}
+
+func (rc *replayCheck) scan(ctx context.Context, w *playWorker) (int64, error) {
+	r, err := w.openSource(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	var (
+		n   int64
+		e   = event.MySQLEvent{Params: []interface{}{}}
+		dec = event.NewDecoder(w.MaxLineSize)
+		in  = event.NewLineScanner(r, w.MaxLineSize)
+	)
+	for in.Scan() {
+		ok, err := dec.Decode(in.Text(), e.Reset(e.Params[:0]))
+		if err != nil {
+			return n, errors.Annotatef(err, "event #%d", n+1)
+		} else if !ok {
+			continue
+		}
+		n += 1
+		switch e.Type {
+		case event.EventHandshake, event.EventInitDB:
+			if len(e.DB) > 0 {
+				rc.dbs[e.DB] = true
+			}
+		case event.EventQuery:
+			if db, ok := replay.ParseUseQuery(e.Query); ok && len(db) > 0 {
+				rc.dbs[db] = true
+			}
+		}
+	}
+	return n, errors.Trace(in.Err())
+}
+
+func (rc *replayCheck) requiredDBs() []string {
+	dbs := make([]string, 0, len(rc.dbs))
+	for db := range rc.dbs {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+	return dbs
+}
+
+func (pc *playControl) checkDatabases(ctx context.Context, rc *replayCheck, pool *sql.DB) {
+	rows, err := pool.QueryContext(ctx, "SHOW DATABASES")
+	if err != nil {
+		rc.add("databases", checkFail, "%s", err)
+		return
+	}
+	defer rows.Close()
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var db string
+		if err = rows.Scan(&db); err != nil {
+			rc.add("databases", checkFail, "%s", err)
+			return
+		}
+		existing[strings.ToLower(db)] = true
+	}
+	var missing []string
+	for _, db := range rc.requiredDBs() {
+		if !existing[strings.ToLower(db)] {
+			missing = append(missing, db)
+		}
+	}
+	if len(missing) > 0 {
+		rc.add("databases", checkFail, "missing %s", strings.Join(missing, ", "))
+	} else {
+		rc.add("databases", checkOK, "%d databases used by sampled sessions exist", len(rc.dbs))
+	}
+}
+
+// dmlPrivileges are privileges needed by a typical workload.
+var dmlPrivileges = []string{"SELECT", "INSERT", "UPDATE", "DELETE"}
+
+// checkPrivileges tells whether the user is granted dml privileges on the
+// databases by its direct grants, privileges granted via roles are not taken
+// into account thus only warned.
+func (pc *playControl) checkPrivileges(ctx context.Context, rc *replayCheck, pool *sql.DB) {
+	rows, err := pool.QueryContext(ctx, "SHOW GRANTS")
+	if err != nil {
+		rc.add("privileges", checkWarn, "%s", err)
+		return
+	}
+	defer rows.Close()
+	grants := make(map[string]map[string]bool)
+	for rows.Next() {
+		var grant string
+		if err = rows.Scan(&grant); err != nil {
+			rc.add("privileges", checkWarn, "%s", err)
+			return
+		}
+		if privs, object, ok := parseGrant(grant); ok {
+			if grants[object] == nil {
+				grants[object] = make(map[string]bool)
+			}
+			for _, priv := range privs {
+				grants[object][priv] = true
+			}
+		}
+	}
+	granted := func(db string, priv string) bool {
+		for _, object := range []string{"*", strings.ToLower(db)} {
+			if grants[object]["ALL PRIVILEGES"] || grants[object]["ALL"] || grants[object][priv] {
+				return true
+			}
+		}
+		return false
+	}
+	dbs := rc.requiredDBs()
+	if len(dbs) == 0 {
+		dbs = []string{"*"}
+	}
+	var lacks []string
+	for _, db := range dbs {
+		for _, priv := range dmlPrivileges {
+			if !granted(db, priv) {
+				lacks = append(lacks, priv+" on "+db)
+			}
+		}
+	}
+	if len(lacks) > 0 {
+		rc.add("privileges", checkWarn, "not granted %s", strings.Join(lacks, ", "))
+	} else {
+		rc.add("privileges", checkOK, "%s granted", strings.Join(dmlPrivileges, ", "))
+	}
+}
+
+// parseGrant parses a line of SHOW GRANTS like `GRANT SELECT, INSERT ON
+// `db`.* TO ...`, the object is the database in lower case or `*`.
+func parseGrant(grant string) ([]string, string, bool) {
+	upper := strings.ToUpper(grant)
+	on, to := strings.Index(upper, " ON "), strings.LastIndex(upper, " TO ")
+	if !strings.HasPrefix(upper, "GRANT ") || on < 0 || to < on {
+		return nil, "", false
+	}
+	privs := strings.Split(upper[len("GRANT "):on], ",")
+	for i := range privs {
+		privs[i] = strings.TrimSpace(privs[i])
+		if k := strings.IndexByte(privs[i], '('); k > 0 {
+			privs[i] = strings.TrimSpace(privs[i][:k])
+		}
+	}
+	object := strings.TrimSpace(grant[on+len(" ON ") : to])
+	if k := strings.LastIndex(object, "."); k >= 0 {
+		object = object[:k]
+	}
+	object = strings.ToLower(strings.Trim(object, "`"))
+	return privs, object, true
+}
+
+// checkConnections compares the peak number of concurrent sessions in the dump
+// with free connections of the target.
+func (pc *playControl) checkConnections(ctx context.Context, rc *replayCheck, pool *sql.DB) {
+	var (
+		maxConns  int64
+		name      string
+		connected int64
+	)
+	if err := pool.QueryRowContext(ctx, "SELECT @@max_connections").Scan(&maxConns); err != nil {
+		rc.add("connections", checkWarn, "%s", err)
+		return
+	}
+	if err := pool.QueryRowContext(ctx, "SHOW GLOBAL STATUS LIKE 'Threads_connected'").Scan(&name, &connected); err != nil {
+		rc.add("connections", checkWarn, "%s", err)
+		return
+	}
+	peak := peakSessions(pc.workers)
+	free := maxConns - connected
+	detail := fmt.Sprintf("%d peak concurrent sessions, %d of max_connections %d free", peak, free, maxConns)
+	switch {
+	case int64(peak) > free:
+		rc.add("connections", checkFail, "%s", detail)
+	case int64(peak)*10 > free*8:
+		rc.add("connections", checkWarn, "%s", detail)
+	default:
+		rc.add("connections", checkOK, "%s", detail)
+	}
+}
+
+// peakSessions returns the max number of sessions overlapping in captured time.
+func peakSessions(workers []*playWorker) int {
+	type edge struct {
+		t     int64
+		delta int
+	}
+	edges := make([]edge, 0, 2*len(workers))
+	for _, w := range workers {
+		end := w.end
+		if end < w.ts {
+			end = w.ts
+		}
+		edges = append(edges, edge{w.ts, 1}, edge{end, -1})
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i].t != edges[j].t {
+			return edges[i].t < edges[j].t
+		}
+		return edges[i].delta > edges[j].delta
+	})
+	peak, cur := 0, 0
+	for _, e := range edges {
+		if cur += e.delta; cur > peak {
+			peak = cur
+		}
+	}
+	return peak
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/event"
+	"go.uber.org/zap"
+)
+
+func checkFormat(format string) error {
+	for _, f := range event.Formats() {
+		if f == format {
+			return nil
+		}
+	}
+	if format == "pcap" {
+		return errors.New("pcap files are converted by text dump")
+	}
+	return errors.Errorf("unsupported format: %s (%s)", format, strings.Join(event.Formats(), "|"))
+}
+
+func checkChunkSize(size int) error {
+	if size != 0 && size < event.MinChunkSize {
+		return errors.Errorf("chunk size should be 0 or at least %d", event.MinChunkSize)
+	}
+	return nil
+}
+
+// convertSession copies events of a session from r in the format from to a
+// session file of the format to under output, it returns the number of events.
+// Events are split into chunks of chunkSize (if positive) in tsv.
+func convertSession(r io.Reader, from string, to string, maxLineSize int, chunkSize int, output string, id uint64) (int, error) {
+	in, err := event.NewReader(from, r, maxLineSize)
+	if err != nil {
+		return 0, err
+	}
+	name := fmt.Sprintf("%016x", id)
+	f, err := os.CreateTemp(output, "."+name+".*")
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	var (
+		e        = event.MySQLEvent{Params: []interface{}{}}
+		out      event.Writer
+		fst, lst int64
+		count    = 0
+	)
+	for {
+		if err = in.Read(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			return count, errors.Trace(err)
+		}
+		if out == nil {
+			h := in.Header()
+			if h.Time == 0 {
+				h.Time = e.Time
+			}
+			h.Columns, h.Chunk = event.Columns, chunkSize
+			if out, err = event.NewWriter(to, f, h); err != nil {
+				return count, err
+			}
+			fst = e.Time
+		}
+		if err = out.Write(e); err != nil {
+			return count, errors.Trace(err)
+		}
+		lst = e.Time
+		count += 1
+	}
+	if out == nil {
+		return 0, nil
+	}
+	if err = out.Flush(); err != nil {
+		return count, errors.Trace(err)
+	}
+	if err = f.Close(); err != nil {
+		return count, errors.Trace(err)
+	}
+	return count, errors.Trace(os.Rename(f.Name(), filepath.Join(output, fmt.Sprintf("%d.%d.%s.%s", fst, lst, name, to))))
+}
+
+func NewTextConvertCommand() *cobra.Command {
+	var (
+		from        string
+		to          string
+		maxLineSize int
+		chunkSize   int
+	)
+	cmd := &cobra.Command{
+		Use:   "convert <input> <output>",
+		Short: "Convert session files of a dump to another format (pcap files are dumped by text dump)",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := checkFormat(from); err != nil {
+				return err
+			}
+			if err := checkFormat(to); err != nil {
+				return err
+			}
+			if err := checkChunkSize(chunkSize); err != nil {
+				return err
+			}
+			ctl, err := newPlayControl(playConfig{DryRun: true, Format: from}, args[0], "")
+			if err != nil {
+				return err
+			}
+			output := args[1]
+			if err = os.MkdirAll(output, 0755); err != nil {
+				return errors.Trace(err)
+			}
+			ctx := context.Background()
+			sessions, events := 0, 0
+			for _, w := range ctl.workers {
+				r, err := w.openSource(ctx)
+				if err != nil {
+					return errors.Annotate(err, "open "+w.src)
+				}
+				n, err := convertSession(r, from, to, maxLineSize, chunkSize, output, w.id)
+				r.Close()
+				if err != nil {
+					return errors.Annotate(err, "convert "+w.src)
+				}
+				if n > 0 {
+					sessions += 1
+					events += n
+				}
+			}
+			zap.L().Info("convert done", zap.Int("sessions", sessions), zap.Int("events", events))
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&from, "from", event.FormatTSV, "format of the input ("+strings.Join(event.Formats(), "|")+")")
+	cmd.Flags().StringVar(&to, "to", event.FormatJSON, "format of the output ("+strings.Join(event.Formats(), "|")+")")
+	cmd.Flags().IntVar(&maxLineSize, "max-line-size", 16777216, "max line size of the input in tsv or json")
+	cmd.Flags().IntVar(&chunkSize, "chunk-size", 0, "split events longer than the size into lines of chunks (format v3) in tsv (0 means never)")
+	return cmd
+}
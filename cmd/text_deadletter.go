@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/event"
+	"go.uber.org/zap"
+)
+
+// deadLetterIndex lists every failed event as a line of the session, the error
+// (quoted) and the event encoded as in tsv dumps.
+const deadLetterIndex = "failed.tsv"
+
+// deadLetters writes failed events into dir in the format of dumps, thus they
+// can be replayed again by `text play dir`. Each session with failures gets a
+// session file of its failed events, which are preceded by events restoring
+// the state of the session (schema, session variables and prepared
+// statements).
+type deadLetters struct {
+	dir    string
+	format string
+
+	lock  sync.Mutex
+	index *os.File
+	w     *bufio.Writer
+	buf   []byte
+	count int64
+}
+
+func newDeadLetters(dir string, format string) (*deadLetters, error) {
+	if len(format) == 0 {
+		format = event.FormatTSV
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Trace(err)
+	}
+	f, err := os.Create(filepath.Join(dir, deadLetterIndex))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &deadLetters{dir: dir, format: format, index: f, w: bufio.NewWriter(f)}, nil
+}
+
+// deadLetterSession is the session file of failed events of a worker.
+type deadLetterSession struct {
+	f     *os.File
+	w     event.Writer
+	first int64
+	last  int64
+	db    string
+	sets  int
+	stmts map[uint64]bool
+}
+
+// Write writes the failed event of the worker into its session file and the
+// index.
+func (dl *deadLetters) Write(pw *playWorker, e *event.MySQLEvent, cause error) {
+	if err := dl.writeSession(pw, e); err != nil {
+		pw.log.Warn("failed to write failed event", zap.Error(err))
+	}
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	buf := append(dl.buf[:0], fmt.Sprintf("%016x", pw.id)...)
+	buf = append(buf, '\t')
+	buf = strconv.AppendQuote(buf, oneLine(cause.Error()))
+	buf = append(buf, '\t')
+	buf, err := event.AppendEvent(buf, *e)
+	if err != nil {
+		pw.log.Warn("failed to write failed event", zap.Error(err))
+		return
+	}
+	dl.buf = append(buf, '\n')
+	dl.w.Write(dl.buf)
+	dl.count += 1
+}
+
+func (dl *deadLetters) writeSession(pw *playWorker, e *event.MySQLEvent) error {
+	var (
+		s      = pw.dead
+		rs     = &pw.repro
+		events []event.MySQLEvent
+	)
+	if s == nil {
+		f, err := os.Create(filepath.Join(dl.dir, fmt.Sprintf("%016x.tmp", pw.id)))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		w, err := event.NewWriter(dl.format, f, event.Header{Time: e.Time})
+		if err != nil {
+			f.Close()
+			return errors.Trace(err)
+		}
+		s = &deadLetterSession{f: f, w: w, first: e.Time, db: rs.db, stmts: make(map[uint64]bool)}
+		pw.dead = s
+		events = append(events, event.MySQLEvent{Type: event.EventHandshake, DB: rs.db, Charset: rs.charset})
+	} else if s.db != rs.db {
+		s.db = rs.db
+		events = append(events, event.MySQLEvent{Type: event.EventInitDB, DB: rs.db})
+	}
+	if s.sets > len(rs.sets) {
+		s.sets = 0
+	}
+	for _, query := range rs.sets[s.sets:] {
+		events = append(events, event.MySQLEvent{Type: event.EventQuery, Query: query})
+	}
+	s.sets = len(rs.sets)
+	if e.Type == event.EventStmtExecute || e.Type == event.EventStmtFetch {
+		if query, ok := rs.stmts[e.StmtID]; ok && !s.stmts[e.StmtID] {
+			events = append(events, event.MySQLEvent{Type: event.EventStmtPrepare, StmtID: e.StmtID, Query: query})
+			s.stmts[e.StmtID] = true
+		}
+	} else if e.Type == event.EventStmtPrepare {
+		s.stmts[e.StmtID] = true
+	}
+	events = append(events, *e)
+	for i := range events {
+		events[i].Time = e.Time
+		if err := s.w.Write(events[i]); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	s.last = e.Time
+	return nil
+}
+
+// isStatement tells whether the event runs a statement on the target.
+func isStatement(e *event.MySQLEvent) bool {
+	switch e.Type {
+	case event.EventQuery, event.EventStmtPrepare, event.EventStmtExecute, event.EventStmtFetch:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeSession closes the session file of the worker and names it as session
+// files of dumps.
+func (dl *deadLetters) closeSession(pw *playWorker) error {
+	s := pw.dead
+	if s == nil {
+		return nil
+	}
+	pw.dead = nil
+	if err := s.w.Flush(); err != nil {
+		s.f.Close()
+		return errors.Trace(err)
+	}
+	if err := s.f.Close(); err != nil {
+		return errors.Trace(err)
+	}
+	name := fmt.Sprintf("%d.%d.%016x.%s", s.first, s.last, pw.id, dl.format)
+	return errors.Trace(os.Rename(s.f.Name(), filepath.Join(dl.dir, name)))
+}
+
+// Close flushes the index and returns the number of failed events written.
+func (dl *deadLetters) Close() (int64, error) {
+	dl.lock.Lock()
+	defer dl.lock.Unlock()
+	if err := dl.w.Flush(); err != nil {
+		dl.index.Close()
+		return dl.count, errors.Trace(err)
+	}
+	return dl.count, errors.Trace(dl.index.Close())
+}
@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zyguan/mysql-replay/event"
+	"go.uber.org/zap"
+)
+
+// digestStat counts statements of a digest, Total and Max are latencies of the
+// succeeded ones only, thus fast errors and timeouts never distort rankings of
+// slow statements. Latencies of failed ones are kept by FailedMax instead.
+type digestStat struct {
+	Digest    string        `json:"digest"`
+	Sample    string        `json:"sample"`
+	Count     int64         `json:"count"`
+	Total     time.Duration `json:"total"`
+	Max       time.Duration `json:"max"`
+	Errors    int64         `json:"errors,omitempty"`
+	FailedMax time.Duration `json:"failedMax,omitempty"`
+	// Mismatches counts statements of which rows affected differ from the
+	// ones in the capture.
+	Mismatches int64 `json:"mismatches,omitempty"`
+	// Captured counts statements of which latencies in the capture are known
+	// (from result events), CapturedTotal and ReplayedTotal are the sums of
+	// their latencies in the capture and in the replay.
+	Captured      int64         `json:"captured,omitempty"`
+	CapturedTotal time.Duration `json:"capturedTotal,omitempty"`
+	ReplayedTotal time.Duration `json:"replayedTotal,omitempty"`
+}
+
+// Avg returns the average latency of succeeded statements.
+func (s digestStat) Avg() time.Duration {
+	if s.Count <= s.Errors {
+		return 0
+	}
+	return s.Total / time.Duration(s.Count-s.Errors)
+}
+
+// Ratio returns the ratio of the latency in the replay to the one in the
+// capture, 0 is returned if the latency in the capture is unknown.
+func (s digestStat) Ratio() float64 {
+	if s.Captured == 0 || s.CapturedTotal <= 0 {
+		return 0
+	}
+	return float64(s.ReplayedTotal) / float64(s.CapturedTotal)
+}
+
+type digestStats struct {
+	lock    sync.Mutex
+	digests map[string]*digestStat
+}
+
+func newDigestStats() *digestStats {
+	return &digestStats{digests: make(map[string]*digestStat)}
+}
+
+func (ds *digestStats) Observe(digest string, query string, d time.Duration, err error) {
+	if ds == nil {
+		return
+	}
+	if len(digest) == 0 {
+		digest = event.Digest(query)
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	s, ok := ds.digests[digest]
+	if !ok {
+		s = &digestStat{Digest: digest, Sample: formatSample(query)}
+		ds.digests[digest] = s
+	}
+	s.Count += 1
+	if err != nil {
+		s.Errors += 1
+		if d > s.FailedMax {
+			s.FailedMax = d
+		}
+		return
+	}
+	s.Total += d
+	if d > s.Max {
+		s.Max = d
+		s.Sample = formatSample(query)
+	}
+}
+
+// ObserveMismatch counts a statement of which rows affected differ from the
+// ones in the capture.
+func (ds *digestStats) ObserveMismatch(digest string, query string) {
+	if ds == nil {
+		return
+	}
+	if len(digest) == 0 {
+		digest = event.Digest(query)
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	s, ok := ds.digests[digest]
+	if !ok {
+		s = &digestStat{Digest: digest, Sample: formatSample(query)}
+		ds.digests[digest] = s
+	}
+	s.Mismatches += 1
+}
+
+// ObserveCaptured compares the latency of a statement in the replay with the
+// one in the capture, it must be called for succeeded statements only.
+func (ds *digestStats) ObserveCaptured(digest string, query string, captured time.Duration, replayed time.Duration) {
+	if ds == nil || captured <= 0 {
+		return
+	}
+	if len(digest) == 0 {
+		digest = event.Digest(query)
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	s, ok := ds.digests[digest]
+	if !ok {
+		s = &digestStat{Digest: digest, Sample: formatSample(query)}
+		ds.digests[digest] = s
+	}
+	s.Captured += 1
+	s.CapturedTotal += captured
+	s.ReplayedTotal += replayed
+}
+
+// Slowest returns at most n digests ordered by the max latency of their
+// succeeded statements, digests of which statements all failed are left out.
+func (ds *digestStats) Slowest(n int) []digestStat {
+	if ds == nil {
+		return nil
+	}
+	ds.lock.Lock()
+	out := make([]digestStat, 0, len(ds.digests))
+	for _, s := range ds.digests {
+		if s.Count > s.Errors {
+			out = append(out, *s)
+		}
+	}
+	ds.lock.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Max > out[j].Max })
+	if n >= 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// Frequent returns at most n digests ordered by their counts.
+func (ds *digestStats) Frequent(n int) []digestStat {
+	if ds == nil {
+		return nil
+	}
+	ds.lock.Lock()
+	out := make([]digestStat, 0, len(ds.digests))
+	for _, s := range ds.digests {
+		out = append(out, *s)
+	}
+	ds.lock.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Count > out[j].Count })
+	if n >= 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// Failing returns at most n digests with errors ordered by their error counts.
+func (ds *digestStats) Failing(n int) []digestStat {
+	if ds == nil {
+		return nil
+	}
+	ds.lock.Lock()
+	out := make([]digestStat, 0)
+	for _, s := range ds.digests {
+		if s.Errors > 0 {
+			out = append(out, *s)
+		}
+	}
+	ds.lock.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Errors > out[j].Errors })
+	if n >= 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// Mismatched returns at most n digests with mismatches of rows affected ordered
+// by their mismatch counts.
+func (ds *digestStats) Mismatched(n int) []digestStat {
+	if ds == nil {
+		return nil
+	}
+	ds.lock.Lock()
+	out := make([]digestStat, 0)
+	for _, s := range ds.digests {
+		if s.Mismatches > 0 {
+			out = append(out, *s)
+		}
+	}
+	ds.lock.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Mismatches > out[j].Mismatches })
+	if n >= 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// Regressed returns at most n digests of which latencies in the capture are
+// known, ordered by the ratio of their latencies in the replay to the captured.
+func (ds *digestStats) Regressed(n int) []digestStat {
+	if ds == nil {
+		return nil
+	}
+	ds.lock.Lock()
+	out := make([]digestStat, 0)
+	for _, s := range ds.digests {
+		if s.Captured > 0 {
+			out = append(out, *s)
+		}
+	}
+	ds.lock.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Ratio() > out[j].Ratio() })
+	if n >= 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// Report logs top n slow and regressed statements, failed ones are reported by
+// failure groups of the play report instead.
+func (ds *digestStats) Report(log *zap.Logger, n int) {
+	if ds == nil || n <= 0 {
+		return
+	}
+	for i, s := range ds.Slowest(n) {
+		log.Info("slow statement",
+			zap.Int("rank", i+1),
+			zap.String("digest", s.Digest),
+			zap.Int64("count", s.Count),
+			zap.Duration("avg", s.Avg()),
+			zap.Duration("max", s.Max),
+			zap.String("sample", s.Sample))
+	}
+	for i, s := range ds.Regressed(n) {
+		log.Info("regressed statement",
+			zap.Int("rank", i+1),
+			zap.String("digest", s.Digest),
+			zap.Int64("count", s.Captured),
+			zap.Float64("ratio", s.Ratio()),
+			zap.Duration("captured", s.CapturedTotal/time.Duration(s.Captured)),
+			zap.Duration("replayed", s.ReplayedTotal/time.Duration(s.Captured)),
+			zap.String("sample", s.Sample))
+	}
+	for i, s := range ds.Mismatched(n) {
+		log.Warn("affected rows mismatch",
+			zap.Int("rank", i+1),
+			zap.String("digest", s.Digest),
+			zap.Int64("count", s.Count),
+			zap.Int64("mismatches", s.Mismatches),
+			zap.String("sample", s.Sample))
+	}
+}
+
+func formatSample(query string) string {
+	if len(query) > 1024 {
+		query = query[:700] + "..." + query[len(query)-300:]
+	}
+	return query
+}
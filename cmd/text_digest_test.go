@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDigestStatsFailures(t *testing.T) {
+	ds := newDigestStats()
+	timeout := errors.New("timeout")
+	ds.Observe("a", "select a", 10*time.Millisecond, nil)
+	ds.Observe("a", "select a", 30*time.Millisecond, nil)
+	ds.Observe("a", "select a", time.Minute, timeout)
+	ds.Observe("b", "select b", 20*time.Millisecond, nil)
+	ds.Observe("c", "select c", time.Millisecond, timeout)
+
+	slowest := ds.Slowest(-1)
+	require.Len(t, slowest, 2)
+	require.Equal(t, "a", slowest[0].Digest)
+	require.Equal(t, 30*time.Millisecond, slowest[0].Max)
+	require.Equal(t, 20*time.Millisecond, slowest[0].Avg())
+	require.Equal(t, int64(3), slowest[0].Count)
+	require.Equal(t, "b", slowest[1].Digest)
+
+	failing := ds.Failing(-1)
+	require.Len(t, failing, 2)
+	for _, s := range failing {
+		require.Equal(t, int64(1), s.Errors)
+	}
+	require.ElementsMatch(t, []time.Duration{time.Minute, time.Millisecond}, []time.Duration{failing[0].FailedMax, failing[1].FailedMax})
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/spf13/pflag"
+)
+
+// dsnSource resolves a dsn given by a flag, an environment variable, a file or
+// the output of a command, thus credentials needn't appear in shell history and
+// process lists. The password given by an environment variable or a file (if
+// any) replaces the one of the dsn.
+type dsnSource struct {
+	prefix string
+
+	DSN          string
+	Env          string
+	File         string
+	Cmd          string
+	PasswordEnv  string
+	PasswordFile string
+}
+
+func (s *dsnSource) Register(flags *pflag.FlagSet, prefix string, usage string) {
+	s.prefix = prefix
+	flags.StringVar(&s.DSN, prefix+"dsn", "", usage)
+	flags.StringVar(&s.Env, prefix+"dsn-env", "", "read the "+usage+" from the environment variable")
+	flags.StringVar(&s.File, prefix+"dsn-file", "", "read the "+usage+" from the file")
+	flags.StringVar(&s.Cmd, prefix+"dsn-cmd", "", "read the "+usage+" from the output of the shell command (e.g. a secret store cli)")
+	flags.StringVar(&s.PasswordEnv, prefix+"password-env", "", "replace the password of the "+usage+" with the value of the environment variable")
+	flags.StringVar(&s.PasswordFile, prefix+"password-file", "", "replace the password of the "+usage+" with the content of the file")
+}
+
+// Resolve returns the dsn, which is empty if none is given.
+func (s *dsnSource) Resolve() (string, error) {
+	var (
+		dsn     string
+		sources int
+	)
+	if len(s.DSN) > 0 {
+		dsn, sources = s.DSN, sources+1
+	}
+	if len(s.Env) > 0 {
+		v, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", errors.Errorf("environment variable %s of --%sdsn-env is not set", s.Env, s.prefix)
+		}
+		dsn, sources = strings.TrimSpace(v), sources+1
+	}
+	if len(s.File) > 0 {
+		content, err := ioutil.ReadFile(s.File)
+		if err != nil {
+			return "", errors.Annotatef(err, "read --%sdsn-file", s.prefix)
+		}
+		dsn, sources = strings.TrimSpace(string(content)), sources+1
+	}
+	if len(s.Cmd) > 0 {
+		var stderr bytes.Buffer
+		cmd := exec.Command("sh", "-c", s.Cmd)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			if msg := strings.TrimSpace(stderr.String()); len(msg) > 0 {
+				err = errors.Annotate(err, msg)
+			}
+			return "", errors.Annotatef(err, "run --%sdsn-cmd", s.prefix)
+		}
+		dsn, sources = strings.TrimSpace(string(out)), sources+1
+	}
+	if sources > 1 {
+		return "", errors.Errorf("--%[1]sdsn, --%[1]sdsn-env, --%[1]sdsn-file and --%[1]sdsn-cmd are mutually exclusive", s.prefix)
+	}
+	var (
+		password string
+		replace  bool
+	)
+	if len(s.PasswordEnv) > 0 {
+		if password, replace = os.LookupEnv(s.PasswordEnv); !replace {
+			return "", errors.Errorf("environment variable %s of --%spassword-env is not set", s.PasswordEnv, s.prefix)
+		}
+	}
+	if len(s.PasswordFile) > 0 {
+		if replace {
+			return "", errors.Errorf("--%[1]spassword-env and --%[1]spassword-file are mutually exclusive", s.prefix)
+		}
+		content, err := ioutil.ReadFile(s.PasswordFile)
+		if err != nil {
+			return "", errors.Annotatef(err, "read --%spassword-file", s.prefix)
+		}
+		password, replace = strings.TrimRight(string(content), "\r\n"), true
+	}
+	if !replace || len(dsn) == 0 {
+		return dsn, nil
+	}
+	return withPassword(dsn, password)
+}
+
+// withPassword replaces the password of the dsn, which is either a mysql dsn or
+// a url (e.g. of postgres).
+func withPassword(dsn string, password string) (string, error) {
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", errors.Annotate(err, "parse dsn")
+		}
+		user := ""
+		if u.User != nil {
+			user = u.User.Username()
+		}
+		u.User = url.UserPassword(user, password)
+		return u.String(), nil
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", errors.Annotate(err, "parse dsn")
+	}
+	cfg.Passwd = password
+	return cfg.FormatDSN(), nil
+}
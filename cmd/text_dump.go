@@ -0,0 +1,393 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/google/gopacket/reassembly"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/stats"
+	"github.com/zyguan/mysql-replay/stream"
+	"go.uber.org/zap"
+)
+
+// dumpAssembler reassembles tcp packets of a dump, packets are sharded to
+// assemblers by their connections and assembled in parallel.
+type dumpAssembler struct {
+	shards        []*dumpShard
+	defrag        *stream.Defragmenter
+	flushInterval time.Duration
+	budget        *stream.MemoryBudget
+	wg            sync.WaitGroup
+}
+
+type dumpShard struct {
+	*reassembly.Assembler
+	ch chan dumpPacket
+
+	lastFlushTime time.Time
+	lastShedTime  time.Time
+}
+
+func newDumpAssembler(factory reassembly.StreamFactory, n int, flushInterval time.Duration, budget *stream.MemoryBudget) *dumpAssembler {
+	if n < 1 {
+		n = 1
+	}
+	a := &dumpAssembler{defrag: stream.NewDefragmenter(), flushInterval: flushInterval, budget: budget}
+	for i := 0; i < n; i++ {
+		s := &dumpShard{Assembler: reassembly.NewAssembler(reassembly.NewStreamPool(factory)), ch: make(chan dumpPacket, 1024)}
+		if pages := budget.MaxBufferedPages(); pages > 0 {
+			s.MaxBufferedPagesTotal = pages/n + 1
+		}
+		a.shards = append(a.shards, s)
+		a.wg.Add(1)
+		go a.run(s)
+	}
+	return a
+}
+
+// dumpPacket is the innermost tcp segment of a captured packet.
+type dumpPacket struct {
+	flow gopacket.Flow
+	tcp  *layers.TCP
+	ci   gopacket.CaptureInfo
+}
+
+// Assemble dispatches the packet to the shard of its connection, packets which
+// are not tcp are ignored. Encapsulations like VLAN, VXLAN, GRE and ERSPAN are
+// stripped, and ipv4 fragments are reassembled.
+func (a *dumpAssembler) Assemble(pkt gopacket.Packet) {
+	flow, tcp, ok := a.defrag.TCPLayer(pkt)
+	if !ok {
+		return
+	}
+	if ci := pkt.Metadata().CaptureInfo; ci.CaptureLength < ci.Length {
+		// data cut by the snap length is lost, which shows up as a gap later
+		stats.Add(stats.TruncatedPackets, 1)
+	}
+	// the hash is the same for both directions of a connection
+	conn := stream.ConnID{flow, tcp.TransportFlow()}
+	a.shards[conn.Hash()%uint64(len(a.shards))].ch <- dumpPacket{flow: flow, tcp: tcp, ci: pkt.Metadata().CaptureInfo}
+}
+
+func (a *dumpAssembler) run(s *dumpShard) {
+	defer a.wg.Done()
+	for pkt := range s.ch {
+		meta := pkt.ci
+		if meta.Timestamp.Sub(s.lastFlushTime) > a.flushInterval {
+			s.FlushCloseOlderThan(s.lastFlushTime)
+			s.lastFlushTime = meta.Timestamp
+		}
+		if a.budget.Exceeded() && meta.Timestamp.Sub(s.lastShedTime) > time.Second {
+			// close streams idle for the longest time until the buffered data fits in the budget
+			for d := a.flushInterval / 2; d >= time.Second && a.budget.Exceeded(); d /= 2 {
+				if _, closed := s.FlushCloseOlderThan(meta.Timestamp.Add(-d)); closed > 0 {
+					zap.L().Warn("close idle streams due to memory budget", zap.Int("closed", closed), zap.Duration("idle", d))
+				}
+			}
+			s.lastShedTime = meta.Timestamp
+		}
+		s.AssembleWithContext(pkt.flow, pkt.tcp, captureContext(meta))
+	}
+	s.FlushAll()
+}
+
+// Close waits for all packets dispatched to be assembled and closes all
+// streams.
+func (a *dumpAssembler) Close() {
+	for _, s := range a.shards {
+		close(s.ch)
+	}
+	a.wg.Wait()
+}
+
+// readPcaps passes packets of the pcap files to h. If parallel, files are read
+// concurrently and their packets are merged in the order of capture time, thus
+// connections across rotated files are kept in order.
+func readPcaps(names []string, parallel bool, h func(pkt gopacket.Packet)) error {
+	if !parallel || len(names) <= 1 {
+		for _, name := range names {
+			zap.L().Info("processing " + name)
+			f, err := openPcap(name)
+			if err != nil {
+				return errors.Annotate(err, "open "+name)
+			}
+			for pkt := range f.Packets() {
+				h(pkt)
+			}
+			f.Close()
+		}
+		return nil
+	}
+	files := make([]*pcapFile, 0, len(names))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, name := range names {
+		f, err := openPcap(name)
+		if err != nil {
+			return errors.Annotate(err, "open "+name)
+		}
+		files = append(files, f)
+	}
+	heads := make(pcapHeads, 0, len(files))
+	for i, f := range files {
+		zap.L().Info("processing " + names[i])
+		ch := make(chan gopacket.Packet, 256)
+		go func(f *pcapFile) {
+			defer close(ch)
+			for pkt := range f.Packets() {
+				ch <- pkt
+			}
+		}(f)
+		if pkt, ok := <-ch; ok {
+			heads = append(heads, &pcapHead{pkt: pkt, ch: ch})
+		}
+	}
+	heap.Init(&heads)
+	for heads.Len() > 0 {
+		head := heads[0]
+		h(head.pkt)
+		var ok bool
+		if head.pkt, ok = <-head.ch; ok {
+			heap.Fix(&heads, 0)
+		} else {
+			heap.Pop(&heads)
+		}
+	}
+	return nil
+}
+
+// pcapWatcher watches a directory where pcap files are rotated (e.g. by
+// `tcpdump -G` or `-C`), completed files are read in the order of their
+// modification time and are then deleted or moved into archive.
+type pcapWatcher struct {
+	dir      string
+	archive  string
+	interval time.Duration
+	// settle is how long the newest file is left unmodified before it's
+	// considered completed, it waits for a newer file if settle is 0.
+	settle time.Duration
+
+	seen map[string]bool
+}
+
+// Run passes packets of completed files to h until it's interrupted by SIGINT
+// or SIGTERM, the file being read is finished first.
+func (w *pcapWatcher) Run(h func(pkt gopacket.Packet)) error {
+	if len(w.archive) > 0 {
+		if err := os.MkdirAll(w.archive, 0755); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	w.seen = make(map[string]bool)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	zap.L().Info("watching "+w.dir, zap.Duration("interval", w.interval))
+	for {
+		names, err := w.completed(time.Now())
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if ctx.Err() != nil {
+				break
+			}
+			w.read(name, h)
+		}
+		select {
+		case <-ctx.Done():
+			zap.L().Info("stop watching " + w.dir)
+			return nil
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+// completed lists completed files which are not read yet in order.
+func (w *pcapWatcher) completed(now time.Time) ([]string, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	type file struct {
+		name  string
+		mtime time.Time
+	}
+	files := make([]file, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{filepath.Join(w.dir, entry.Name()), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].mtime.Equal(files[j].mtime) {
+			return files[i].name < files[j].name
+		}
+		return files[i].mtime.Before(files[j].mtime)
+	})
+	names := make([]string, 0, len(files))
+	for i, f := range files {
+		// the newest file may be still written by tcpdump
+		if i == len(files)-1 && (w.settle <= 0 || now.Sub(f.mtime) < w.settle) {
+			break
+		}
+		if !w.seen[f.name] {
+			names = append(names, f.name)
+		}
+	}
+	return names, nil
+}
+
+// read passes packets of the file to h and then deletes or archives it.
+func (w *pcapWatcher) read(name string, h func(pkt gopacket.Packet)) {
+	w.seen[name] = true
+	zap.L().Info("processing " + name)
+	f, err := openPcap(name)
+	if err != nil {
+		zap.L().Warn("skip "+name, zap.Error(err))
+		return
+	}
+	for pkt := range f.Packets() {
+		h(pkt)
+	}
+	f.Close()
+	if len(w.archive) > 0 {
+		err = os.Rename(name, filepath.Join(w.archive, filepath.Base(name)))
+	} else {
+		err = os.Remove(name)
+	}
+	if err != nil {
+		zap.L().Warn("failed to clean up "+name, zap.Error(err))
+		return
+	}
+	delete(w.seen, name)
+}
+
+var (
+	gzipMagic   = []byte{0x1f, 0x8b}
+	zstdMagic   = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+)
+
+// pcapFile is an opened pcap or pcapng file, which is decompressed if it's
+// compressed by gzip or zstd.
+type pcapFile struct {
+	gopacket.PacketDataSource
+	linkType layers.LinkType
+	closers  []io.Closer
+}
+
+// openPcap opens the pcap file of the name, or stdin if the name is "-". The
+// format and compression are detected by the content instead of the name.
+func openPcap(name string) (*pcapFile, error) {
+	if name == "-" {
+		return newPcapFile(os.Stdin)
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return newPcapFile(file)
+}
+
+// newPcapFile reads the pcap stream of in, which is closed along with the
+// returned file.
+func newPcapFile(in io.ReadCloser) (*pcapFile, error) {
+	f := &pcapFile{}
+	f.closers = append(f.closers, in)
+	r := bufio.NewReaderSize(in, 65536)
+	magic, _ := r.Peek(4)
+	if bytes.HasPrefix(magic, gzipMagic) {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, errors.Annotate(err, "open gzip")
+		}
+		f.closers = append(f.closers, zr)
+		r = bufio.NewReaderSize(zr, 65536)
+	} else if bytes.HasPrefix(magic, zstdMagic) {
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, errors.Annotate(err, "open zstd")
+		}
+		f.closers = append(f.closers, zr.IOReadCloser())
+		r = bufio.NewReaderSize(zr, 65536)
+	}
+	if magic, _ = r.Peek(4); bytes.Equal(magic, pcapngMagic) {
+		ng, err := pcapgo.NewNgReader(r, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			f.Close()
+			return nil, errors.Annotate(err, "read pcapng")
+		}
+		f.PacketDataSource, f.linkType = ng, ng.LinkType()
+	} else {
+		pr, err := pcapgo.NewReader(r)
+		if err != nil {
+			f.Close()
+			return nil, errors.Annotate(err, "read pcap")
+		}
+		f.PacketDataSource, f.linkType = pr, pr.LinkType()
+	}
+	return f, nil
+}
+
+// Packets returns a channel of decoded packets of the file.
+func (f *pcapFile) Packets() chan gopacket.Packet {
+	return gopacket.NewPacketSource(f, f.linkType).Packets()
+}
+
+func (f *pcapFile) Close() {
+	for i := len(f.closers) - 1; i >= 0; i-- {
+		f.closers[i].Close()
+	}
+}
+
+type pcapHead struct {
+	pkt gopacket.Packet
+	ch  <-chan gopacket.Packet
+}
+
+// pcapHeads is a min heap of the next packets of pcap files by capture time.
+type pcapHeads []*pcapHead
+
+func (h pcapHeads) Len() int { return len(h) }
+
+func (h pcapHeads) Less(i, j int) bool {
+	return h[i].pkt.Metadata().Timestamp.Before(h[j].pkt.Metadata().Timestamp)
+}
+
+func (h pcapHeads) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *pcapHeads) Push(x interface{}) { *h = append(*h, x.(*pcapHead)) }
+
+func (h *pcapHeads) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
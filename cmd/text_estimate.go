@@ -0,0 +1,293 @@
+package cmd
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/event"
+	"go.uber.org/zap"
+)
+
+// loadBucket is the width (in ms) of buckets of statement counts.
+const loadBucket = 100
+
+// sessionLoad is the load of a session read from its file.
+type sessionLoad struct {
+	id         uint64
+	start      int64
+	end        int64
+	statements int64
+	buckets    map[int64]int64
+	maxLine    int
+	stmtBytes  int
+}
+
+func loadSession(r io.Reader, id uint64, maxLineSize int) (*sessionLoad, error) {
+	var (
+		sl    = &sessionLoad{id: id, buckets: make(map[int64]int64)}
+		e     = event.MySQLEvent{Params: []interface{}{}}
+		dec   = event.NewDecoder(maxLineSize)
+		in    = bufio.NewScanner(r)
+		stmts = make(map[uint64]int)
+		bytes = 0
+		first = true
+	)
+	if maxLineSize > 0 {
+		in.Buffer(make([]byte, 0, 4096), maxLineSize)
+	}
+	for in.Scan() {
+		line := in.Text()
+		if len(line) > sl.maxLine {
+			sl.maxLine = len(line)
+		}
+		ok, err := dec.Decode(line, e.Reset(e.Params[:0]))
+		if err != nil {
+			return sl, err
+		} else if !ok {
+			continue
+		}
+		if first {
+			sl.start, first = e.Time, false
+		}
+		if e.Time > sl.end {
+			sl.end = e.Time
+		}
+		switch e.Type {
+		case event.EventQuery, event.EventStmtExecute, event.EventStmtFetch:
+			sl.statements += 1
+			sl.buckets[(e.Time-sl.start)/loadBucket] += 1
+		case event.EventStmtPrepare:
+			bytes += len(e.Query) - stmts[e.StmtID]
+			stmts[e.StmtID] = len(e.Query)
+			if bytes > sl.stmtBytes {
+				sl.stmtBytes = bytes
+			}
+		case event.EventStmtClose:
+			bytes -= stmts[e.StmtID]
+			delete(stmts, e.StmtID)
+		}
+	}
+	if sl.end < sl.start {
+		sl.end = sl.start
+	}
+	return sl, errors.Trace(in.Err())
+}
+
+// replayEstimate is the expected load of replaying a dump, times are in ms.
+type replayEstimate struct {
+	Sessions   int     `json:"sessions"`
+	Statements int64   `json:"statements"`
+	Speed      float64 `json:"speed"`
+	MaxConns   int     `json:"maxConns"`
+	Span       int64   `json:"span"`
+	Duration   int64   `json:"duration"`
+	PeakConns  int     `json:"peakConns"`
+	PeakQPS    int64   `json:"peakQPS"`
+	AvgQPS     float64 `json:"avgQPS"`
+	Delayed    int     `json:"delayed"`
+	MaxDelay   int64   `json:"maxDelay"`
+	Memory     int64   `json:"memory"`
+}
+
+// finishTimes is a min-heap of the finish times of active sessions.
+type finishTimes []float64
+
+func (h finishTimes) Len() int { return len(h) }
+
+func (h finishTimes) Less(i, j int) bool { return h[i] < h[j] }
+
+func (h finishTimes) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *finishTimes) Push(x interface{}) { *h = append(*h, x.(float64)) }
+
+func (h *finishTimes) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// estimateReplay simulates the replay of sessions at the speed, sessions over
+// maxConns (if positive) wait for a free connection and are shifted by the
+// delay as a whole. The memory is estimated by the largest sessions that may
+// run at the same time.
+func estimateReplay(loads []*sessionLoad, speed float64, maxConns int, connMemory int64) replayEstimate {
+	est := replayEstimate{Sessions: len(loads), Speed: speed, MaxConns: maxConns}
+	if len(loads) == 0 {
+		return est
+	}
+	sort.Slice(loads, func(i, j int) bool { return loads[i].start < loads[j].start })
+	var (
+		orig   = loads[0].start
+		active = make(finishTimes, 0, len(loads))
+		end    = float64(0)
+		qps    = make(map[int64]int64)
+	)
+	for _, sl := range loads {
+		est.Statements += sl.statements
+		if sl.end-orig > est.Span {
+			est.Span = sl.end - orig
+		}
+		begin := float64(sl.start-orig) / speed
+		for active.Len() > 0 && active[0] <= begin {
+			heap.Pop(&active)
+		}
+		if maxConns > 0 && active.Len() >= maxConns {
+			if t := heap.Pop(&active).(float64); t > begin {
+				est.Delayed += 1
+				if delay := int64(t - begin); delay > est.MaxDelay {
+					est.MaxDelay = delay
+				}
+				begin = t
+			}
+		}
+		finish := begin + float64(sl.end-sl.start)/speed
+		heap.Push(&active, finish)
+		if active.Len() > est.PeakConns {
+			est.PeakConns = active.Len()
+		}
+		if finish > end {
+			end = finish
+		}
+		for b, n := range sl.buckets {
+			qps[int64(begin+float64(b*loadBucket)/speed)/1000] += n
+		}
+	}
+	est.Duration = int64(end)
+	for _, n := range qps {
+		if n > est.PeakQPS {
+			est.PeakQPS = n
+		}
+	}
+	if est.Duration > 0 {
+		est.AvgQPS = float64(est.Statements) * 1000 / float64(est.Duration)
+	} else {
+		est.AvgQPS = float64(est.Statements)
+	}
+
+	mem := make([]int64, len(loads))
+	for i, sl := range loads {
+		mem[i] = connMemory + int64(sl.maxLine+sl.stmtBytes)
+	}
+	sort.Slice(mem, func(i, j int) bool { return mem[i] > mem[j] })
+	for _, m := range mem[:est.PeakConns] {
+		est.Memory += m
+	}
+	return est
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func (est replayEstimate) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	ms := func(n int64) time.Duration { return time.Duration(n) * time.Millisecond }
+	fmt.Fprintf(tw, "sessions\t%d\n", est.Sessions)
+	fmt.Fprintf(tw, "statements\t%d\n", est.Statements)
+	fmt.Fprintf(tw, "captured span\t%s\n", ms(est.Span))
+	fmt.Fprintf(tw, "speed\t%g\n", est.Speed)
+	if est.MaxConns > 0 {
+		fmt.Fprintf(tw, "max conns\t%d\n", est.MaxConns)
+		fmt.Fprintf(tw, "delayed sessions\t%d (max %s)\n", est.Delayed, ms(est.MaxDelay))
+	}
+	fmt.Fprintf(tw, "duration\t%s\n", ms(est.Duration))
+	fmt.Fprintf(tw, "peak conns\t%d\n", est.PeakConns)
+	fmt.Fprintf(tw, "peak qps\t%d\n", est.PeakQPS)
+	fmt.Fprintf(tw, "avg qps\t%.1f\n", est.AvgQPS)
+	fmt.Fprintf(tw, "memory\t%s\n", formatBytes(est.Memory))
+}
+
+func NewTextEstimateCommand() *cobra.Command {
+	var (
+		speed       float64
+		maxConns    int
+		connMemory  int64
+		maxLineSize int
+		asJSON      bool
+	)
+	cmd := &cobra.Command{
+		Use:   "estimate <dir>",
+		Short: "Estimate the duration and resource needs of replaying a dump",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if speed <= 0 {
+				return errors.New("speed must be positive")
+			}
+			ctl, err := newPlayControl(playConfig{DryRun: true}, args[0], "")
+			if err != nil {
+				return err
+			}
+			var (
+				ctx   = context.Background()
+				jobs  = make(chan *playWorker)
+				loads = make([]*sessionLoad, 0, len(ctl.workers))
+				lock  sync.Mutex
+				wg    sync.WaitGroup
+			)
+			for i := 0; i < runtime.NumCPU(); i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for w := range jobs {
+						f, err := w.openSource(ctx)
+						if err != nil {
+							w.log.Error("failed to open source file of the stream", zap.Error(err))
+							continue
+						}
+						sl, err := loadSession(f, w.id, maxLineSize)
+						f.Close()
+						if err != nil {
+							w.log.Warn("failed to read events", zap.Error(err))
+						}
+						lock.Lock()
+						loads = append(loads, sl)
+						lock.Unlock()
+					}
+				}()
+			}
+			for _, w := range ctl.workers {
+				jobs <- w
+			}
+			close(jobs)
+			wg.Wait()
+
+			est := estimateReplay(loads, speed, maxConns, connMemory)
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				return errors.Trace(enc.Encode(est))
+			}
+			est.Print(os.Stdout)
+			return nil
+		},
+	}
+	cmd.Flags().Float64Var(&speed, "speed", 1, "replay speed ratio")
+	cmd.Flags().IntVar(&maxConns, "max-conns", 0, "max number of concurrent connections (0 means unlimited)")
+	cmd.Flags().Int64Var(&connMemory, "conn-memory", 262144, "estimated memory (in bytes) used by a connection besides its buffers")
+	cmd.Flags().IntVar(&maxLineSize, "max-line-size", 16777216, "max line size")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the estimate as json")
+	return cmd
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+	"go.uber.org/zap"
+)
+
+// failureRepros writes a self-contained sql script for each statement failed
+// on the target into dir, which restores the state of its session (schema,
+// charset, session init and session variables) and runs the statement again.
+// At most limit scripts are written.
+type failureRepros struct {
+	dir   string
+	limit int64
+	count int64
+}
+
+func newFailureRepros(dir string, limit int64) *failureRepros {
+	return &failureRepros{dir: dir, limit: limit}
+}
+
+// reproState tracks the state of a session needed to reproduce its statements.
+type reproState struct {
+	db      string
+	charset uint64
+	sets    []string
+	stmts   map[uint64]string
+	seq     int
+}
+
+// Observe updates the state by an event applied.
+func (rs *reproState) Observe(e *event.MySQLEvent) {
+	switch e.Type {
+	case event.EventHandshake:
+		rs.db, rs.charset, rs.sets, rs.stmts = e.DB, e.Charset, nil, nil
+	case event.EventInitDB:
+		rs.db = e.DB
+	case event.EventQuery:
+		if db, ok := replay.ParseUseQuery(e.Query); ok {
+			rs.db = db
+		} else if replay.IsSessionSet(e.Query) {
+			rs.sets = append(rs.sets, e.Query)
+		}
+	case event.EventStmtPrepare:
+		if rs.stmts == nil {
+			rs.stmts = make(map[uint64]string)
+		}
+		rs.stmts[e.StmtID] = e.Query
+	case event.EventStmtClose:
+		delete(rs.stmts, e.StmtID)
+	}
+}
+
+// Write writes the repro script of the failed event of the worker.
+func (fr *failureRepros) Write(pw *playWorker, e *event.MySQLEvent, cause error) {
+	if atomic.AddInt64(&fr.count, 1) > fr.limit && fr.limit > 0 {
+		return
+	}
+	rs := &pw.repro
+	rs.seq += 1
+	name := fmt.Sprintf("%016x-%d", pw.id, rs.seq)
+	sw, err := newSQLScriptWriter(fr.dir, name, sqlStylePrepare)
+	if err != nil {
+		pw.log.Warn("failed to create repro script", zap.Error(err))
+		return
+	}
+	fmt.Fprintf(sw.w, "-- %s of session %016x failed with: %s\n", e.String(), pw.id, oneLine(cause.Error()))
+	events := []event.MySQLEvent{{Type: event.EventHandshake, DB: rs.db, Charset: rs.charset}}
+	for _, query := range pw.SessionInit {
+		events = append(events, event.MySQLEvent{Type: event.EventQuery, Query: query})
+	}
+	for _, query := range rs.sets {
+		events = append(events, event.MySQLEvent{Type: event.EventQuery, Query: query})
+	}
+	if e.Type == event.EventStmtExecute || e.Type == event.EventStmtFetch {
+		if query, ok := rs.stmts[e.StmtID]; ok {
+			events = append(events, event.MySQLEvent{Type: event.EventStmtPrepare, StmtID: e.StmtID, Query: query})
+		}
+	}
+	events = append(events, *e)
+	for i := range events {
+		if err = sw.Write(&events[i]); err != nil {
+			break
+		}
+	}
+	if cerr := sw.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		pw.log.Warn("failed to write repro script", zap.String("name", name), zap.Error(err))
+	}
+}
+
+func oneLine(s string) string {
+	buf := []byte(s)
+	for i, c := range buf {
+		if c == '\n' || c == '\r' {
+			buf[i] = ' '
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,407 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+	"go.uber.org/zap"
+)
+
+// eventFilter selects sessions and statements of a dump.
+type eventFilter struct {
+	since       string
+	until       string
+	dbs         []string
+	users       []string
+	clients     []string
+	stmtTypes   []string
+	digestAllow []string
+	digestDeny  []string
+	sample      float64
+
+	start   int64
+	end     int64
+	dbSet   map[string]bool
+	userSet map[string]bool
+	typeSet map[string]bool
+	nets    []*net.IPNet
+	allow   map[string]bool
+	deny    map[string]bool
+}
+
+func (f *eventFilter) Register(flags *pflag.FlagSet) {
+	flags.StringVar(&f.since, "since", "", "drop statements before the time (rfc3339 or unix ms)")
+	flags.StringVar(&f.until, "until", "", "drop events after the time (rfc3339 or unix ms)")
+	flags.StringSliceVar(&f.dbs, "db", nil, "keep statements running on the databases only")
+	flags.StringSliceVar(&f.users, "user", nil, "keep sessions of the users only (requires dumps of format v2)")
+	flags.StringSliceVar(&f.clients, "client-ip", nil, "keep sessions from the client ips or cidrs only (requires dumps of format v2)")
+	flags.StringSliceVar(&f.stmtTypes, "stmt-type", nil, "keep statements of the types only (e.g. select,insert)")
+	flags.StringSliceVar(&f.digestAllow, "digest-allow", nil, "keep statements of the digests only (or @file with a digest per line)")
+	flags.StringSliceVar(&f.digestDeny, "digest-deny", nil, "drop statements of the digests (or @file with a digest per line)")
+	flags.Float64Var(&f.sample, "sample", 1, "ratio of sessions to keep")
+}
+
+// Init parses the flags, it must be called before filtering.
+func (f *eventFilter) Init() error {
+	var err error
+	if f.start, err = parseTimeMillis(f.since); err != nil {
+		return errors.Annotate(err, "parse since")
+	}
+	if f.end, err = parseTimeMillis(f.until); err != nil {
+		return errors.Annotate(err, "parse until")
+	}
+	if f.sample < 0 || f.sample > 1 {
+		return errors.New("sample ratio must be in [0, 1]")
+	}
+	f.dbSet, f.userSet, f.typeSet = stringSet(f.dbs, false), stringSet(f.users, false), stringSet(f.stmtTypes, true)
+	if f.nets, err = parseNets(f.clients); err != nil {
+		return err
+	}
+	if f.allow, err = digestSet(f.digestAllow); err != nil {
+		return err
+	}
+	if f.deny, err = digestSet(f.digestDeny); err != nil {
+		return err
+	}
+	return nil
+}
+
+func parseTimeMillis(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return ms, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+	return t.UnixNano() / int64(time.Millisecond), nil
+}
+
+func stringSet(items []string, lower bool) map[string]bool {
+	if len(items) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		if lower {
+			item = strings.ToLower(item)
+		}
+		set[item] = true
+	}
+	return set
+}
+
+func digestSet(items []string) (map[string]bool, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+	set := make(map[string]bool, len(items))
+	for _, item := range items {
+		if !strings.HasPrefix(item, "@") {
+			set[item] = true
+			continue
+		}
+		f, err := os.Open(item[1:])
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		in := bufio.NewScanner(f)
+		for in.Scan() {
+			if line := strings.TrimSpace(in.Text()); len(line) > 0 && !strings.HasPrefix(line, "#") {
+				set[line] = true
+			}
+		}
+		f.Close()
+		if err = in.Err(); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return set, nil
+}
+
+// parseNets parses ips or cidrs into networks, an ip is a network of itself.
+func parseNets(items []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(items))
+	for _, item := range items {
+		if _, ipnet, err := net.ParseCIDR(item); err == nil {
+			nets = append(nets, ipnet)
+			continue
+		}
+		ip := net.ParseIP(item)
+		if ip == nil {
+			return nil, errors.New("invalid client ip: " + item)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	if len(nets) == 0 {
+		return nil, nil
+	}
+	return nets, nil
+}
+
+// acceptClient tells whether the session from the client address (host:port)
+// is kept.
+func (f *eventFilter) acceptClient(addr string) bool {
+	if f.nets == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	for _, ipnet := range f.nets {
+		if ip != nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// setKeys returns keys of the set in order.
+func setKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// AcceptSession tells whether the session is sampled, which is decided by its
+// id so that the result is stable across runs.
+func (f *eventFilter) AcceptSession(id uint64) bool {
+	if f.sample >= 1 {
+		return true
+	}
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], id)
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return float64(h.Sum64()%1000000) < f.sample*1000000
+}
+
+func (f *eventFilter) acceptStatement(query string) bool {
+	if f.typeSet == nil && f.allow == nil && f.deny == nil {
+		return true
+	}
+	normalized := event.Normalize(query)
+	if f.typeSet != nil && !f.typeSet[event.Keyword(normalized)] {
+		return false
+	}
+	if f.allow == nil && f.deny == nil {
+		return true
+	}
+	digest := event.DigestNormalized(normalized)
+	return (f.allow == nil || f.allow[digest]) && !f.deny[digest]
+}
+
+// sessionFilter applies an event filter to events of a session, events which
+// change the state of the session are kept as long as the session is kept.
+type sessionFilter struct {
+	*eventFilter
+
+	db       string
+	headed   bool
+	rejected bool
+	stmts    map[uint64]string
+}
+
+func (f *eventFilter) Session() *sessionFilter {
+	return &sessionFilter{eventFilter: f, stmts: make(map[uint64]string)}
+}
+
+// AcceptHeader rejects the session if it's not from the selected clients.
+func (sf *sessionFilter) AcceptHeader(h event.Header) {
+	sf.headed = true
+	if !sf.acceptClient(h.Source) {
+		sf.rejected = true
+	}
+}
+
+// Accept tells whether to keep the event and whether it is a statement (other
+// events only change the state of the session), the time of state changes
+// earlier than the start of the range are moved to the start.
+func (sf *sessionFilter) Accept(e *event.MySQLEvent) (bool, bool) {
+	if sf.nets != nil && !sf.headed {
+		// clients of sessions without headers are unknown
+		sf.rejected = true
+	}
+	if sf.rejected || (sf.end > 0 && e.Time > sf.end) {
+		return false, false
+	}
+	var query string
+	switch e.Type {
+	case event.EventHandshake:
+		sf.db = e.DB
+		if sf.userSet != nil && !sf.userSet[e.User] {
+			sf.rejected = true
+			return false, false
+		}
+	case event.EventInitDB:
+		sf.db = e.DB
+	case event.EventStmtPrepare:
+		sf.stmts[e.StmtID] = e.Query
+	case event.EventStmtClose:
+		delete(sf.stmts, e.StmtID)
+	case event.EventQuery:
+		query = e.Query
+		if db, ok := replay.ParseUseQuery(query); ok {
+			sf.db = db
+			query = ""
+		} else if replay.IsSessionSet(query) {
+			query = ""
+		}
+	case event.EventStmtExecute, event.EventStmtFetch:
+		query = sf.stmts[e.StmtID]
+	}
+	if len(query) == 0 {
+		if e.Time < sf.start {
+			e.Time = sf.start
+		}
+		return true, false
+	}
+	if e.Time < sf.start || (sf.dbSet != nil && !sf.dbSet[sf.db]) {
+		return false, true
+	}
+	return sf.acceptStatement(query), true
+}
+
+// filterSession copies events of a session accepted by sf to h, it returns the
+// number of statements kept.
+func filterSession(r io.Reader, maxLineSize int, sf *sessionFilter, h *textDumpHandler) (int, error) {
+	var (
+		e     = event.MySQLEvent{Params: []interface{}{}}
+		dec   = event.NewDecoder(maxLineSize)
+		in    = bufio.NewScanner(r)
+		kept  = 0
+		state []event.MySQLEvent
+	)
+	if maxLineSize > 0 {
+		in.Buffer(make([]byte, 0, 4096), maxLineSize)
+	}
+	for in.Scan() {
+		ok, err := dec.Decode(in.Text(), e.Reset(e.Params[:0]))
+		if err != nil {
+			return kept, err
+		} else if !ok {
+			h.header.Host, h.header.Source, h.header.Server = dec.Header.Host, dec.Header.Source, dec.Header.Server
+			sf.AcceptHeader(dec.Header)
+			continue
+		}
+		keep, statement := sf.Accept(&e)
+		if !keep {
+			continue
+		} else if statement {
+			kept += 1
+		}
+		if kept == 0 {
+			// hold state changes until a statement is kept, so that sessions
+			// without statements are dropped
+			params := append([]interface{}(nil), e.Params...)
+			state = append(state, e)
+			state[len(state)-1].Params = params
+			continue
+		}
+		for _, s := range state {
+			h.OnEvent(s)
+		}
+		state = nil
+		h.OnEvent(e)
+	}
+	return kept, errors.Trace(in.Err())
+}
+
+// rewriteDump writes sessions accepted by accept into a new dump directory via
+// rewrite, which returns the number of statements kept (sessions without
+// statements are dropped).
+func rewriteDump(ctl *playControl, output string, accept func(w *playWorker) bool, rewrite func(r io.Reader, h *textDumpHandler) (int, error)) (int, int, error) {
+	if err := os.MkdirAll(output, 0755); err != nil {
+		return 0, 0, errors.Trace(err)
+	}
+	ctx := context.Background()
+	sessions, statements := 0, 0
+	for _, w := range ctl.workers {
+		if !accept(w) {
+			continue
+		}
+		r, err := w.openSource(ctx)
+		if err != nil {
+			return sessions, statements, errors.Annotate(err, "open "+w.src)
+		}
+		name := fmt.Sprintf("%016x", w.id)
+		out, err := os.CreateTemp(output, "."+name+".*")
+		if err != nil {
+			r.Close()
+			return sessions, statements, errors.Trace(err)
+		}
+		h := newTextDumpHandler(name, out, w.log, nil)
+		n, err := rewrite(r, h)
+		r.Close()
+		h.OnClose()
+		if err != nil {
+			return sessions, statements, errors.Annotate(err, "rewrite "+w.src)
+		}
+		if n > 0 {
+			sessions += 1
+			statements += n
+		}
+	}
+	return sessions, statements, nil
+}
+
+func NewTextFilterCommand() *cobra.Command {
+	var (
+		filter      eventFilter
+		maxLineSize int
+	)
+	cmd := &cobra.Command{
+		Use:   "filter <input> <output>",
+		Short: "Write a new dump with sessions and statements selected by filters",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := filter.Init(); err != nil {
+				return err
+			}
+			ctl, err := newPlayControl(playConfig{DryRun: true}, args[0], "")
+			if err != nil {
+				return err
+			}
+			sessions, statements, err := rewriteDump(ctl, args[1], func(w *playWorker) bool {
+				return filter.AcceptSession(w.id) && (filter.end <= 0 || w.ts <= filter.end) && (w.end <= 0 || w.end >= filter.start)
+			}, func(r io.Reader, h *textDumpHandler) (int, error) {
+				return filterSession(r, maxLineSize, filter.Session(), h)
+			})
+			if err != nil {
+				return err
+			}
+			zap.L().Info("filter done", zap.Int("input", len(ctl.workers)), zap.Int("sessions", sessions), zap.Int("statements", statements))
+			return nil
+		},
+	}
+	filter.Register(cmd.Flags())
+	cmd.Flags().IntVar(&maxLineSize, "max-line-size", 16777216, "max line size")
+	return cmd
+}
@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"container/heap"
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/zyguan/mysql-replay/event"
+	"go.uber.org/zap"
+)
+
+const (
+	orderSession = "session"
+	orderGlobal  = "global"
+)
+
+// globalStream is a session being merged into the global stream.
+type globalStream struct {
+	idx    int
+	worker *playWorker
+	r      io.ReadCloser
+	in     *event.LineScanner
+	dec    *event.Decoder
+	script *sqlScriptWriter
+	event  event.MySQLEvent
+	slow   bool
+}
+
+func (s *globalStream) next() bool {
+	for s.in.Scan() {
+		ok, err := s.dec.Decode(s.in.Text(), s.event.Reset(s.event.Params[:0]))
+		if err != nil {
+			s.worker.log.Error("failed to scan event", zap.Error(err))
+			return false
+		} else if !ok && s.worker.Statements != nil {
+			s.worker.sessionFilter().AcceptHeader(s.dec.Header)
+		} else if ok && s.worker.accept(&s.event) {
+			return true
+		}
+	}
+	if err := s.in.Err(); err != nil {
+		s.worker.log.Error("failed to read event", zap.Error(err))
+	}
+	return false
+}
+
+func (s *globalStream) close() {
+	s.r.Close()
+	s.worker.close()
+	s.worker.Stats.SetLagging(s.worker.id, 0)
+	s.worker.progress.Finish()
+	if s.script != nil {
+		if err := s.script.Close(); err != nil {
+			s.worker.log.Error("failed to close sql script", zap.Error(err))
+		}
+	}
+}
+
+// globalStreams is a min-heap of streams ordered by their next events.
+type globalStreams []*globalStream
+
+func (h globalStreams) Len() int { return len(h) }
+
+func (h globalStreams) Less(i, j int) bool {
+	if h[i].event.Time != h[j].event.Time {
+		return h[i].event.Time < h[j].event.Time
+	}
+	return h[i].idx < h[j].idx
+}
+
+func (h globalStreams) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *globalStreams) Push(x interface{}) { *h = append(*h, x.(*globalStream)) }
+
+func (h *globalStreams) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// openStream opens the stream of the i-th worker and reads its first event,
+// it returns nil if the session is finished already.
+func (pc *playControl) openStream(ctx context.Context, i int) *globalStream {
+	worker := pc.workers[i]
+	worker.playConfig = pc.playConfig
+	worker.exec = pc.exec
+	f, err := worker.openSource(ctx)
+	if err != nil {
+		worker.log.Error("failed to open source file of the stream", zap.Error(err))
+		atomic.AddInt64(&pc.finished, 1)
+		return nil
+	}
+	worker.track()
+	s := &globalStream{idx: i, worker: worker, r: f, in: event.NewLineScanner(f, worker.MaxLineSize), dec: event.NewDecoder(worker.MaxLineSize)}
+	s.event.Params = []interface{}{}
+	if worker.DryRun && len(worker.SQLOut) > 0 {
+		if s.script, err = newSQLScriptWriter(worker.SQLOut, worker.src, worker.SQLStyle); err != nil {
+			worker.log.Error("failed to create sql script", zap.Error(err))
+			f.Close()
+			atomic.AddInt64(&pc.finished, 1)
+			return nil
+		}
+	}
+	if !s.next() {
+		s.close()
+		atomic.AddInt64(&pc.finished, 1)
+		return nil
+	}
+	return s
+}
+
+// PlayGlobal merges events of all sessions into a single stream ordered by
+// their capture time and applies them one by one on connections of their own
+// sessions, so that the order across sessions is kept (at the cost of
+// concurrency). Since workers are sorted by the start of their sessions, a
+// session is only opened once its start is reached by the stream, thus files
+// opened are bounded by sessions overlapping rather than all of them.
+func (pc *playControl) PlayGlobal(ctx context.Context) {
+	pc.warmup(ctx)
+	pc.PlayStartTime = time.Now().UnixNano() / int64(time.Millisecond)
+	if len(pc.workers) > 0 {
+		pc.OrigStartTime = pc.workers[0].ts
+	}
+	var (
+		h    globalStreams
+		next int
+	)
+	defer func() {
+		for _, s := range h {
+			s.close()
+		}
+	}()
+	for {
+		for next < len(pc.workers) && (h.Len() == 0 || pc.workers[next].ts <= h[0].event.Time) {
+			if s := pc.openStream(ctx, next); s != nil {
+				heap.Push(&h, s)
+			}
+			next += 1
+		}
+		if h.Len() == 0 {
+			return
+		}
+		s := h[0]
+		if !s.worker.pace(ctx, s.event.Time, &s.slow) {
+			pc.log.Debug("exit due to context done")
+			return
+		}
+		s.worker.apply(s.worker.execContext(ctx), &s.event, s.script)
+		if !s.worker.gapped && s.next() {
+			heap.Fix(&h, 0)
+			continue
+		}
+		heap.Pop(&h)
+		s.close()
+		atomic.AddInt64(&pc.finished, 1)
+	}
+}
@@ -0,0 +1,562 @@
+package cmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The agent grpc service is defined by hand and uses json as its codec, so
+// that messages simply reuse the structs of the http api:
+//
+//	service Agent {
+//	  rpc SubmitTask(stream TaskChunk) returns (Ack);
+//	  rpc StreamStatus(StatusRequest) returns (stream playJobStatus);
+//	  rpc Cancel(CancelRequest) returns (Ack);
+//	  rpc Prepare(PrepareRequest) returns (playJobClock);
+//	  rpc Control(ControlRequest) returns (Ack);
+//	  rpc Capacity(CapacityRequest) returns (agentCapacity);
+//	}
+const (
+	grpcCodecName   = "json"
+	grpcServiceName = "mysqlreplay.Agent"
+)
+
+func init() {
+	encoding.RegisterCodec(grpcJSONCodec{})
+	registerCapability(capExecutor, "grpc-agent")
+}
+
+type grpcJSONCodec struct{}
+
+func (grpcJSONCodec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (grpcJSONCodec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (grpcJSONCodec) Name() string                               { return grpcCodecName }
+
+// grpcTaskChunk carries the meta of a task in the first chunk and the content
+// of the session file (if not fetched from a shared storage) in the following
+// ones.
+type grpcTaskChunk struct {
+	Job  string        `json:"job,omitempty"`
+	Meta *playTaskMeta `json:"meta,omitempty"`
+	Data []byte        `json:"data,omitempty"`
+}
+
+type grpcStatusRequest struct {
+	Job      string `json:"job"`
+	Interval int64  `json:"interval"`
+	Detail   bool   `json:"detail"`
+}
+
+type grpcCancelRequest struct {
+	Job string `json:"job"`
+}
+
+type grpcPrepareRequest struct {
+	Job   string       `json:"job"`
+	Clock playJobClock `json:"clock"`
+}
+
+type grpcControlRequest struct {
+	Job     string         `json:"job"`
+	Control playJobControl `json:"control"`
+}
+
+type grpcCapacityRequest struct{}
+
+type grpcAck struct{}
+
+type agentGRPCServer interface {
+	SubmitTask(stream grpc.ServerStream) error
+	StreamStatus(req *grpcStatusRequest, stream grpc.ServerStream) error
+	Cancel(ctx context.Context, req *grpcCancelRequest) (*grpcAck, error)
+	Prepare(ctx context.Context, req *grpcPrepareRequest) (*playJobClock, error)
+	Control(ctx context.Context, req *grpcControlRequest) (*grpcAck, error)
+	Capacity(ctx context.Context, req *grpcCapacityRequest) (*agentCapacity, error)
+}
+
+var agentServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*agentGRPCServer)(nil),
+	Methods: []grpc.MethodDesc{{
+		MethodName: "Cancel",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(grpcCancelRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			call := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(agentGRPCServer).Cancel(ctx, req.(*grpcCancelRequest))
+			}
+			if interceptor == nil {
+				return call(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/Cancel"}, call)
+		},
+	}, {
+		MethodName: "Prepare",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(grpcPrepareRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			call := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(agentGRPCServer).Prepare(ctx, req.(*grpcPrepareRequest))
+			}
+			if interceptor == nil {
+				return call(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/Prepare"}, call)
+		},
+	}, {
+		MethodName: "Control",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(grpcControlRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			call := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(agentGRPCServer).Control(ctx, req.(*grpcControlRequest))
+			}
+			if interceptor == nil {
+				return call(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/Control"}, call)
+		},
+	}, {
+		MethodName: "Capacity",
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(grpcCapacityRequest)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			call := func(ctx context.Context, req interface{}) (interface{}, error) {
+				return srv.(agentGRPCServer).Capacity(ctx, req.(*grpcCapacityRequest))
+			}
+			if interceptor == nil {
+				return call(ctx, req)
+			}
+			return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcServiceName + "/Capacity"}, call)
+		},
+	}},
+	Streams: []grpc.StreamDesc{{
+		StreamName:    "SubmitTask",
+		ClientStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(agentGRPCServer).SubmitTask(stream)
+		},
+	}, {
+		StreamName:    "StreamStatus",
+		ServerStreams: true,
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			req := new(grpcStatusRequest)
+			if err := stream.RecvMsg(req); err != nil {
+				return err
+			}
+			return srv.(agentGRPCServer).StreamStatus(req, stream)
+		},
+	}},
+}
+
+type grpcAgent struct {
+	store *playTaskStore
+}
+
+func (a *grpcAgent) SubmitTask(stream grpc.ServerStream) error {
+	var head grpcTaskChunk
+	if err := stream.RecvMsg(&head); err != nil {
+		return err
+	}
+	if head.Meta == nil || len(head.Job) == 0 {
+		return status.Error(codes.InvalidArgument, "job and meta are required in the first chunk")
+	}
+	task, err := newPlayTask(*head.Meta, a.store.dataDir)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	if task.worker.store == nil {
+		f, err := os.CreateTemp("", "mysql-replay-task-*.tsv")
+		if err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		task.data = f.Name()
+		err = writeTaskChunks(f, head.Data, stream)
+		f.Close()
+		if err != nil {
+			os.Remove(task.data)
+			return err
+		}
+	}
+	if err = a.store.submit("/"+head.Job, task); err != nil {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return stream.SendMsg(&grpcAck{})
+}
+
+func writeTaskChunks(w io.Writer, data []byte, stream grpc.ServerStream) error {
+	for {
+		if _, err := w.Write(data); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+		var chunk grpcTaskChunk
+		if err := stream.RecvMsg(&chunk); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		data = chunk.Data
+	}
+}
+
+func (a *grpcAgent) StreamStatus(req *grpcStatusRequest, stream grpc.ServerStream) error {
+	interval := time.Duration(req.Interval) * time.Millisecond
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	since := int64(0)
+	for {
+		s := a.store.jobStatus("/"+req.Job, req.Detail, since)
+		if n := len(s.Failures); n > 0 {
+			since = s.Failures[n-1].Seq
+		}
+		if err := stream.SendMsg(&s); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (a *grpcAgent) Prepare(ctx context.Context, req *grpcPrepareRequest) (*playJobClock, error) {
+	clock := a.store.prepare("/"+req.Job, req.Clock)
+	return &clock, nil
+}
+
+func (a *grpcAgent) Control(ctx context.Context, req *grpcControlRequest) (*grpcAck, error) {
+	if !a.store.control("/"+req.Job, req.Control) {
+		return nil, status.Error(codes.NotFound, "no such job")
+	}
+	return &grpcAck{}, nil
+}
+
+func (a *grpcAgent) Capacity(ctx context.Context, req *grpcCapacityRequest) (*agentCapacity, error) {
+	return a.store.capacity(), nil
+}
+
+func (a *grpcAgent) Cancel(ctx context.Context, req *grpcCancelRequest) (*grpcAck, error) {
+	if !a.store.cancel("/" + req.Job) {
+		return nil, status.Error(codes.NotFound, "no such job")
+	}
+	return &grpcAck{}, nil
+}
+
+func grpcAuthorized(ctx context.Context, token string) error {
+	if len(token) == 0 {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(v, "Bearer ")), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "invalid auth token")
+}
+
+func serveAgentGRPC(addr string, store *playTaskStore, security agentSecurity) error {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := grpcAuthorized(ctx, security.Token); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := grpcAuthorized(ss.Context(), security.Token); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+	tlsConfig, err := security.ServerTLSConfig()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	srv := grpc.NewServer(opts...)
+	srv.RegisterService(&agentServiceDesc, &grpcAgent{store: store})
+	zap.L().Info("serve agent grpc api", zap.String("address", addr))
+	return srv.Serve(lis)
+}
+
+// grpcTransport talks to agents via grpc, job status is pushed by agents
+// through StreamStatus instead of being polled, see Updates.
+type grpcTransport struct {
+	security agentSecurity
+	interval time.Duration
+	updates  chan string
+
+	lock    sync.Mutex
+	conns   map[string]*grpc.ClientConn
+	watches map[string]*grpcStatusWatch
+}
+
+type grpcStatusWatch struct {
+	lock     sync.Mutex
+	status   *playJobStatus
+	failures []agentFailure
+	err      error
+	cancel   context.CancelFunc
+}
+
+func newGRPCTransport(security agentSecurity, interval time.Duration) *grpcTransport {
+	return &grpcTransport{
+		security: security,
+		interval: interval,
+		updates:  make(chan string, 64),
+		conns:    make(map[string]*grpc.ClientConn),
+		watches:  make(map[string]*grpcStatusWatch),
+	}
+}
+
+func (t *grpcTransport) conn(agent string) (*grpc.ClientConn, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if cc, ok := t.conns[agent]; ok {
+		return cc, nil
+	}
+	opts := []grpc.DialOption{grpc.WithDefaultCallOptions(grpc.CallContentSubtype(grpcCodecName))}
+	tlsConfig, err := t.security.ClientTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	cc, err := grpc.Dial(agent, opts...)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	t.conns[agent] = cc
+	return cc, nil
+}
+
+func (t *grpcTransport) context(ctx context.Context) context.Context {
+	if len(t.security.Token) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+t.security.Token)
+}
+
+func (t *grpcTransport) Capacity(agent string) (*agentCapacity, error) {
+	cc, err := t.conn(agent)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(t.context(context.Background()), 10*time.Second)
+	defer cancel()
+	c := new(agentCapacity)
+	if err = cc.Invoke(ctx, "/"+grpcServiceName+"/Capacity", &grpcCapacityRequest{}, c); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return c, nil
+}
+
+// Updates implements statusPusher.
+func (t *grpcTransport) Updates() <-chan string { return t.updates }
+
+// notify tells the controller that status of the agent is pushed, pending
+// notifications are coalesced since Status returns the latest one anyway.
+func (t *grpcTransport) notify(agent string) {
+	select {
+	case t.updates <- agent:
+	default:
+	}
+}
+
+func (t *grpcTransport) Submit(agent string, job string, task *playTask, in io.ReadCloser) error {
+	cc, err := t.conn(agent)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		defer in.Close()
+	}
+	stream, err := cc.NewStream(t.context(context.Background()), &agentServiceDesc.Streams[0], "/"+grpcServiceName+"/SubmitTask")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	meta := task.meta()
+	if err = stream.SendMsg(&grpcTaskChunk{Job: job, Meta: &meta}); err != nil {
+		return errors.Trace(err)
+	}
+	if in != nil {
+		buf := make([]byte, 1<<20)
+		for {
+			n, rerr := in.Read(buf)
+			if n > 0 {
+				if err = stream.SendMsg(&grpcTaskChunk{Data: buf[:n]}); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			if rerr == io.EOF {
+				break
+			} else if rerr != nil {
+				return errors.Trace(rerr)
+			}
+		}
+	}
+	if err = stream.CloseSend(); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(stream.RecvMsg(&grpcAck{}))
+}
+
+// Status returns the latest status pushed by the agent, the watch is restarted
+// if the stream is broken.
+func (t *grpcTransport) Status(agent string, job string) (*playJobStatus, error) {
+	key := agent + "/" + job
+	t.lock.Lock()
+	w, ok := t.watches[key]
+	if !ok {
+		w = &grpcStatusWatch{}
+		t.watches[key] = w
+	}
+	t.lock.Unlock()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.cancel == nil || w.err != nil {
+		lastErr := w.err
+		if err := t.watch(agent, job, w); err != nil {
+			return nil, err
+		}
+		if lastErr != nil {
+			zap.L().Debug("status stream restarted", zap.String("agent", agent), zap.Error(lastErr))
+		}
+	}
+	s := *w.status
+	s.Failures, w.failures = w.failures, nil
+	return &s, nil
+}
+
+func (t *grpcTransport) watch(agent string, job string, w *grpcStatusWatch) error {
+	cc, err := t.conn(agent)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(t.context(context.Background()))
+	stream, err := cc.NewStream(ctx, &agentServiceDesc.Streams[1], "/"+grpcServiceName+"/StreamStatus")
+	if err == nil {
+		err = stream.SendMsg(&grpcStatusRequest{Job: job, Interval: t.interval.Milliseconds(), Detail: true})
+	}
+	if err == nil {
+		err = stream.CloseSend()
+	}
+	first := new(playJobStatus)
+	if err == nil {
+		err = stream.RecvMsg(first)
+	}
+	if err != nil {
+		cancel()
+		return errors.Trace(err)
+	}
+	w.err, w.cancel, w.status = nil, cancel, first
+	w.failures = append(w.failures, first.Failures...)
+	go func() {
+		for {
+			var s playJobStatus
+			err := stream.RecvMsg(&s)
+			w.lock.Lock()
+			if err != nil {
+				w.err = err
+				w.status = nil
+				w.lock.Unlock()
+				cancel()
+				t.notify(agent)
+				return
+			}
+			w.status = &s
+			w.failures = append(w.failures, s.Failures...)
+			w.lock.Unlock()
+			t.notify(agent)
+		}
+	}()
+	return nil
+}
+
+func (t *grpcTransport) Cancel(agent string, job string) error {
+	cc, err := t.conn(agent)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(t.context(context.Background()), 10*time.Second)
+	defer cancel()
+	return errors.Trace(cc.Invoke(ctx, "/"+grpcServiceName+"/Cancel", &grpcCancelRequest{Job: job}, &grpcAck{}))
+}
+
+func (t *grpcTransport) Prepare(agent string, job string, clock playJobClock) (*playJobClock, error) {
+	cc, err := t.conn(agent)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(t.context(context.Background()), 10*time.Second)
+	defer cancel()
+	ack := new(playJobClock)
+	if err = cc.Invoke(ctx, "/"+grpcServiceName+"/Prepare", &grpcPrepareRequest{Job: job, Clock: clock}, ack); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return ack, nil
+}
+
+func (t *grpcTransport) Control(agent string, job string, c playJobControl) error {
+	cc, err := t.conn(agent)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(t.context(context.Background()), 10*time.Second)
+	defer cancel()
+	return errors.Trace(cc.Invoke(ctx, "/"+grpcServiceName+"/Control", &grpcControlRequest{Job: job, Control: c}, &grpcAck{}))
+}
+
+func (t *grpcTransport) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, w := range t.watches {
+		w.lock.Lock()
+		if w.cancel != nil {
+			w.cancel()
+		}
+		w.lock.Unlock()
+	}
+	for _, cc := range t.conns {
+		cc.Close()
+	}
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/event"
+	"go.uber.org/zap"
+)
+
+// sessionDumper writes events of sessions identified by connection ids into
+// per-session tsv files, which is shared by importers of various log formats.
+type sessionDumper struct {
+	dir      string
+	log      *zap.Logger
+	sessions map[uint64]*importSession
+}
+
+type importSession struct {
+	h  *textDumpHandler
+	db string
+}
+
+func newSessionDumper(dir string) (*sessionDumper, error) {
+	if len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	return &sessionDumper{dir: dir, log: zap.L().Named("import"), sessions: make(map[uint64]*importSession)}, nil
+}
+
+func (d *sessionDumper) Connect(conn uint64, t int64, db string) error {
+	if s, ok := d.sessions[conn]; ok {
+		s.h.OnClose()
+		delete(d.sessions, conn)
+	}
+	name := formatSessionID(conn)
+	out, err := os.CreateTemp(d.dir, "."+name+".*")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	s := &importSession{h: newTextDumpHandler(name, out, d.log.With(zap.Uint64("conn", conn)), nil), db: db}
+	d.sessions[conn] = s
+	s.h.OnEvent(event.MySQLEvent{Time: t, Type: event.EventHandshake, DB: db})
+	return nil
+}
+
+func (d *sessionDumper) session(conn uint64, t int64, db string) (*importSession, error) {
+	s, ok := d.sessions[conn]
+	if !ok {
+		if err := d.Connect(conn, t, db); err != nil {
+			return nil, err
+		}
+		return d.sessions[conn], nil
+	}
+	if len(db) > 0 && db != s.db {
+		s.h.OnEvent(event.MySQLEvent{Time: t, Type: event.EventQuery, Query: "use `" + strings.ReplaceAll(db, "`", "``") + "`"})
+		s.db = db
+	}
+	return s, nil
+}
+
+func (d *sessionDumper) Use(conn uint64, t int64, db string) error {
+	_, err := d.session(conn, t, db)
+	return err
+}
+
+func (d *sessionDumper) Query(conn uint64, t int64, db string, query string) error {
+	s, err := d.session(conn, t, db)
+	if err != nil {
+		return err
+	}
+	s.h.OnEvent(event.MySQLEvent{Time: t, Type: event.EventQuery, Query: query})
+	return nil
+}
+
+func (d *sessionDumper) Quit(conn uint64, t int64) {
+	s, ok := d.sessions[conn]
+	if !ok {
+		return
+	}
+	s.h.OnEvent(event.MySQLEvent{Time: t, Type: event.EventQuit})
+	s.h.OnClose()
+	delete(d.sessions, conn)
+}
+
+func (d *sessionDumper) Close() {
+	for conn, s := range d.sessions {
+		s.h.OnClose()
+		delete(d.sessions, conn)
+	}
+}
+
+func formatSessionID(conn uint64) string {
+	s := strconv.FormatUint(conn, 16)
+	if len(s) < 16 {
+		s = strings.Repeat("0", 16-len(s)) + s
+	}
+	return s
+}
+
+type importParser func(in io.Reader, out *sessionDumper) error
+
+func importFiles(files []string, dir string, parse importParser) error {
+	out, err := newSessionDumper(dir)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	for _, name := range files {
+		zap.L().Info("processing " + name)
+		var in io.ReadCloser = os.Stdin
+		if name != "-" {
+			if in, err = os.Open(name); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		err = parse(in, out)
+		in.Close()
+		if err != nil {
+			return errors.Annotate(err, "parse "+name)
+		}
+	}
+	return nil
+}
+
+// newImportCommand builds a command with `dump` and `play` sub-commands for
+// replaying workloads recorded by a log of the given format.
+func newImportCommand(use string, short string, parse importParser) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+	}
+
+	var output string
+	dumpCmd := &cobra.Command{
+		Use:   "dump",
+		Short: "Convert " + use + " files into per-session text files",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return importFiles(args, output, parse)
+		},
+	}
+	dumpCmd.Flags().StringVarP(&output, "output", "o", "", "output directory")
+
+	var (
+		opts    textPlayOptions
+		workDir string
+	)
+	playCmd := &cobra.Command{
+		Use:   "play",
+		Short: "Play " + use + " files",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := workDir
+			if len(dir) == 0 {
+				tmp, err := ioutil.TempDir("", "mysql-replay-"+use+"-")
+				if err != nil {
+					return errors.Trace(err)
+				}
+				defer os.RemoveAll(tmp)
+				dir = tmp
+			}
+			if err := importFiles(args, dir, parse); err != nil {
+				return err
+			}
+			return opts.Run(dir)
+		},
+	}
+	playCmd.Flags().StringVar(&workDir, "work-dir", "", "directory to keep converted text files (a temporary directory is used by default)")
+	opts.Register(playCmd.Flags())
+
+	cmd.AddCommand(dumpCmd)
+	cmd.AddCommand(playCmd)
+	return cmd
+}
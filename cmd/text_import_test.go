@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/mysql-replay/event"
+)
+
+// importCase is a log snippet with events expected of each session.
+type importCase struct {
+	name   string
+	input  string
+	expect map[uint64][]event.MySQLEvent
+}
+
+func testImport(t *testing.T, parse importParser, cases []importCase) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			out, err := newSessionDumper(dir)
+			require.NoError(t, err)
+			require.NoError(t, parse(strings.NewReader(c.input), out))
+			out.Close()
+			require.Equal(t, c.expect, readImported(t, dir))
+		})
+	}
+}
+
+// readImported reads events of session files under dir by connection ids.
+func readImported(t *testing.T, dir string) map[uint64][]event.MySQLEvent {
+	files, err := filepath.Glob(filepath.Join(dir, "*.tsv"))
+	require.NoError(t, err)
+	sessions := make(map[uint64][]event.MySQLEvent)
+	for _, file := range files {
+		fields := strings.Split(filepath.Base(file), ".")
+		require.Len(t, fields, 4, file)
+		conn, err := strconv.ParseUint(fields[2], 16, 64)
+		require.NoError(t, err)
+		data, err := os.ReadFile(file)
+		require.NoError(t, err)
+		dec := event.NewDecoder(0)
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var e event.MySQLEvent
+			ok, err := dec.Decode(line, e.Reset(nil))
+			require.NoError(t, err)
+			if ok {
+				sessions[conn] = append(sessions[conn], e)
+			}
+		}
+	}
+	return sessions
+}
+
+func localMillis(layout string, value string) int64 {
+	t, err := time.ParseInLocation(layout, value, time.Local)
+	if err != nil {
+		panic(err)
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,305 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+	"go.uber.org/zap"
+)
+
+const maxMalformedSamples = 100
+
+type malformedLine struct {
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// dumpSummary is the result of inspecting a dump directory.
+type dumpSummary struct {
+	Sessions     int              `json:"sessions"`
+	Events       int64            `json:"events"`
+	Types        map[string]int64 `json:"types"`
+	Start        int64            `json:"start"`
+	End          int64            `json:"end"`
+	Versions     map[int]int      `json:"versions"`
+	Databases    map[string]int64 `json:"databases"`
+	Users        map[string]int64 `json:"users,omitempty"`
+	Digests      []digestStat     `json:"digests"`
+	Malformed    int64            `json:"malformed"`
+	Samples      []malformedLine  `json:"malformedSamples,omitempty"`
+	Unordered    int64            `json:"unordered"`
+	UnknownStmts int64            `json:"unknownStmts"`
+
+	lock    sync.Mutex
+	digests *digestStats
+}
+
+func newDumpSummary() *dumpSummary {
+	return &dumpSummary{
+		Types:     make(map[string]int64),
+		Versions:  make(map[int]int),
+		Databases: make(map[string]int64),
+		Users:     make(map[string]int64),
+		digests:   newDigestStats(),
+	}
+}
+
+// sessionSummary is collected by a single session and merged into the dump
+// summary when the session is done.
+type sessionSummary struct {
+	version   int
+	events    int64
+	types     map[uint64]int64
+	start     int64
+	end       int64
+	databases map[string]int64
+	users     map[string]int64
+	malformed []malformedLine
+	unordered int64
+	unknown   int64
+}
+
+func (s *dumpSummary) merge(ss *sessionSummary) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.Sessions += 1
+	s.Versions[ss.version] += 1
+	s.Events += ss.events
+	for t, n := range ss.types {
+		s.Types[event.TypeName(t)] += n
+	}
+	if ss.events > 0 {
+		if s.Start == 0 || ss.start < s.Start {
+			s.Start = ss.start
+		}
+		if ss.end > s.End {
+			s.End = ss.end
+		}
+	}
+	for db, n := range ss.databases {
+		s.Databases[db] += n
+	}
+	for user, n := range ss.users {
+		s.Users[user] += n
+	}
+	s.Malformed += int64(len(ss.malformed))
+	for _, l := range ss.malformed {
+		if len(s.Samples) < maxMalformedSamples {
+			s.Samples = append(s.Samples, l)
+		}
+	}
+	s.Unordered += ss.unordered
+	s.UnknownStmts += ss.unknown
+}
+
+func inspectSession(r io.Reader, name string, maxLineSize int, digests *digestStats) (*sessionSummary, error) {
+	ss := &sessionSummary{
+		types:     make(map[uint64]int64),
+		databases: make(map[string]int64),
+		users:     make(map[string]int64),
+	}
+	var (
+		e     = event.MySQLEvent{Params: []interface{}{}}
+		dec   = event.NewDecoder(maxLineSize)
+		in    = bufio.NewScanner(r)
+		stmts = make(map[uint64]string)
+		lines = 0
+	)
+	if maxLineSize > 0 {
+		in.Buffer(make([]byte, 0, 4096), maxLineSize)
+	}
+	for in.Scan() {
+		lines += 1
+		ok, err := dec.Decode(in.Text(), e.Reset(e.Params[:0]))
+		if err != nil {
+			ss.malformed = append(ss.malformed, malformedLine{File: name, Line: lines, Error: err.Error()})
+			continue
+		} else if !ok {
+			continue
+		}
+		if ss.events == 0 {
+			ss.start = e.Time
+		} else if e.Time < ss.end {
+			ss.unordered += 1
+		}
+		if e.Time > ss.end {
+			ss.end = e.Time
+		}
+		ss.events += 1
+		ss.types[e.Type] += 1
+		switch e.Type {
+		case event.EventHandshake:
+			ss.databases[e.DB] += 1
+			if len(e.User) > 0 {
+				ss.users[e.User] += 1
+			}
+		case event.EventInitDB:
+			ss.databases[e.DB] += 1
+		case event.EventQuery:
+			if db, ok := replay.ParseUseQuery(e.Query); ok {
+				ss.databases[db] += 1
+			}
+			digests.Observe("", e.Query, 0, nil)
+		case event.EventStmtPrepare:
+			stmts[e.StmtID] = e.Query
+		case event.EventStmtExecute, event.EventStmtFetch:
+			query, ok := stmts[e.StmtID]
+			if !ok {
+				ss.unknown += 1
+			} else if e.Type == event.EventStmtExecute {
+				digests.Observe("", query, 0, nil)
+			}
+		case event.EventStmtClose:
+			delete(stmts, e.StmtID)
+		}
+	}
+	ss.version = dec.Header.Version
+	return ss, errors.Trace(in.Err())
+}
+
+func (s *dumpSummary) Print(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+	fmt.Fprintf(tw, "sessions\t%d\n", s.Sessions)
+	fmt.Fprintf(tw, "events\t%d\n", s.Events)
+	if s.Events > 0 {
+		start, end := time.Unix(0, s.Start*int64(time.Millisecond)), time.Unix(0, s.End*int64(time.Millisecond))
+		fmt.Fprintf(tw, "time span\t%s - %s (%s)\n", start.Format(time.RFC3339), end.Format(time.RFC3339), end.Sub(start))
+	}
+	fmt.Fprintf(tw, "malformed lines\t%d\n", s.Malformed)
+	fmt.Fprintf(tw, "unordered events\t%d\n", s.Unordered)
+	fmt.Fprintf(tw, "unknown stmts\t%d\n", s.UnknownStmts)
+	versions := make([]int, 0, len(s.Versions))
+	for v := range s.Versions {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	for _, v := range versions {
+		fmt.Fprintf(tw, "format v%d\t%d sessions\n", v, s.Versions[v])
+	}
+	fmt.Fprintln(tw, "\nTYPE\tEVENTS")
+	for _, t := range sortedKeys(s.Types) {
+		fmt.Fprintf(tw, "%s\t%d\n", t, s.Types[t])
+	}
+	fmt.Fprintln(tw, "\nDATABASE\tSWITCHES")
+	for _, db := range sortedKeys(s.Databases) {
+		fmt.Fprintf(tw, "%q\t%d\n", db, s.Databases[db])
+	}
+	if len(s.Users) > 0 {
+		fmt.Fprintln(tw, "\nUSER\tSESSIONS")
+		for _, user := range sortedKeys(s.Users) {
+			fmt.Fprintf(tw, "%q\t%d\n", user, s.Users[user])
+		}
+	}
+	fmt.Fprintln(tw, "\nDIGEST\tCOUNT\tSAMPLE")
+	for _, d := range s.Digests {
+		sample := d.Sample
+		if len(sample) > 120 {
+			sample = sample[:117] + "..."
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%q\n", d.Digest, d.Count, sample)
+	}
+	if len(s.Samples) > 0 {
+		fmt.Fprintln(tw, "\nFILE\tLINE\tERROR")
+		for _, l := range s.Samples {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", l.File, l.Line, l.Error)
+		}
+	}
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func NewTextInspectCommand() *cobra.Command {
+	var (
+		topDigests  int
+		concurrency int
+		maxLineSize int
+		asJSON      bool
+	)
+	cmd := &cobra.Command{
+		Use:   "inspect <dir>",
+		Short: "Validate and summarize a dump directory",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctl, err := newPlayControl(playConfig{DryRun: true}, args[0], "")
+			if err != nil {
+				return err
+			}
+			var (
+				ctx     = context.Background()
+				summary = newDumpSummary()
+				jobs    = make(chan *playWorker)
+				wg      sync.WaitGroup
+			)
+			if concurrency <= 0 {
+				concurrency = 1
+			}
+			for i := 0; i < concurrency; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for w := range jobs {
+						f, err := w.openSource(ctx)
+						if err != nil {
+							w.log.Error("failed to open source file of the stream", zap.Error(err))
+							continue
+						}
+						ss, err := inspectSession(f, w.file, maxLineSize, summary.digests)
+						f.Close()
+						if err != nil {
+							w.log.Error("failed to read events", zap.Error(err))
+							ss.malformed = append(ss.malformed, malformedLine{File: w.file, Error: err.Error()})
+						}
+						summary.merge(ss)
+					}
+				}()
+			}
+			for _, w := range ctl.workers {
+				jobs <- w
+			}
+			close(jobs)
+			wg.Wait()
+			summary.Digests = summary.digests.Frequent(topDigests)
+
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err := enc.Encode(summary); err != nil {
+					return errors.Trace(err)
+				}
+			} else {
+				summary.Print(os.Stdout)
+			}
+			if summary.Malformed > 0 {
+				return errors.Errorf("found %d malformed lines", summary.Malformed)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&topDigests, "top-digests", 10, "number of the most frequent digests to show")
+	cmd.Flags().IntVar(&concurrency, "concurrency", runtime.NumCPU(), "number of sessions to inspect concurrently")
+	cmd.Flags().IntVar(&maxLineSize, "max-line-size", 16777216, "max line size")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print the summary as json")
+	return cmd
+}
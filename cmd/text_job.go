@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+func NewTextJobCommand() *cobra.Command {
+	var (
+		agents   []string
+		protocol string
+		security agentSecurity
+	)
+	cmd := &cobra.Command{
+		Use:   "job",
+		Short: "Manage jobs running on agents",
+	}
+	cmd.PersistentFlags().StringSliceVar(&agents, "agents", []string{}, "agents list")
+	security.Register(cmd.PersistentFlags(), "agent-")
+	cmd.PersistentFlags().StringVar(&protocol, "agent-protocol", agentProtocolHTTP, "protocol for talking to agents (http|grpc, only http supports listing jobs)")
+
+	listCmd := &cobra.Command{
+		Use:   "list [job]",
+		Short: "List jobs of agents, or tasks of the given job",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			client, err := security.Client()
+			if err != nil {
+				return err
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			defer w.Flush()
+			if len(args) == 0 {
+				fmt.Fprintln(w, "AGENT\tJOB\tTOTAL\tFINISHED\tCANCELLED")
+				for _, agent := range agents {
+					var jobs []playJobStatus
+					if err := agentRequest(client, http.MethodGet, agent+"/jobs", &jobs); err != nil {
+						zap.L().Error("list jobs", zap.String("agent", agent), zap.Error(err))
+						continue
+					}
+					for _, job := range jobs {
+						fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%v\n", agent, strings.TrimPrefix(job.Name, "/"), job.Total, job.Finished, job.Cancelled)
+					}
+				}
+				return nil
+			}
+			fmt.Fprintln(w, "AGENT\tTASK\tFILE\tEVENTS\tERRORS\tFINISHED\tLAST ERROR")
+			for _, agent := range agents {
+				var status playJobStatus
+				if err := agentRequest(client, http.MethodGet, agentJobURL(agent, args[0])+"?detail=1", &status); err != nil {
+					zap.L().Error("query job status", zap.String("agent", agent), zap.Error(err))
+					continue
+				}
+				for _, task := range status.Tasks {
+					fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%v\t%s\n", agent, task.ID, task.File, task.Events, task.Errors, task.Finished, task.LastError)
+				}
+			}
+			return nil
+		},
+	}
+
+	cancelCmd := &cobra.Command{
+		Use:   "cancel <job>",
+		Short: "Cancel a job on all agents",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			transport, err := newAgentTransport(protocol, security)
+			if err != nil {
+				return err
+			}
+			defer transport.Close()
+			failed := 0
+			for _, agent := range agents {
+				if err := transport.Cancel(agent, args[0]); err != nil {
+					zap.L().Error("cancel job", zap.String("agent", agent), zap.Error(err))
+					failed += 1
+					continue
+				}
+				zap.L().Info("job cancelled", zap.String("agent", agent), zap.String("job", args[0]))
+			}
+			if failed > 0 {
+				return errors.Errorf("failed to cancel job on %d agent(s)", failed)
+			}
+			return nil
+		},
+	}
+
+	controlCmd := func(use string, short string, c playJobControl) *cobra.Command {
+		return &cobra.Command{
+			Use:   use + " <job>",
+			Short: short,
+			Args:  cobra.ExactArgs(1),
+			RunE: func(cmd *cobra.Command, args []string) error {
+				transport, err := newAgentTransport(protocol, security)
+				if err != nil {
+					return err
+				}
+				defer transport.Close()
+				failed := 0
+				for _, agent := range agents {
+					if err := transport.Control(agent, args[0], c); err != nil {
+						zap.L().Error(use+" job", zap.String("agent", agent), zap.Error(err))
+						failed += 1
+					}
+				}
+				if failed > 0 {
+					return errors.Errorf("failed to %s job on %d agent(s)", use, failed)
+				}
+				return nil
+			},
+		}
+	}
+	paused, resumed := true, false
+
+	cmd.AddCommand(listCmd)
+	cmd.AddCommand(cancelCmd)
+	cmd.AddCommand(controlCmd("pause", "Pause a job on all agents", playJobControl{Paused: &paused}))
+	cmd.AddCommand(controlCmd("resume", "Resume a paused job on all agents", playJobControl{Paused: &resumed}))
+	return cmd
+}
+
+// agentJobURL returns the url of the job on the agent, see agentJobsPath.
+func agentJobURL(agent string, job string) string {
+	return agent + agentJobsPath + url.PathEscape(job)
+}
+
+func agentRequest(client *agentClient, method string, url string, out interface{}) error {
+	return agentRequestWithBody(client, method, url, nil, out)
+}
+
+func agentRequestWithBody(client *agentClient, method string, url string, in interface{}, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("unexpected response (%d): %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return errors.Trace(json.NewDecoder(resp.Body).Decode(out))
+}
@@ -0,0 +1,254 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/storage"
+	"go.uber.org/zap"
+)
+
+const (
+	mergedIndexName = "index.json"
+
+	partitionByTime = "time"
+	partitionByHash = "hash"
+)
+
+// mergedIndex lists sessions of a merged dump, each of which is a section of
+// a partition file.
+type mergedIndex struct {
+	Partition string          `json:"partition"`
+	Files     []string        `json:"files"`
+	Sessions  []mergedSession `json:"sessions"`
+}
+
+type mergedSession struct {
+	ID     uint64 `json:"id"`
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	File   string `json:"file"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+func hasMergedIndex(files []storage.File) bool {
+	for _, file := range files {
+		if file.Name == mergedIndexName {
+			return true
+		}
+	}
+	return false
+}
+
+func (pc *playControl) loadMergedIndex(store storage.Storage, input string) error {
+	r, err := store.Open(context.Background(), mergedIndexName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	var index mergedIndex
+	if err = json.NewDecoder(r).Decode(&index); err != nil {
+		return errors.Annotate(err, "decode "+mergedIndexName)
+	}
+	for _, s := range index.Sessions {
+		if pc.Redrive != nil && !pc.Redrive.Has(s.ID) {
+			continue
+		}
+		src := filepath.Join(input, s.File)
+		if storage.IsRemote(input) {
+			src = store.String() + s.File
+		}
+		pc.workers = append(pc.workers, &playWorker{
+			playConfig: pc.playConfig,
+			src:        src,
+			store:      store,
+			file:       s.File,
+			log:        pc.workerLogger(s.ID),
+			wg:         pc.wg,
+			ts:         s.Start,
+			end:        s.End,
+			id:         s.ID,
+			offset:     s.Offset,
+			size:       s.Size,
+		})
+	}
+	return nil
+}
+
+type sectionReader struct {
+	io.Reader
+	io.Closer
+}
+
+// openSection returns a reader of size bytes starting from offset of r.
+func openSection(r io.ReadCloser, offset int64, size int64) (io.ReadCloser, error) {
+	var err error
+	if s, ok := r.(io.Seeker); ok {
+		_, err = s.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, r, offset)
+	}
+	if err != nil {
+		r.Close()
+		return nil, errors.Annotatef(err, "seek to %d", offset)
+	}
+	return sectionReader{Reader: io.LimitReader(r, size), Closer: r}, nil
+}
+
+// countingWriter tracks the size and the last byte written.
+type countingWriter struct {
+	w    io.Writer
+	n    int64
+	last byte
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	if n > 0 {
+		cw.last = p[n-1]
+	}
+	return n, err
+}
+
+// writePartition concatenates sessions into a partition file, each session
+// ends with a newline so that it can be scanned on its own.
+func writePartition(ctx context.Context, path string, workers []*playWorker) ([]mergedSession, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	var (
+		bw       = bufio.NewWriterSize(f, 1048576)
+		cw       = &countingWriter{w: bw}
+		name     = filepath.Base(path)
+		sessions = make([]mergedSession, 0, len(workers))
+	)
+	for _, w := range workers {
+		r, err := w.openSource(ctx)
+		if err != nil {
+			return nil, errors.Annotate(err, "open "+w.src)
+		}
+		offset := cw.n
+		_, err = io.Copy(cw, r)
+		r.Close()
+		if err != nil {
+			return nil, errors.Annotate(err, "copy "+w.src)
+		}
+		if cw.n > offset && cw.last != '\n' {
+			cw.Write([]byte{'\n'})
+		}
+		if cw.n == offset {
+			continue
+		}
+		sessions = append(sessions, mergedSession{ID: w.id, Start: w.ts, End: w.end, File: name, Offset: offset, Size: cw.n - offset})
+	}
+	if err = bw.Flush(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return sessions, errors.Trace(f.Close())
+}
+
+func NewTextMergeCommand() *cobra.Command {
+	var (
+		partitions int
+		by         string
+	)
+	cmd := &cobra.Command{
+		Use:   "merge <input> <output>",
+		Short: "Merge session files of a dump into a few partition files with an index",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if partitions <= 0 {
+				return errors.New("partitions must be positive")
+			}
+			if by != partitionByTime && by != partitionByHash {
+				return errors.New("unsupported partition: " + by)
+			}
+			ctl, err := newPlayControl(playConfig{DryRun: true}, args[0], "")
+			if err != nil {
+				return err
+			}
+			output := args[1]
+			if err = os.MkdirAll(output, 0755); err != nil {
+				return errors.Trace(err)
+			}
+			if partitions > len(ctl.workers) && len(ctl.workers) > 0 {
+				partitions = len(ctl.workers)
+			}
+			// workers are sorted by their start time
+			parts := make([][]*playWorker, partitions)
+			for i, w := range ctl.workers {
+				p := i * partitions / len(ctl.workers)
+				if by == partitionByHash {
+					p = int(w.id % uint64(partitions))
+				}
+				parts[p] = append(parts[p], w)
+			}
+
+			var (
+				ctx   = context.Background()
+				index = mergedIndex{Partition: by}
+				lock  sync.Mutex
+				errs  = make([]error, partitions)
+				wg    sync.WaitGroup
+			)
+			for p, workers := range parts {
+				if len(workers) == 0 {
+					continue
+				}
+				name := fmt.Sprintf("part-%04d.tsv", p)
+				index.Files = append(index.Files, name)
+				wg.Add(1)
+				go func(p int, name string, workers []*playWorker) {
+					defer wg.Done()
+					sessions, err := writePartition(ctx, filepath.Join(output, name), workers)
+					if err != nil {
+						errs[p] = err
+						return
+					}
+					lock.Lock()
+					index.Sessions = append(index.Sessions, sessions...)
+					lock.Unlock()
+					zap.L().Info("partition merged", zap.String("file", name), zap.Int("sessions", len(sessions)))
+				}(p, name, workers)
+			}
+			wg.Wait()
+			for _, err := range errs {
+				if err != nil {
+					return err
+				}
+			}
+			sort.Slice(index.Sessions, func(i, j int) bool { return index.Sessions[i].Start < index.Sessions[j].Start })
+
+			// write the index at last, so that an incomplete output is not taken as a merged dump
+			tmp := filepath.Join(output, "."+mergedIndexName)
+			data, err := json.MarshalIndent(index, "", "  ")
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err = os.WriteFile(tmp, data, 0644); err != nil {
+				return errors.Trace(err)
+			}
+			if err = os.Rename(tmp, filepath.Join(output, mergedIndexName)); err != nil {
+				return errors.Trace(err)
+			}
+			zap.L().Info("merge done", zap.Int("sessions", len(index.Sessions)), zap.Int("files", len(index.Files)))
+			return nil
+		},
+	}
+	cmd.Flags().IntVar(&partitions, "partitions", 16, "number of partition files")
+	cmd.Flags().StringVar(&by, "by", partitionByTime, "partition sessions by their start time or by the hash of their ids (time|hash)")
+	return cmd
+}
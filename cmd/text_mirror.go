@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+// mirrorConfig sends every event to the mirror (e.g. the original server or a
+// production-compatible one) as well as the target, and compares outcomes of
+// both on the fly. The mirror receives events as captured, neither rewritten
+// by interceptors nor initialized by SessionInit.
+type mirrorConfig struct {
+	Target *mysql.Config
+	// MaxDiffs (if positive) is the max number of differences to log.
+	MaxDiffs int64
+}
+
+// mirrorResult is the outcome of an event applied to the mirror.
+type mirrorResult struct {
+	event string
+	res   replay.Result
+	err   error
+}
+
+// mirrored tells whether the event is sent to the mirror, result events are
+// compared with the capture by the target only.
+func mirrored(e *event.MySQLEvent) bool {
+	return e.Type != event.EventResult && e.Type != event.EventGap
+}
+
+// mirror applies a copy of the event to the mirror in background, the result
+// must be received before applying the next event.
+func (pw *playWorker) mirror(ctx context.Context, e *event.MySQLEvent) <-chan mirrorResult {
+	if pw.mirrorConn == nil {
+		pw.mirrorConn = replay.NewConn(replay.ConnConfig{
+			Target:       pw.Mirror.Target,
+			QueryTimeout: pw.QueryTimeout,
+			Untracked:    true,
+		}, pw.id, pw.log.With(zap.String("mirror", pw.Mirror.Target.Addr)))
+	}
+	me := *e
+	me.Params = append([]interface{}(nil), e.Params...)
+	ch := make(chan mirrorResult, 1)
+	go func() {
+		res, err := pw.mirrorConn.Apply(ctx, &me)
+		ch <- mirrorResult{event: me.String(), res: res, err: err}
+	}()
+	return ch
+}
+
+// compareMirror compares the outcome of the target with the one of the mirror,
+// events failed due to other than server errors (e.g. broken connections) on
+// either side are not compared.
+func (pw *playWorker) compareMirror(m mirrorResult, res replay.Result, err error) {
+	if !m.res.Executed && !res.Executed && m.err == nil && err == nil {
+		return
+	}
+	if !comparableOutcome(err) || !comparableOutcome(m.err) {
+		return
+	}
+	pw.Stats.Add(stats.MirrorCompared, 1)
+	expected, actual := outcomeOf(m.res.Result, m.err), outcomeOf(res.Result, err)
+	if expected == actual {
+		return
+	}
+	n := pw.Stats.Add(stats.MirrorDiffs, 1)
+	if pw.Mirror.MaxDiffs <= 0 || n <= pw.Mirror.MaxDiffs {
+		pw.log.Warn("different outcome from the mirror", zap.String("event", m.event), zap.String("digest", res.Digest),
+			zap.String("mirror", expected), zap.String("target", actual))
+	} else {
+		pw.log.Debug("different outcome from the mirror", zap.String("event", m.event),
+			zap.String("mirror", expected), zap.String("target", actual))
+	}
+}
+
+func comparableOutcome(err error) bool {
+	if err == nil {
+		return true
+	}
+	_, ok := mysqlError(err)
+	return ok
+}
@@ -0,0 +1,598 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+const (
+	profileQuery = "query"
+	profileStmt  = "stmt"
+
+	maxParamDistinct = 10000
+)
+
+// profileBounds are upper bounds of histogram buckets, the last bucket holds
+// the rest.
+var profileBounds = []int64{0, 1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 30000, 60000, 300000, 3600000}
+
+type profileBucket struct {
+	Le    int64 `json:"le"`
+	Count int64 `json:"count"`
+}
+
+// profileHist is a histogram of a distribution, percentiles are the upper
+// bounds of the buckets they fall in.
+type profileHist struct {
+	Count   int64           `json:"count"`
+	Min     int64           `json:"min"`
+	Max     int64           `json:"max"`
+	Mean    float64         `json:"mean"`
+	P50     int64           `json:"p50"`
+	P90     int64           `json:"p90"`
+	P99     int64           `json:"p99"`
+	Buckets []profileBucket `json:"buckets"`
+
+	sum    int64
+	counts []int64
+}
+
+func (h *profileHist) Observe(v int64) {
+	if h.counts == nil {
+		h.counts = make([]int64, len(profileBounds)+1)
+	}
+	if h.Count == 0 || v < h.Min {
+		h.Min = v
+	}
+	if v > h.Max {
+		h.Max = v
+	}
+	h.Count += 1
+	h.sum += v
+	h.counts[sort.Search(len(profileBounds), func(i int) bool { return profileBounds[i] >= v })] += 1
+}
+
+func (h *profileHist) finish() {
+	if h.Count == 0 {
+		return
+	}
+	h.Mean = float64(h.sum) / float64(h.Count)
+	h.Buckets = h.Buckets[:0]
+	acc := int64(0)
+	for i, n := range h.counts {
+		if n == 0 {
+			continue
+		}
+		le := h.Max
+		if i < len(profileBounds) && profileBounds[i] < le {
+			le = profileBounds[i]
+		}
+		h.Buckets = append(h.Buckets, profileBucket{Le: le, Count: n})
+		for _, p := range []struct {
+			q float64
+			v *int64
+		}{{0.5, &h.P50}, {0.9, &h.P90}, {0.99, &h.P99}} {
+			if float64(acc) < p.q*float64(h.Count) && float64(acc+n) >= p.q*float64(h.Count) {
+				*p.v = le
+			}
+		}
+		acc += n
+	}
+}
+
+// Sample returns a random value of the distribution, which is uniform in the
+// bucket picked by its weight.
+func (h *profileHist) Sample(r *rand.Rand) int64 {
+	if h.Count == 0 {
+		return 0
+	}
+	n := r.Int63n(h.Count)
+	lo := h.Min
+	for _, b := range h.Buckets {
+		if n < b.Count {
+			if b.Le <= lo {
+				return b.Le
+			}
+			return lo + r.Int63n(b.Le-lo+1)
+		}
+		n -= b.Count
+		lo = b.Le
+	}
+	return h.Max
+}
+
+type paramProfile struct {
+	Distinct  int   `json:"distinct"`
+	Saturated bool  `json:"saturated,omitempty"`
+	Nulls     int64 `json:"nulls,omitempty"`
+
+	values map[string]struct{}
+}
+
+type profileDigest struct {
+	Digest  string          `json:"digest"`
+	Kind    string          `json:"kind"`
+	Query   string          `json:"query"`
+	Count   int64           `json:"count"`
+	Params  []*paramProfile `json:"params,omitempty"`
+	Queries []string        `json:"queries,omitempty"`
+	Samples [][]*string     `json:"samples,omitempty"`
+}
+
+// workloadProfile is a statistical summary of a dump, times are in ms.
+type workloadProfile struct {
+	Sessions          int              `json:"sessions"`
+	Statements        int64            `json:"statements"`
+	Span              int64            `json:"span"`
+	Digests           []*profileDigest `json:"digests"`
+	ThinkTime         profileHist      `json:"thinkTime"`
+	SessionStatements profileHist      `json:"sessionStatements"`
+	SessionDuration   profileHist      `json:"sessionDuration"`
+
+	lock    sync.Mutex
+	digests map[string]*profileDigest
+	samples int
+	start   int64
+	end     int64
+}
+
+func newWorkloadProfile(samples int) *workloadProfile {
+	return &workloadProfile{digests: make(map[string]*profileDigest), samples: samples}
+}
+
+func (p *workloadProfile) digest(kind string, query string) *profileDigest {
+	key := kind + ":" + event.Digest(query)
+	d, ok := p.digests[key]
+	if !ok {
+		d = &profileDigest{Digest: event.Digest(query), Kind: kind, Query: query}
+		p.digests[key] = d
+	}
+	return d
+}
+
+func (p *workloadProfile) observeQuery(query string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	d := p.digest(profileQuery, query)
+	d.Count += 1
+	if len(d.Queries) < p.samples {
+		d.Queries = append(d.Queries, query)
+	} else if i := rand.Int63n(d.Count); i < int64(p.samples) {
+		d.Queries[i] = query
+	}
+}
+
+func (p *workloadProfile) observeStmt(query string, params []interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	d := p.digest(profileStmt, query)
+	d.Count += 1
+	for len(d.Params) < len(params) {
+		d.Params = append(d.Params, &paramProfile{values: make(map[string]struct{})})
+	}
+	sample := make([]*string, len(params))
+	for i, param := range params {
+		pp := d.Params[i]
+		if param == nil {
+			pp.Nulls += 1
+			continue
+		}
+		var s string
+		if b, ok := param.([]byte); ok {
+			s = string(b)
+		} else {
+			s = fmt.Sprint(param)
+		}
+		sample[i] = &s
+		if len(pp.values) < maxParamDistinct {
+			pp.values[s] = struct{}{}
+		} else if _, ok := pp.values[s]; !ok {
+			pp.Saturated = true
+		}
+	}
+	// reservoir sampling of param tuples
+	if len(d.Samples) < p.samples {
+		d.Samples = append(d.Samples, sample)
+	} else if i := rand.Int63n(d.Count); i < int64(p.samples) {
+		d.Samples[i] = sample
+	}
+}
+
+func (p *workloadProfile) observeSession(statements int64, start int64, end int64, think *profileHist) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.Sessions += 1
+	p.Statements += statements
+	if p.start == 0 || start < p.start {
+		p.start = start
+	}
+	if end > p.end {
+		p.end = end
+	}
+	p.SessionStatements.Observe(statements)
+	p.SessionDuration.Observe(end - start)
+	if p.ThinkTime.counts == nil {
+		p.ThinkTime.counts = make([]int64, len(profileBounds)+1)
+	}
+	if think.Count > 0 {
+		if p.ThinkTime.Count == 0 || think.Min < p.ThinkTime.Min {
+			p.ThinkTime.Min = think.Min
+		}
+		if think.Max > p.ThinkTime.Max {
+			p.ThinkTime.Max = think.Max
+		}
+		p.ThinkTime.Count += think.Count
+		p.ThinkTime.sum += think.sum
+		for i, n := range think.counts {
+			p.ThinkTime.counts[i] += n
+		}
+	}
+}
+
+func (p *workloadProfile) finish(top int) {
+	p.Span = p.end - p.start
+	p.ThinkTime.finish()
+	p.SessionStatements.finish()
+	p.SessionDuration.finish()
+	p.Digests = make([]*profileDigest, 0, len(p.digests))
+	for _, d := range p.digests {
+		for _, pp := range d.Params {
+			pp.Distinct = len(pp.values)
+		}
+		p.Digests = append(p.Digests, d)
+	}
+	sort.Slice(p.Digests, func(i, j int) bool {
+		if p.Digests[i].Count != p.Digests[j].Count {
+			return p.Digests[i].Count > p.Digests[j].Count
+		}
+		return p.Digests[i].Digest < p.Digests[j].Digest
+	})
+	if top > 0 && len(p.Digests) > top {
+		p.Digests = p.Digests[:top]
+	}
+}
+
+// profileSession observes statements of a session, statements are queries
+// and stmt executes except those changing the session state.
+func profileSession(r io.Reader, maxLineSize int, p *workloadProfile) error {
+	var (
+		e          = event.MySQLEvent{Params: []interface{}{}}
+		dec        = event.NewDecoder(maxLineSize)
+		in         = bufio.NewScanner(r)
+		stmts      = make(map[uint64]string)
+		think      profileHist
+		statements int64
+		start, end int64
+		last       int64
+	)
+	if maxLineSize > 0 {
+		in.Buffer(make([]byte, 0, 4096), maxLineSize)
+	}
+	for in.Scan() {
+		ok, err := dec.Decode(in.Text(), e.Reset(e.Params[:0]))
+		if err != nil {
+			return err
+		} else if !ok {
+			continue
+		}
+		if start == 0 {
+			start = e.Time
+		}
+		if e.Time > end {
+			end = e.Time
+		}
+		statement := false
+		switch e.Type {
+		case event.EventQuery:
+			if _, ok := replay.ParseUseQuery(e.Query); !ok && !replay.IsSessionSet(e.Query) {
+				p.observeQuery(e.Query)
+				statement = true
+			}
+		case event.EventStmtPrepare:
+			stmts[e.StmtID] = e.Query
+		case event.EventStmtExecute:
+			if query, ok := stmts[e.StmtID]; ok {
+				p.observeStmt(query, e.Params)
+				statement = true
+			}
+		case event.EventStmtClose:
+			delete(stmts, e.StmtID)
+		}
+		if !statement {
+			continue
+		}
+		if statements > 0 {
+			think.Observe(e.Time - last)
+		}
+		statements += 1
+		last = e.Time
+	}
+	if err := in.Err(); err != nil {
+		return errors.Trace(err)
+	}
+	if statements > 0 {
+		p.observeSession(statements, start, end, &think)
+	}
+	return nil
+}
+
+func (p *workloadProfile) Print(w io.Writer) {
+	fmt.Fprintf(w, "sessions: %d, statements: %d, span: %s\n", p.Sessions, p.Statements, time.Duration(p.Span)*time.Millisecond)
+	for _, h := range []struct {
+		name string
+		hist *profileHist
+	}{{"think time (ms)", &p.ThinkTime}, {"session statements", &p.SessionStatements}, {"session duration (ms)", &p.SessionDuration}} {
+		fmt.Fprintf(w, "%s: count=%d min=%d mean=%.1f p50=%d p90=%d p99=%d max=%d\n", h.name, h.hist.Count, h.hist.Min, h.hist.Mean, h.hist.P50, h.hist.P90, h.hist.P99, h.hist.Max)
+	}
+	fmt.Fprintln(w)
+	for _, d := range p.Digests {
+		cards := make([]string, len(d.Params))
+		for i, pp := range d.Params {
+			cards[i] = fmt.Sprint(pp.Distinct)
+			if pp.Saturated {
+				cards[i] += "+"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t[%s]\t%q\n", d.Digest, d.Kind, d.Count, strings.Join(cards, ","), formatSample(d.Query))
+	}
+}
+
+// synthLoad replays a workload generated from a profile: each connection
+// runs sessions whose lengths and think times follow the distributions of the
+// profile and whose statements are picked by the frequencies of digests.
+type synthLoad struct {
+	profile *workloadProfile
+	pool    *sql.DB
+	log     *zap.Logger
+	digests []*profileDigest
+	weights []int64
+	speed   float64
+}
+
+func newSynthLoad(p *workloadProfile, pool *sql.DB, speed float64) (*synthLoad, error) {
+	s := &synthLoad{profile: p, pool: pool, log: zap.L().Named("synth"), speed: speed}
+	acc := int64(0)
+	for _, d := range p.Digests {
+		if len(d.Queries) == 0 && len(d.Samples) == 0 {
+			continue
+		}
+		acc += d.Count
+		s.digests = append(s.digests, d)
+		s.weights = append(s.weights, acc)
+	}
+	if acc == 0 {
+		return nil, errors.New("no statement to replay in the profile")
+	}
+	return s, nil
+}
+
+func (s *synthLoad) pick(r *rand.Rand) *profileDigest {
+	n := r.Int63n(s.weights[len(s.weights)-1])
+	return s.digests[sort.Search(len(s.weights), func(i int) bool { return s.weights[i] > n })]
+}
+
+func (s *synthLoad) loop(ctx context.Context, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	for ctx.Err() == nil {
+		if err := s.session(ctx, r); err != nil && ctx.Err() == nil {
+			s.log.Warn("synthetic session failed", zap.Error(err))
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+func (s *synthLoad) session(ctx context.Context, r *rand.Rand) error {
+	conn, err := s.pool.Conn(ctx)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer conn.Close()
+	stmts := make(map[string]*sql.Stmt)
+	defer func() {
+		for _, stmt := range stmts {
+			stmt.Close()
+		}
+	}()
+	n := s.profile.SessionStatements.Sample(r)
+	if n <= 0 {
+		n = 1
+	}
+	for i := int64(0); i < n; i++ {
+		if i > 0 {
+			think := time.Duration(float64(s.profile.ThinkTime.Sample(r)) * float64(time.Millisecond) / s.speed)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(think):
+			}
+		}
+		d := s.pick(r)
+		if d.Kind == profileQuery {
+			stats.Add(stats.Queries, 1)
+			if _, err = conn.ExecContext(ctx, d.Queries[r.Intn(len(d.Queries))]); err != nil && ctx.Err() == nil {
+				stats.Add(stats.FailedQueries, 1)
+				s.log.Debug("failed to execute query", zap.String("digest", d.Digest), zap.Error(err))
+			}
+			continue
+		}
+		stmt, ok := stmts[d.Digest]
+		if !ok {
+			stats.Add(stats.StmtPrepares, 1)
+			if stmt, err = conn.PrepareContext(ctx, d.Query); err != nil {
+				stats.Add(stats.FailedStmtPrepares, 1)
+				s.log.Debug("failed to prepare stmt", zap.String("digest", d.Digest), zap.Error(err))
+				continue
+			}
+			stmts[d.Digest] = stmt
+		}
+		sample := d.Samples[r.Intn(len(d.Samples))]
+		args := make([]interface{}, len(sample))
+		for j, v := range sample {
+			if v != nil {
+				args[j] = *v
+			}
+		}
+		stats.Add(stats.StmtExecutes, 1)
+		if _, err = stmt.ExecContext(ctx, args...); err != nil && ctx.Err() == nil {
+			stats.Add(stats.FailedStmtExecutes, 1)
+			s.log.Debug("failed to execute stmt", zap.String("digest", d.Digest), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func loadWorkloadProfile(path string) (*workloadProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	p := new(workloadProfile)
+	if err = json.Unmarshal(data, p); err != nil {
+		return nil, errors.Annotate(err, "decode profile")
+	}
+	return p, nil
+}
+
+func NewTextProfileCommand() *cobra.Command {
+	var (
+		output      string
+		top         int
+		samples     int
+		maxLineSize int
+		text        bool
+		target      string
+		conns       int
+		speed       float64
+		duration    time.Duration
+	)
+	cmd := &cobra.Command{
+		Use:   "profile <dir|profile.json>",
+		Short: "Extract a workload profile from a dump or run a synthetic load by a profile",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var (
+				p   *workloadProfile
+				err error
+			)
+			if strings.HasSuffix(args[0], ".json") {
+				if p, err = loadWorkloadProfile(args[0]); err != nil {
+					return err
+				}
+			} else {
+				ctl, err := newPlayControl(playConfig{DryRun: true}, args[0], "")
+				if err != nil {
+					return err
+				}
+				p = newWorkloadProfile(samples)
+				ctx := context.Background()
+				for _, w := range ctl.workers {
+					f, err := w.openSource(ctx)
+					if err != nil {
+						w.log.Error("failed to open source file of the stream", zap.Error(err))
+						continue
+					}
+					err = profileSession(f, maxLineSize, p)
+					f.Close()
+					if err != nil {
+						w.log.Warn("failed to read events", zap.Error(err))
+					}
+				}
+				p.finish(top)
+			}
+
+			if len(output) > 0 || len(target) == 0 {
+				out := os.Stdout
+				if len(output) > 0 {
+					if out, err = os.Create(output); err != nil {
+						return errors.Trace(err)
+					}
+					defer out.Close()
+				}
+				if text {
+					p.Print(out)
+				} else {
+					enc := json.NewEncoder(out)
+					enc.SetIndent("", "  ")
+					if err = enc.Encode(p); err != nil {
+						return errors.Trace(err)
+					}
+				}
+			}
+			if len(target) == 0 {
+				return nil
+			}
+
+			if conns <= 0 || speed <= 0 {
+				return errors.New("conns and speed must be positive")
+			}
+			cfg, err := mysql.ParseDSN(target)
+			if err != nil {
+				return err
+			}
+			pool, err := sql.Open("mysql", cfg.FormatDSN())
+			if err != nil {
+				return errors.Trace(err)
+			}
+			defer pool.Close()
+			pool.SetMaxOpenConns(conns)
+			pool.SetMaxIdleConns(conns)
+			load, err := newSynthLoad(p, pool, speed)
+			if err != nil {
+				return err
+			}
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			if duration > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, duration)
+				defer cancel()
+			}
+			load.log.Info("start synthetic load", zap.Int("conns", conns), zap.Int("digests", len(load.weights)), zap.Duration("duration", duration))
+			var wg sync.WaitGroup
+			seed := time.Now().UnixNano()
+			for i := 0; i < conns; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					load.loop(ctx, seed+int64(i))
+				}(i)
+			}
+			wg.Wait()
+			zap.L().Info("synthetic load done", zap.Int64("queries", stats.Get(stats.Queries)), zap.Int64("executes", stats.Get(stats.StmtExecutes)))
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "write the profile to the file instead of stdout")
+	cmd.Flags().IntVar(&top, "top-digests", 0, "number of the most frequent digests to keep (0 means all)")
+	cmd.Flags().IntVar(&samples, "samples", 32, "number of sample queries or params kept per digest")
+	cmd.Flags().IntVar(&maxLineSize, "max-line-size", 16777216, "max line size")
+	cmd.Flags().BoolVar(&text, "text", false, "print the profile as text instead of json")
+	cmd.Flags().StringVar(&target, "target", "", "run a synthetic load matching the profile against the target dsn")
+	cmd.Flags().IntVar(&conns, "conns", 8, "number of connections of the synthetic load")
+	cmd.Flags().Float64Var(&speed, "speed", 1, "speed ratio of the synthetic load (think times are divided by it)")
+	cmd.Flags().DurationVar(&duration, "duration", 0, "duration of the synthetic load (0 means until interrupted)")
+	return cmd
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+)
+
+// failureSet holds failed events listed by a failed.tsv (see deadLetters),
+// sessions of which are replayed again with only their failed statements.
+// Events changing the state of the sessions (schema, session variables and
+// prepared statements) are replayed as well in context mode, otherwise only
+// connections and statements prepared for the failed ones are.
+type failureSet struct {
+	context bool
+	// events are encoded failed events by sessions, and stmts are ids of
+	// statements executed by them.
+	events map[uint64]map[string]bool
+	stmts  map[uint64]map[uint64]bool
+	total  int
+}
+
+// loadFailureSet loads failed events from the path, which is a failed.tsv or
+// the directory of it.
+func loadFailureSet(path string, context bool) (*failureSet, error) {
+	if info, err := os.Stat(path); err != nil {
+		return nil, errors.Trace(err)
+	} else if info.IsDir() {
+		path = filepath.Join(path, deadLetterIndex)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer f.Close()
+	var (
+		fs = &failureSet{context: context, events: make(map[uint64]map[string]bool), stmts: make(map[uint64]map[uint64]bool)}
+		in = bufio.NewScanner(f)
+		e  = event.MySQLEvent{Params: []interface{}{}}
+		n  = 0
+	)
+	in.Buffer(make([]byte, 0, 4096), 16*1024*1024)
+	for in.Scan() {
+		n += 1
+		fields := strings.SplitN(in.Text(), "\t", 3)
+		if len(fields) != 3 {
+			return nil, errors.Errorf("%s:%d: expect a session, an error and an event", path, n)
+		}
+		id, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			return nil, errors.Annotatef(err, "%s:%d: parse session", path, n)
+		}
+		if _, err = event.ScanEvent(fields[2], 0, e.Reset(e.Params[:0])); err != nil {
+			return nil, errors.Annotatef(err, "%s:%d: scan event", path, n)
+		}
+		if fs.events[id] == nil {
+			fs.events[id], fs.stmts[id] = make(map[string]bool), make(map[uint64]bool)
+		}
+		fs.events[id][fields[2]] = true
+		if e.Type == event.EventStmtExecute || e.Type == event.EventStmtFetch {
+			fs.stmts[id][e.StmtID] = true
+		}
+		fs.total += 1
+	}
+	return fs, errors.Trace(in.Err())
+}
+
+// Has tells whether the session has failed events.
+func (fs *failureSet) Has(id uint64) bool {
+	return fs.events[id] != nil
+}
+
+// Accept tells whether to replay the event of the session.
+func (fs *failureSet) Accept(id uint64, e *event.MySQLEvent) bool {
+	switch e.Type {
+	case event.EventHandshake, event.EventQuit:
+		return true
+	case event.EventInitDB, event.EventStmtClose:
+		return fs.context
+	case event.EventStmtPrepare:
+		return fs.context || fs.stmts[id][e.StmtID]
+	case event.EventQuery:
+		if fs.context {
+			if _, ok := replay.ParseUseQuery(e.Query); ok || replay.IsSessionSet(e.Query) {
+				return true
+			}
+		}
+	case event.EventStmtExecute, event.EventStmtFetch:
+	default:
+		return false
+	}
+	line, err := event.AppendEvent(nil, *e)
+	return err == nil && fs.events[id][string(line)]
+}
@@ -0,0 +1,415 @@
+package cmd
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"go.uber.org/zap"
+)
+
+const maxSubmitFailures = 3
+
+const (
+	agentProtocolHTTP = "http"
+	agentProtocolGRPC = "grpc"
+)
+
+// agentTransport is how the controller talks to agents.
+type agentTransport interface {
+	Capacity(agent string) (*agentCapacity, error)
+	// Submit submits a task of the job, the session file is referenced by the
+	// meta of the task if in is nil.
+	Submit(agent string, job string, task *playTask, in io.ReadCloser) error
+	Status(agent string, job string) (*playJobStatus, error)
+	Cancel(agent string, job string) error
+	// Prepare distributes the clock of the job, the clock of the agent is
+	// returned in the acknowledgement.
+	Prepare(agent string, job string, clock playJobClock) (*playJobClock, error)
+	// Control pauses or resumes the job.
+	Control(agent string, job string, c playJobControl) error
+	Close()
+}
+
+// statusPusher is implemented by transports on which agents push job status,
+// the url of an agent is sent to the channel whenever its status is pushed (or
+// its stream breaks), so that the controller needn't poll for it.
+type statusPusher interface {
+	Updates() <-chan string
+}
+
+// remoteStatusInterval is the interval of polling job status, which only
+// restarts broken streams and detects lost agents if status is pushed.
+const remoteStatusInterval = 5 * time.Second
+
+func newAgentTransport(protocol string, security agentSecurity) (agentTransport, error) {
+	switch protocol {
+	case agentProtocolHTTP:
+		client, err := security.Client()
+		if err != nil {
+			return nil, err
+		}
+		return &httpTransport{client: client, seqs: make(map[string]int64)}, nil
+	case agentProtocolGRPC:
+		return newGRPCTransport(security, time.Second), nil
+	default:
+		return nil, errors.New("unknown agent protocol: " + protocol)
+	}
+}
+
+type httpTransport struct {
+	client *agentClient
+	lock   sync.Mutex
+	seqs   map[string]int64
+}
+
+func (t *httpTransport) Capacity(agent string) (*agentCapacity, error) {
+	var c agentCapacity
+	if err := agentRequest(t.client, http.MethodGet, agent+"/capacity", &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (t *httpTransport) Submit(agent string, job string, task *playTask, in io.ReadCloser) error {
+	req, err := task.buildRequest(agentJobURL(agent, job), in)
+	if err != nil {
+		return errors.Annotate(err, "build remote request")
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return errors.Annotate(err, "send remote request")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.Errorf("unexpected response (%d): %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (t *httpTransport) Status(agent string, job string) (*playJobStatus, error) {
+	var s playJobStatus
+	key := agentJobURL(agent, job)
+	t.lock.Lock()
+	since := t.seqs[key]
+	t.lock.Unlock()
+	if err := agentRequest(t.client, http.MethodGet, key+"?detail=1&since="+strconv.FormatInt(since, 10), &s); err != nil {
+		return nil, err
+	}
+	if n := len(s.Failures); n > 0 {
+		t.lock.Lock()
+		t.seqs[key] = s.Failures[n-1].Seq
+		t.lock.Unlock()
+	}
+	return &s, nil
+}
+
+func (t *httpTransport) Cancel(agent string, job string) error {
+	return agentRequest(t.client, http.MethodDelete, agentJobURL(agent, job), nil)
+}
+
+func (t *httpTransport) Prepare(agent string, job string, clock playJobClock) (*playJobClock, error) {
+	var ack playJobClock
+	if err := agentRequestWithBody(t.client, http.MethodPut, agentJobURL(agent, job), clock, &ack); err != nil {
+		return nil, err
+	}
+	return &ack, nil
+}
+
+func (t *httpTransport) Control(agent string, job string, c playJobControl) error {
+	return agentRequestWithBody(t.client, http.MethodPatch, agentJobURL(agent, job), c, nil)
+}
+
+func (t *httpTransport) Close() {}
+
+type remoteAgent struct {
+	url      string
+	capacity agentCapacity
+	external int
+	alive    bool
+	failures int
+	lastSeen time.Time
+	sessions map[sessionKey]*playWorker
+	finished int
+	offset   int64
+	lagging  float64
+}
+
+// sessionKey identifies a session among all inputs, ids are connection hashes
+// which may collide across captures or sessions of merged partitions.
+type sessionKey struct {
+	file   string
+	offset int64
+	id     uint64
+}
+
+func (pw *playWorker) key() sessionKey {
+	return sessionKey{file: pw.file, offset: pw.offset, id: pw.id}
+}
+
+// remoteScheduler tracks sessions assigned to agents, so that unfinished
+// sessions of lost agents can be reassigned to the alive ones.
+type remoteScheduler struct {
+	lock    sync.Mutex
+	agents  []*remoteAgent
+	timeout time.Duration
+	next    int
+	orphans []*playWorker
+}
+
+func newRemoteScheduler(urls []string, timeout time.Duration) *remoteScheduler {
+	s := &remoteScheduler{timeout: timeout}
+	now := time.Now()
+	for _, url := range urls {
+		s.agents = append(s.agents, &remoteAgent{
+			url:      url,
+			capacity: agentCapacity{CPUs: 1, Weight: 1},
+			alive:    true,
+			lastSeen: now,
+			sessions: make(map[sessionKey]*playWorker),
+		})
+	}
+	return s
+}
+
+// Probe fetches capacities of agents, agents keep the default capacity if
+// they fail to respond.
+func (s *remoteScheduler) Probe(transport agentTransport) {
+	for _, agent := range s.agents {
+		c, err := transport.Capacity(agent.url)
+		if err != nil {
+			zap.L().Warn("probe agent capacity", zap.String("agent", agent.url), zap.Error(err))
+			continue
+		}
+		if c == nil {
+			continue
+		}
+		s.lock.Lock()
+		s.update(agent, c)
+		s.lock.Unlock()
+	}
+}
+
+// Assign picks the alive agent with the least load relative to its capacity
+// (weight * cpus), the load counts unfinished sessions assigned by us as well
+// as sessions running on the agent for other jobs.
+func (s *remoteScheduler) Assign(worker *playWorker) *remoteAgent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.assign(worker)
+}
+
+func (s *remoteScheduler) assign(worker *playWorker) *remoteAgent {
+	var (
+		best  *remoteAgent
+		score float64
+	)
+	for i := 0; i < len(s.agents); i++ {
+		agent := s.agents[(s.next+i)%len(s.agents)]
+		if !agent.alive {
+			continue
+		}
+		if x := float64(s.unfinished(agent)+agent.external+1) / agent.capacity.power(); best == nil || x < score {
+			best, score = agent, x
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	s.next = (s.next + 1) % len(s.agents)
+	best.sessions[worker.key()] = worker
+	return best
+}
+
+func (s *remoteScheduler) unfinished(agent *remoteAgent) int {
+	return len(agent.sessions)
+}
+
+func (s *remoteScheduler) update(agent *remoteAgent, c *agentCapacity) {
+	if c.CPUs <= 0 {
+		c.CPUs = 1
+	}
+	agent.capacity = *c
+	agent.external = c.Running - s.unfinished(agent)
+	if agent.external < 0 {
+		agent.external = 0
+	}
+}
+
+func (c agentCapacity) power() float64 {
+	w := c.Weight
+	if w <= 0 {
+		w = 1
+	}
+	return w * float64(c.CPUs)
+}
+
+// Fail records a failed submission and reassigns the session, nil is returned
+// if there is no alive agent.
+func (s *remoteScheduler) Fail(agent *remoteAgent, worker *playWorker) *remoteAgent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(agent.sessions, worker.key())
+	agent.failures += 1
+	if agent.failures >= maxSubmitFailures {
+		s.orphans = append(s.orphans, s.drop(agent)...)
+	}
+	return s.assign(worker)
+}
+
+// Orphans returns sessions left by agents which are dropped due to failed
+// submissions.
+func (s *remoteScheduler) Orphans() []*playWorker {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	orphans := s.orphans
+	s.orphans = nil
+	return orphans
+}
+
+func (s *remoteScheduler) drop(agent *remoteAgent) []*playWorker {
+	agent.alive = false
+	lost := make([]*playWorker, 0, len(agent.sessions))
+	for key, worker := range agent.sessions {
+		lost = append(lost, worker)
+		delete(agent.sessions, key)
+	}
+	return lost
+}
+
+func (s *remoteScheduler) Alive() []*remoteAgent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	agents := make([]*remoteAgent, 0, len(s.agents))
+	for _, agent := range s.agents {
+		if agent.alive {
+			agents = append(agents, agent)
+		}
+	}
+	return agents
+}
+
+// Agent returns the alive agent of the url, nil is returned if not found.
+func (s *remoteScheduler) Agent(url string) *remoteAgent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, agent := range s.agents {
+		if agent.alive && agent.url == url {
+			return agent
+		}
+	}
+	return nil
+}
+
+// Heartbeat acknowledges sessions finished by the agent, they are dropped from
+// the agent and only counted since then.
+func (s *remoteScheduler) Heartbeat(agent *remoteAgent, status *playJobStatus) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	agent.lastSeen = time.Now()
+	agent.failures = 0
+	agent.lagging = status.Lagging
+	for _, task := range status.Tasks {
+		if !task.Finished {
+			continue
+		}
+		id, err := strconv.ParseUint(task.ID, 16, 64)
+		if err != nil {
+			continue
+		}
+		key := sessionKey{file: task.File, offset: task.Offset, id: id}
+		if _, ok := agent.sessions[key]; ok {
+			delete(agent.sessions, key)
+			agent.finished += 1
+		}
+	}
+	if status.Capacity != nil {
+		s.update(agent, status.Capacity)
+	}
+}
+
+// Miss records a failed status query, the agent is considered lost if it
+// hasn't responded within the timeout, and its unfinished sessions are
+// returned for reassignment.
+func (s *remoteScheduler) Miss(agent *remoteAgent) []*playWorker {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !agent.alive || time.Since(agent.lastSeen) < s.timeout {
+		return nil
+	}
+	return s.drop(agent)
+}
+
+func (s *remoteScheduler) Unfinished() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cnt := len(s.orphans)
+	for _, agent := range s.agents {
+		cnt += len(agent.sessions)
+	}
+	return cnt
+}
+
+// Progress returns sessions assigned to and finished by each agent.
+func (s *remoteScheduler) Progress() []progressRow {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rows := make([]progressRow, 0, len(s.agents))
+	for _, agent := range s.agents {
+		rows = append(rows, progressRow{
+			Name:     agent.url,
+			Alive:    agent.alive,
+			Total:    len(agent.sessions) + agent.finished,
+			Finished: agent.finished,
+			Lagging:  agent.lagging,
+		})
+	}
+	return rows
+}
+
+// Barrier distributes a shared play start time (which is delay later than now)
+// to all alive agents and waits for their acknowledgements. Clock offsets of
+// agents are estimated by a round trip beforehand, agents failing to ack are
+// dropped. The play start time in the clock of the controller is returned.
+func (s *remoteScheduler) Barrier(transport agentTransport, job string, origStart int64, delay time.Duration) (int64, error) {
+	agents := s.Alive()
+	for _, agent := range agents {
+		t0 := time.Now().UnixNano() / int64(time.Millisecond)
+		ack, err := transport.Prepare(agent.url, job, playJobClock{})
+		if err != nil {
+			zap.L().Error("sync clock with agent", zap.String("agent", agent.url), zap.Error(err))
+			s.Drop(agent)
+			continue
+		}
+		t1 := time.Now().UnixNano() / int64(time.Millisecond)
+		agent.offset = ack.Now - (t0+t1)/2
+		zap.L().Info("agent clock synced", zap.String("agent", agent.url), zap.Int64("offset", agent.offset), zap.Int64("rtt", t1-t0))
+	}
+	start := time.Now().Add(delay).UnixNano() / int64(time.Millisecond)
+	for _, agent := range s.Alive() {
+		if _, err := transport.Prepare(agent.url, job, playJobClock{PlayStart: start + agent.offset, OrigStart: origStart}); err != nil {
+			zap.L().Error("prepare job on agent", zap.String("agent", agent.url), zap.Error(err))
+			s.Drop(agent)
+		}
+	}
+	if len(s.Alive()) == 0 {
+		return 0, errors.New("no agent acknowledged the start barrier")
+	}
+	if now := time.Now().UnixNano() / int64(time.Millisecond); now >= start {
+		return 0, errors.Errorf("start barrier took longer than %s", delay)
+	}
+	return start, nil
+}
+
+// Drop marks the agent as lost, it must not have sessions assigned.
+func (s *remoteScheduler) Drop(agent *remoteAgent) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.orphans = append(s.orphans, s.drop(agent)...)
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteSchedulerSessions(t *testing.T) {
+	s := newRemoteScheduler([]string{"a"}, time.Minute)
+	workers := []*playWorker{
+		{file: "capture-1/1-0.tsv", id: 1},
+		{file: "capture-2/1-0.tsv", id: 1},
+		{file: "part-0.tsv", offset: 0, id: 2},
+		{file: "part-0.tsv", offset: 128, id: 2},
+	}
+	for _, w := range workers {
+		require.NotNil(t, s.Assign(w))
+	}
+	require.Equal(t, 4, s.Unfinished())
+
+	agent := s.Agent("a")
+	status := &playJobStatus{Tasks: []playTaskDetail{
+		{ID: "0000000000000001", File: "capture-2/1-0.tsv", Finished: true},
+		{ID: "0000000000000002", File: "part-0.tsv", Offset: 128, Finished: true},
+		{ID: "0000000000000002", File: "part-0.tsv", Finished: false},
+	}}
+	s.Heartbeat(agent, status)
+	require.Equal(t, 2, s.Unfinished())
+	require.Len(t, agent.sessions, 2)
+	// finished sessions are acknowledged only once
+	s.Heartbeat(agent, status)
+	require.Equal(t, []progressRow{{Name: "a", Alive: true, Total: 4, Finished: 2}}, s.Progress())
+
+	s.Drop(agent)
+	require.ElementsMatch(t, []*playWorker{workers[0], workers[2]}, s.Orphans())
+}
@@ -0,0 +1,485 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+type latencySummary struct {
+	Count int64         `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P95   time.Duration `json:"p95"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+func summarizeLatency(h *stats.Histogram) latencySummary {
+	return latencySummary{
+		Count: h.Count(),
+		Mean:  h.Mean(),
+		P50:   h.Quantile(.5),
+		P90:   h.Quantile(.9),
+		P95:   h.Quantile(.95),
+		P99:   h.Quantile(.99),
+		Max:   h.Max(),
+	}
+}
+
+// laggingPoint is a sample of the lagging, the pace of the replay (captured
+// time replayed per intended time, which is below 1 while falling behind and
+// above 1 while catching up) and the fidelity score of events paced since the
+// previous sample.
+type laggingPoint struct {
+	Time     time.Time     `json:"time"`
+	Lagging  time.Duration `json:"lagging"`
+	Pace     float64       `json:"pace"`
+	Fidelity float64       `json:"fidelity"`
+}
+
+type playReport struct {
+	Start    time.Time        `json:"start"`
+	End      time.Time        `json:"end"`
+	Duration time.Duration    `json:"duration"`
+	Totals   map[string]int64 `json:"totals"`
+	Failures map[string]int64 `json:"failures"`
+	Samples  []agentFailure   `json:"failure_samples,omitempty"`
+	Latency  latencySummary   `json:"latency"`
+	Lagging  []laggingPoint   `json:"lagging"`
+	Digests  []digestStat     `json:"digests"`
+	// Regressed are digests ordered by the ratio of their latencies in the
+	// replay to the ones in the capture, which are dumped with results only.
+	Regressed []digestStat `json:"regressed,omitempty"`
+	// Fidelity is how closely events are paced as captured, it's only
+	// available if events are paced locally.
+	Fidelity *fidelityReport `json:"fidelity,omitempty"`
+
+	Incompatible []incompatibleStat `json:"incompatible,omitempty"`
+	// FailureGroups aggregates failures by error code and digest.
+	FailureGroups []stats.FailureGroup `json:"failure_groups,omitempty"`
+	// Stragglers are connections fell behind the most.
+	Stragglers []stats.ProgressInfo `json:"stragglers,omitempty"`
+	// Labeled are stats per target, job, agent and schema.
+	Labeled []stats.LabeledStat `json:"labeled,omitempty"`
+}
+
+type fidelityReport struct {
+	Score float64 `json:"score"`
+	stats.PacingStat
+}
+
+// incompatibleStat counts statements of a digest failed due to syntax or
+// features not supported by the target (TiDB).
+type incompatibleStat struct {
+	Digest string `json:"digest"`
+	Sample string `json:"sample"`
+	Error  string `json:"error"`
+	Count  int64  `json:"count"`
+}
+
+// reportCollector gathers what is needed by the final report while playing.
+type reportCollector struct {
+	start    time.Time
+	latency  *stats.Histogram
+	lock     sync.Mutex
+	failures map[string]int64
+	samples  []agentFailure
+	lagging  []laggingPoint
+	pacing   stats.PacingStat
+	stats    *stats.Registry
+
+	incompatible map[string]*incompatibleStat
+}
+
+const maxFailureSamples = 1000
+
+func newReportCollector(reg *stats.Registry) *reportCollector {
+	return &reportCollector{
+		start:    time.Now(),
+		latency:  stats.NewHistogram(),
+		failures: make(map[string]int64),
+		stats:    reg,
+
+		incompatible: make(map[string]*incompatibleStat),
+	}
+}
+
+func (rc *reportCollector) Observe(d time.Duration, err error) {
+	if rc == nil {
+		return
+	}
+	rc.latency.Observe(d)
+	if err == nil {
+		return
+	}
+	rc.lock.Lock()
+	rc.failures[errorCode(err)] += 1
+	rc.lock.Unlock()
+}
+
+// ObserveRemote counts failures reported by agents by the increases of their
+// counts and keeps a bounded number of them as samples.
+func (rc *reportCollector) ObserveRemote(failures []agentFailure, counts []agentFailureCount) {
+	if rc == nil {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	for _, c := range counts {
+		rc.failures[c.Code] += c.Count
+	}
+	for _, f := range failures {
+		if len(rc.samples) < maxFailureSamples {
+			rc.samples = append(rc.samples, f)
+		}
+	}
+}
+
+// ObserveIncompatible records a statement failed due to syntax or features not
+// supported by the target.
+func (rc *reportCollector) ObserveIncompatible(digest string, query string, err error) {
+	if rc == nil {
+		return
+	}
+	if len(digest) == 0 {
+		digest = event.Digest(query)
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	s, ok := rc.incompatible[digest]
+	if !ok {
+		s = &incompatibleStat{Digest: digest, Sample: formatSample(query), Error: err.Error()}
+		rc.incompatible[digest] = s
+	}
+	s.Count += 1
+}
+
+// topFailureGroups is the number of failure groups in periodic stats.
+const topFailureGroups = 3
+
+// describeFailure returns the error code, the digest and a sample of the
+// failed statement of an event.
+func describeFailure(e *event.MySQLEvent, res replay.Result, err error) (string, string, string) {
+	query := res.Query
+	if len(query) == 0 {
+		query = e.Query
+	}
+	digest := res.Digest
+	if len(digest) == 0 && len(query) > 0 {
+		digest = event.Digest(query)
+	}
+	sample := formatSample(query)
+	if e.Type == event.EventStmtExecute && len(e.Params) > 0 {
+		sample += fmt.Sprintf(" %v", e.Params)
+	}
+	return errorCode(err), digest, sample
+}
+
+// formatFailureGroups formats failure groups like `1146/9a8b7c6d x12`.
+func formatFailureGroups(groups []stats.FailureGroup) []string {
+	out := make([]string, len(groups))
+	for i, g := range groups {
+		digest := g.Digest
+		if len(digest) > 8 {
+			digest = digest[:8]
+		}
+		out[i] = fmt.Sprintf("%s/%s x%d", g.Code, digest, g.Count)
+	}
+	return out
+}
+
+// reportFailures logs the top n failure groups with their samples.
+func reportFailures(log *zap.Logger, reg *stats.Registry, n int) {
+	if n <= 0 {
+		return
+	}
+	for i, g := range reg.Failures(n) {
+		log.Warn("failed statements",
+			zap.Int("rank", i+1),
+			zap.String("code", g.Code),
+			zap.String("digest", g.Digest),
+			zap.Int64("count", g.Count),
+			zap.Strings("samples", g.Samples))
+	}
+}
+
+const (
+	// maxStragglers is the number of stragglers in the final report.
+	maxStragglers = 100
+	// stragglerMinLagging is the lagging a connection must have reached to be
+	// considered as a straggler.
+	stragglerMinLagging = time.Second
+)
+
+// eventFields returns fields of counts of events by type and the coverage of
+// the capture, which is the fraction of events decoded among all events,
+// client commands skipped and packets failed to decode.
+func eventFields(metrics map[string]int64) []zap.Field {
+	var (
+		events  = make(map[string]int64)
+		decoded int64
+	)
+	for name, n := range metrics {
+		if !strings.HasPrefix(name, stats.EventsPrefix) {
+			continue
+		}
+		t := strings.TrimPrefix(name, stats.EventsPrefix)
+		events[t] = n
+		if t != "unknown" {
+			decoded += n
+		}
+	}
+	total := decoded + events["unknown"] + metrics[stats.SkippedCommands] + metrics[stats.UndecodedPackets]
+	if total == 0 {
+		return nil
+	}
+	fields := []zap.Field{zap.Any("events", events), zap.String("coverage", fmt.Sprintf("%.2f%%", float64(decoded)*100/float64(total)))}
+	if n := metrics[stats.SkippedCommands]; n > 0 {
+		skipped := make(map[string]int64)
+		for name, n := range metrics {
+			if strings.HasPrefix(name, stats.SkippedCommands+".") {
+				skipped[strings.TrimPrefix(name, stats.SkippedCommands+".")] = n
+			}
+		}
+		fields = append(fields, zap.Any(stats.SkippedCommands, skipped))
+	}
+	if n := metrics[stats.UndecodedPackets]; n > 0 {
+		fields = append(fields, zap.Int64(stats.UndecodedPackets, n))
+	}
+	return fields
+}
+
+// reportPacing logs the fidelity score of a paced replay, which tells how
+// closely the replay matches the captured timing.
+func reportPacing(log *zap.Logger, reg *stats.Registry) {
+	p := reg.Pacing()
+	if p.Events == 0 {
+		return
+	}
+	log.Info("pacing",
+		zap.String("fidelity", fmt.Sprintf("%.2f", p.Score())),
+		zap.Int64("events", p.Events),
+		zap.Int64("on_time", p.OnTime),
+		zap.Duration("tolerance", stats.PacingTolerance),
+		zap.Duration("mean_delay", p.Mean),
+		zap.Duration("p99_delay", p.P99),
+		zap.Duration("max_delay", p.Max))
+}
+
+// reportFetches logs result sets read fully by --fetch-rows.
+func reportFetches(log *zap.Logger, reg *stats.Registry) {
+	f := reg.Fetches()
+	if f.ResultSets == 0 {
+		return
+	}
+	log.Info("fetches",
+		zap.Int64("result_sets", f.ResultSets),
+		zap.Int64("truncated", f.Truncated),
+		zap.Int64("rows", f.Rows),
+		zap.Int64("bytes", f.Bytes),
+		zap.Duration("mean_first_row", f.FirstRowMean),
+		zap.Duration("p99_first_row", f.FirstRowP99),
+		zap.Duration("mean_fetch", f.FetchMean),
+		zap.Duration("p99_fetch", f.FetchP99))
+}
+
+// reportLabeled logs stats per target, job, agent and schema.
+func reportLabeled(log *zap.Logger, reg *stats.Registry) {
+	for _, s := range reg.Labeled() {
+		log.Info("labeled stats",
+			zap.String("target", s.Target),
+			zap.String("job", s.Job),
+			zap.String("agent", s.Agent),
+			zap.String("schema", s.Schema),
+			zap.Int64("statements", s.Statements),
+			zap.Int64("failures", s.Failures),
+			zap.Duration("mean", s.Mean),
+			zap.Duration("p99", s.P99),
+			zap.Duration("max", s.Max))
+	}
+}
+
+// reportStragglers logs the top n connections fell behind the most.
+func reportStragglers(log *zap.Logger, reg *stats.Registry, n int) {
+	if n <= 0 {
+		return
+	}
+	for i, p := range reg.Stragglers(n, stragglerMinLagging) {
+		log.Warn("straggler",
+			zap.Int("rank", i+1),
+			zap.String("session", fmt.Sprintf("%016x", p.ID)),
+			zap.String("name", p.Name),
+			zap.Int64("events", p.Events),
+			zap.String("progress", fmt.Sprintf("%.1f%%", p.Percent)),
+			zap.Duration("max_lagging", p.MaxLagging),
+			zap.Duration("lagging", p.Lagging),
+			zap.Bool("done", p.Done))
+	}
+}
+
+func errorCode(err error) string {
+	if myErr, ok := mysqlError(err); ok {
+		return strconv.Itoa(int(myErr.Number))
+	} else if _, ok := errors.Cause(err).(*replay.AffectedRowsError); ok {
+		return "affected"
+	}
+	return "unknown"
+}
+
+func (rc *reportCollector) SampleLagging(t time.Time, d time.Duration) {
+	if rc == nil {
+		return
+	}
+	pacing := rc.stats.Pacing()
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	last := laggingPoint{Time: rc.start}
+	if n := len(rc.lagging); n > 0 {
+		last = rc.lagging[n-1]
+	}
+	p := laggingPoint{Time: t, Lagging: d, Pace: 1, Fidelity: pacing.Since(rc.pacing).Score()}
+	if dt := t.Sub(last.Time); dt > 0 {
+		p.Pace = math.Max(0, float64(dt-(d-last.Lagging))/float64(dt))
+	}
+	rc.lagging = append(rc.lagging, p)
+	rc.pacing = pacing
+}
+
+func (rc *reportCollector) Build(digests *digestStats) *playReport {
+	r := &playReport{
+		Start:    rc.start,
+		End:      time.Now(),
+		Totals:   rc.stats.Dump(),
+		Failures: make(map[string]int64),
+		Latency:  summarizeLatency(rc.latency),
+	}
+	r.Duration = r.End.Sub(r.Start)
+	rc.lock.Lock()
+	for k, v := range rc.failures {
+		r.Failures[k] = v
+	}
+	r.Samples = append(r.Samples, rc.samples...)
+	r.Lagging = append(r.Lagging, rc.lagging...)
+	for _, s := range rc.incompatible {
+		r.Incompatible = append(r.Incompatible, *s)
+	}
+	rc.lock.Unlock()
+	sort.Slice(r.Incompatible, func(i, j int) bool { return r.Incompatible[i].Count > r.Incompatible[j].Count })
+	if digests != nil {
+		r.Digests = digests.Slowest(-1)
+		r.Regressed = digests.Regressed(-1)
+	}
+	r.FailureGroups = rc.stats.Failures(-1)
+	r.Stragglers = rc.stats.Stragglers(maxStragglers, stragglerMinLagging)
+	r.Labeled = rc.stats.Labeled()
+	if p := rc.stats.Pacing(); p.Events > 0 {
+		r.Fidelity = &fidelityReport{Score: p.Score(), PacingStat: p}
+	}
+	return r
+}
+
+// LogIncompatible logs statements failed only due to unsupported syntax or
+// features, which is the compatibility report of tidb mode.
+func (r *playReport) LogIncompatible(log *zap.Logger) {
+	for _, s := range r.Incompatible {
+		log.Warn("incompatible statement",
+			zap.String("digest", s.Digest),
+			zap.Int64("count", s.Count),
+			zap.String("error", s.Error),
+			zap.String("sample", s.Sample))
+	}
+}
+
+func (r *playReport) WriteJSON(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return errors.Trace(enc.Encode(r))
+}
+
+func (r *playReport) WriteHTML(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+	return errors.Trace(reportTemplate.Execute(f, r))
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>mysql-replay report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; text-align: left; }
+td.sql { font-family: monospace; max-width: 60em; overflow-wrap: anywhere; }
+</style>
+</head>
+<body>
+<h1>mysql-replay report</h1>
+<p>{{.Start.Format "2006-01-02 15:04:05"}} ~ {{.End.Format "2006-01-02 15:04:05"}} ({{.Duration}})</p>
+<h2>Totals</h2>
+<table>{{range $k, $v := .Totals}}<tr><th>{{$k}}</th><td>{{$v}}</td></tr>{{end}}</table>
+<h2>Latency</h2>
+<table>
+<tr><th>count</th><th>mean</th><th>p50</th><th>p90</th><th>p95</th><th>p99</th><th>max</th></tr>
+<tr><td>{{.Latency.Count}}</td><td>{{.Latency.Mean}}</td><td>{{.Latency.P50}}</td><td>{{.Latency.P90}}</td><td>{{.Latency.P95}}</td><td>{{.Latency.P99}}</td><td>{{.Latency.Max}}</td></tr>
+</table>
+<h2>Failures</h2>
+<table><tr><th>error code</th><th>count</th></tr>{{range $k, $v := .Failures}}<tr><td>{{$k}}</td><td>{{$v}}</td></tr>{{end}}</table>
+{{if .Samples}}<table><tr><th>time</th><th>agent</th><th>session</th><th>event</th><th>error</th></tr>
+{{range .Samples}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Agent}}</td><td>{{.Session}}</td><td class="sql">{{.Event}}</td><td>{{.Error}}</td></tr>
+{{end}}</table>{{end}}
+{{if .FailureGroups}}<table><tr><th>error code</th><th>digest</th><th>count</th><th>samples</th></tr>
+{{range .FailureGroups}}<tr><td>{{.Code}}</td><td>{{.Digest}}</td><td>{{.Count}}</td><td class="sql">{{range .Samples}}{{.}}<br>{{end}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Incompatible}}<h2>Incompatible</h2>
+<table><tr><th>digest</th><th>count</th><th>error</th><th>sample</th></tr>
+{{range .Incompatible}}<tr><td>{{.Digest}}</td><td>{{.Count}}</td><td>{{.Error}}</td><td class="sql">{{.Sample}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Stragglers}}<h2>Stragglers</h2>
+<table><tr><th>session</th><th>name</th><th>events</th><th>progress</th><th>max lagging</th><th>done</th></tr>
+{{range .Stragglers}}<tr><td>{{printf "%016x" .ID}}</td><td>{{.Name}}</td><td>{{.Events}}</td><td>{{printf "%.1f%%" .Percent}}</td><td>{{.MaxLagging}}</td><td>{{.Done}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Labeled}}<h2>Targets</h2>
+<table><tr><th>target</th><th>job</th><th>agent</th><th>schema</th><th>statements</th><th>failures</th><th>mean</th><th>p99</th><th>max</th></tr>
+{{range .Labeled}}<tr><td>{{.Target}}</td><td>{{.Job}}</td><td>{{.Agent}}</td><td>{{.Schema}}</td><td>{{.Statements}}</td><td>{{.Failures}}</td><td>{{.Mean}}</td><td>{{.P99}}</td><td>{{.Max}}</td></tr>
+{{end}}</table>{{end}}
+<h2>Lagging</h2>
+{{with .Fidelity}}<p>fidelity score: {{printf "%.2f" .Score}} ({{.OnTime}} of {{.Events}} events on time, mean delay {{.Mean}}, p99 delay {{.P99}}, max delay {{.Max}})</p>{{end}}
+<table><tr><th>time</th><th>lagging</th><th>pace</th><th>fidelity</th></tr>{{range .Lagging}}<tr><td>{{.Time.Format "15:04:05"}}</td><td>{{.Lagging}}</td><td>{{printf "%.2f" .Pace}}</td><td>{{printf "%.2f" .Fidelity}}</td></tr>{{end}}</table>
+<h2>Digests</h2>
+<table>
+<tr><th>digest</th><th>count</th><th>avg</th><th>max</th><th>sample</th></tr>
+{{range .Digests}}<tr><td>{{.Digest}}</td><td>{{.Count}}</td><td>{{.Avg}}</td><td>{{.Max}}</td><td class="sql">{{.Sample}}</td></tr>
+{{end}}</table>
+{{if .Regressed}}<h2>Regressed</h2>
+<table>
+<tr><th>digest</th><th>count</th><th>ratio</th><th>sample</th></tr>
+{{range .Regressed}}<tr><td>{{.Digest}}</td><td>{{.Captured}}</td><td>{{printf "%.2f" .Ratio}}</td><td class="sql">{{.Sample}}</td></tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`))
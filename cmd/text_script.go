@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/replay"
+	"go.uber.org/zap"
+)
+
+const (
+	scriptBefore = "before"
+	scriptAfter  = "after"
+)
+
+// isSQLScript tells whether the script is a sql file instead of a shell
+// command.
+func isSQLScript(script string) bool {
+	return strings.HasSuffix(strings.ToLower(script), ".sql")
+}
+
+// RunScript runs the script of the phase (before or after the replay), which
+// is either a sql file executed on the target, or a shell command run with the
+// phase, the input and the target dsn in its environment (MYSQL_REPLAY_PHASE,
+// MYSQL_REPLAY_INPUT and MYSQL_REPLAY_TARGET_DSN).
+func (pc *playControl) RunScript(ctx context.Context, phase string, script string) error {
+	t := time.Now()
+	log := pc.log.With(zap.String("phase", phase), zap.String("script", script))
+	log.Info("run script")
+	var err error
+	if isSQLScript(script) {
+		err = pc.runSQLScript(ctx, script)
+	} else {
+		cmd := exec.CommandContext(ctx, "sh", "-c", script)
+		cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+		cmd.Env = append(os.Environ(), "MYSQL_REPLAY_PHASE="+phase, "MYSQL_REPLAY_INPUT="+pc.source)
+		if pc.MySQLConfig != nil {
+			cmd.Env = append(cmd.Env, "MYSQL_REPLAY_TARGET_DSN="+pc.MySQLConfig.FormatDSN())
+		}
+		err = errors.Trace(cmd.Run())
+	}
+	if err != nil {
+		return errors.Annotatef(err, "run %s script", phase)
+	}
+	log.Info("script done", zap.Duration("duration", time.Since(t)))
+	return nil
+}
+
+// runSQLScript executes statements of the sql file on a connection of the
+// target.
+func (pc *playControl) runSQLScript(ctx context.Context, path string) error {
+	if pc.MySQLConfig == nil {
+		return errors.New("sql scripts require a target")
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	driver, err := replay.LookupDriver(pc.Driver)
+	if err != nil {
+		return err
+	}
+	cfg := pc.MySQLConfig.Clone()
+	cfg.MultiStatements = true
+	conn, err := driver.Connect(ctx, cfg)
+	if err != nil {
+		return errors.Annotate(err, "connect to target")
+	}
+	defer conn.Close()
+	_, err = conn.Exec(ctx, string(content))
+	return errors.Trace(err)
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+)
+
+const (
+	sqlStylePrepare     = "prepare"
+	sqlStyleInterpolate = "interpolate"
+)
+
+// sqlScriptWriter renders events of a session into a sql script which can be
+// executed by any mysql client. Scripts start by turning NO_BACKSLASH_ESCAPES
+// off, which string literals rely on (see event.AppendQuotedString).
+type sqlScriptWriter struct {
+	style string
+	out   *os.File
+	w     *bufio.Writer
+	buf   []byte
+	stmts map[uint64]string
+}
+
+func newSQLScriptWriter(dir string, src string, style string) (*sqlScriptWriter, error) {
+	if style != sqlStylePrepare && style != sqlStyleInterpolate {
+		return nil, errors.New("unknown sql style: " + style)
+	}
+	name := strings.TrimSuffix(filepath.Base(src), filepath.Ext(src)) + ".sql"
+	out, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sw := &sqlScriptWriter{
+		style: style,
+		out:   out,
+		w:     bufio.NewWriterSize(out, 65536),
+		stmts: make(map[uint64]string),
+	}
+	sw.w.WriteString(sqlScriptPreamble)
+	return sw, nil
+}
+
+const sqlScriptPreamble = "SET SESSION sql_mode = REPLACE(@@SESSION.sql_mode, 'NO_BACKSLASH_ESCAPES', '');\n"
+
+// appendStatement appends the query terminated by `;`, which goes to a new
+// line if the query ends in a line comment.
+func appendStatement(buf []byte, query string) []byte {
+	buf = append(buf, query...)
+	if event.EndsInLineComment(query) {
+		buf = append(buf, '\n')
+	}
+	return append(buf, ";\n"...)
+}
+
+func (sw *sqlScriptWriter) Write(e *event.MySQLEvent) error {
+	var err error
+	buf := sw.buf[:0]
+	id := strconv.FormatUint(e.StmtID, 10)
+	switch e.Type {
+	case event.EventHandshake:
+		buf = append(buf, "-- connect @"...)
+		buf = strconv.AppendInt(buf, e.Time, 10)
+		buf = append(buf, '\n')
+		if name := replay.CollationName(e.Charset); len(name) > 0 {
+			buf = append(buf, "SET NAMES "+replay.CharsetOfCollation(name)+" COLLATE "+name+";\n"...)
+		}
+		if len(e.DB) > 0 {
+			buf = append(buf, "USE `"...)
+			buf = append(buf, strings.ReplaceAll(e.DB, "`", "``")...)
+			buf = append(buf, "`;\n"...)
+		}
+	case event.EventStmtFetch:
+		buf = append(buf, "-- fetch stmt"+id+" rows "...)
+		buf = strconv.AppendUint(buf, e.Rows, 10)
+		buf = append(buf, '\n')
+	case event.EventInitDB:
+		buf = append(buf, "USE `"...)
+		buf = append(buf, strings.ReplaceAll(e.DB, "`", "``")...)
+		buf = append(buf, "`;\n"...)
+	case event.EventGap:
+		buf = append(buf, "-- gap of "...)
+		buf = strconv.AppendUint(buf, e.Gap, 10)
+		buf = append(buf, " bytes lost in capture @"...)
+		buf = strconv.AppendInt(buf, e.Time, 10)
+		buf = append(buf, '\n')
+	case event.EventResult:
+		buf = append(buf, "-- affected rows "...)
+		buf = strconv.AppendUint(buf, e.Affected, 10)
+		buf = append(buf, '\n')
+	case event.EventQuit:
+		buf = append(buf, "-- quit @"...)
+		buf = strconv.AppendInt(buf, e.Time, 10)
+		buf = append(buf, '\n')
+	case event.EventQuery:
+		buf = appendStatement(buf, e.Query)
+	case event.EventStmtPrepare:
+		sw.stmts[e.StmtID] = e.Query
+		if sw.style == sqlStylePrepare {
+			buf = append(buf, "PREPARE stmt"+id+" FROM "...)
+			buf = event.AppendQuotedString(buf, e.Query)
+			buf = append(buf, ";\n"...)
+		}
+	case event.EventStmtExecute:
+		if sw.style == sqlStyleInterpolate {
+			query, ok := sw.stmts[e.StmtID]
+			if !ok {
+				return errors.Errorf("no such statement #%d", e.StmtID)
+			}
+			query, err = event.Interpolate(query, e.Params)
+			if err != nil {
+				return err
+			}
+			buf = appendStatement(buf, query)
+			break
+		}
+		if len(e.Params) > 0 {
+			buf = append(buf, "SET "...)
+			for i, param := range e.Params {
+				if i > 0 {
+					buf = append(buf, ", "...)
+				}
+				buf = append(buf, "@p"...)
+				buf = strconv.AppendInt(buf, int64(i), 10)
+				buf = append(buf, " = "...)
+				if buf, err = event.AppendSQLLiteral(buf, param); err != nil {
+					return err
+				}
+			}
+			buf = append(buf, ";\n"...)
+		}
+		buf = append(buf, "EXECUTE stmt"+id...)
+		for i := range e.Params {
+			if i == 0 {
+				buf = append(buf, " USING "...)
+			} else {
+				buf = append(buf, ", "...)
+			}
+			buf = append(buf, "@p"...)
+			buf = strconv.AppendInt(buf, int64(i), 10)
+		}
+		buf = append(buf, ";\n"...)
+	case event.EventStmtClose:
+		delete(sw.stmts, e.StmtID)
+		if sw.style == sqlStylePrepare {
+			buf = append(buf, "DEALLOCATE PREPARE stmt"+id+";\n"...)
+		}
+	default:
+		return errors.Errorf("unknown event type: %v", e.Type)
+	}
+	sw.buf = buf
+	_, err = sw.w.Write(buf)
+	return err
+}
+
+func (sw *sqlScriptWriter) Close() error {
+	if err := sw.w.Flush(); err != nil {
+		sw.out.Close()
+		return err
+	}
+	return sw.out.Close()
+}
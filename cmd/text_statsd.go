@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+// statsdMaxPacket keeps packets within the mtu of common networks.
+const statsdMaxPacket = 1432
+
+// statsdGauges are metrics going up and down, other metrics are monotonic
+// counters which are pushed as deltas.
+var statsdGauges = map[string]bool{
+	stats.Connections: true,
+	stats.ConnRunning: true,
+	stats.ConnWaiting: true,
+}
+
+// statsdClient pushes metrics over udp in the statsd protocol, tags are
+// appended in the dogstatsd format (|#key:value,...).
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	tags   string
+	rate   float64
+	log    *zap.Logger
+	stats  *stats.Registry
+
+	lock sync.Mutex
+	buf  []byte
+	rnd  *rand.Rand
+	// last values of counters are guarded by pushLock.
+	pushLock sync.Mutex
+	last     map[string]int64
+}
+
+// newStatsdClient returns a client pushing to the addr, rate is the sample rate
+// of timings of statements.
+func newStatsdClient(reg *stats.Registry, addr string, prefix string, tags []string, rate float64) (*statsdClient, error) {
+	if rate <= 0 || rate > 1 {
+		return nil, errors.New("statsd sample rate should be in (0, 1]")
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, errors.Annotate(err, "dial statsd")
+	}
+	c := &statsdClient{
+		conn:   conn,
+		prefix: prefix,
+		rate:   rate,
+		log:    zap.L().Named("statsd"),
+		stats:  reg,
+		buf:    make([]byte, 0, statsdMaxPacket),
+		rnd:    rand.New(rand.NewSource(time.Now().UnixNano())),
+		last:   make(map[string]int64),
+	}
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, ".") {
+		c.prefix += "."
+	}
+	if len(tags) > 0 {
+		c.tags = "|#" + strings.Join(tags, ",")
+	}
+	return c, nil
+}
+
+// statsdTags merges tags like key:value, tags given later override the ones
+// of the same key before.
+func statsdTags(tags ...string) []string {
+	var (
+		keys []string
+		vals = make(map[string]string, len(tags))
+	)
+	for _, tag := range tags {
+		kv := strings.SplitN(tag, ":", 2)
+		if _, ok := vals[kv[0]]; !ok {
+			keys = append(keys, kv[0])
+		}
+		vals[kv[0]] = tag
+	}
+	out := make([]string, len(keys))
+	for i, k := range keys {
+		out[i] = vals[k]
+	}
+	return out
+}
+
+func (c *statsdClient) send(name string, value string, typ string, rate float64) {
+	line := c.prefix + name + ":" + value + "|" + typ
+	if rate < 1 {
+		line += "|@" + strconv.FormatFloat(rate, 'f', -1, 64)
+	}
+	line += c.tags
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.buf) > 0 && len(c.buf)+1+len(line) > statsdMaxPacket {
+		c.flush()
+	}
+	if len(c.buf) > 0 {
+		c.buf = append(c.buf, '\n')
+	}
+	c.buf = append(c.buf, line...)
+}
+
+func (c *statsdClient) flush() {
+	if len(c.buf) == 0 {
+		return
+	}
+	if _, err := c.conn.Write(c.buf); err != nil {
+		c.log.Debug("failed to push metrics", zap.Error(err))
+	}
+	c.buf = c.buf[:0]
+}
+
+// Timing pushes the latency of a statement, which is sampled by the rate.
+func (c *statsdClient) Timing(name string, d time.Duration) {
+	if c.rate < 1 {
+		c.lock.Lock()
+		skip := c.rnd.Float64() >= c.rate
+		c.lock.Unlock()
+		if skip {
+			return
+		}
+	}
+	c.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64), "ms", c.rate)
+}
+
+// Push pushes the current stats, counters are pushed as deltas since the last
+// push.
+func (c *statsdClient) Push() {
+	c.pushLock.Lock()
+	defer c.pushLock.Unlock()
+	metrics := c.stats.Dump()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := metrics[name]
+		if statsdGauges[name] {
+			c.send(name, strconv.FormatInt(v, 10), "g", 1)
+			continue
+		}
+		if delta := v - c.last[name]; delta != 0 {
+			c.send(name, strconv.FormatInt(delta, 10), "c", 1)
+		}
+		c.last[name] = v
+	}
+	c.send("lagging", strconv.FormatInt(c.stats.GetLagging().Milliseconds(), 10), "g", 1)
+	c.lock.Lock()
+	c.flush()
+	c.lock.Unlock()
+}
+
+// Run pushes stats every interval until done.
+func (c *statsdClient) Run(done <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			c.Push()
+		}
+	}
+}
+
+func (c *statsdClient) Close() error {
+	c.lock.Lock()
+	c.flush()
+	c.lock.Unlock()
+	return c.conn.Close()
+}
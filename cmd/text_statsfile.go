@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+// statsFileColumns are counters written into stats files, columns of csv files
+// are fixed by the header thus counters appearing later are never missed.
+var statsFileColumns = []string{
+	stats.Connections, stats.ConnRunning, stats.ConnWaiting,
+	stats.Queries, stats.StmtExecutes, stats.StmtPrepares,
+	stats.FailedQueries, stats.FailedStmtExecutes, stats.FailedStmtPrepares,
+	stats.Retries, stats.Reconnects, stats.AffectedRowsMismatches, stats.StmtEvictions,
+	stats.MirrorCompared, stats.MirrorDiffs,
+	stats.BgQueries, stats.FailedBgQueries,
+}
+
+// statsFile writes a row of counters and rates derived from them per report
+// interval, as csv if the path ends with .csv or json lines otherwise.
+type statsFile struct {
+	stats *stats.Registry
+	f     *os.File
+	w     *bufio.Writer
+	csv   *csv.Writer
+	start time.Time
+	last  time.Time
+	prev  map[string]int64
+}
+
+func newStatsFile(reg *stats.Registry, path string) (*statsFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	sf := &statsFile{stats: reg, f: f, w: bufio.NewWriter(f), start: time.Now()}
+	sf.last = sf.start
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		sf.csv = csv.NewWriter(sf.w)
+		header := append([]string{"time", "elapsed"}, statsFileColumns...)
+		header = append(header, "qps", "errors_per_sec", "lagging_ms")
+		if err = sf.csv.Write(header); err != nil {
+			f.Close()
+			return nil, errors.Trace(err)
+		}
+	}
+	return sf, nil
+}
+
+// Write writes a row of the current stats at t.
+func (sf *statsFile) Write(t time.Time) error {
+	var (
+		metrics = sf.stats.Dump()
+		secs    = t.Sub(sf.last).Seconds()
+		qps     float64
+		eps     float64
+		lagging = sf.stats.GetLagging().Milliseconds()
+	)
+	if secs > 0 {
+		delta := func(names ...string) float64 {
+			n := int64(0)
+			for _, name := range names {
+				n += metrics[name] - sf.prev[name]
+			}
+			return float64(n) / secs
+		}
+		qps = delta(stats.Queries, stats.StmtExecutes)
+		eps = delta(stats.FailedQueries, stats.FailedStmtExecutes, stats.FailedStmtPrepares)
+	}
+	sf.prev, sf.last = metrics, t
+	if sf.csv != nil {
+		row := []string{t.Format(time.RFC3339), strconv.FormatFloat(t.Sub(sf.start).Seconds(), 'f', 3, 64)}
+		for _, name := range statsFileColumns {
+			row = append(row, strconv.FormatInt(metrics[name], 10))
+		}
+		row = append(row, strconv.FormatFloat(qps, 'f', 2, 64), strconv.FormatFloat(eps, 'f', 2, 64), strconv.FormatInt(lagging, 10))
+		if err := sf.csv.Write(row); err != nil {
+			return errors.Trace(err)
+		}
+		if sf.csv.Flush(); sf.csv.Error() != nil {
+			return errors.Trace(sf.csv.Error())
+		}
+		return errors.Trace(sf.w.Flush())
+	}
+	row := map[string]interface{}{
+		"time":           t.Format(time.RFC3339),
+		"elapsed":        t.Sub(sf.start).Seconds(),
+		"qps":            qps,
+		"errors_per_sec": eps,
+		"lagging_ms":     lagging,
+	}
+	for name, v := range metrics {
+		row[name] = v
+	}
+	if err := json.NewEncoder(sf.w).Encode(row); err != nil {
+		return errors.Trace(err)
+	}
+	return errors.Trace(sf.w.Flush())
+}
+
+// Run writes a row every interval until done, then writes the final row and
+// closes the file. It stops writing on errors.
+func (sf *statsFile) Run(done <-chan struct{}, interval time.Duration, log *zap.Logger) {
+	defer func() {
+		if err := sf.Close(); err != nil {
+			log.Warn("failed to close stats file", zap.Error(err))
+		}
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			if err := sf.Write(time.Now()); err != nil {
+				log.Warn("failed to write stats file", zap.Error(err))
+			}
+			return
+		case t := <-ticker.C:
+			if err := sf.Write(t); err != nil {
+				log.Warn("failed to write stats file", zap.Error(err))
+				return
+			}
+		}
+	}
+}
+
+func (sf *statsFile) Close() error {
+	if err := sf.w.Flush(); err != nil {
+		sf.f.Close()
+		return errors.Trace(err)
+	}
+	return errors.Trace(sf.f.Close())
+}
@@ -0,0 +1,308 @@
+package cmd
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+// playThrottle is shared by play workers to pause, resume or change the speed
+// of the replay at runtime. It maintains a virtual clock (in ms) which goes at
+// rate times the configured speed and stops while paused, so that workers
+// continue from where they were instead of catching up.
+type playThrottle struct {
+	lock     sync.RWMutex
+	segments []throttleSegment
+	// starts caches virtual times of play starts passed, which never change
+	// since segments are only appended from now on.
+	starts  map[int64]float64
+	paused  bool
+	held    bool
+	rate    float64
+	changed chan struct{}
+}
+
+// throttleSegment is a period of the virtual clock starting from the wall
+// clock wall (in ms) going at rate.
+type throttleSegment struct {
+	wall int64
+	virt float64
+	rate float64
+}
+
+func newPlayThrottle() *playThrottle {
+	return &playThrottle{
+		segments: []throttleSegment{{rate: 1}},
+		starts:   make(map[int64]float64),
+		rate:     1,
+		changed:  make(chan struct{}),
+	}
+}
+
+func nowMillis() int64 { return time.Now().UnixNano() / int64(time.Millisecond) }
+
+func (pt *playThrottle) virtual(wall int64) float64 {
+	i := len(pt.segments) - 1
+	for i > 0 && pt.segments[i].wall > wall {
+		i -= 1
+	}
+	seg := pt.segments[i]
+	return seg.virt + seg.rate*float64(wall-seg.wall)
+}
+
+// start returns the virtual time of playStart, it's looked up in segments only
+// once playStart is passed, thus WaitTime doesn't slow down as segments grow.
+func (pt *playThrottle) start(playStart int64) (float64, throttleSegment) {
+	pt.lock.RLock()
+	virt, ok := pt.starts[playStart]
+	cur := pt.segments[len(pt.segments)-1]
+	pt.lock.RUnlock()
+	if ok {
+		return virt, cur
+	}
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	virt = pt.virtual(playStart)
+	if playStart <= nowMillis() {
+		pt.starts[playStart] = virt
+	}
+	return virt, pt.segments[len(pt.segments)-1]
+}
+
+// WaitTime returns how long to wait before an event happened t ms after
+// origStart, which is scheduled to replay at playStart with the given speed.
+func (pt *playThrottle) WaitTime(playStart int64, origStart int64, speed float64, t int64) time.Duration {
+	virt, cur := pt.start(playStart)
+	target := virt + float64(t-origStart)/speed
+	if cur.rate <= 0 {
+		// workers are woken up by Changed when resuming
+		return time.Duration(math.MaxInt64)
+	}
+	wall := float64(cur.wall) + (target-cur.virt)/cur.rate
+	return time.Duration((wall - float64(nowMillis())) * float64(time.Millisecond))
+}
+
+func (pt *playThrottle) update() {
+	now := nowMillis()
+	rate := pt.rate
+	if pt.paused {
+		rate = 0
+	}
+	pt.segments = append(pt.segments, throttleSegment{wall: now, virt: pt.virtual(now), rate: rate})
+	close(pt.changed)
+	pt.changed = make(chan struct{})
+}
+
+// SetPaused pauses or resumes the replay, it returns false if nothing changed.
+func (pt *playThrottle) SetPaused(paused bool) bool {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	if pt.paused == paused {
+		return false
+	}
+	pt.paused = paused
+	pt.update()
+	return true
+}
+
+// SetRate changes the speed of the replay to rate times the configured one.
+func (pt *playThrottle) SetRate(rate float64) {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	pt.rate = rate
+	pt.update()
+}
+
+func (pt *playThrottle) Rate() float64 {
+	if pt == nil {
+		return 1
+	}
+	pt.lock.RLock()
+	defer pt.lock.RUnlock()
+	return pt.rate
+}
+
+func (pt *playThrottle) Paused() bool {
+	if pt == nil {
+		return false
+	}
+	pt.lock.RLock()
+	defer pt.lock.RUnlock()
+	return pt.paused
+}
+
+// Changed returns a channel which is closed on the next change.
+func (pt *playThrottle) Changed() <-chan struct{} {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	return pt.changed
+}
+
+// Wait blocks while paused, it returns false if ctx is done.
+func (pt *playThrottle) Wait(ctx context.Context) bool {
+	for {
+		pt.lock.Lock()
+		paused, changed := pt.paused, pt.changed
+		pt.lock.Unlock()
+		if !paused {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+// SetHeld holds or releases sessions not started yet, it returns false if
+// nothing changed. Unlike pausing, sessions started go on as usual.
+func (pt *playThrottle) SetHeld(held bool) bool {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	if pt.held == held {
+		return false
+	}
+	pt.held = held
+	close(pt.changed)
+	pt.changed = make(chan struct{})
+	return true
+}
+
+// WaitHeld blocks while sessions are held, it returns false if ctx is done.
+func (pt *playThrottle) WaitHeld(ctx context.Context) bool {
+	if pt == nil {
+		return true
+	}
+	for {
+		pt.lock.Lock()
+		held, changed := pt.held, pt.changed
+		pt.lock.Unlock()
+		if !held {
+			return true
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-changed:
+		}
+	}
+}
+
+const (
+	adaptiveInterval = time.Second
+	adaptiveMinRate  = 0.01
+	// adaptiveMaxPending is the depth of the backlog of a connection (events
+	// due before it caught up) regarded as overloaded regardless of lagging,
+	// which reacts sooner to statements piling up behind a slow one.
+	adaptiveMaxPending = 100
+)
+
+// adapt lowers the rate of the replay while the target can't keep up, that is
+// the lagging exceeds maxLag or a connection has a backlog deeper than
+// adaptiveMaxPending, and recovers it gradually once both drop below half. New
+// sessions are held while the rate is at its min and the target is still
+// overloaded, since slowing down doesn't help then.
+func (pc *playControl) adapt(done <-chan struct{}, maxLag time.Duration) {
+	defer pc.Throttle.SetHeld(false)
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if pc.Throttle.Paused() {
+			continue
+		}
+		var (
+			lagging       = pc.Stats.GetLagging()
+			pending, busy = pc.Stats.GetPending()
+			rate          = pc.Throttle.Rate()
+			next          = rate
+			overloaded    = (lagging > maxLag || pending > adaptiveMaxPending) && pc.Stats.Get(stats.ConnRunning) > 0
+		)
+		if overloaded {
+			next = math.Max(rate*0.8, adaptiveMinRate)
+		} else if lagging < maxLag/2 && pending < adaptiveMaxPending/2 && rate < 1 {
+			next = math.Min(rate*1.1, 1)
+		}
+		if held := overloaded && rate <= adaptiveMinRate; pc.Throttle.SetHeld(held) {
+			if held {
+				pc.log.Warn("hold new sessions since the target is overloaded", zap.Duration("lagging", lagging), zap.Int64("pending", pending), zap.Int("conns", busy))
+			} else {
+				pc.log.Info("release new sessions", zap.Duration("lagging", lagging), zap.Int64("pending", pending))
+			}
+		}
+		if next == rate {
+			continue
+		}
+		pc.log.Info("adjust replay rate", zap.Duration("lagging", lagging), zap.Int64("pending", pending), zap.Int("conns", busy), zap.Float64("rate", next))
+		if err := pc.Control(playJobControl{Rate: &next}); err != nil {
+			pc.log.Warn("adjust replay rate", zap.Error(err))
+		}
+	}
+}
+
+const (
+	targetQPSMaxRate = 1000
+	targetQPSMaxStep = 2.0
+)
+
+// trackQPS adjusts the rate of the replay every adaptiveInterval, so that the
+// qps of queries and statement executions tracks target. The rate is not
+// raised while lagging exceeds maxLag, which means the target is saturated.
+func (pc *playControl) trackQPS(done <-chan struct{}, target float64, maxLag time.Duration) {
+	ticker := time.NewTicker(adaptiveInterval)
+	defer ticker.Stop()
+	var (
+		lastTime  = time.Now()
+		lastCount = pc.Stats.Get(stats.Queries) + pc.Stats.Get(stats.StmtExecutes)
+		saturated bool
+	)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if pc.Throttle.Paused() {
+			lastTime, lastCount = time.Now(), pc.Stats.Get(stats.Queries)+pc.Stats.Get(stats.StmtExecutes)
+			continue
+		}
+		// stats of remote replays are only refreshed every report interval
+		count := pc.Stats.Get(stats.Queries) + pc.Stats.Get(stats.StmtExecutes)
+		if count == lastCount {
+			continue
+		}
+		now := time.Now()
+		qps := float64(count-lastCount) / now.Sub(lastTime).Seconds()
+		lastTime, lastCount = now, count
+		var (
+			lagging = pc.Stats.GetLagging()
+			rate    = pc.Throttle.Rate()
+			step    = math.Max(math.Min(target/qps, targetQPSMaxStep), 1/targetQPSMaxStep)
+		)
+		if step > 1 && maxLag > 0 && lagging > maxLag {
+			if !saturated {
+				pc.log.Warn("target qps is not reached since the replay is lagging", zap.Float64("qps", qps), zap.Duration("lagging", lagging))
+				saturated = true
+			}
+			continue
+		}
+		saturated = false
+		next := math.Max(math.Min(rate*step, targetQPSMaxRate), adaptiveMinRate)
+		if math.Abs(next-rate) < rate*0.05 {
+			continue
+		}
+		pc.log.Info("adjust replay rate", zap.Float64("qps", qps), zap.Float64("speed", next*pc.Speed))
+		if err := pc.Control(playJobControl{Rate: &next}); err != nil {
+			pc.log.Warn("adjust replay rate", zap.Error(err))
+		}
+	}
+}
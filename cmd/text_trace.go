@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const (
+	// otlpBatchSize and otlpQueueSize are the max number of spans of an export
+	// request and the max number of spans waiting to be exported, spans are
+	// dropped if the queue is full.
+	otlpBatchSize     = 512
+	otlpQueueSize     = 65536
+	otlpFlushInterval = 5 * time.Second
+	otlpCloseTimeout  = 30 * time.Second
+)
+
+// tracer exports spans of sessions and their statements to an OTLP/HTTP
+// collector in background.
+type tracer struct {
+	trace.Tracer
+	provider *sdktrace.TracerProvider
+}
+
+// newTracer returns a tracer exporting to the endpoint like
+// http://localhost:4318, headers are like key=value.
+func newTracer(endpoint string, headers []string, service string) (*tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, errors.New("otlp endpoint should be a http(s) url: " + endpoint)
+	}
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+	if path := strings.TrimSuffix(u.Path, "/"); len(path) > 0 {
+		opts = append(opts, otlptracehttp.WithURLPath(path))
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	if len(headers) > 0 {
+		m := make(map[string]string, len(headers))
+		for _, kv := range headers {
+			kv := strings.SplitN(kv, "=", 2)
+			if len(kv) != 2 || len(strings.TrimSpace(kv[0])) == 0 {
+				return nil, errors.New("invalid otlp header: " + strings.Join(kv, "="))
+			}
+			m[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+		opts = append(opts, otlptracehttp.WithHeaders(m))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, errors.Annotate(err, "create otlp exporter")
+	}
+	log := zap.L().Named("otlp")
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn("failed to export spans", zap.Error(err))
+	}))
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter,
+			sdktrace.WithMaxExportBatchSize(otlpBatchSize),
+			sdktrace.WithMaxQueueSize(otlpQueueSize),
+			sdktrace.WithBatchTimeout(otlpFlushInterval)),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(service))),
+	)
+	return &tracer{Tracer: provider.Tracer("mysql-replay"), provider: provider}, nil
+}
+
+// Close exports spans queued and stops the tracer.
+func (t *tracer) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), otlpCloseTimeout)
+	defer cancel()
+	if err := t.provider.Shutdown(ctx); err != nil {
+		zap.L().Named("otlp").Warn("failed to shutdown tracer", zap.Error(err))
+	}
+}
+
+// trace records a span of the statement executed (or failed), as a child of
+// the span of the session which is started by the first statement.
+func (pw *playWorker) trace(e *event.MySQLEvent, res replay.Result, err error) {
+	if !res.Executed && err == nil && e.Type != event.EventStmtPrepare {
+		return
+	}
+	end := time.Now()
+	if pw.span == nil {
+		_, pw.span = pw.Tracer.Start(context.Background(), "session",
+			trace.WithTimestamp(end.Add(-res.Duration)),
+			trace.WithAttributes(attribute.String("mysql_replay.session", pw.src), attribute.Int64("mysql_replay.session_id", int64(pw.id))))
+	}
+	query := res.Query
+	if len(query) == 0 {
+		query = e.Query
+	}
+	attrs := []attribute.KeyValue{
+		semconv.DBSystemMySQL,
+		semconv.DBStatementKey.String(formatSample(query)),
+		attribute.Int64("mysql_replay.captured_time", e.Time),
+	}
+	if len(res.Digest) > 0 {
+		attrs = append(attrs, attribute.String("mysql_replay.digest", res.Digest))
+	}
+	if err != nil {
+		code, _, _ := describeFailure(e, res, err)
+		attrs = append(attrs, attribute.String("mysql_replay.error_code", code))
+	}
+	_, span := pw.Tracer.Start(trace.ContextWithSpan(context.Background(), pw.span), eventName(e),
+		trace.WithSpanKind(trace.SpanKindClient), trace.WithTimestamp(end.Add(-res.Duration)), trace.WithAttributes(attrs...))
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// endTrace ends the span of the session if any.
+func (pw *playWorker) endTrace() {
+	if pw.span != nil {
+		pw.span.End()
+		pw.span = nil
+	}
+}
+
+func eventName(e *event.MySQLEvent) string {
+	switch e.Type {
+	case event.EventQuery:
+		return "query"
+	case event.EventStmtPrepare:
+		return "stmt prepare"
+	case event.EventStmtExecute:
+		return "stmt execute"
+	case event.EventStmtFetch:
+		return "stmt fetch"
+	case event.EventInitDB:
+		return "init db"
+	case event.EventHandshake:
+		return "connect"
+	default:
+		return "event"
+	}
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/zyguan/mysql-replay/stats"
+)
+
+const tuiBarWidth = 50
+
+// tuiMonitor redraws a terminal screen with live stats of the replay, it is
+// used instead of periodic log lines when playing interactively.
+type tuiMonitor struct {
+	out      io.Writer
+	title    string
+	start    time.Time
+	report   *reportCollector
+	digests  *digestStats
+	progress func() []progressRow
+	stats    *stats.Registry
+
+	lastTime  time.Time
+	lastCount int64
+}
+
+func newTUIMonitor(out io.Writer, title string, ctl *playControl) *tuiMonitor {
+	now := time.Now()
+	return &tuiMonitor{
+		out:      out,
+		title:    title,
+		start:    now,
+		report:   ctl.Report,
+		digests:  ctl.Digests,
+		progress: ctl.Progress,
+		stats:    ctl.Stats,
+		lastTime: now,
+	}
+}
+
+func (m *tuiMonitor) Render(now time.Time) {
+	var (
+		buf     bytes.Buffer
+		metrics = m.stats.Dump()
+		elapsed = now.Sub(m.start)
+		count   = metrics[stats.Queries] + metrics[stats.StmtExecutes]
+		qps     float64
+	)
+	if d := now.Sub(m.lastTime); d > 0 {
+		qps = float64(count-m.lastCount) / d.Seconds()
+	}
+	m.lastTime, m.lastCount = now, count
+
+	// move to the top-left corner and clear the screen
+	buf.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&buf, "%s    elapsed %s\n\n", m.title, elapsed.Truncate(time.Second))
+
+	total, finished := 0, 0
+	for _, row := range m.progress() {
+		total += row.Total
+		finished += row.Finished
+	}
+	ratio, eta := 0.0, "-"
+	if total > 0 {
+		ratio = float64(finished) / float64(total)
+	}
+	if finished > 0 && finished < total {
+		eta = (time.Duration(float64(elapsed) * float64(total-finished) / float64(finished))).Truncate(time.Second).String()
+	}
+	n := int(ratio * tuiBarWidth)
+	fmt.Fprintf(&buf, "[%s%s] %5.1f%%  %d/%d sessions  eta %s\n\n",
+		strings.Repeat("#", n), strings.Repeat(".", tuiBarWidth-n), ratio*100, finished, total, eta)
+
+	fmt.Fprintf(&buf, "qps %-10.1f lagging %s\n", qps, m.stats.GetLagging().Truncate(time.Millisecond))
+	fmt.Fprintf(&buf, "connections %d (running %d, waiting %d)\n",
+		metrics[stats.Connections], metrics[stats.ConnRunning], metrics[stats.ConnWaiting])
+	fmt.Fprintf(&buf, "queries %d, stmt executes %d, stmt prepares %d\n",
+		metrics[stats.Queries], metrics[stats.StmtExecutes], metrics[stats.StmtPrepares])
+	fmt.Fprintf(&buf, "failed queries %d, stmt executes %d, stmt prepares %d\n",
+		metrics[stats.FailedQueries], metrics[stats.FailedStmtExecutes], metrics[stats.FailedStmtPrepares])
+	if m.report != nil {
+		l := summarizeLatency(m.report.latency)
+		fmt.Fprintf(&buf, "latency p50 %s, p99 %s, max %s\n", l.P50, l.P99, l.Max)
+	}
+
+	if failing := m.digests.Failing(5); len(failing) > 0 {
+		buf.WriteString("\ntop failing digests:\n")
+		for _, s := range failing {
+			sample := s.Sample
+			if len(sample) > 80 {
+				sample = sample[:77] + "..."
+			}
+			fmt.Fprintf(&buf, "  %8d/%-8d %s\n", s.Errors, s.Count, strings.ReplaceAll(sample, "\n", " "))
+		}
+	}
+	m.out.Write(buf.Bytes())
+}
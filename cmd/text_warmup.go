@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/event"
+	"go.uber.org/zap"
+)
+
+// warmupConcurrency is the max number of connections being established at the
+// same time during the warmup.
+const warmupConcurrency = 16
+
+// warmupPolicy selects sessions of which connections are established before
+// the replay starts, which are the first n sessions or the ones starting in
+// the first duration of the capture. Stmts (if positive) is the max number of
+// statements most prepared by each session to prepare as well.
+type warmupPolicy struct {
+	sessions int
+	window   time.Duration
+	Stmts    int
+}
+
+func parseWarmup(s string) (warmupPolicy, error) {
+	if len(s) == 0 {
+		return warmupPolicy{}, nil
+	}
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return warmupPolicy{sessions: n}, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return warmupPolicy{}, errors.New("invalid warmup (expect a number of sessions or a duration): " + s)
+	}
+	return warmupPolicy{window: d}, nil
+}
+
+func (p warmupPolicy) Enabled() bool {
+	return p.sessions > 0 || p.window > 0
+}
+
+// selects returns workers (in the order of start time) to warm up.
+func (p warmupPolicy) selects(workers []*playWorker) []*playWorker {
+	if p.sessions > 0 {
+		if len(workers) > p.sessions {
+			return workers[:p.sessions]
+		}
+		return workers
+	}
+	n := 0
+	for n < len(workers) && workers[n].ts-workers[0].ts <= p.window.Milliseconds() {
+		n += 1
+	}
+	return workers[:n]
+}
+
+// warmup establishes connections of sessions selected by the Warmup policy
+// before the timed replay starts, thus connection storms at the start don't
+// pollute latencies.
+func (pc *playControl) warmup(ctx context.Context) {
+	if !pc.Warmup.Enabled() || pc.DryRun {
+		return
+	}
+	var (
+		workers = pc.Warmup.selects(pc.workers)
+		sem     = make(chan struct{}, warmupConcurrency)
+		wg      sync.WaitGroup
+		failed  int64
+		t       = time.Now()
+	)
+	pc.log.Info("warm up connections", zap.Int("sessions", len(workers)), zap.Int("stmts", pc.Warmup.Stmts))
+	for _, worker := range workers {
+		worker.playConfig = pc.playConfig
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(pw *playWorker) {
+			defer func() { <-sem; wg.Done() }()
+			if err := pw.warmup(ctx, pc.Warmup.Stmts); err != nil {
+				pw.log.Warn("failed to warm up connection", zap.Error(err))
+				atomic.AddInt64(&failed, 1)
+			}
+		}(worker)
+	}
+	wg.Wait()
+	pc.log.Info("connections are warmed up", zap.Int("sessions", len(workers)), zap.Int64("failed", failed), zap.Duration("elapsed", time.Since(t)))
+}
+
+// warmup establishes the connection of the session as its first handshake
+// (if any) does, and prepares up to stmts statements most prepared by it.
+func (pw *playWorker) warmup(ctx context.Context, stmts int) error {
+	r, err := pw.openSource(ctx)
+	if err != nil {
+		return errors.Annotate(err, "open source")
+	}
+	defer r.Close()
+	var (
+		first  *event.MySQLEvent
+		counts = make(map[string]int)
+		e      = event.MySQLEvent{Params: []interface{}{}}
+		dec    = event.NewDecoder(pw.MaxLineSize)
+		in     = event.NewLineScanner(r, pw.MaxLineSize)
+	)
+	for in.Scan() {
+		ok, err := dec.Decode(in.Text(), e.Reset(e.Params[:0]))
+		if err != nil {
+			return errors.Annotate(err, "scan event")
+		} else if !ok {
+			continue
+		}
+		if first == nil {
+			first = &event.MySQLEvent{Type: e.Type, DB: e.DB, Charset: e.Charset}
+		}
+		if stmts <= 0 {
+			break
+		}
+		if e.Type == event.EventStmtPrepare {
+			counts[e.Query] += 1
+		}
+	}
+	if err = in.Err(); err != nil {
+		return errors.Annotate(err, "read source")
+	}
+	queries := make([]string, 0, len(counts))
+	for query := range counts {
+		queries = append(queries, query)
+	}
+	sort.Slice(queries, func(i, j int) bool {
+		if counts[queries[i]] != counts[queries[j]] {
+			return counts[queries[i]] > counts[queries[j]]
+		}
+		return queries[i] < queries[j]
+	})
+	if len(queries) > stmts {
+		queries = queries[:stmts]
+	}
+	if pw.conn == nil {
+		if pw.conn, err = pw.newConn(); err != nil {
+			return err
+		}
+	}
+	var (
+		schema  string
+		charset uint64
+	)
+	if first != nil && first.Type == event.EventHandshake {
+		schema, charset = first.DB, first.Charset
+	}
+	return pw.conn.Warmup(pw.execContext(ctx), schema, charset, queries)
+}
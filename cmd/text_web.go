@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+// progressRow is a line of the progress table of the dashboard, which is an
+// agent for controllers and a job for agents.
+type progressRow struct {
+	Name     string  `json:"name"`
+	Alive    bool    `json:"alive"`
+	Total    int     `json:"total"`
+	Finished int     `json:"finished"`
+	Lagging  float64 `json:"lagging"`
+}
+
+type dashboardSnapshot struct {
+	Time     time.Time        `json:"time"`
+	Elapsed  time.Duration    `json:"elapsed"`
+	QPS      float64          `json:"qps"`
+	Stats    map[string]int64 `json:"stats"`
+	Lagging  time.Duration    `json:"lagging"`
+	Latency  latencySummary   `json:"latency"`
+	Failures map[string]int64 `json:"failures"`
+	Total    int              `json:"total"`
+	Finished int              `json:"finished"`
+	Progress []progressRow    `json:"progress,omitempty"`
+}
+
+// webDashboard serves a small web page showing live stats of the replay.
+type webDashboard struct {
+	title    string
+	start    time.Time
+	report   *reportCollector
+	progress func() []progressRow
+	control  func(c playJobControl) error
+	stats    *stats.Registry
+
+	lock      sync.Mutex
+	lastTime  time.Time
+	lastCount int64
+	qps       float64
+}
+
+func newWebDashboard(title string, reg *stats.Registry, report *reportCollector, progress func() []progressRow) *webDashboard {
+	now := time.Now()
+	return &webDashboard{title: title, start: now, report: report, progress: progress, stats: reg, lastTime: now}
+}
+
+func (d *webDashboard) Snapshot() dashboardSnapshot {
+	now := time.Now()
+	s := dashboardSnapshot{
+		Time:     now,
+		Elapsed:  now.Sub(d.start),
+		Stats:    d.stats.Dump(),
+		Lagging:  d.stats.GetLagging(),
+		Failures: map[string]int64{},
+	}
+	if d.report != nil {
+		s.Latency = summarizeLatency(d.report.latency)
+		d.report.lock.Lock()
+		for k, v := range d.report.failures {
+			s.Failures[k] = v
+		}
+		d.report.lock.Unlock()
+	}
+	if d.progress != nil {
+		s.Progress = d.progress()
+		for _, row := range s.Progress {
+			s.Total += row.Total
+			s.Finished += row.Finished
+		}
+	}
+	count := s.Stats[stats.Queries] + s.Stats[stats.StmtExecutes]
+	d.lock.Lock()
+	if elapsed := now.Sub(d.lastTime); elapsed >= time.Second {
+		d.qps = float64(count-d.lastCount) / elapsed.Seconds()
+		d.lastTime, d.lastCount = now, count
+	}
+	s.QPS = d.qps
+	d.lock.Unlock()
+	return s
+}
+
+func (d *webDashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/stats":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(d.Snapshot())
+	case "/api/pause", "/api/resume", "/api/control":
+		d.handleControl(w, r)
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		dashboardTemplate.Execute(w, d.title)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleControl pauses or resumes the replay via `POST /api/pause`, `POST
+// /api/resume`, or changes it via `POST /api/control` with a json body like
+// `{"speed": 2}`.
+func (d *webDashboard) handleControl(w http.ResponseWriter, r *http.Request) {
+	if d.control == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var c playJobControl
+	switch r.URL.Path {
+	case "/api/pause", "/api/resume":
+		paused := r.URL.Path == "/api/pause"
+		c.Paused = &paused
+	default:
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := d.control(c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Serve starts serving the dashboard in background.
+func (d *webDashboard) Serve(addr string) {
+	srv := &http.Server{Addr: addr, Handler: d}
+	go func() {
+		zap.L().Info("serve web dashboard on " + addr)
+		if err := srv.ListenAndServe(); err != nil {
+			zap.L().Error("stop serving web dashboard", zap.Error(err))
+		}
+	}()
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>{{.}}</title>
+<style>
+body{font-family:sans-serif;margin:2em}
+table{border-collapse:collapse;margin-bottom:1.5em}
+td,th{border:1px solid #ccc;padding:4px 8px;text-align:right}
+th{background:#eee}
+.bar{width:400px;height:16px;background:#eee}
+.bar div{height:100%;background:#4a8}
+</style></head>
+<body>
+<h1>{{.}}</h1>
+<p>elapsed <span id="elapsed"></span>, qps <b id="qps"></b>, lagging <b id="lagging"></b></p>
+<div class="bar"><div id="bar" style="width:0"></div></div>
+<p><span id="finished"></span> / <span id="total"></span> sessions finished</p>
+<h2>Latency</h2>
+<table id="latency"></table>
+<h2>Counters</h2>
+<table id="stats"></table>
+<h2>Failures</h2>
+<table id="failures"></table>
+<h2>Progress</h2>
+<table id="progress"></table>
+<script>
+function ms(ns) { return (ns / 1e6).toFixed(3) + "ms"; }
+function rows(el, head, data) {
+  var html = "<tr>" + head.map(function (h) { return "<th>" + h + "</th>"; }).join("") + "</tr>";
+  data.forEach(function (r) { html += "<tr>" + r.map(function (c) { return "<td>" + c + "</td>"; }).join("") + "</tr>"; });
+  document.getElementById(el).innerHTML = html;
+}
+function refresh() {
+  fetch("api/stats").then(function (r) { return r.json(); }).then(function (s) {
+    document.getElementById("elapsed").textContent = (s.elapsed / 1e9).toFixed(0) + "s";
+    document.getElementById("qps").textContent = s.qps.toFixed(1);
+    document.getElementById("lagging").textContent = ms(s.lagging);
+    document.getElementById("finished").textContent = s.finished;
+    document.getElementById("total").textContent = s.total;
+    document.getElementById("bar").style.width = (s.total > 0 ? 100 * s.finished / s.total : 0) + "%";
+    var l = s.latency;
+    rows("latency", ["count", "mean", "p50", "p90", "p95", "p99", "max"], [[l.count, ms(l.mean), ms(l.p50), ms(l.p90), ms(l.p95), ms(l.p99), ms(l.max)]]);
+    rows("stats", ["name", "value"], Object.keys(s.stats).sort().map(function (k) { return [k, s.stats[k]]; }));
+    rows("failures", ["error code", "count"], Object.keys(s.failures).sort().map(function (k) { return [k, s.failures[k]]; }));
+    rows("progress", ["name", "alive", "finished", "total", "lagging"], (s.progress || []).map(function (p) {
+      return [p.name, p.alive, p.finished, p.total, p.lagging.toFixed(3) + "s"];
+    }));
+  }).catch(function () {}).then(function () { setTimeout(refresh, 2000); });
+}
+refresh();
+</script>
+</body></html>
+`))
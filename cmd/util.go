@@ -1,6 +1,10 @@
 package cmd
 
-import "github.com/google/gopacket"
+import (
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/gopacket"
+	"github.com/pingcap/errors"
+)
 
 func captureContext(ci gopacket.CaptureInfo) *Context {
 	return &Context{ci}
@@ -13,3 +17,11 @@ type Context struct {
 func (c *Context) GetCaptureInfo() gopacket.CaptureInfo {
 	return c.CaptureInfo
 }
+
+func mysqlError(err error) (*mysql.MySQLError, bool) {
+	if err == nil {
+		return nil, false
+	}
+	myErr, ok := errors.Cause(err).(*mysql.MySQLError)
+	return myErr, ok
+}
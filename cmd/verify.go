@@ -0,0 +1,531 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/replay"
+	"go.uber.org/zap"
+)
+
+const (
+	verifyOK      = "ok"
+	verifyMissing = "missing"
+	verifyExtra   = "extra"
+)
+
+// binlogPageSize is the number of binlog events fetched at a time.
+const binlogPageSize = 1000
+
+type dmlKey struct {
+	table string
+	kind  string
+}
+
+// dmlCount counts data modifying statements of a table, Affected and Rows
+// are only known if affected rows are dumped.
+type dmlCount struct {
+	Statements int64
+	Affected   int64
+	Rows       int64
+}
+
+type dmlCounts map[dmlKey]*dmlCount
+
+func (c dmlCounts) get(table string, kind string) *dmlCount {
+	key := dmlKey{strings.ToLower(table), kind}
+	n, ok := c[key]
+	if !ok {
+		n = new(dmlCount)
+		c[key] = n
+	}
+	return n
+}
+
+func (c dmlCounts) merge(other dmlCounts) {
+	for key, n := range other {
+		m := c.get(key.table, key.kind)
+		m.Statements += n.Statements
+		m.Affected += n.Affected
+		m.Rows += n.Rows
+	}
+}
+
+// scanDML counts data modifying statements of a session by their tables, which
+// are qualified by the current database of the session. It tells whether
+// affected rows are dumped.
+func scanDML(r io.Reader, maxLineSize int) (dmlCounts, bool, error) {
+	var (
+		counts  = make(dmlCounts)
+		results = false
+		db      string
+		stmts   = make(map[uint64]string)
+		last    *dmlCount
+		e       = event.MySQLEvent{Params: []interface{}{}}
+		dec     = event.NewDecoder(maxLineSize)
+		in      = bufio.NewScanner(r)
+	)
+	if maxLineSize > 0 {
+		in.Buffer(make([]byte, 0, 4096), maxLineSize)
+	}
+	for in.Scan() {
+		ok, err := dec.Decode(in.Text(), e.Reset(e.Params[:0]))
+		if err != nil {
+			return counts, results, err
+		} else if !ok {
+			continue
+		}
+		if e.Type == event.EventResult {
+			results = true
+			if last != nil && e.Affected > 0 {
+				last.Affected += 1
+				last.Rows += int64(e.Affected)
+			}
+			last = nil
+			continue
+		}
+		last = nil
+		query := e.Query
+		switch e.Type {
+		case event.EventHandshake, event.EventInitDB:
+			db = e.DB
+			continue
+		case event.EventStmtPrepare:
+			stmts[e.StmtID] = e.Query
+			continue
+		case event.EventStmtClose:
+			delete(stmts, e.StmtID)
+			continue
+		case event.EventStmtExecute:
+			query = stmts[e.StmtID]
+		case event.EventQuery:
+			if name, ok := replay.ParseUseQuery(e.Query); ok {
+				db = name
+				continue
+			}
+		default:
+			continue
+		}
+		dml, ok := event.ParseDML(query)
+		if !ok {
+			continue
+		}
+		if len(dml.Schema) == 0 {
+			dml.Schema = db
+		}
+		last = counts.get(dml.Schema+"."+dml.Table, dml.Kind)
+		last.Statements += 1
+	}
+	return counts, results, errors.Trace(in.Err())
+}
+
+// binlogPos is a position of the binlog like `mysql-bin.000001:4`.
+type binlogPos struct {
+	file string
+	pos  uint64
+}
+
+func parseBinlogPos(s string) (binlogPos, error) {
+	var p binlogPos
+	if len(s) == 0 {
+		return p, nil
+	}
+	i := strings.LastIndexByte(s, ':')
+	if i <= 0 {
+		return p, errors.Errorf("invalid binlog position: %s", s)
+	}
+	pos, err := strconv.ParseUint(s[i+1:], 10, 64)
+	if err != nil {
+		return p, errors.Errorf("invalid binlog position: %s", s)
+	}
+	return binlogPos{file: s[:i], pos: pos}, nil
+}
+
+// scanStrings scans a row of any columns as strings.
+func scanStrings(rows *sql.Rows) ([]string, error) {
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	raw := make([]sql.RawBytes, len(cols))
+	dest := make([]interface{}, len(cols))
+	for i := range raw {
+		dest[i] = &raw[i]
+	}
+	if err = rows.Scan(dest...); err != nil {
+		return nil, errors.Trace(err)
+	}
+	out := make([]string, len(cols))
+	for i := range raw {
+		out[i] = string(raw[i])
+	}
+	return out, nil
+}
+
+// binlogDML counts row events of the binlog from the position to the end (or
+// the given position) by tables. Row events of a table are counted once per
+// statement, which ends at an event flagged by STMT_END_F.
+func binlogDML(ctx context.Context, db *sql.DB, from binlogPos, to binlogPos) (dmlCounts, error) {
+	rows, err := db.QueryContext(ctx, "SHOW BINARY LOGS")
+	if err != nil {
+		return nil, errors.Annotate(err, "list binlogs")
+	}
+	var files []string
+	for rows.Next() {
+		row, err := scanStrings(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if row[0] >= from.file && (len(to.file) == 0 || row[0] <= to.file) {
+			files = append(files, row[0])
+		}
+	}
+	rows.Close()
+
+	var (
+		counts = make(dmlCounts)
+		tables = make(map[string]string)
+		seen   = make(map[dmlKey]bool)
+	)
+	for _, file := range files {
+		pos := uint64(4)
+		if file == from.file && from.pos > pos {
+			pos = from.pos
+		}
+		for {
+			rows, err := db.QueryContext(ctx, fmt.Sprintf("SHOW BINLOG EVENTS IN '%s' FROM %d LIMIT %d", strings.ReplaceAll(file, "'", "''"), pos, binlogPageSize))
+			if err != nil {
+				return nil, errors.Annotatef(err, "read binlog %s", file)
+			}
+			n, stop := 0, false
+			for rows.Next() {
+				// Log_name, Pos, Event_type, Server_id, End_log_pos, Info
+				row, err := scanStrings(rows)
+				if err != nil {
+					rows.Close()
+					return nil, err
+				}
+				n += 1
+				start, _ := strconv.ParseUint(row[1], 10, 64)
+				if file == to.file && to.pos > 0 && start >= to.pos {
+					stop = true
+					break
+				}
+				pos, _ = strconv.ParseUint(row[4], 10, 64)
+				typ, info := row[2], row[5]
+				id := binlogTableID(info)
+				switch {
+				case typ == "Table_map":
+					if i, j := strings.IndexByte(info, '('), strings.LastIndexByte(info, ')'); i > 0 && j > i {
+						tables[id] = strings.ReplaceAll(info[i+1:j], "`", "")
+					}
+					continue
+				case strings.HasPrefix(typ, "Write_rows"):
+					typ = event.DMLInsert
+				case strings.HasPrefix(typ, "Update_rows"):
+					typ = event.DMLUpdate
+				case strings.HasPrefix(typ, "Delete_rows"):
+					typ = event.DMLDelete
+				default:
+					continue
+				}
+				key := dmlKey{strings.ToLower(tables[id]), typ}
+				if !seen[key] {
+					seen[key] = true
+					counts.get(key.table, key.kind).Statements += 1
+				}
+				if strings.Contains(info, "STMT_END_F") {
+					seen = make(map[dmlKey]bool)
+				}
+			}
+			err = rows.Err()
+			rows.Close()
+			if err != nil {
+				return nil, errors.Annotatef(err, "read binlog %s", file)
+			}
+			if stop {
+				return counts, nil
+			}
+			if n < binlogPageSize {
+				break
+			}
+		}
+	}
+	return counts, nil
+}
+
+// readBinlogDML counts row events of the binlog of the target.
+func readBinlogDML(ctx context.Context, dsn string, from binlogPos, to binlogPos) (dmlCounts, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer db.Close()
+	return binlogDML(ctx, db, from, to)
+}
+
+// binlogTableID returns the table id in info of row events like `table_id: 108
+// flags: STMT_END_F`.
+func binlogTableID(info string) string {
+	const prefix = "table_id: "
+	i := strings.Index(info, prefix)
+	if i < 0 {
+		return ""
+	}
+	s := info[i+len(prefix):]
+	if j := strings.IndexAny(s, " ("); j >= 0 {
+		s = s[:j]
+	}
+	return s
+}
+
+// cdcDML counts rows changed by tables from canal-json files (e.g. written by
+// TiCDC) under the path.
+func cdcDML(path string, maxLineSize int) (dmlCounts, error) {
+	var files []string
+	if info, err := os.Stat(path); err != nil {
+		return nil, errors.Trace(err)
+	} else if info.IsDir() {
+		err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				files = append(files, p)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	} else {
+		files = []string{path}
+	}
+	counts := make(dmlCounts)
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		in := bufio.NewScanner(f)
+		if maxLineSize > 0 {
+			in.Buffer(make([]byte, 0, 4096), maxLineSize)
+		}
+		for in.Scan() {
+			var msg struct {
+				Database string            `json:"database"`
+				Table    string            `json:"table"`
+				Type     string            `json:"type"`
+				IsDDL    bool              `json:"isDdl"`
+				Data     []json.RawMessage `json:"data"`
+			}
+			if err = json.Unmarshal(in.Bytes(), &msg); err != nil || msg.IsDDL {
+				continue
+			}
+			kind := strings.ToLower(msg.Type)
+			if kind != event.DMLInsert && kind != event.DMLUpdate && kind != event.DMLDelete {
+				continue
+			}
+			n := counts.get(msg.Database+"."+msg.Table, kind)
+			n.Statements += 1
+			n.Rows += int64(len(msg.Data))
+		}
+		err = in.Err()
+		f.Close()
+		if err != nil {
+			return nil, errors.Annotatef(err, "read %s", name)
+		}
+	}
+	return counts, nil
+}
+
+// dmlVerdict compares writes of a table expected by the capture with the
+// actual ones.
+type dmlVerdict struct {
+	Table    string `json:"table"`
+	Kind     string `json:"kind"`
+	Expected int64  `json:"expected"`
+	Actual   int64  `json:"actual"`
+	Status   string `json:"status"`
+}
+
+// verifyDML compares expected counts with actual ones by rows (otherwise
+// statements). Counts are only compared exactly (within the tolerance) if
+// affected rows are dumped, since statements affected no rows leave nothing in
+// the binlog, otherwise only tables not written at all are missing.
+func verifyDML(expected dmlCounts, actual dmlCounts, results bool, rows bool, tolerance float64) []dmlVerdict {
+	var out []dmlVerdict
+	for key, n := range expected {
+		v := dmlVerdict{Table: key.table, Kind: key.kind, Status: verifyOK}
+		switch {
+		case results && rows:
+			v.Expected = n.Rows
+		case results:
+			v.Expected = n.Affected
+		default:
+			v.Expected = n.Statements
+		}
+		if m, ok := actual[key]; ok && rows {
+			v.Actual = m.Rows
+		} else if ok {
+			v.Actual = m.Statements
+		}
+		margin := int64(float64(v.Expected) * tolerance)
+		switch {
+		case v.Expected > 0 && v.Actual == 0:
+			v.Status = verifyMissing
+		case results && v.Actual < v.Expected-margin:
+			v.Status = verifyMissing
+		case (results || !rows) && v.Actual > v.Expected+margin:
+			v.Status = verifyExtra
+		}
+		out = append(out, v)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Table != out[j].Table {
+			return out[i].Table < out[j].Table
+		}
+		return out[i].Kind < out[j].Kind
+	})
+	return out
+}
+
+func NewVerifyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify effects of a replay on the target",
+	}
+	cmd.AddCommand(NewVerifyBinlogCommand())
+	cmd.AddCommand(NewVerifyChecksumCommand())
+	return cmd
+}
+
+func NewVerifyBinlogCommand() *cobra.Command {
+	var (
+		targetDSN   string
+		from        string
+		to          string
+		cdc         string
+		tolerance   float64
+		maxLineSize int
+		asJSON      bool
+	)
+	cmd := &cobra.Command{
+		Use:   "binlog <dir>",
+		Short: "Compare writes of the target's binlog (or TiDB CDC output) during a replay with writes of the dump",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(cdc) == 0 && (len(targetDSN) == 0 || len(from) == 0) {
+				return errors.New("either --cdc or --target-dsn and --from is required")
+			}
+			start, err := parseBinlogPos(from)
+			if err != nil {
+				return err
+			}
+			end, err := parseBinlogPos(to)
+			if err != nil {
+				return err
+			}
+			ctl, err := newPlayControl(playConfig{DryRun: true}, args[0], "")
+			if err != nil {
+				return err
+			}
+			var (
+				ctx      = context.Background()
+				jobs     = make(chan *playWorker)
+				expected = make(dmlCounts)
+				results  bool
+				lock     sync.Mutex
+				wg       sync.WaitGroup
+			)
+			for i := 0; i < runtime.NumCPU(); i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for w := range jobs {
+						f, err := w.openSource(ctx)
+						if err != nil {
+							w.log.Error("failed to open source file of the stream", zap.Error(err))
+							continue
+						}
+						counts, ok, err := scanDML(f, maxLineSize)
+						f.Close()
+						if err != nil {
+							w.log.Warn("failed to read events", zap.Error(err))
+						}
+						lock.Lock()
+						expected.merge(counts)
+						results = results || ok
+						lock.Unlock()
+					}
+				}()
+			}
+			for _, w := range ctl.workers {
+				jobs <- w
+			}
+			close(jobs)
+			wg.Wait()
+
+			var actual dmlCounts
+			if len(cdc) > 0 {
+				actual, err = cdcDML(cdc, maxLineSize)
+			} else {
+				actual, err = readBinlogDML(ctx, targetDSN, start, end)
+			}
+			if err != nil {
+				return err
+			}
+			verdicts := verifyDML(expected, actual, results, len(cdc) > 0, tolerance)
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err = enc.Encode(verdicts); err != nil {
+					return errors.Trace(err)
+				}
+			} else {
+				unit := "statements"
+				if len(cdc) > 0 {
+					unit = "rows"
+				}
+				tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintf(tw, "table\tkind\texpected %s\tactual %s\tstatus\n", unit, unit)
+				for _, v := range verdicts {
+					fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\n", v.Table, v.Kind, v.Expected, v.Actual, v.Status)
+				}
+				tw.Flush()
+			}
+			for _, v := range verdicts {
+				if v.Status == verifyMissing {
+					return errors.New("writes of some tables are missing")
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&targetDSN, "target-dsn", "", "dsn of the target whose binlog is read")
+	cmd.Flags().StringVar(&from, "from", "", "binlog position like mysql-bin.000001:4 where the replay started (e.g. from SHOW MASTER STATUS)")
+	cmd.Flags().StringVar(&to, "to", "", "binlog position where the replay finished (default: the end)")
+	cmd.Flags().StringVar(&cdc, "cdc", "", "read canal-json files (e.g. by TiCDC) under the path instead of the binlog, rows are compared instead of statements")
+	cmd.Flags().Float64Var(&tolerance, "tolerance", 0, "ratio of differences between expected and actual counts still considered ok")
+	cmd.Flags().IntVar(&maxLineSize, "max-line-size", 16777216, "max line size")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print results as json")
+	return cmd
+}
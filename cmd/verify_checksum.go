@@ -0,0 +1,355 @@
+package cmd
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	checksumCRC    = "crc"
+	checksumTable  = "checksum"
+	checksumTiDB   = "admin"
+	checksumOK     = "ok"
+	checksumDiff   = "diverged"
+	checksumAbsent = "missing"
+	checksumError  = "error"
+)
+
+// systemSchemas are skipped unless databases are given explicitly.
+var systemSchemas = map[string]bool{
+	"mysql":              true,
+	"information_schema": true,
+	"performance_schema": true,
+	"sys":                true,
+	"metrics_schema":     true,
+}
+
+// tableChecksum is the result of comparing a table of the source and the
+// target.
+type tableChecksum struct {
+	Table  string `json:"table"`
+	Source string `json:"source"`
+	Target string `json:"target"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type checksumOptions struct {
+	method    string
+	chunkSize int64
+}
+
+func quoteIdent(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// listTables lists base tables of the databases (all but system ones if none).
+func listTables(ctx context.Context, db *sql.DB, dbs []string) ([][2]string, error) {
+	rows, err := db.QueryContext(ctx, "SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES WHERE TABLE_TYPE = 'BASE TABLE'")
+	if err != nil {
+		return nil, errors.Annotate(err, "list tables")
+	}
+	defer rows.Close()
+	wanted := make(map[string]bool, len(dbs))
+	for _, name := range dbs {
+		wanted[strings.ToLower(name)] = true
+	}
+	var tables [][2]string
+	for rows.Next() {
+		var schema, name string
+		if err = rows.Scan(&schema, &name); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if (len(wanted) > 0 && !wanted[strings.ToLower(schema)]) || (len(wanted) == 0 && systemSchemas[strings.ToLower(schema)]) {
+			continue
+		}
+		tables = append(tables, [2]string{schema, name})
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i][0] != tables[j][0] {
+			return tables[i][0] < tables[j][0]
+		}
+		return tables[i][1] < tables[j][1]
+	})
+	return tables, errors.Trace(rows.Err())
+}
+
+// tableLayout is what is needed to checksum a table by crc, the key is the
+// first column of the primary key if it's an integer.
+type tableLayout struct {
+	columns []string
+	key     string
+}
+
+func loadLayout(ctx context.Context, db *sql.DB, schema string, table string) (tableLayout, error) {
+	var layout tableLayout
+	rows, err := db.QueryContext(ctx, "SELECT COLUMN_NAME, DATA_TYPE, COLUMN_KEY FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION", schema, table)
+	if err != nil {
+		return layout, errors.Trace(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, typ, key string
+		if err = rows.Scan(&name, &typ, &key); err != nil {
+			return layout, errors.Trace(err)
+		}
+		layout.columns = append(layout.columns, name)
+		if len(layout.key) == 0 && key == "PRI" && strings.HasSuffix(strings.ToLower(typ), "int") {
+			layout.key = name
+		}
+	}
+	if len(layout.columns) == 0 {
+		return layout, errors.Errorf("no such table %s.%s", schema, table)
+	}
+	return layout, errors.Trace(rows.Err())
+}
+
+// crcQuery returns the query of the row count and the xor of crc32 of rows,
+// which is supported by both MySQL and TiDB.
+func (layout tableLayout) crcQuery(schema string, table string) string {
+	cols := make([]string, len(layout.columns))
+	nulls := make([]string, len(layout.columns))
+	for i, col := range layout.columns {
+		cols[i] = quoteIdent(col)
+		nulls[i] = "ISNULL(" + quoteIdent(col) + ")"
+	}
+	return fmt.Sprintf("SELECT COUNT(*), COALESCE(BIT_XOR(CAST(CRC32(CONCAT_WS('#', %s, CONCAT(%s))) AS UNSIGNED)), 0) FROM %s.%s",
+		strings.Join(cols, ", "), strings.Join(nulls, ", "), quoteIdent(schema), quoteIdent(table))
+}
+
+// checksum returns the checksum of the table of the db by the method, chunks
+// (by the key) are summed separately and returned as details for crc.
+func (opts checksumOptions) checksum(ctx context.Context, db *sql.DB, schema string, table string, layout tableLayout, chunks [][2]int64) (string, []string, error) {
+	name := quoteIdent(schema) + "." + quoteIdent(table)
+	switch opts.method {
+	case checksumTable:
+		var t string
+		var sum sql.NullString
+		if err := db.QueryRowContext(ctx, "CHECKSUM TABLE "+name).Scan(&t, &sum); err != nil {
+			return "", nil, errors.Trace(err)
+		}
+		return sum.String, nil, nil
+	case checksumTiDB:
+		rows, err := db.QueryContext(ctx, "ADMIN CHECKSUM TABLE "+name)
+		if err != nil {
+			return "", nil, errors.Trace(err)
+		}
+		defer rows.Close()
+		if !rows.Next() {
+			return "", nil, errors.Errorf("no checksum of %s", name)
+		}
+		// Db_name, Table_name, Checksum_crc64_xor, Total_kvs, Total_bytes
+		row, err := scanStrings(rows)
+		if err != nil {
+			return "", nil, err
+		}
+		return strings.Join(row[2:], "/"), nil, nil
+	}
+	query := layout.crcQuery(schema, table)
+	if len(chunks) == 0 {
+		var n, sum uint64
+		if err := db.QueryRowContext(ctx, query).Scan(&n, &sum); err != nil {
+			return "", nil, errors.Trace(err)
+		}
+		return fmt.Sprintf("%d/%08x", n, sum), nil, nil
+	}
+	var (
+		total, xor uint64
+		sums       = make([]string, len(chunks))
+		key        = quoteIdent(layout.key)
+	)
+	for i, chunk := range chunks {
+		var n, sum uint64
+		if err := db.QueryRowContext(ctx, query+" WHERE "+key+" >= ? AND "+key+" < ?", chunk[0], chunk[1]).Scan(&n, &sum); err != nil {
+			return "", nil, errors.Trace(err)
+		}
+		total, xor = total+n, xor^sum
+		sums[i] = fmt.Sprintf("%d/%08x", n, sum)
+	}
+	return fmt.Sprintf("%d/%08x", total, xor), sums, nil
+}
+
+// keyChunks splits the key range of the table on the source into chunks, rows
+// out of the range on the target are caught by the chunks at both ends.
+func (opts checksumOptions) keyChunks(ctx context.Context, db *sql.DB, schema string, table string, key string) ([][2]int64, error) {
+	var lo, hi sql.NullInt64
+	err := db.QueryRowContext(ctx, fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s.%s", quoteIdent(key), quoteIdent(key), quoteIdent(schema), quoteIdent(table))).Scan(&lo, &hi)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if !lo.Valid || hi.Int64-lo.Int64 < opts.chunkSize {
+		return nil, nil
+	}
+	var chunks [][2]int64
+	for start := lo.Int64; ; start += opts.chunkSize {
+		chunks = append(chunks, [2]int64{start, start + opts.chunkSize})
+		if hi.Int64-start < opts.chunkSize {
+			break
+		}
+	}
+	chunks[0][0] = -1 << 63
+	chunks[len(chunks)-1][1] = 1<<63 - 1
+	return chunks, nil
+}
+
+func (opts checksumOptions) compare(ctx context.Context, source *sql.DB, target *sql.DB, schema string, table string) tableChecksum {
+	res := tableChecksum{Table: schema + "." + table, Status: checksumOK}
+	fail := func(status string, err error) tableChecksum {
+		res.Status, res.Detail = status, err.Error()
+		return res
+	}
+	var (
+		layout tableLayout
+		chunks [][2]int64
+		err    error
+	)
+	if opts.method == checksumCRC {
+		if layout, err = loadLayout(ctx, source, schema, table); err != nil {
+			return fail(checksumError, err)
+		}
+		if _, err = loadLayout(ctx, target, schema, table); err != nil {
+			return fail(checksumAbsent, err)
+		}
+		if len(layout.key) > 0 && opts.chunkSize > 0 {
+			if chunks, err = opts.keyChunks(ctx, source, schema, table, layout.key); err != nil {
+				return fail(checksumError, err)
+			}
+		}
+	}
+	var srcChunks, dstChunks []string
+	if res.Source, srcChunks, err = opts.checksum(ctx, source, schema, table, layout, chunks); err != nil {
+		return fail(checksumError, errors.Annotate(err, "source"))
+	}
+	if res.Target, dstChunks, err = opts.checksum(ctx, target, schema, table, layout, chunks); err != nil {
+		if myErr, ok := mysqlError(err); ok && myErr.Number == 1146 {
+			return fail(checksumAbsent, err)
+		}
+		return fail(checksumError, errors.Annotate(err, "target"))
+	}
+	if res.Source == res.Target {
+		return res
+	}
+	res.Status = checksumDiff
+	var diverged []string
+	for i := range srcChunks {
+		if srcChunks[i] != dstChunks[i] {
+			diverged = append(diverged, fmt.Sprintf("[%d,%d)", chunks[i][0], chunks[i][1]))
+		}
+	}
+	if len(diverged) > 0 {
+		res.Detail = fmt.Sprintf("%d of %d chunks of %s diverged, e.g. %s", len(diverged), len(chunks), layout.key, diverged[0])
+	}
+	return res
+}
+
+func openDSN(dsn string) (*sql.DB, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	return db, errors.Trace(err)
+}
+
+func NewVerifyChecksumCommand() *cobra.Command {
+	var (
+		opts        checksumOptions
+		sourceDSN   string
+		targetDSN   string
+		dbs         []string
+		concurrency int
+		asJSON      bool
+	)
+	cmd := &cobra.Command{
+		Use:   "checksum",
+		Short: "Compare checksums of tables of the source and the target",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(sourceDSN) == 0 || len(targetDSN) == 0 {
+				return errors.New("both --source-dsn and --target-dsn are required")
+			}
+			switch opts.method {
+			case checksumCRC, checksumTable, checksumTiDB:
+			default:
+				return errors.New("unknown checksum method: " + opts.method)
+			}
+			if concurrency <= 0 {
+				concurrency = 1
+			}
+			source, err := openDSN(sourceDSN)
+			if err != nil {
+				return err
+			}
+			defer source.Close()
+			target, err := openDSN(targetDSN)
+			if err != nil {
+				return err
+			}
+			defer target.Close()
+			ctx := context.Background()
+			tables, err := listTables(ctx, source, dbs)
+			if err != nil {
+				return err
+			}
+			var (
+				results = make([]tableChecksum, len(tables))
+				jobs    = make(chan int)
+				wg      sync.WaitGroup
+			)
+			for i := 0; i < concurrency; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for k := range jobs {
+						results[k] = opts.compare(ctx, source, target, tables[k][0], tables[k][1])
+					}
+				}()
+			}
+			for k := range tables {
+				jobs <- k
+			}
+			close(jobs)
+			wg.Wait()
+
+			if asJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				if err = enc.Encode(results); err != nil {
+					return errors.Trace(err)
+				}
+			} else {
+				tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+				fmt.Fprintf(tw, "table\tsource\ttarget\tstatus\tdetail\n")
+				for _, r := range results {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Table, r.Source, r.Target, r.Status, r.Detail)
+				}
+				tw.Flush()
+			}
+			for _, r := range results {
+				if r.Status != checksumOK {
+					return errors.New("some tables diverged")
+				}
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&sourceDSN, "source-dsn", "", "dsn of the source")
+	cmd.Flags().StringVar(&targetDSN, "target-dsn", "", "dsn of the target")
+	cmd.Flags().StringSliceVar(&dbs, "db", nil, "databases to compare (default: all but system ones)")
+	cmd.Flags().StringVar(&opts.method, "method", checksumCRC, "checksum method, crc works across MySQL and TiDB, while checksum (CHECKSUM TABLE) and admin (ADMIN CHECKSUM TABLE of TiDB) require both sides to be the same kind (crc|checksum|admin)")
+	cmd.Flags().Int64Var(&opts.chunkSize, "chunk-size", 100000, "key range of chunks summed separately by crc, which locates diverged rows (0 means a single chunk per table)")
+	cmd.Flags().IntVar(&concurrency, "concurrency", 4, "number of tables compared at the same time")
+	cmd.Flags().BoolVar(&asJSON, "json", false, "print results as json")
+	return cmd
+}
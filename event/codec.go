@@ -0,0 +1,311 @@
+package event
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+const (
+	// FormatTSV is the text format written by `text dump`.
+	FormatTSV = "tsv"
+	// FormatJSON holds a json object per line, the first of which may be the
+	// header like `{"header":{...}}`.
+	FormatJSON = "json"
+	// FormatParquet holds a row per event in a parquet file, the header is
+	// kept in the metadata of the file.
+	FormatParquet = "parquet"
+)
+
+// codec creates readers and writers of a format.
+type codec struct {
+	newReader func(r io.Reader, maxLineSize int) (Reader, error)
+	newWriter func(w io.Writer, h Header) (Writer, error)
+}
+
+// codecs are registered in init of files implementing them, see Formats.
+var codecs = map[string]codec{}
+
+func registerCodec(format string, c codec) {
+	if _, ok := codecs[format]; ok {
+		panic("event: codec " + format + " is already registered")
+	}
+	codecs[format] = c
+}
+
+func init() {
+	registerCodec(FormatTSV, codec{
+		newReader: func(r io.Reader, maxLineSize int) (Reader, error) {
+			return &tsvReader{in: NewLineScanner(r, maxLineSize), dec: NewDecoder(maxLineSize)}, nil
+		},
+		newWriter: func(w io.Writer, h Header) (Writer, error) {
+			return &tsvWriter{w: bufio.NewWriter(w), header: h}, nil
+		},
+	})
+	registerCodec(FormatJSON, codec{
+		newReader: func(r io.Reader, maxLineSize int) (Reader, error) {
+			return &jsonReader{in: NewLineScanner(r, maxLineSize), header: Header{Version: FormatVersion}}, nil
+		},
+		newWriter: func(w io.Writer, h Header) (Writer, error) {
+			return &jsonWriter{w: bufio.NewWriter(w), header: h}, nil
+		},
+	})
+}
+
+// Formats lists formats supported by NewReader and NewWriter.
+func Formats() []string {
+	formats := make([]string, 0, len(codecs))
+	for format := range codecs {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// Reader reads events of a session one by one.
+type Reader interface {
+	// Read reads the next event into e, it returns io.EOF at the end.
+	Read(e *MySQLEvent) error
+	// Header returns the header read so far.
+	Header() Header
+}
+
+// Writer writes events of a session.
+type Writer interface {
+	Write(e MySQLEvent) error
+	// Flush flushes events written, no more event can be written afterwards
+	// in FormatParquet.
+	Flush() error
+}
+
+// NewReader returns a reader of which lines are limited in size by maxLineSize
+// if it's positive. Files of FormatParquet are read into memory at once.
+func NewReader(format string, r io.Reader, maxLineSize int) (Reader, error) {
+	c, ok := codecs[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+	return c.newReader(r, maxLineSize)
+}
+
+// NewWriter returns a writer which writes h before the first event, events
+// are split into chunks of h.Chunk (if positive) in FormatTSV.
+func NewWriter(format string, w io.Writer, h Header) (Writer, error) {
+	c, ok := codecs[format]
+	if !ok {
+		return nil, fmt.Errorf("unsupported format: %s", format)
+	}
+	return c.newWriter(w, h)
+}
+
+type tsvReader struct {
+	in  *LineScanner
+	dec *Decoder
+}
+
+func (r *tsvReader) Read(e *MySQLEvent) error {
+	for r.in.Scan() {
+		ok, err := r.dec.Decode(r.in.Text(), e.Reset(e.Params[:0]))
+		if err != nil {
+			return err
+		} else if ok {
+			return nil
+		}
+	}
+	if err := r.in.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (r *tsvReader) Header() Header { return r.dec.Header }
+
+type tsvWriter struct {
+	w       *bufio.Writer
+	buf     []byte
+	line    []byte
+	header  Header
+	started bool
+}
+
+func (w *tsvWriter) Write(e MySQLEvent) error {
+	var err error
+	w.buf = w.buf[:0]
+	if !w.started {
+		w.started = true
+		w.header.Version = FormatVersion
+		if w.header.Chunk > 0 {
+			w.header.Version = FormatV3
+		}
+		if w.buf, err = AppendHeader(w.buf, w.header); err != nil {
+			return err
+		}
+		w.buf = append(w.buf, '\n')
+	}
+	if w.line, err = AppendEvent(w.line[:0], e); err != nil {
+		return err
+	}
+	w.buf = append(AppendChunks(w.buf, w.line, w.header.Chunk), '\n')
+	_, err = w.w.Write(w.buf)
+	return err
+}
+
+func (w *tsvWriter) Flush() error { return w.w.Flush() }
+
+// jsonEvent is the json form of an event, params are tagged by their types
+// so that they are decoded as they were.
+type jsonEvent struct {
+	*MySQLEvent
+	Params []jsonParam `json:"params,omitempty"`
+}
+
+func newJSONEvent(e *MySQLEvent) jsonEvent {
+	je := jsonEvent{MySQLEvent: e}
+	for _, p := range e.Params {
+		je.Params = append(je.Params, jsonParam{v: p})
+	}
+	return je
+}
+
+// EncodeJSON encodes the event as a json object like lines of FormatJSON.
+func EncodeJSON(e MySQLEvent) ([]byte, error) {
+	return json.Marshal(newJSONEvent(&e))
+}
+
+// DecodeJSON decodes an event encoded by EncodeJSON into e.
+func DecodeJSON(data []byte, e *MySQLEvent) error {
+	je := jsonEvent{MySQLEvent: e}
+	if err := json.Unmarshal(data, &je); err != nil {
+		return err
+	}
+	e.Params = e.Params[:0]
+	for _, p := range je.Params {
+		e.Params = append(e.Params, p.v)
+	}
+	return nil
+}
+
+type jsonHeader struct {
+	Header *Header `json:"header"`
+}
+
+// jsonParam is encoded as an object with a single key which is the type of
+// the param in the text format (e.g. `{"i":"-1"}`), or null.
+type jsonParam struct {
+	v interface{}
+}
+
+func (p jsonParam) MarshalJSON() ([]byte, error) {
+	var (
+		t string
+		v interface{}
+	)
+	switch x := p.v.(type) {
+	case nil:
+		return []byte("null"), nil
+	case int64:
+		t, v = string(typeI64), strconv.FormatInt(x, 10)
+	case uint64:
+		t, v = string(typeU64), strconv.FormatUint(x, 10)
+	case float32:
+		t, v = string(typeF32), strconv.FormatFloat(float64(x), 'g', -1, 32)
+	case float64:
+		t, v = string(typeF64), strconv.FormatFloat(x, 'g', -1, 64)
+	case string:
+		t, v = string(typeStr), x
+	case []byte:
+		t, v = string(typeBin), base64.StdEncoding.EncodeToString(x)
+	default:
+		return nil, fmt.Errorf("unsupported param type: %T", p.v)
+	}
+	return json.Marshal(map[string]interface{}{t: v})
+}
+
+func (p *jsonParam) UnmarshalJSON(data []byte) error {
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	if m == nil {
+		p.v = nil
+		return nil
+	}
+	if len(m) != 1 {
+		return fmt.Errorf("unexpected param: %s", data)
+	}
+	var err error
+	for t, raw := range m {
+		if len(t) != 1 {
+			return fmt.Errorf("unsupported param type: %s", t)
+		}
+		switch t[0] {
+		case typeI64:
+			p.v, err = strconv.ParseInt(raw, 10, 64)
+		case typeU64:
+			p.v, err = strconv.ParseUint(raw, 10, 64)
+		case typeF32:
+			var f float64
+			f, err = strconv.ParseFloat(raw, 32)
+			p.v = float32(f)
+		case typeF64:
+			p.v, err = strconv.ParseFloat(raw, 64)
+		case typeStr:
+			p.v = raw
+		case typeBin:
+			p.v, err = base64.StdEncoding.DecodeString(raw)
+		default:
+			return fmt.Errorf("unsupported param type: %s", t)
+		}
+	}
+	return err
+}
+
+type jsonReader struct {
+	in     *LineScanner
+	header Header
+}
+
+func (r *jsonReader) Read(e *MySQLEvent) error {
+	for r.in.Scan() {
+		line := r.in.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var h jsonHeader
+		if err := json.Unmarshal(line, &h); err == nil && h.Header != nil {
+			r.header = *h.Header
+			continue
+		}
+		return DecodeJSON(line, e.Reset(e.Params[:0]))
+	}
+	if err := r.in.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (r *jsonReader) Header() Header { return r.header }
+
+type jsonWriter struct {
+	w       *bufio.Writer
+	header  Header
+	started bool
+}
+
+func (w *jsonWriter) Write(e MySQLEvent) error {
+	enc := json.NewEncoder(w.w)
+	if !w.started {
+		w.started = true
+		w.header.Version = FormatVersion
+		if err := enc.Encode(jsonHeader{Header: &w.header}); err != nil {
+			return err
+		}
+	}
+	return enc.Encode(newJSONEvent(&e))
+}
+
+func (w *jsonWriter) Flush() error { return w.w.Flush() }
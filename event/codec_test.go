@@ -0,0 +1,93 @@
+package event
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodec(t *testing.T) {
+	events := []MySQLEvent{
+		{Time: 1, Type: EventHandshake, DB: "test", Charset: 45, User: "root"},
+		{Time: 2, Type: EventQuery, Query: "select 1"},
+		{Time: 3, Type: EventStmtPrepare, StmtID: 1, Query: "select ?, ?, ?, ?, ?, ?, ?"},
+		{Time: 4, Type: EventStmtExecute, StmtID: 1,
+			Params:     []interface{}{int64(-1), uint64(math.MaxUint64), float32(1.5), math.Pi, "a\tb", []byte{0, 1}, nil},
+			ParamTypes: []uint16{TypeLongLong, TypeLongLong | paramUnsigned, TypeFloat, TypeDouble, TypeVarString, TypeBLOB, TypeNULL}},
+		{Time: 5, Type: EventStmtExecute, StmtID: 1, Params: []interface{}{int64(1), uint64(2), 1.5, 2.5, "", []byte{}, nil}, Cursor: 1},
+		{Time: 5, Type: EventStmtFetch, StmtID: 1, Rows: 10},
+		{Time: 6, Type: EventStmtClose, StmtID: 1},
+		{Time: 7, Type: EventInitDB, DB: "db2"},
+		{Time: 8, Type: EventGap, Gap: 1460},
+		{Time: 8, Type: EventResult, Affected: 2, Latency: 1500},
+		{Time: 9, Type: EventQuit},
+	}
+	h := Header{Host: "h1", Source: "10.0.0.1:1234", Columns: Columns}
+	for _, format := range Formats() {
+		var buf bytes.Buffer
+		w, err := NewWriter(format, &buf, h)
+		require.NoError(t, err)
+		for _, e := range events {
+			require.NoError(t, w.Write(e), format)
+		}
+		require.NoError(t, w.Flush())
+
+		r, err := NewReader(format, &buf, 0)
+		require.NoError(t, err)
+		e := MySQLEvent{Params: []interface{}{}}
+		for _, expect := range events {
+			require.NoError(t, r.Read(&e), format)
+			if len(expect.Params) == 0 {
+				expect.Params = e.Params
+			}
+			require.Equal(t, expect, e, format)
+		}
+		require.Equal(t, io.EOF, r.Read(&e), format)
+		require.Equal(t, Header{Version: FormatVersion, Host: "h1", Source: "10.0.0.1:1234", Columns: Columns}, r.Header(), format)
+	}
+	_, err := NewReader("orc", nil, 0)
+	require.Error(t, err)
+}
+
+func TestCodecChunked(t *testing.T) {
+	events := []MySQLEvent{
+		{Time: 1, Type: EventQuery, Query: "select 1"},
+		{Time: 2, Type: EventQuery, Query: "insert into t values ('" + strings.Repeat("x", 1000) + "')"},
+		{Time: 3, Type: EventStmtPrepare, StmtID: 1, Query: "insert into t values (?)"},
+		{Time: 4, Type: EventStmtExecute, StmtID: 1, Params: []interface{}{strings.Repeat("y\n", 300)}, ParamTypes: []uint16{TypeVarString}},
+	}
+	var buf bytes.Buffer
+	w, err := NewWriter(FormatTSV, &buf, Header{Chunk: MinChunkSize})
+	require.NoError(t, err)
+	for _, e := range events {
+		require.NoError(t, w.Write(e))
+	}
+	require.NoError(t, w.Flush())
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		require.LessOrEqual(t, len(line), MinChunkSize)
+	}
+
+	// events joined from chunks are limited in size like lines
+	r, err := NewReader(FormatTSV, bytes.NewReader(buf.Bytes()), 512)
+	require.NoError(t, err)
+	e := MySQLEvent{Params: []interface{}{}}
+	require.NoError(t, r.Read(&e))
+	require.Equal(t, bufio.ErrTooLong, r.Read(&e))
+
+	r, err = NewReader(FormatTSV, &buf, 2048)
+	require.NoError(t, err)
+	for _, expect := range events {
+		require.NoError(t, r.Read(&e))
+		if len(expect.Params) == 0 {
+			expect.Params = e.Params
+		}
+		require.Equal(t, expect, e)
+	}
+	require.Equal(t, io.EOF, r.Read(&e))
+	require.Equal(t, Header{Version: FormatV3, Chunk: MinChunkSize}, r.Header())
+}
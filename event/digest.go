@@ -0,0 +1,170 @@
+package event
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// Normalize returns the fingerprint of a query: literals are replaced by '?',
+// comments are dropped, whitespaces are collapsed, keywords and identifiers
+// are lowercased and value lists like `(?, ?, ?)` are folded as `(...)`.
+func Normalize(query string) string {
+	var (
+		out = make([]byte, 0, len(query))
+		i   = 0
+		n   = len(query)
+	)
+	space := func() {
+		if len(out) > 0 && out[len(out)-1] != ' ' {
+			out = append(out, ' ')
+		}
+	}
+	for i < n {
+		c, prev := query[i], byte(0)
+		if len(out) > 0 {
+			prev = out[len(out)-1]
+		}
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			space()
+			i++
+			continue
+		case c == '#' || (c == '-' && i+2 < n && query[i+1] == '-' && (query[i+2] == ' ' || query[i+2] == '\t')):
+			for i < n && query[i] != '\n' {
+				i++
+			}
+			space()
+			continue
+		case c == '/' && i+1 < n && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				i = n
+			} else {
+				i += end + 4
+			}
+			space()
+			continue
+		case c == '\'' || c == '"':
+			i = skipQuoted(query, i, c)
+			out = append(out, '?')
+		case c == '`':
+			j := skipQuoted(query, i, c)
+			out = append(out, strings.ToLower(query[i:j])...)
+			i = j
+		case isDigit(c) && !isIdentChar(prev):
+			j := i
+			if c == '0' && j+1 < n && (query[j+1] == 'x' || query[j+1] == 'X' || query[j+1] == 'b' || query[j+1] == 'B') {
+				j += 2
+			}
+			for j < n && (isIdentChar(query[j]) || query[j] == '.') {
+				j++
+			}
+			if j < n && (query[j] == '+' || query[j] == '-') && (query[j-1] == 'e' || query[j-1] == 'E') {
+				j++
+				for j < n && isDigit(query[j]) {
+					j++
+				}
+			}
+			i = j
+			out = append(out, '?')
+		case (c == 'x' || c == 'X' || c == 'b' || c == 'B') && i+1 < n && query[i+1] == '\'' && !isIdentChar(prev):
+			i = skipQuoted(query, i+1, '\'')
+			out = append(out, '?')
+		default:
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			out = append(out, c)
+			i++
+		}
+	}
+	return foldValueLists(strings.TrimSpace(string(out)))
+}
+
+// Digest returns a hex digest of the normalized query.
+func Digest(query string) string {
+	return DigestNormalized(Normalize(query))
+}
+
+func DigestNormalized(normalized string) string {
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Keyword returns the leading keyword of a normalized query (e.g. `select`),
+// opening parentheses are skipped.
+func Keyword(normalized string) string {
+	s := strings.TrimLeft(normalized, "( ")
+	i := 0
+	for i < len(s) && isIdentChar(s[i]) {
+		i++
+	}
+	return s[:i]
+}
+
+func skipQuoted(s string, i int, quote byte) int {
+	i++
+	for i < len(s) {
+		if s[i] == '\\' && quote != '`' {
+			i += 2
+			continue
+		}
+		if s[i] == quote {
+			if i+1 < len(s) && s[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return len(s)
+}
+
+func foldValueLists(s string) string {
+	if !strings.Contains(s, "?") {
+		return s
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '(' {
+			j, k := i+1, 0
+			for j < len(s) {
+				for j < len(s) && s[j] == ' ' {
+					j++
+				}
+				if j >= len(s) || s[j] != '?' {
+					break
+				}
+				j, k = j+1, k+1
+				for j < len(s) && s[j] == ' ' {
+					j++
+				}
+				if j < len(s) && s[j] == ',' {
+					j++
+					continue
+				}
+				break
+			}
+			if k > 1 && j < len(s) && s[j] == ')' {
+				b.WriteString("(...)")
+				i = j
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	out := b.String()
+	for strings.Contains(out, "(...) , (...)") || strings.Contains(out, "(...), (...)") || strings.Contains(out, "(...),(...)") {
+		out = strings.NewReplacer("(...) , (...)", "(...)", "(...), (...)", "(...)", "(...),(...)", "(...)").Replace(out)
+	}
+	return out
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || isDigit(c) || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
@@ -0,0 +1,41 @@
+package event
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalize(t *testing.T) {
+	for _, tt := range []struct {
+		query  string
+		expect string
+	}{
+		{"SELECT * FROM t WHERE id = 1", "select * from t where id = ?"},
+		{"select *  from t1\n where c = 'it''s' and d = \"x\\\"y\"", "select * from t1 where c = ? and d = ?"},
+		{"select a from t where id in (1, 2, 3)", "select a from t where id in (...)"},
+		{"insert into t values (1, 'a'), (2, 'b')", "insert into t values (...)"},
+		{"select 1.5e-3, 0x1F, x'ab' /* hint */ from `T`", "select ?, ?, ? from `t`"},
+		{"select c1 from t -- trailing\n where id=-2 # other", "select c1 from t where id=-?"},
+		{"update t set c = ? where id = ?", "update t set c = ? where id = ?"},
+	} {
+		require.Equal(t, tt.expect, Normalize(tt.query), tt.query)
+	}
+	require.Equal(t, Digest("select 1"), Digest("SELECT   2"))
+	require.NotEqual(t, Digest("select 1"), Digest("select 1 from dual"))
+}
+
+func TestKeyword(t *testing.T) {
+	for _, tt := range []struct {
+		query  string
+		expect string
+	}{
+		{"SELECT * FROM t", "select"},
+		{"/* hint */ insert into t values (1)", "insert"},
+		{"(select 1) union (select 2)", "select"},
+		{"set names utf8mb4", "set"},
+		{"", ""},
+	} {
+		require.Equal(t, tt.expect, Keyword(Normalize(tt.query)), tt.query)
+	}
+}
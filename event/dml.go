@@ -0,0 +1,140 @@
+package event
+
+import "strings"
+
+const (
+	DMLInsert = "insert"
+	DMLUpdate = "update"
+	DMLDelete = "delete"
+)
+
+// DML is the kind and the target table of a data modifying statement, Schema is
+// empty if the table is not qualified.
+type DML struct {
+	Kind   string
+	Schema string
+	Table  string
+}
+
+// dmlModifiers are keywords between the verb and the table of statements.
+var dmlModifiers = map[string]bool{
+	"low_priority":  true,
+	"high_priority": true,
+	"delayed":       true,
+	"quick":         true,
+	"ignore":        true,
+	"into":          true,
+	"from":          true,
+}
+
+// ParseDML returns the kind and the table of INSERT, REPLACE (as inserts),
+// UPDATE and DELETE statements, the first table is returned for multi-table
+// statements.
+func ParseDML(query string) (DML, bool) {
+	var (
+		dml DML
+		s   = skipSpaceAndComments(query, 0)
+		i   = s
+	)
+	for i < len(query) && isIdentChar(query[i]) {
+		i++
+	}
+	switch strings.ToLower(query[s:i]) {
+	case "insert", "replace":
+		dml.Kind = DMLInsert
+	case "update":
+		dml.Kind = DMLUpdate
+	case "delete":
+		dml.Kind = DMLDelete
+	default:
+		return dml, false
+	}
+	for {
+		i = skipSpaceAndComments(query, i)
+		j := i
+		for j < len(query) && isIdentChar(query[j]) {
+			j++
+		}
+		if j == i || !dmlModifiers[strings.ToLower(query[i:j])] {
+			break
+		}
+		i = j
+	}
+	name, i := scanIdent(query, i)
+	if len(name) == 0 {
+		return dml, false
+	}
+	if i < len(query) && query[i] == '.' {
+		var table string
+		if table, i = scanIdent(query, i+1); len(table) == 0 {
+			return dml, false
+		}
+		dml.Schema, name = name, table
+	}
+	dml.Table = name
+	return dml, true
+}
+
+// scanIdent scans a (maybe quoted by backticks) identifier at i.
+func scanIdent(s string, i int) (string, int) {
+	if i < len(s) && s[i] == '`' {
+		end := skipQuoted(s, i, '`')
+		if end <= i+1 || s[end-1] != '`' {
+			return "", end
+		}
+		return strings.ReplaceAll(s[i+1:end-1], "``", "`"), end
+	}
+	j := i
+	for j < len(s) && isIdentChar(s[j]) {
+		j++
+	}
+	return s[i:j], j
+}
+
+func skipSpaceAndComments(s string, i int) int {
+	for i < len(s) {
+		switch {
+		case s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r' || s[i] == '(':
+			i++
+		case s[i] == '/' && i+1 < len(s) && s[i+1] == '*':
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return len(s)
+			}
+			i += end + 4
+		case s[i] == '#' || (s[i] == '-' && i+2 < len(s) && s[i+1] == '-' && (s[i+2] == ' ' || s[i+2] == '\t')):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		default:
+			return i
+		}
+	}
+	return i
+}
+
+// rowsKeywords are the leading keywords of statements returning result sets.
+var rowsKeywords = map[string]bool{
+	"select":   true,
+	"show":     true,
+	"with":     true,
+	"explain":  true,
+	"describe": true,
+	"desc":     true,
+	"table":    true,
+	"values":   true,
+}
+
+// ReturnsRows tells whether the statement returns a result set (e.g. SELECT
+// and SHOW), by its leading keyword.
+func ReturnsRows(query string) bool {
+	i := skipSpaceAndComments(query, 0)
+	for i < len(query) && query[i] == '(' {
+		i = skipSpaceAndComments(query, i+1)
+	}
+	j := i
+	for j < len(query) && isIdentChar(query[j]) {
+		j++
+	}
+	return rowsKeywords[strings.ToLower(query[i:j])]
+}
@@ -0,0 +1,38 @@
+package event
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDML(t *testing.T) {
+	for _, tt := range []struct {
+		query  string
+		expect DML
+		ok     bool
+	}{
+		{"select * from t", DML{}, false},
+		{"insert into t values (1)", DML{DMLInsert, "", "t"}, true},
+		{"/* c */ INSERT IGNORE INTO `db`.`t 1` (a) VALUES (1)", DML{DMLInsert, "db", "t 1"}, true},
+		{"replace low_priority into db.t set a = 1", DML{DMLInsert, "db", "t"}, true},
+		{"UPDATE t1, t2 SET t1.a = t2.a", DML{DMLUpdate, "", "t1"}, true},
+		{"delete quick from t where id = ?", DML{DMLDelete, "", "t"}, true},
+		{"delete", DML{}, false},
+	} {
+		dml, ok := ParseDML(tt.query)
+		require.Equal(t, tt.ok, ok, tt.query)
+		if ok {
+			require.Equal(t, tt.expect, dml, tt.query)
+		}
+	}
+}
+
+func TestReturnsRows(t *testing.T) {
+	for _, query := range []string{"select 1", " /* x */ SELECT 1", "(select 1) union (select 2)", "show tables", "with t as (select 1) select * from t", "desc t", "EXPLAIN select 1"} {
+		require.True(t, ReturnsRows(query), query)
+	}
+	for _, query := range []string{"", "update t set a = 1", "insert into t select * from s", "set @a = 1", "begin", "selected"} {
+		require.False(t, ReturnsRows(query), query)
+	}
+}
@@ -14,6 +14,14 @@ const (
 	EventStmtPrepare
 	EventStmtExecute
 	EventStmtClose
+	EventInitDB
+	EventStmtFetch
+	// EventGap marks data of the connection lost in the capture, events after
+	// it may be missing or corrupted.
+	EventGap
+	// EventResult carries the result of the last statement in the capture,
+	// which is only dumped on demand.
+	EventResult
 )
 
 type MySQLEvent struct {
@@ -21,8 +29,18 @@ type MySQLEvent struct {
 	Type   uint64        `json:"type"`
 	StmtID uint64        `json:"stmtID,omitempty"`
 	Params []interface{} `json:"params,omitempty"`
-	DB     string        `json:"db,omitempty"`
-	Query  string        `json:"query,omitempty"`
+	// ParamTypes are mysql type codes of params sent in the binary protocol,
+	// flags (e.g. 0x80 for unsigned) are kept in the high byte.
+	ParamTypes []uint16 `json:"paramTypes,omitempty"`
+	DB         string   `json:"db,omitempty"`
+	Query      string   `json:"query,omitempty"`
+	Charset    uint64   `json:"charset,omitempty"`  // collation id sent in the handshake
+	User       string   `json:"user,omitempty"`     // user name sent in the handshake
+	Rows       uint64   `json:"rows,omitempty"`     // number of rows to fetch from a cursor
+	Gap        uint64   `json:"gap,omitempty"`      // number of bytes lost in the capture
+	Affected   uint64   `json:"affected,omitempty"` // number of rows affected in the capture
+	Latency    uint64   `json:"latency,omitempty"`  // microseconds taken by the statement in the capture
+	Cursor     uint64   `json:"cursor,omitempty"`   // cursor type flags of the execution in the capture
 }
 
 func (event *MySQLEvent) Reset(params []interface{}) *MySQLEvent {
@@ -30,8 +48,16 @@ func (event *MySQLEvent) Reset(params []interface{}) *MySQLEvent {
 	event.Type = 0
 	event.StmtID = 0
 	event.Params = params
+	event.ParamTypes = nil
 	event.DB = ""
 	event.Query = ""
+	event.Charset = 0
+	event.User = ""
+	event.Rows = 0
+	event.Gap = 0
+	event.Affected = 0
+	event.Latency = 0
+	event.Cursor = 0
 	return event
 }
 
@@ -49,11 +75,29 @@ func (event *MySQLEvent) String() string {
 		return fmt.Sprintf("connect {db:%q} @%d", event.DB, event.Time)
 	case EventQuit:
 		return fmt.Sprintf("quit @%d", event.Time)
+	case EventStmtFetch:
+		return fmt.Sprintf("fetch stmt {id:%d,rows:%d} @%d", event.StmtID, event.Rows, event.Time)
+	case EventInitDB:
+		return fmt.Sprintf("init db {db:%q} @%d", event.DB, event.Time)
+	case EventGap:
+		return fmt.Sprintf("gap {bytes:%d} @%d", event.Gap, event.Time)
+	case EventResult:
+		return fmt.Sprintf("result {affected:%d,latency:%dus} @%d", event.Affected, event.Latency, event.Time)
 	default:
 		return fmt.Sprintf("unknown event {type:%v} @%d", event.Type, event.Time)
 	}
 }
 
+var typeNames = []string{"handshake", "quit", "query", "stmt prepare", "stmt execute", "stmt close", "init db", "stmt fetch", "gap", "result"}
+
+// TypeName returns the name of the event type.
+func TypeName(t uint64) string {
+	if t < uint64(len(typeNames)) {
+		return typeNames[t]
+	}
+	return "unknown"
+}
+
 func formatQuery(query string) string {
 	if len(query) > 1024 {
 		query = query[:700] + "..." + query[len(query)-300:]
@@ -72,6 +116,7 @@ const (
 	typeBin = byte('b')
 	typeNil = byte('0')
 	typeLst = byte('[')
+	typeTag = byte('#')
 )
 
 func AppendEvent(buf []byte, event MySQLEvent) ([]byte, error) {
@@ -91,6 +136,14 @@ func AppendEvent(buf []byte, event MySQLEvent) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+		if len(event.ParamTypes) > 0 {
+			buf = append(buf, sep)
+			buf = AppendParamTypes(buf, event.ParamTypes)
+		}
+		if event.Cursor > 0 {
+			buf = appendColumn(buf, columnCursor)
+			buf = strconv.AppendUint(buf, event.Cursor, 10)
+		}
 	case EventStmtPrepare:
 		buf = append(buf, sep)
 		buf = strconv.AppendUint(buf, event.StmtID, 10)
@@ -102,6 +155,32 @@ func AppendEvent(buf []byte, event MySQLEvent) ([]byte, error) {
 	case EventHandshake:
 		buf = append(buf, sep)
 		buf = strconv.AppendQuote(buf, event.DB)
+		if event.Charset > 0 {
+			buf = append(buf, sep)
+			buf = strconv.AppendUint(buf, event.Charset, 10)
+		}
+		if len(event.User) > 0 {
+			buf = appendColumn(buf, columnUser)
+			buf = strconv.AppendQuote(buf, event.User)
+		}
+	case EventStmtFetch:
+		buf = append(buf, sep)
+		buf = strconv.AppendUint(buf, event.StmtID, 10)
+		buf = append(buf, sep)
+		buf = strconv.AppendUint(buf, event.Rows, 10)
+	case EventInitDB:
+		buf = append(buf, sep)
+		buf = strconv.AppendQuote(buf, event.DB)
+	case EventGap:
+		buf = append(buf, sep)
+		buf = strconv.AppendUint(buf, event.Gap, 10)
+	case EventResult:
+		buf = append(buf, sep)
+		buf = strconv.AppendUint(buf, event.Affected, 10)
+		if event.Latency > 0 {
+			buf = appendColumn(buf, columnLatency)
+			buf = strconv.AppendUint(buf, event.Latency, 10)
+		}
 	case EventQuit:
 	default:
 		return nil, fmt.Errorf("unknown event type: %v", event.Type)
@@ -152,7 +231,60 @@ func AppendStmtParams(buf []byte, params []interface{}) ([]byte, error) {
 	return buf, nil
 }
 
+// AppendParamTypes appends types of params as `#` followed by 4 hex digits for
+// each param.
+func AppendParamTypes(buf []byte, types []uint16) []byte {
+	buf = append(buf, typeTag)
+	for _, t := range types {
+		buf = append(buf, hexDigits[t>>12], hexDigits[(t>>8)&0xf], hexDigits[(t>>4)&0xf], hexDigits[t&0xf])
+	}
+	return buf
+}
+
+const hexDigits = "0123456789abcdef"
+
+func ScanParamTypes(s string, pos int, types []uint16) ([]uint16, int, error) {
+	if len(s) < pos+1 || s[pos] != typeTag {
+		return nil, pos, fmt.Errorf("scan param types from (%s)", s[pos:])
+	}
+	pos += 1
+	posNext := nextSep(s, pos)
+	raw := s[pos:posNext]
+	if len(raw)%4 != 0 {
+		return nil, pos, fmt.Errorf("unexpected length of param types: %d", len(raw))
+	}
+	for i := 0; i < len(raw); i += 4 {
+		t, err := strconv.ParseUint(raw[i:i+4], 16, 16)
+		if err != nil {
+			return nil, pos, fmt.Errorf("parse param types[%d] from (%s): %v", i/4, raw[i:i+4], err)
+		}
+		types = append(types, uint16(t))
+	}
+	return types, posNext, nil
+}
+
+// ScanEvent scans an event in the latest format from s.
 func ScanEvent(s string, pos int, event *MySQLEvent) (int, error) {
+	return ScanEventVersion(FormatVersion, s, pos, event)
+}
+
+// ScanEventVersion scans an event in the given version of format from s.
+func ScanEventVersion(version int, s string, pos int, event *MySQLEvent) (int, error) {
+	switch version {
+	case FormatV1:
+		return scanEventV1(s, pos, event)
+	case FormatV2, FormatV3:
+		posNext, err := scanEventV1(s, pos, event)
+		if err != nil {
+			return posNext, err
+		}
+		return scanColumns(s, posNext, event)
+	default:
+		return pos, fmt.Errorf("unsupported format version: %d", version)
+	}
+}
+
+func scanEventV1(s string, pos int, event *MySQLEvent) (int, error) {
 	var (
 		posNext int
 		err     error
@@ -206,6 +338,13 @@ func ScanEvent(s string, pos int, event *MySQLEvent) (int, error) {
 		if err != nil {
 			return pos, fmt.Errorf("scan params of event from (%s): %v", s[pos:posNext], err)
 		}
+		// param types are optional
+		if pos = posNext + 1; len(s) > pos && s[pos] == typeTag {
+			event.ParamTypes, posNext, err = ScanParamTypes(s, pos, event.ParamTypes[:0])
+			if err != nil {
+				return pos, fmt.Errorf("scan param types of event from (%s): %v", s[pos:posNext], err)
+			}
+		}
 		return posNext, nil
 	case EventStmtPrepare:
 		// stmt-id
@@ -249,6 +388,68 @@ func ScanEvent(s string, pos int, event *MySQLEvent) (int, error) {
 		if err != nil {
 			return pos, fmt.Errorf("scan db of event from (%s): %v", s[pos:posNext], err)
 		}
+		// charset is optional, unknown trailing fields are ignored as usual
+		if pos = posNext + 1; len(s) < pos+1 {
+			return posNext, nil
+		}
+		if charset, err := strconv.ParseUint(s[pos:nextSep(s, pos)], 10, 64); err == nil {
+			event.Charset = charset
+			return nextSep(s, pos), nil
+		}
+		return posNext, nil
+	case EventStmtFetch:
+		// stmt-id
+		if len(s) < pos+1 {
+			return pos, fmt.Errorf("scan stmt-id of event from an empty string")
+		}
+		posNext = nextSep(s, pos)
+		event.StmtID, err = strconv.ParseUint(s[pos:posNext], 10, 64)
+		if err != nil {
+			return pos, fmt.Errorf("scan stmt-id of event from (%s): %v", s[pos:posNext], err)
+		}
+		pos = posNext + 1
+		// rows
+		if len(s) < pos+1 {
+			return pos, fmt.Errorf("scan rows of event from an empty string")
+		}
+		posNext = nextSep(s, pos)
+		event.Rows, err = strconv.ParseUint(s[pos:posNext], 10, 64)
+		if err != nil {
+			return pos, fmt.Errorf("scan rows of event from (%s): %v", s[pos:posNext], err)
+		}
+		return posNext, nil
+	case EventInitDB:
+		// db
+		if len(s) < pos+1 {
+			return pos, fmt.Errorf("scan db of event from an empty string")
+		}
+		posNext = nextSep(s, pos)
+		event.DB, err = strconv.Unquote(s[pos:posNext])
+		if err != nil {
+			return pos, fmt.Errorf("scan db of event from (%s): %v", s[pos:posNext], err)
+		}
+		return posNext, nil
+	case EventGap:
+		// bytes
+		if len(s) < pos+1 {
+			return pos, fmt.Errorf("scan gap of event from an empty string")
+		}
+		posNext = nextSep(s, pos)
+		event.Gap, err = strconv.ParseUint(s[pos:posNext], 10, 64)
+		if err != nil {
+			return pos, fmt.Errorf("scan gap of event from (%s): %v", s[pos:posNext], err)
+		}
+		return posNext, nil
+	case EventResult:
+		// affected rows
+		if len(s) < pos+1 {
+			return pos, fmt.Errorf("scan affected rows of event from an empty string")
+		}
+		posNext = nextSep(s, pos)
+		event.Affected, err = strconv.ParseUint(s[pos:posNext], 10, 64)
+		if err != nil {
+			return pos, fmt.Errorf("scan affected rows of event from (%s): %v", s[pos:posNext], err)
+		}
 		return posNext, nil
 	case EventQuit:
 		return posNext, nil
@@ -33,6 +33,24 @@ func TestEventCodec(t *testing.T) {
 			Type: EventHandshake,
 			DB:   "test",
 		}, "1\t0\t\"test\"", true},
+		{MySQLEvent{
+			Time:    1,
+			Type:    EventHandshake,
+			DB:      "test",
+			Charset: 45,
+		}, "1\t0\t\"test\"\t45", true},
+		{MySQLEvent{
+			Time:    1,
+			Type:    EventHandshake,
+			DB:      "test",
+			Charset: 45,
+			User:    "root",
+		}, "1\t0\t\"test\"\t45\tuser=\"root\"", true},
+		{MySQLEvent{
+			Time: 1,
+			Type: EventHandshake,
+			User: "u\t1",
+		}, "1\t0\t\"\"\tuser=\"u\\t1\"", true},
 		{MySQLEvent{
 			Time: 2,
 			Type: EventQuit,
@@ -70,6 +88,55 @@ func TestEventCodec(t *testing.T) {
 			Type:   EventStmtClose,
 			StmtID: 1,
 		}, "8\t5\t1", true},
+		{MySQLEvent{
+			Time: 9,
+			Type: EventInitDB,
+			DB:   "test",
+		}, "9\t6\t\"test\"", true},
+		{MySQLEvent{
+			Time:   10,
+			Type:   EventStmtFetch,
+			StmtID: 1,
+			Rows:   100,
+		}, "10\t7\t1\t100", true},
+		{MySQLEvent{
+			Time: 12,
+			Type: EventGap,
+			Gap:  1460,
+		}, "12\t8\t1460", true},
+		{MySQLEvent{
+			Time:     13,
+			Type:     EventResult,
+			Affected: 3,
+		}, "13\t9\t3", true},
+		{MySQLEvent{
+			Time:     14,
+			Type:     EventResult,
+			Affected: 1,
+			Latency:  250,
+		}, "14\t9\t1\tlatency=250", true},
+		{MySQLEvent{
+			Time:       11,
+			Type:       EventStmtExecute,
+			StmtID:     1,
+			Params:     []interface{}{uint64(1), "2021-01-02 03:04:05", "1.50", nil},
+			ParamTypes: []uint16{0x8008, 0x000c, 0x00f6, 0x0006},
+		}, "11\t4\t1\t[uss0\t1\t\"2021-01-02 03:04:05\"\t\"1.50\"\tnil\t#8008000c00f60006", true},
+		{MySQLEvent{
+			Time:       15,
+			Type:       EventStmtExecute,
+			StmtID:     2,
+			Params:     []interface{}{int64(1)},
+			ParamTypes: []uint16{0x0008},
+			Cursor:     1,
+		}, "15\t4\t2\t[i\t1\t#0008\tcursor=1", true},
+		{MySQLEvent{
+			Time:   16,
+			Type:   EventStmtExecute,
+			StmtID: 2,
+			Params: []interface{}{},
+			Cursor: 1,
+		}, "16\t4\t2\t[\tcursor=1", true},
 	} {
 		t.Run(t.Name()+strconv.Itoa(i), func(t *testing.T) {
 			buf = buf[:0]
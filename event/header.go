@@ -0,0 +1,206 @@
+package event
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// FormatV1 is the original format: events only, one per line.
+	FormatV1 = 1
+	// FormatV2 starts with a header line, and events may carry extra columns
+	// as `name=value` fields after the fields of v1, unknown ones are ignored.
+	FormatV2 = 2
+	// FormatV3 is v2 where events longer than the chunk size of the header are
+	// split into lines of chunks, all of which but the last start with '+' and
+	// the last one starts with '.', thus lines stay bounded in size.
+	FormatV3 = 3
+
+	// FormatVersion is the version of the format being written.
+	FormatVersion = FormatV2
+)
+
+// FormatVersions lists versions of the text format that can be scanned.
+var FormatVersions = []int{FormatV1, FormatV2, FormatV3}
+
+const (
+	headerPrefix = "#mysql-replay"
+
+	chunkMore = '+'
+	chunkLast = '.'
+	// MinChunkSize is the min chunk size of v3.
+	MinChunkSize = 64
+
+	columnUser    = "user"
+	columnLatency = "latency"
+	columnCursor  = "cursor"
+)
+
+// Columns lists extra columns of events known by the current version.
+var Columns = []string{columnUser, columnLatency, columnCursor}
+
+// Header is the first line of a dump file since v2.
+type Header struct {
+	Version int      `json:"version"`
+	Host    string   `json:"host,omitempty"`    // host of the capture
+	Source  string   `json:"source,omitempty"`  // client address of the session
+	Server  string   `json:"server,omitempty"`  // server address of the session
+	Time    int64    `json:"time,omitempty"`    // time of the first event
+	Columns []string `json:"columns,omitempty"` // extra columns of events
+	// Protocol is the wire protocol of the session, empty means mysql.
+	Protocol string `json:"protocol,omitempty"`
+	// Chunk is the max size of lines since v3, events longer than which are
+	// split into chunks by writers.
+	Chunk int `json:"chunk,omitempty"`
+}
+
+// IsHeader tells whether the line is a header.
+func IsHeader(line string) bool { return strings.HasPrefix(line, headerPrefix) }
+
+// AppendHeader appends the header line like `#mysql-replay<TAB>2<TAB>{json}`.
+func AppendHeader(buf []byte, h Header) ([]byte, error) {
+	meta, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, headerPrefix...)
+	buf = append(buf, sep)
+	buf = strconv.AppendInt(buf, int64(h.Version), 10)
+	buf = append(buf, sep)
+	return append(buf, meta...), nil
+}
+
+func ScanHeader(s string) (Header, error) {
+	var h Header
+	if !IsHeader(s) {
+		return h, fmt.Errorf("scan header from (%s)", s)
+	}
+	pos := len(headerPrefix) + 1
+	posNext := nextSep(s, pos)
+	if pos >= posNext {
+		return h, fmt.Errorf("scan version of header from an empty string")
+	}
+	version, err := strconv.Atoi(s[pos:posNext])
+	if err != nil {
+		return h, fmt.Errorf("scan version of header from (%s): %v", s[pos:posNext], err)
+	}
+	if posNext < len(s) {
+		if err = json.Unmarshal([]byte(s[posNext+1:]), &h); err != nil {
+			return h, fmt.Errorf("scan metadata of header: %v", err)
+		}
+	}
+	h.Version = version
+	return h, nil
+}
+
+// Decoder scans events line by line, lines without a header are taken as v1.
+// Chunks of events are joined before being scanned since v3, events joined are
+// limited in size by max if it's positive like lines of a LineScanner.
+type Decoder struct {
+	Header Header
+
+	max    int
+	chunks []byte
+}
+
+func NewDecoder(max int) *Decoder { return &Decoder{Header: Header{Version: FormatV1}, max: max} }
+
+// Decode scans the line into event, it returns false if the line is a header
+// or a chunk to be continued.
+func (d *Decoder) Decode(line string, event *MySQLEvent) (bool, error) {
+	if IsHeader(line) {
+		h, err := ScanHeader(line)
+		if err != nil {
+			return false, err
+		}
+		d.Header = h
+		return false, nil
+	}
+	if d.Header.Version >= FormatV3 && len(line) > 0 {
+		switch line[0] {
+		case chunkMore, chunkLast:
+			if d.max > 0 && len(d.chunks)+len(line)-1 > d.max {
+				d.chunks = nil
+				return false, bufio.ErrTooLong
+			}
+			if line[0] == chunkMore {
+				d.chunks = append(d.chunks, line[1:]...)
+				return false, nil
+			}
+			line = string(append(d.chunks, line[1:]...))
+			d.chunks = retain(d.chunks)
+		}
+	}
+	_, err := ScanEventVersion(d.Header.Version, line, 0, event)
+	return err == nil, err
+}
+
+// AppendChunks appends the line of an event to buf, which is split into lines
+// of chunks (see FormatV3) if it's longer than size (if positive).
+func AppendChunks(buf []byte, line []byte, size int) []byte {
+	if size <= 0 || len(line) <= size {
+		return append(buf, line...)
+	}
+	if size < MinChunkSize {
+		size = MinChunkSize
+	}
+	for n := size - 1; len(line) > n; line = line[n:] {
+		buf = append(buf, chunkMore)
+		buf = append(buf, line[:n]...)
+		buf = append(buf, '\n')
+	}
+	buf = append(buf, chunkLast)
+	return append(buf, line...)
+}
+
+func appendColumn(buf []byte, name string) []byte {
+	buf = append(buf, sep)
+	buf = append(buf, name...)
+	return append(buf, '=')
+}
+
+// scanColumns scans `name=value` fields from s[pos:] until something else.
+func scanColumns(s string, pos int, event *MySQLEvent) (int, error) {
+	for pos < len(s) && s[pos] == sep {
+		posNext := nextSep(s, pos+1)
+		field := s[pos+1 : posNext]
+		i := strings.IndexByte(field, '=')
+		if i <= 0 || !isColumnName(field[:i]) {
+			break
+		}
+		switch field[:i] {
+		case columnUser:
+			val, err := strconv.Unquote(field[i+1:])
+			if err != nil {
+				return pos, fmt.Errorf("scan %s of event from (%s): %v", columnUser, field[i+1:], err)
+			}
+			event.User = val
+		case columnLatency:
+			val, err := strconv.ParseUint(field[i+1:], 10, 64)
+			if err != nil {
+				return pos, fmt.Errorf("scan %s of event from (%s): %v", columnLatency, field[i+1:], err)
+			}
+			event.Latency = val
+		case columnCursor:
+			val, err := strconv.ParseUint(field[i+1:], 10, 8)
+			if err != nil {
+				return pos, fmt.Errorf("scan %s of event from (%s): %v", columnCursor, field[i+1:], err)
+			}
+			event.Cursor = val
+		}
+		pos = posNext
+	}
+	return pos, nil
+}
+
+func isColumnName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; !(c >= 'a' && c <= 'z' || c == '_' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
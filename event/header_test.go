@@ -0,0 +1,100 @@
+package event
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeaderCodec(t *testing.T) {
+	h := Header{Version: FormatV2, Host: "h1", Source: "10.0.0.1:1234", Server: "10.0.0.2:3306", Time: 1, Columns: Columns}
+	buf, err := AppendHeader(nil, h)
+	require.NoError(t, err)
+	require.True(t, IsHeader(string(buf)))
+	actual, err := ScanHeader(string(buf))
+	require.NoError(t, err)
+	require.Equal(t, h, actual)
+
+	actual, err = ScanHeader("#mysql-replay\t3")
+	require.NoError(t, err)
+	require.Equal(t, Header{Version: 3}, actual)
+
+	_, err = ScanHeader("#mysql-replay\t")
+	require.Error(t, err)
+	_, err = ScanHeader("1\t0\t\"\"")
+	require.Error(t, err)
+}
+
+func TestDecoder(t *testing.T) {
+	var e MySQLEvent
+
+	// v1 files have no header and ignore trailing fields
+	dec := NewDecoder(0)
+	ok, err := dec.Decode("1\t0\t\"test\"\tuser=\"root\"", e.Reset(nil))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "test", e.DB)
+	require.Empty(t, e.User)
+
+	dec = NewDecoder(0)
+	ok, err = dec.Decode("#mysql-replay\t2\t{\"version\":2,\"source\":\"10.0.0.1:1234\"}", e.Reset(nil))
+	require.NoError(t, err)
+	require.False(t, ok)
+	require.Equal(t, FormatV2, dec.Header.Version)
+	require.Equal(t, "10.0.0.1:1234", dec.Header.Source)
+	ok, err = dec.Decode("1\t0\t\"test\"\t45\tuser=\"root\"\tfuture=12\t...", e.Reset(nil))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, MySQLEvent{Time: 1, Type: EventHandshake, DB: "test", Charset: 45, User: "root"}, e)
+	_, err = dec.Decode("1\t0\t\"test\"\tuser=root", e.Reset(nil))
+	require.Error(t, err)
+
+	dec = NewDecoder(0)
+	_, err = dec.Decode("#mysql-replay\t9", e.Reset(nil))
+	require.NoError(t, err)
+	_, err = dec.Decode("2\t1", e.Reset(nil))
+	require.Error(t, err)
+}
+
+func TestDecoderChunks(t *testing.T) {
+	var e MySQLEvent
+	line, err := AppendEvent(nil, MySQLEvent{Time: 1, Type: EventQuery, Query: "select '" + strings.Repeat("x", 200) + "'"})
+	require.NoError(t, err)
+	require.Equal(t, line, AppendChunks(nil, line, 0))
+	chunks := strings.Split(string(AppendChunks(nil, line, MinChunkSize)), "\n")
+	require.Len(t, chunks, 4)
+
+	dec := NewDecoder(0)
+	ok, err := dec.Decode("#mysql-replay\t3\t{\"chunk\":64}", e.Reset(nil))
+	require.NoError(t, err)
+	require.False(t, ok)
+	for _, chunk := range chunks[:3] {
+		require.Equal(t, byte(chunkMore), chunk[0])
+		ok, err = dec.Decode(chunk, e.Reset(nil))
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+	ok, err = dec.Decode(chunks[3], e.Reset(nil))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, MySQLEvent{Time: 1, Type: EventQuery, Query: "select '" + strings.Repeat("x", 200) + "'"}, e)
+	line, err = AppendEvent(nil, MySQLEvent{Time: 2, Type: EventQuery, Query: "select 1"})
+	require.NoError(t, err)
+	ok, err = dec.Decode(string(line), e.Reset(nil))
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, "select 1", e.Query)
+
+	// events joined from chunks are limited like lines
+	dec = NewDecoder(150)
+	_, err = dec.Decode("#mysql-replay\t3\t{\"chunk\":64}", e.Reset(nil))
+	require.NoError(t, err)
+	_, err = dec.Decode(chunks[0], e.Reset(nil))
+	require.NoError(t, err)
+	_, err = dec.Decode(chunks[1], e.Reset(nil))
+	require.NoError(t, err)
+	_, err = dec.Decode(chunks[2], e.Reset(nil))
+	require.Equal(t, bufio.ErrTooLong, err)
+}
@@ -0,0 +1,87 @@
+package event
+
+import (
+	"bufio"
+	"io"
+)
+
+const (
+	lineBufferSize = 64 * 1024
+	// lineRetained is the max capacity of buffers kept for the next lines,
+	// larger ones grown by long lines are released once they are used.
+	lineRetained = 256 * 1024
+)
+
+// LineScanner reads lines like a bufio.Scanner, except that lines are only
+// limited in size by max if it's positive, and buffers grown by long lines
+// are released once the next line is scanned. Thus memory held between events
+// is bounded regardless of sizes of statements.
+type LineScanner struct {
+	in   *bufio.Reader
+	max  int
+	line []byte
+	err  error
+}
+
+func NewLineScanner(r io.Reader, max int) *LineScanner {
+	return &LineScanner{in: bufio.NewReaderSize(r, lineBufferSize), max: max}
+}
+
+// Scan reads the next line, it returns false at the end or on errors.
+func (s *LineScanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+	s.line = retain(s.line)
+	for {
+		chunk, err := s.in.ReadSlice('\n')
+		s.line = append(s.line, chunk...)
+		if err == bufio.ErrBufferFull {
+			if s.max > 0 && len(s.line) > s.max {
+				s.err = bufio.ErrTooLong
+				return false
+			}
+			continue
+		} else if err != nil {
+			s.err = err
+			if err != io.EOF || len(s.line) == 0 {
+				return false
+			}
+		}
+		break
+	}
+	if n := len(s.line); n > 0 && s.line[n-1] == '\n' {
+		s.line = s.line[:n-1]
+	}
+	if n := len(s.line); n > 0 && s.line[n-1] == '\r' {
+		s.line = s.line[:n-1]
+	}
+	if s.max > 0 && len(s.line) > s.max {
+		s.err = bufio.ErrTooLong
+		return false
+	}
+	return true
+}
+
+// Text returns the line scanned by Scan.
+func (s *LineScanner) Text() string { return string(s.line) }
+
+// Bytes returns the line scanned by Scan, which is overwritten by the next
+// call to Scan.
+func (s *LineScanner) Bytes() []byte { return s.line }
+
+// Err returns the first error other than io.EOF.
+func (s *LineScanner) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
+
+// retain returns buf emptied for reuse unless it's grown too large.
+func retain(buf []byte) []byte {
+	if cap(buf) > lineRetained {
+		return nil
+	}
+	return buf[:0]
+}
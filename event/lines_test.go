@@ -0,0 +1,26 @@
+package event
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineScanner(t *testing.T) {
+	long := strings.Repeat("x", 3*lineBufferSize)
+	in := NewLineScanner(strings.NewReader("a\r\n"+long+"\n\nb"), 0)
+	var lines []string
+	for in.Scan() {
+		lines = append(lines, in.Text())
+	}
+	require.NoError(t, in.Err())
+	require.Equal(t, []string{"a", long, "", "b"}, lines)
+
+	in = NewLineScanner(strings.NewReader("a\n"+long+"\nb\n"), lineBufferSize)
+	require.True(t, in.Scan())
+	require.Equal(t, "a", in.Text())
+	require.False(t, in.Scan())
+	require.Equal(t, bufio.ErrTooLong, in.Err())
+}
@@ -0,0 +1,278 @@
+package event
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaskHash replaces literals by values derived from their hashes, equal
+	// literals are replaced by equal values.
+	MaskHash = "hash"
+	// MaskConst replaces literals by constants.
+	MaskConst = "const"
+)
+
+const temporalTemplate = "2000-01-01 00:00:00.000000"
+
+// Masker replaces literals of queries and values of stmt params while keeping
+// the shape of statements (digests are kept) and the length of values.
+type Masker struct {
+	mode string
+	salt string
+}
+
+func NewMasker(mode string, salt string) (*Masker, error) {
+	if mode != MaskHash && mode != MaskConst {
+		return nil, fmt.Errorf("unsupported mask mode: %s", mode)
+	}
+	return &Masker{mode: mode, salt: salt}, nil
+}
+
+// Event masks the query and params of the event, params are copied so that
+// the slice shared with other copies of the event is kept.
+func (m *Masker) Event(e *MySQLEvent) {
+	switch e.Type {
+	case EventQuery, EventStmtPrepare:
+		e.Query = m.Query(e.Query)
+	case EventStmtExecute:
+		params := make([]interface{}, len(e.Params))
+		for i, param := range e.Params {
+			t := uint16(0xffff)
+			if i < len(e.ParamTypes) {
+				t = e.ParamTypes[i]
+			}
+			params[i] = m.Param(param, t)
+		}
+		e.Params = params
+	}
+}
+
+// stream returns n pseudo random bytes derived from the value.
+func (m *Masker) stream(value string, n int) []byte {
+	out := make([]byte, 0, n+sha256.Size)
+	var counter [4]byte
+	for i := uint32(0); len(out) < n; i++ {
+		binary.LittleEndian.PutUint32(counter[:], i)
+		h := sha256.New()
+		h.Write([]byte(m.salt))
+		h.Write(counter[:])
+		h.Write([]byte(value))
+		out = h.Sum(out)
+	}
+	return out[:n]
+}
+
+// Query replaces string, numeric, hex and bit literals of the query.
+func (m *Masker) Query(query string) string {
+	var (
+		out = make([]byte, 0, len(query))
+		i   = 0
+		n   = len(query)
+	)
+	for i < n {
+		c, prev := query[i], byte(0)
+		if i > 0 {
+			prev = query[i-1]
+		}
+		switch {
+		case c == '#' || (c == '-' && i+2 < n && query[i+1] == '-' && (query[i+2] == ' ' || query[i+2] == '\t')):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				j = n - i
+			}
+			out = append(out, query[i:i+j]...)
+			i += j
+		case c == '/' && i+1 < n && query[i+1] == '*':
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				j = n
+			} else {
+				j += i + 4
+			}
+			out = append(out, query[i:j]...)
+			i = j
+		case c == '`':
+			j := skipQuoted(query, i, c)
+			out = append(out, query[i:j]...)
+			i = j
+		case c == '\'' || c == '"':
+			j := skipQuoted(query, i, c)
+			end := j
+			if end > i+1 && query[end-1] == c {
+				end -= 1
+			}
+			out = append(out, c)
+			out = append(out, m.String(query[i+1:end])...)
+			out = append(out, query[end:j]...)
+			i = j
+		case (c == 'x' || c == 'X' || c == 'b' || c == 'B') && i+1 < n && query[i+1] == '\'' && !isIdentChar(prev):
+			j := skipQuoted(query, i+1, '\'')
+			end := j
+			if end > i+2 && query[end-1] == '\'' {
+				end -= 1
+			}
+			out = append(out, query[i:i+2]...)
+			if c == 'x' || c == 'X' {
+				out = append(out, m.hex(query[i+2:end])...)
+			} else {
+				out = append(out, m.bits(query[i+2:end])...)
+			}
+			out = append(out, query[end:j]...)
+			i = j
+		case isDigit(c) && !isIdentChar(prev):
+			j := i
+			if c == '0' && j+1 < n && (query[j+1] == 'x' || query[j+1] == 'X' || query[j+1] == 'b' || query[j+1] == 'B') {
+				j += 2
+			}
+			for j < n && (isIdentChar(query[j]) || query[j] == '.') {
+				j++
+			}
+			if j < n && (query[j] == '+' || query[j] == '-') && (query[j-1] == 'e' || query[j-1] == 'E') {
+				j++
+				for j < n && isDigit(query[j]) {
+					j++
+				}
+			}
+			out = append(out, m.number(query[i:j])...)
+			i = j
+		default:
+			out = append(out, c)
+			i++
+		}
+	}
+	return string(out)
+}
+
+// String masks a string literal (the raw content between quotes), temporal
+// values are replaced by a valid one of the same layout.
+func (m *Masker) String(s string) string {
+	if len(s) == 0 {
+		return s
+	}
+	if isTemporal(s) {
+		return temporalTemplate[:len(s)]
+	}
+	if m.mode == MaskConst {
+		return strings.Repeat("x", len(s))
+	}
+	out := m.stream("s"+s, len(s))
+	for i, b := range out {
+		out[i] = hexDigits[b&0xf]
+	}
+	return string(out)
+}
+
+// isTemporal tells whether s looks like `YYYY-MM-DD[ hh:mm:ss[.ffffff]]`.
+func isTemporal(s string) bool {
+	if n := len(s); n != 10 && n != 19 && (n < 21 || n > len(temporalTemplate)) {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if t := temporalTemplate[i]; isDigit(t) != isDigit(s[i]) || (!isDigit(t) && t != s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// number masks digits of a numeric literal, prefixes (0x, 0b), signs, dots
+// and exponents are kept.
+func (m *Masker) number(s string) string {
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		return s[:2] + m.hex(s[2:])
+	}
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'b' || s[1] == 'B') {
+		return s[:2] + m.bits(s[2:])
+	}
+	out := []byte(s)
+	mantissa := len(out)
+	if i := strings.IndexAny(s, "eE"); i > 0 {
+		mantissa = i
+	}
+	rnd := m.stream("n"+s, mantissa)
+	first := true
+	for i := 0; i < mantissa; i++ {
+		if !isDigit(out[i]) {
+			continue
+		}
+		switch {
+		case m.mode == MaskConst:
+			out[i] = '1'
+		case first:
+			out[i] = '1' + rnd[i]%9
+		default:
+			out[i] = '0' + rnd[i]%10
+		}
+		first = false
+	}
+	return string(out)
+}
+
+func (m *Masker) hex(s string) string {
+	if m.mode == MaskConst {
+		return strings.Repeat("0", len(s))
+	}
+	out := m.stream("x"+s, len(s))
+	for i, b := range out {
+		out[i] = hexDigits[b&0xf]
+	}
+	return string(out)
+}
+
+func (m *Masker) bits(s string) string {
+	if m.mode == MaskConst {
+		return strings.Repeat("0", len(s))
+	}
+	out := m.stream("b"+s, len(s))
+	for i, b := range out {
+		out[i] = '0' + b&1
+	}
+	return string(out)
+}
+
+// Param masks a stmt param of the mysql type t (0xffff if unknown).
+func (m *Masker) Param(param interface{}, t uint16) interface{} {
+	switch x := param.(type) {
+	case int64:
+		if v, err := strconv.ParseInt(m.number(strconv.FormatInt(x, 10)), 10, 64); err == nil {
+			return v
+		}
+		return int64(1)
+	case uint64:
+		if v, err := strconv.ParseUint(m.number(strconv.FormatUint(x, 10)), 10, 64); err == nil {
+			return v
+		}
+		return uint64(1)
+	case float64:
+		if v, err := strconv.ParseFloat(m.number(strconv.FormatFloat(x, 'g', -1, 64)), 64); err == nil {
+			return v
+		}
+		return float64(1)
+	case float32:
+		if v, err := strconv.ParseFloat(m.number(strconv.FormatFloat(float64(x), 'g', -1, 32)), 32); err == nil {
+			return float32(v)
+		}
+		return float32(1)
+	case string:
+		switch t & 0xff {
+		case TypeDecimal, TypeNewDecimal:
+			return m.number(x)
+		case TypeTime:
+			return "0 00:00:00"
+		case TypeJSON:
+			return "{}"
+		}
+		return m.String(x)
+	case []byte:
+		if m.mode == MaskConst {
+			return make([]byte, len(x))
+		}
+		return m.stream("B"+string(x), len(x))
+	default:
+		return param
+	}
+}
@@ -0,0 +1,63 @@
+package event
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaskQuery(t *testing.T) {
+	hash, err := NewMasker(MaskHash, "salt")
+	require.NoError(t, err)
+	cst, err := NewMasker(MaskConst, "")
+	require.NoError(t, err)
+	_, err = NewMasker("none", "")
+	require.Error(t, err)
+
+	for _, tt := range []struct {
+		query string
+		cst   string
+	}{
+		{"select * from t where name = 'alice' and id = 42", "select * from t where name = 'xxxxx' and id = 11"},
+		{"insert into t values (1, 'it''s', \"x\\\"y\"), (-2.5, '', x'ab')", "insert into t values (1, 'xxxxx', \"xxxx\"), (-1.1, '', x'00')"},
+		{"select 1.5e-3, 0x1F, b'101' /* 'hint' */ from `t1` -- 'c'\n where d = '2021-01-02 03:04:05'", "select 1.1e-3, 0x00, b'000' /* 'hint' */ from `t1` -- 'c'\n where d = '2000-01-01 00:00:00'"},
+		{"select c1 from t1 where c2 = ?", "select c1 from t1 where c2 = ?"},
+	} {
+		require.Equal(t, tt.cst, cst.Query(tt.query), tt.query)
+		masked := hash.Query(tt.query)
+		require.Len(t, masked, len(tt.query), tt.query)
+		require.Equal(t, Normalize(tt.query), Normalize(masked), tt.query)
+		require.Equal(t, masked, hash.Query(tt.query))
+	}
+	require.NotEqual(t, hash.Query("select 'alice'"), hash.Query("select 'bob__'"))
+	require.Equal(t, "select '2000-01-01'", hash.Query("select '1999-12-31'"))
+	require.Equal(t, "select t1.c1", hash.Query("select t1.c1"))
+}
+
+func TestMaskParam(t *testing.T) {
+	hash, _ := NewMasker(MaskHash, "salt")
+	cst, _ := NewMasker(MaskConst, "")
+
+	require.Nil(t, hash.Param(nil, TypeNULL))
+	require.Equal(t, int64(11), cst.Param(int64(42), TypeLongLong))
+	require.Equal(t, uint64(1), cst.Param(uint64(0), TypeLongLong|paramUnsigned))
+	require.Equal(t, float64(1.1), cst.Param(float64(9.5), TypeDouble))
+	require.Equal(t, "xxx", cst.Param("abc", TypeVarString))
+	require.Equal(t, "111.11", cst.Param("123.45", TypeNewDecimal))
+	require.Equal(t, "2000-01-01 00:00:00", cst.Param("2021-01-02 03:04:05", TypeDateTime))
+	require.Equal(t, "0 00:00:00", cst.Param("1 02:03:04", TypeTime))
+	require.Equal(t, "{}", cst.Param(`{"a":1}`, TypeJSON))
+	require.Equal(t, []byte{0, 0}, cst.Param([]byte{1, 2}, TypeBLOB))
+
+	v := hash.Param(int64(-12345), TypeLong)
+	require.IsType(t, int64(0), v)
+	require.True(t, v.(int64) <= -10000 && v.(int64) > -100000)
+	require.Equal(t, v, hash.Param(int64(-12345), TypeLong))
+	require.IsType(t, uint64(0), hash.Param(uint64(18446744073709551615), TypeLongLong|paramUnsigned))
+	require.Len(t, hash.Param("secret", 0xffff), 6)
+	require.Len(t, hash.Param([]byte("secret"), TypeBLOB), 6)
+
+	e := MySQLEvent{Type: EventStmtExecute, Params: []interface{}{int64(42), "abc"}}
+	cst.Event(&e)
+	require.Equal(t, []interface{}{int64(11), "xxx"}, e.Params)
+}
@@ -0,0 +1,179 @@
+package event
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// mysql type codes used in the binary protocol
+const (
+	TypeDecimal    = 0x00
+	TypeTiny       = 0x01
+	TypeShort      = 0x02
+	TypeLong       = 0x03
+	TypeFloat      = 0x04
+	TypeDouble     = 0x05
+	TypeNULL       = 0x06
+	TypeTimestamp  = 0x07
+	TypeLongLong   = 0x08
+	TypeInt24      = 0x09
+	TypeDate       = 0x0a
+	TypeTime       = 0x0b
+	TypeDateTime   = 0x0c
+	TypeYear       = 0x0d
+	TypeNewDate    = 0x0e
+	TypeVarChar    = 0x0f
+	TypeBit        = 0x10
+	TypeJSON       = 0xf5
+	TypeNewDecimal = 0xf6
+	TypeEnum       = 0xf7
+	TypeSet        = 0xf8
+	TypeTinyBLOB   = 0xf9
+	TypeMediumBLOB = 0xfa
+	TypeLongBLOB   = 0xfb
+	TypeBLOB       = 0xfc
+	TypeVarString  = 0xfd
+	TypeString     = 0xfe
+	TypeGeometry   = 0xff
+
+	paramUnsigned = 0x8000
+)
+
+const (
+	dateLayout     = "2006-01-02"
+	datetimeLayout = "2006-01-02 15:04:05.999999"
+)
+
+// BindParams converts params of a stmt execute event to the go types which
+// are sent by the driver as the captured mysql types. Params are returned as
+// is if types are unknown (e.g. events from old dumps), temporal values are
+// parsed in loc, which should be the location of the connection.
+func BindParams(params []interface{}, types []uint16, loc *time.Location) ([]interface{}, error) {
+	if len(types) == 0 {
+		return params, nil
+	} else if len(types) != len(params) {
+		return nil, fmt.Errorf("%d param types for %d params", len(types), len(params))
+	}
+	out := make([]interface{}, len(params))
+	for i, param := range params {
+		val, err := BindParam(param, types[i], loc)
+		if err != nil {
+			return nil, fmt.Errorf("bind params[%d]: %v", i, err)
+		}
+		out[i] = val
+	}
+	return out, nil
+}
+
+// BindParam converts param to the go type of the mysql type t.
+func BindParam(param interface{}, t uint16, loc *time.Location) (interface{}, error) {
+	if param == nil {
+		return nil, nil
+	}
+	unsigned := t&paramUnsigned > 0
+	switch t & 0xff {
+	case TypeNULL:
+		return nil, nil
+	case TypeTiny, TypeShort, TypeInt24, TypeLong, TypeLongLong, TypeYear:
+		if unsigned {
+			return toUint64(param)
+		}
+		return toInt64(param)
+	case TypeFloat:
+		// the driver sends float32 as float64, use the shortest decimal form
+		// to avoid values like 1.100000023841858
+		if x, ok := param.(float32); ok {
+			return strconv.ParseFloat(strconv.FormatFloat(float64(x), 'g', -1, 32), 64)
+		}
+		return toFloat64(param)
+	case TypeDouble:
+		return toFloat64(param)
+	case TypeDate, TypeNewDate, TypeDateTime, TypeTimestamp:
+		s, ok := toString(param)
+		if !ok {
+			return nil, fmt.Errorf("unexpected %T for temporal type 0x%02x", param, t&0xff)
+		}
+		return parseDateTime(s, loc), nil
+	case TypeBit, TypeTinyBLOB, TypeMediumBLOB, TypeLongBLOB, TypeBLOB, TypeGeometry:
+		switch x := param.(type) {
+		case []byte:
+			return x, nil
+		case string:
+			return []byte(x), nil
+		}
+		return nil, fmt.Errorf("unexpected %T for binary type 0x%02x", param, t&0xff)
+	case TypeTime, TypeDecimal, TypeNewDecimal, TypeVarChar, TypeVarString, TypeString, TypeEnum, TypeSet, TypeJSON:
+		// time values may be out of the range of a day (e.g. -838:59:59) and
+		// decimals must not lose precision, keep them as strings
+		if s, ok := toString(param); ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("unexpected %T for string type 0x%02x", param, t&0xff)
+	default:
+		return param, nil
+	}
+}
+
+// parseDateTime parses s as time.Time, zero or invalid dates (which are valid
+// in some sql modes) are kept as strings.
+func parseDateTime(s string, loc *time.Location) interface{} {
+	if loc == nil {
+		loc = time.UTC
+	}
+	layout := datetimeLayout
+	if len(s) == len(dateLayout) {
+		layout = dateLayout
+	}
+	t, err := time.ParseInLocation(layout, s, loc)
+	if err != nil || t.IsZero() {
+		return s
+	}
+	return t
+}
+
+func toString(param interface{}) (string, bool) {
+	switch x := param.(type) {
+	case string:
+		return x, true
+	case []byte:
+		return string(x), true
+	}
+	return "", false
+}
+
+func toInt64(param interface{}) (interface{}, error) {
+	switch x := param.(type) {
+	case int64:
+		return x, nil
+	case uint64:
+		return int64(x), nil
+	case string:
+		return strconv.ParseInt(x, 10, 64)
+	}
+	return nil, fmt.Errorf("unexpected %T for integer type", param)
+}
+
+func toUint64(param interface{}) (interface{}, error) {
+	switch x := param.(type) {
+	case uint64:
+		return x, nil
+	case int64:
+		return uint64(x), nil
+	case string:
+		return strconv.ParseUint(x, 10, 64)
+	}
+	return nil, fmt.Errorf("unexpected %T for unsigned integer type", param)
+}
+
+func toFloat64(param interface{}) (interface{}, error) {
+	switch x := param.(type) {
+	case float64:
+		return x, nil
+	case float32:
+		return float64(x), nil
+	case string:
+		return strconv.ParseFloat(x, 64)
+	}
+	return nil, fmt.Errorf("unexpected %T for float type", param)
+}
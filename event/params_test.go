@@ -0,0 +1,81 @@
+package event
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBindParam(t *testing.T) {
+	loc := time.FixedZone("UTC+8", 8*3600)
+	for _, tt := range []struct {
+		param  interface{}
+		typ    uint16
+		expect interface{}
+		ok     bool
+	}{
+		{nil, TypeLong, nil, true},
+		{nil, TypeVarString, nil, true},
+		{"", TypeVarString, "", true},
+		{"x", TypeNULL, nil, true},
+		{int64(-1), TypeTiny, int64(-1), true},
+		{int64(-1), TypeShort, int64(-1), true},
+		{int64(-1), TypeInt24, int64(-1), true},
+		{int64(-1), TypeLong, int64(-1), true},
+		{int64(-1), TypeLongLong, int64(-1), true},
+		{uint64(1<<63 + 1), TypeLongLong | paramUnsigned, uint64(1<<63 + 1), true},
+		{uint64(255), TypeTiny | paramUnsigned, uint64(255), true},
+		{int64(2021), TypeYear, int64(2021), true},
+		{"12", TypeLong, int64(12), true},
+		{"x", TypeLong, nil, false},
+		{float32(1.1), TypeFloat, float64(1.1), true},
+		{float64(1.1), TypeDouble, float64(1.1), true},
+		{"1.10", TypeDecimal, "1.10", true},
+		{"12345678901234567890.123456789", TypeNewDecimal, "12345678901234567890.123456789", true},
+		{"2021-01-02", TypeDate, time.Date(2021, 1, 2, 0, 0, 0, 0, loc), true},
+		{"2021-01-02", TypeNewDate, time.Date(2021, 1, 2, 0, 0, 0, 0, loc), true},
+		{"2021-01-02 03:04:05", TypeDateTime, time.Date(2021, 1, 2, 3, 4, 5, 0, loc), true},
+		{"2021-01-02 03:04:05.000006", TypeTimestamp, time.Date(2021, 1, 2, 3, 4, 5, 6000, loc), true},
+		{"0000-00-00 00:00:00", TypeDateTime, "0000-00-00 00:00:00", true},
+		{"2021-02-30", TypeDate, "2021-02-30", true},
+		{int64(1), TypeDateTime, nil, false},
+		{"-1 02:03:04.000005", TypeTime, "-1 02:03:04.000005", true},
+		{"abc", TypeVarChar, "abc", true},
+		{"abc", TypeString, "abc", true},
+		{"a", TypeEnum, "a", true},
+		{"a,b", TypeSet, "a,b", true},
+		{`{"a":1}`, TypeJSON, `{"a":1}`, true},
+		{[]byte("abc"), TypeVarString, "abc", true},
+		{"\x01", TypeBit, []byte{1}, true},
+		{"\x00\x01", TypeGeometry, []byte{0, 1}, true},
+		{[]byte{}, TypeBLOB, []byte{}, true},
+		{"ab", TypeTinyBLOB, []byte("ab"), true},
+		{[]byte("ab"), TypeMediumBLOB, []byte("ab"), true},
+		{[]byte("ab"), TypeLongBLOB, []byte("ab"), true},
+		{int64(1), TypeBLOB, nil, false},
+		{int64(1), 0x42, int64(1), true},
+	} {
+		actual, err := BindParam(tt.param, tt.typ, loc)
+		if tt.ok {
+			require.NoError(t, err, "bind %v as 0x%04x", tt.param, tt.typ)
+			require.Equal(t, tt.expect, actual, "bind %v as 0x%04x", tt.param, tt.typ)
+		} else {
+			require.Error(t, err, "bind %v as 0x%04x", tt.param, tt.typ)
+		}
+	}
+}
+
+func TestBindParams(t *testing.T) {
+	params := []interface{}{int64(1), "2021-01-02"}
+	actual, err := BindParams(params, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, params, actual)
+
+	actual, err = BindParams(params, []uint16{TypeLongLong, TypeDate}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{int64(1), time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)}, actual)
+
+	_, err = BindParams(params, []uint16{TypeLongLong}, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,227 @@
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetHeaderKey is the key of the header in the key value metadata of
+// parquet files.
+const parquetHeaderKey = "mysql-replay.header"
+
+// parquetBatchSize is the number of rows read from parquet files at a time.
+const parquetBatchSize = 1024
+
+func init() {
+	registerCodec(FormatParquet, codec{
+		newReader: func(r io.Reader, maxLineSize int) (Reader, error) { return &parquetReader{r: r}, nil },
+		newWriter: func(w io.Writer, h Header) (Writer, error) { return newParquetWriter(w, h) },
+	})
+}
+
+// parquetEvent is a row of FormatParquet, params are encoded like the ones of
+// FormatJSON since they are of various types.
+type parquetEvent struct {
+	Time       int64   `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Type       int64   `parquet:"name=type, type=INT64, convertedtype=UINT_64"`
+	StmtID     int64   `parquet:"name=stmt_id, type=INT64, convertedtype=UINT_64"`
+	Params     string  `parquet:"name=params, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ParamTypes []int32 `parquet:"name=param_types, type=INT32, repetitiontype=REPEATED"`
+	DB         string  `parquet:"name=db, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Query      string  `parquet:"name=query, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Charset    int64   `parquet:"name=charset, type=INT64, convertedtype=UINT_64"`
+	User       string  `parquet:"name=user, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Rows       int64   `parquet:"name=rows, type=INT64, convertedtype=UINT_64"`
+	Gap        int64   `parquet:"name=gap, type=INT64, convertedtype=UINT_64"`
+	Affected   int64   `parquet:"name=affected, type=INT64, convertedtype=UINT_64"`
+	Latency    int64   `parquet:"name=latency, type=INT64, convertedtype=UINT_64"`
+	Cursor     int64   `parquet:"name=cursor, type=INT64, convertedtype=UINT_64"`
+}
+
+func newParquetEvent(e *MySQLEvent) (parquetEvent, error) {
+	pe := parquetEvent{
+		Time:     e.Time,
+		Type:     int64(e.Type),
+		StmtID:   int64(e.StmtID),
+		DB:       e.DB,
+		Query:    e.Query,
+		Charset:  int64(e.Charset),
+		User:     e.User,
+		Rows:     int64(e.Rows),
+		Gap:      int64(e.Gap),
+		Affected: int64(e.Affected),
+		Latency:  int64(e.Latency),
+		Cursor:   int64(e.Cursor),
+	}
+	if len(e.Params) > 0 {
+		params := make([]jsonParam, len(e.Params))
+		for i, p := range e.Params {
+			params[i] = jsonParam{v: p}
+		}
+		data, err := json.Marshal(params)
+		if err != nil {
+			return pe, err
+		}
+		pe.Params = string(data)
+	}
+	for _, t := range e.ParamTypes {
+		pe.ParamTypes = append(pe.ParamTypes, int32(t))
+	}
+	return pe, nil
+}
+
+func (pe *parquetEvent) decode(e *MySQLEvent) error {
+	e.Reset(e.Params[:0])
+	e.Time = pe.Time
+	e.Type = uint64(pe.Type)
+	e.StmtID = uint64(pe.StmtID)
+	e.DB = pe.DB
+	e.Query = pe.Query
+	e.Charset = uint64(pe.Charset)
+	e.User = pe.User
+	e.Rows = uint64(pe.Rows)
+	e.Gap = uint64(pe.Gap)
+	e.Affected = uint64(pe.Affected)
+	e.Latency = uint64(pe.Latency)
+	e.Cursor = uint64(pe.Cursor)
+	if len(pe.Params) > 0 {
+		var params []jsonParam
+		if err := json.Unmarshal([]byte(pe.Params), &params); err != nil {
+			return fmt.Errorf("decode params of event: %v", err)
+		}
+		for _, p := range params {
+			e.Params = append(e.Params, p.v)
+		}
+	}
+	for _, t := range pe.ParamTypes {
+		e.ParamTypes = append(e.ParamTypes, uint16(t))
+	}
+	return nil
+}
+
+// parquetBuffer is a read-only source.ParquetFile of data in memory, since
+// parquet files are read from the footer at the end.
+type parquetBuffer struct {
+	*bytes.Reader
+	data []byte
+}
+
+func newParquetBuffer(data []byte) *parquetBuffer {
+	return &parquetBuffer{Reader: bytes.NewReader(data), data: data}
+}
+
+func (b *parquetBuffer) Open(name string) (source.ParquetFile, error) {
+	return newParquetBuffer(b.data), nil
+}
+
+func (b *parquetBuffer) Create(name string) (source.ParquetFile, error) {
+	return nil, fmt.Errorf("parquet buffer is read-only")
+}
+
+func (b *parquetBuffer) Write(p []byte) (int, error) {
+	return 0, fmt.Errorf("parquet buffer is read-only")
+}
+
+func (b *parquetBuffer) Close() error { return nil }
+
+type parquetReader struct {
+	r      io.Reader
+	pr     *reader.ParquetReader
+	header Header
+	rows   []parquetEvent
+	left   int64
+}
+
+// open reads the whole file since parquet files aren't read sequentially.
+func (r *parquetReader) open() error {
+	data, err := ioutil.ReadAll(r.r)
+	if err != nil {
+		return err
+	}
+	if r.pr, err = reader.NewParquetReader(newParquetBuffer(data), new(parquetEvent), 1); err != nil {
+		return fmt.Errorf("open parquet file: %v", err)
+	}
+	r.left = r.pr.GetNumRows()
+	r.header = Header{Version: FormatVersion}
+	for _, kv := range r.pr.Footer.KeyValueMetadata {
+		if kv.Key == parquetHeaderKey && kv.Value != nil {
+			if err = json.Unmarshal([]byte(*kv.Value), &r.header); err != nil {
+				return fmt.Errorf("decode header of parquet file: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *parquetReader) Read(e *MySQLEvent) error {
+	if r.pr == nil {
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	if len(r.rows) == 0 {
+		if r.left <= 0 {
+			r.pr.ReadStop()
+			return io.EOF
+		}
+		n := r.left
+		if n > parquetBatchSize {
+			n = parquetBatchSize
+		}
+		r.rows = make([]parquetEvent, n)
+		if err := r.pr.Read(&r.rows); err != nil {
+			return fmt.Errorf("read parquet file: %v", err)
+		}
+		r.left -= n
+	}
+	pe := r.rows[0]
+	r.rows = r.rows[1:]
+	return pe.decode(e)
+}
+
+func (r *parquetReader) Header() Header { return r.header }
+
+type parquetWriter struct {
+	pw     *writer.ParquetWriter
+	header Header
+}
+
+func newParquetWriter(w io.Writer, h Header) (*parquetWriter, error) {
+	pw, err := writer.NewParquetWriterFromWriter(w, new(parquetEvent), 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	h.Version = FormatVersion
+	return &parquetWriter{pw: pw, header: h}, nil
+}
+
+func (w *parquetWriter) Write(e MySQLEvent) error {
+	pe, err := newParquetEvent(&e)
+	if err != nil {
+		return err
+	}
+	return w.pw.Write(pe)
+}
+
+// Flush writes the footer (with the header in its metadata), thus the file
+// is complete and no more event can be written.
+func (w *parquetWriter) Flush() error {
+	h, err := json.Marshal(w.header)
+	if err != nil {
+		return err
+	}
+	kv := parquet.NewKeyValue()
+	kv.Key, kv.Value = parquetHeaderKey, new(string)
+	*kv.Value = string(h)
+	w.pw.Footer.KeyValueMetadata = append(w.pw.Footer.KeyValueMetadata, kv)
+	return w.pw.WriteStop()
+}
@@ -0,0 +1,150 @@
+package event
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AppendSQLLiteral appends the sql literal of a stmt param to buf.
+func AppendSQLLiteral(buf []byte, param interface{}) ([]byte, error) {
+	switch x := param.(type) {
+	case nil:
+		return append(buf, "NULL"...), nil
+	case int64:
+		return strconv.AppendInt(buf, x, 10), nil
+	case uint64:
+		return strconv.AppendUint(buf, x, 10), nil
+	case float32:
+		return strconv.AppendFloat(buf, float64(x), 'g', -1, 32), nil
+	case float64:
+		return strconv.AppendFloat(buf, x, 'g', -1, 64), nil
+	case string:
+		return AppendQuotedString(buf, x), nil
+	case []byte:
+		if len(x) == 0 {
+			return append(buf, "''"...), nil
+		}
+		buf = append(buf, "0x"...)
+		return append(buf, hex.EncodeToString(x)...), nil
+	case time.Time:
+		buf = append(buf, '\'')
+		buf = x.AppendFormat(buf, datetimeLayout)
+		return append(buf, '\''), nil
+	default:
+		return nil, fmt.Errorf("unsupported param type: %T", param)
+	}
+}
+
+// AppendQuotedString appends s as a single-quoted sql string. Single quotes
+// are doubled and line breaks are kept as they are, which works whatever the
+// sql_mode is, while backslashes, NULs and ^Zs are escaped like
+// mysql_real_escape_string, which relies on NO_BACKSLASH_ESCAPES being off.
+func AppendQuotedString(buf []byte, s string) []byte {
+	buf = append(buf, '\'')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case 0:
+			buf = append(buf, '\\', '0')
+		case '\x1a':
+			buf = append(buf, '\\', 'Z')
+		case '\'':
+			buf = append(buf, '\'', '\'')
+		case '\\':
+			buf = append(buf, '\\', '\\')
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, '\'')
+}
+
+// EndsInLineComment tells whether the query ends in a `#` or `-- ` comment,
+// thus anything appended to it (e.g. a `;`) has to start on a new line.
+func EndsInLineComment(query string) bool {
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(query, i, c) - 1
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				return false
+			}
+			i += j + 3
+		case c == '#' || (c == '-' && i+1 < len(query) && query[i+1] == '-' && (i+2 == len(query) || query[i+2] <= ' ')):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				return true
+			}
+			i += j
+		}
+	}
+	return false
+}
+
+// Interpolate replaces placeholders in query with the sql literals of params.
+func Interpolate(query string, params []interface{}) (string, error) {
+	var (
+		buf = make([]byte, 0, len(query)+16*len(params))
+		err error
+		k   = 0
+	)
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			j := skipQuoted(query, i, c)
+			buf = append(buf, query[i:j]...)
+			i = j - 1
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			j := strings.Index(query[i+2:], "*/")
+			if j < 0 {
+				j = len(query)
+			} else {
+				j += i + 4
+			}
+			buf = append(buf, query[i:j]...)
+			i = j - 1
+		case c == '#' || (c == '-' && i+2 < len(query) && query[i+1] == '-' && (query[i+2] == ' ' || query[i+2] == '\t')):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				j = len(query)
+			} else {
+				j += i
+			}
+			buf = append(buf, query[i:j]...)
+			i = j - 1
+		case c == '?':
+			if k >= len(params) {
+				return "", fmt.Errorf("too few params (%d) for query", len(params))
+			}
+			buf, err = AppendSQLLiteral(buf, params[k])
+			if err != nil {
+				return "", err
+			}
+			k += 1
+		default:
+			buf = append(buf, c)
+		}
+	}
+	if k != len(params) {
+		return "", fmt.Errorf("too many params (%d) for query (%d placeholders)", len(params), k)
+	}
+	return string(buf), nil
+}
+
+// InterpolateParams is like Interpolate but params are bound by their captured
+// types (see BindParams) first, thus they're written as literals of the types,
+// e.g. integers sent as strings are unquoted (which matters for LIMIT ?) and
+// blobs are written in hex.
+func InterpolateParams(query string, params []interface{}, types []uint16, loc *time.Location) (string, error) {
+	params, err := BindParams(params, types, loc)
+	if err != nil {
+		return "", err
+	}
+	return Interpolate(query, params)
+}
@@ -0,0 +1,72 @@
+package event
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterpolate(t *testing.T) {
+	for _, tt := range []struct {
+		query  string
+		params []interface{}
+		expect string
+		ok     bool
+	}{
+		{"select ?", []interface{}{int64(-1)}, "select -1", true},
+		{"select ?, ?, ?", []interface{}{uint64(1), float64(1.5), nil}, "select 1, 1.5, NULL", true},
+		{"select * from t where c = ? and d = '?'", []interface{}{"it's\n\\"}, "select * from t where c = 'it''s\n\\\\' and d = '?'", true},
+		{"insert into t values (?) /* ? */ -- ?", []interface{}{[]byte{0xab, 0x01}}, "insert into t values (0xab01) /* ? */ -- ?", true},
+		{"select ?", nil, "", false},
+		{"select 1", []interface{}{int64(1)}, "", false},
+	} {
+		actual, err := Interpolate(tt.query, tt.params)
+		if tt.ok {
+			require.NoError(t, err)
+			require.Equal(t, tt.expect, actual)
+		} else {
+			require.Error(t, err)
+		}
+	}
+}
+
+func TestInterpolateParams(t *testing.T) {
+	query, err := InterpolateParams("select * from t where a = ? and b = ? and c = ? and d = ? limit ?",
+		[]interface{}{"-1", "2023-01-02 03:04:05.5", "ab'c", "x", "10"},
+		[]uint16{TypeLong, TypeDateTime, TypeVarString, TypeBLOB, TypeLongLong | paramUnsigned}, time.UTC)
+	require.NoError(t, err)
+	require.Equal(t, "select * from t where a = -1 and b = '2023-01-02 03:04:05.5' and c = 'ab''c' and d = 0x78 limit 10", query)
+
+	// zero dates are kept as strings and params of unknown types as is
+	query, err = InterpolateParams("select ?, ?", []interface{}{"0000-00-00", "1"}, []uint16{TypeDate, TypeVarChar}, nil)
+	require.NoError(t, err)
+	require.Equal(t, "select '0000-00-00', '1'", query)
+	query, err = InterpolateParams("select ?", []interface{}{"1"}, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, "select '1'", query)
+
+	_, err = InterpolateParams("select ?", []interface{}{"x"}, []uint16{TypeLong}, nil)
+	require.Error(t, err)
+}
+
+func TestEndsInLineComment(t *testing.T) {
+	for _, c := range []struct {
+		query  string
+		expect bool
+	}{
+		{"select 1", false},
+		{"select 1 -- one", true},
+		{"select 1 # one", true},
+		{"select 1 --", true},
+		{"select 1 -- one\nfrom dual", false},
+		{"select 1 --1", false},
+		{"select '-- one'", false},
+		{"select \"# one\"", false},
+		{"select 1 /* # one */", false},
+		{"select 1 /* unterminated # one", false},
+		{"select 'it''s' # one", true},
+	} {
+		require.Equal(t, c.expect, EndsInLineComment(c.query), c.query)
+	}
+}
@@ -0,0 +1,237 @@
+package event
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// nondeterministicFuncs lists functions whose results may differ between runs
+// of the same statement, those which can be stabilized are marked.
+var nondeterministicFuncs = map[string]stabilizeKind{
+	"rand":              stabilizeRandom,
+	"uuid":              stabilizeRandom,
+	"uuid_short":        stabilizeRandom,
+	"now":               stabilizeNow,
+	"current_timestamp": stabilizeNow,
+	"localtime":         stabilizeNow,
+	"localtimestamp":    stabilizeNow,
+	"sysdate":           stabilizeNow,
+	"curdate":           stabilizeNow,
+	"current_date":      stabilizeNow,
+	"curtime":           stabilizeNow,
+	"current_time":      stabilizeNow,
+	"unix_timestamp":    stabilizeNow,
+	"utc_timestamp":     stabilizeNone,
+	"utc_date":          stabilizeNone,
+	"utc_time":          stabilizeNone,
+	"last_insert_id":    stabilizeNone,
+	"found_rows":        stabilizeNone,
+	"row_count":         stabilizeNone,
+	"connection_id":     stabilizeNone,
+}
+
+type stabilizeKind int
+
+const (
+	stabilizeNone stabilizeKind = iota
+	stabilizeRandom
+	stabilizeNow
+)
+
+// funcCall is a call of a nondeterministic function in a query, args is the
+// raw text between parentheses.
+type funcCall struct {
+	name       string
+	start, end int
+	args       string
+}
+
+// scanCalls returns calls of nondeterministic functions in the query, skipping
+// quoted strings, identifiers and comments. Functions of the current time can
+// be called without parentheses (e.g. `CURRENT_TIMESTAMP`).
+func scanCalls(query string) []funcCall {
+	var (
+		calls []funcCall
+		n     = len(query)
+	)
+	for i := 0; i < n; {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(query, i, c)
+			continue
+		case c == '#' || (c == '-' && i+2 < n && query[i+1] == '-' && (query[i+2] == ' ' || query[i+2] == '\t')):
+			for i < n && query[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && i+1 < n && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return calls
+			}
+			i += end + 4
+			continue
+		case !isIdentChar(c):
+			i++
+			continue
+		}
+		j := i
+		for j < n && isIdentChar(query[j]) {
+			j++
+		}
+		name := strings.ToLower(query[i:j])
+		kind, ok := nondeterministicFuncs[name]
+		if !ok || (i > 0 && query[i-1] == '.') {
+			i = j
+			continue
+		}
+		k := j
+		for k < n && (query[k] == ' ' || query[k] == '\t' || query[k] == '\n' || query[k] == '\r') {
+			k++
+		}
+		if k < n && query[k] == '(' {
+			if end := strings.IndexByte(query[k:], ')'); end >= 0 {
+				calls = append(calls, funcCall{name: name, start: i, end: k + end + 1, args: strings.TrimSpace(query[k+1 : k+end])})
+				i = k + end + 1
+				continue
+			}
+		} else if kind == stabilizeNow && (strings.HasPrefix(name, "current_") || strings.HasPrefix(name, "local")) {
+			calls = append(calls, funcCall{name: name, start: i, end: j})
+		}
+		i = j
+	}
+	return calls
+}
+
+// NondeterministicCalls returns names (in lower case and sorted) of functions
+// called by the query whose results may differ between runs.
+func NondeterministicCalls(query string) []string {
+	calls := scanCalls(query)
+	if len(calls) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool, len(calls))
+	names := make([]string, 0, len(calls))
+	for _, call := range calls {
+		if call.deterministic() {
+			continue
+		}
+		if !seen[call.name] {
+			seen[call.name] = true
+			names = append(names, call.name)
+		}
+	}
+	sort.Strings(names)
+	if len(names) == 0 {
+		return nil
+	}
+	return names
+}
+
+// deterministic tells whether the call is deterministic due to its arguments
+// (e.g. `RAND(1)`).
+func (call funcCall) deterministic() bool {
+	if len(call.args) == 0 {
+		return false
+	}
+	return call.name == "rand" || call.name == "unix_timestamp" || call.name == "last_insert_id"
+}
+
+// Stabilizer rewrites calls of nondeterministic functions, so that replaying a
+// statement twice gives the same results. RAND, UUID and UUID_SHORT without
+// arguments get values derived from the event, and functions of the current
+// time are replaced by the time of the event if Now is set. Others (e.g.
+// LAST_INSERT_ID) are kept as is.
+type Stabilizer struct {
+	Now bool
+}
+
+// Event rewrites queries of queries and prepares in place, seed distinguishes
+// events happened at the same time (e.g. the id of the session).
+func (s Stabilizer) Event(e *MySQLEvent, seed uint64) {
+	if e.Type == EventQuery || e.Type == EventStmtPrepare {
+		e.Query = s.Query(e.Query, e.Time, seed)
+	}
+}
+
+// Query rewrites the query of an event happened at t (unix ms).
+func (s Stabilizer) Query(query string, t int64, seed uint64) string {
+	calls := scanCalls(query)
+	if len(calls) == 0 {
+		return query
+	}
+	var (
+		buf  = make([]byte, 0, len(query)+32*len(calls))
+		last = 0
+	)
+	for k, call := range calls {
+		repl, ok := s.replace(call, t, stabilizeSeed(query, t, seed, k))
+		if !ok {
+			continue
+		}
+		buf = append(buf, query[last:call.start]...)
+		buf = append(buf, repl...)
+		last = call.end
+	}
+	return string(append(buf, query[last:]...))
+}
+
+func (s Stabilizer) replace(call funcCall, t int64, seed uint64) (string, bool) {
+	switch nondeterministicFuncs[call.name] {
+	case stabilizeRandom:
+		if len(call.args) > 0 {
+			return "", false
+		}
+		switch call.name {
+		case "rand":
+			return fmt.Sprintf("RAND(%d)", seed>>33), true
+		case "uuid":
+			var b [16]byte
+			binary.BigEndian.PutUint64(b[:8], seed)
+			binary.BigEndian.PutUint64(b[8:], seed*0x9e3779b97f4a7c15)
+			b[6], b[8] = b[6]&0x0f|0x40, b[8]&0x3f|0x80
+			return fmt.Sprintf("'%x-%x-%x-%x-%x'", b[:4], b[4:6], b[6:8], b[8:10], b[10:]), true
+		default:
+			return strconv.FormatUint(seed>>1, 10), true
+		}
+	case stabilizeNow:
+		if !s.Now {
+			return "", false
+		}
+		ts := fmt.Sprintf("%d.%03d", t/1000, t%1000)
+		if len(call.args) == 0 || call.args == "0" {
+			ts = strconv.FormatInt(t/1000, 10)
+		}
+		switch call.name {
+		case "unix_timestamp":
+			if len(call.args) > 0 {
+				return "", false
+			}
+			return ts, true
+		case "curdate", "current_date":
+			return "DATE(FROM_UNIXTIME(" + ts + "))", true
+		case "curtime", "current_time":
+			return "TIME(FROM_UNIXTIME(" + ts + "))", true
+		default:
+			return "FROM_UNIXTIME(" + ts + ")", true
+		}
+	}
+	return "", false
+}
+
+// stabilizeSeed derives the seed of the k-th call in the query of an event.
+func stabilizeSeed(query string, t int64, seed uint64, k int) uint64 {
+	var buf [24]byte
+	binary.LittleEndian.PutUint64(buf[:8], uint64(t))
+	binary.LittleEndian.PutUint64(buf[8:16], seed)
+	binary.LittleEndian.PutUint64(buf[16:], uint64(k))
+	h := fnv.New64a()
+	h.Write(buf[:])
+	h.Write([]byte(query))
+	return h.Sum64()
+}
@@ -0,0 +1,50 @@
+package event
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNondeterministicCalls(t *testing.T) {
+	for _, tt := range []struct {
+		query  string
+		expect []string
+	}{
+		{"select 1", nil},
+		{"select NOW(), rand ( ), now()", []string{"now", "rand"}},
+		{"insert into t values (uuid(), CURRENT_TIMESTAMP)", []string{"current_timestamp", "uuid"}},
+		{"select 'now()', `rand`, t.uuid() /* sysdate() */ -- last_insert_id()", nil},
+		{"select last_insert_id()", []string{"last_insert_id"}},
+		{"select rand(1), last_insert_id(5)", nil},
+	} {
+		require.Equal(t, tt.expect, NondeterministicCalls(tt.query), tt.query)
+	}
+}
+
+func TestStabilizer(t *testing.T) {
+	const ts = 1700000000123
+	for _, tt := range []struct {
+		now    bool
+		query  string
+		expect string
+	}{
+		{false, "select now(), last_insert_id(), rand(1)", "select now(), last_insert_id(), rand(1)"},
+		{true, "select now(), NOW(3), current_timestamp, curdate(), unix_timestamp()", "select FROM_UNIXTIME(1700000000), FROM_UNIXTIME(1700000000.123), FROM_UNIXTIME(1700000000), DATE(FROM_UNIXTIME(1700000000)), 1700000000"},
+		{true, "select unix_timestamp(c), 'now()' from t", "select unix_timestamp(c), 'now()' from t"},
+	} {
+		require.Equal(t, tt.expect, Stabilizer{Now: tt.now}.Query(tt.query, ts, 1), tt.query)
+	}
+
+	s := Stabilizer{}
+	query := "insert into t values (uuid(), rand(), uuid_short())"
+	fst, snd := s.Query(query, ts, 1), s.Query(query, ts, 1)
+	require.Equal(t, fst, snd)
+	require.NotEqual(t, fst, s.Query(query, ts, 2))
+	require.Regexp(t, `^insert into t values \('[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}', RAND\(\d+\), \d+\)$`, fst)
+	require.Empty(t, NondeterministicCalls(fst))
+
+	e := MySQLEvent{Time: ts, Type: EventStmtPrepare, Query: "select uuid()"}
+	s.Event(&e, 1)
+	require.NotEqual(t, "select uuid()", e.Query)
+}
@@ -3,14 +3,27 @@ module github.com/zyguan/mysql-replay
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/go-sql-driver/mysql v1.6.0
 	github.com/gocraft/dbr/v2 v2.7.2
 	github.com/google/gopacket v1.1.17
+	github.com/klauspost/compress v1.13.1
+	github.com/lib/pq v1.10.0
 	github.com/mattn/go-sqlite3 v1.14.7
+	github.com/minio/minio-go/v7 v7.0.11
 	github.com/pingcap/errors v0.11.4
 	github.com/pkg/profile v1.6.0
+	github.com/segmentio/kafka-go v0.4.17
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/pflag v1.0.3
 	github.com/stretchr/testify v1.7.0
+	github.com/xitongsys/parquet-go v1.6.2
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
 	go.uber.org/zap v1.18.1
+	golang.org/x/net v0.0.0-20200822124328-c89045814202
+	google.golang.org/grpc v1.41.0
+	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b
 )
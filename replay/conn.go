@@ -0,0 +1,733 @@
+package replay
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+// ConnConfig configures connections to the target.
+type ConnConfig struct {
+	Target       *mysql.Config
+	QueryTimeout time.Duration
+	// SessionInit are statements to run on every new connection.
+	SessionInit []string
+	// Digests tells whether to fill digests of stmt executes in results.
+	Digests bool
+	// Interceptor (if any) intercepts every event applied.
+	Interceptor Interceptor
+	// Driver connects to the target, the DefaultDriver is used if nil.
+	Driver TargetDriver
+	// Retry (if any) tells whether a failed query or stmt execute should be
+	// retried, which is retried at most Retries times.
+	Retry   func(err error) bool
+	Retries int
+	// MaxStmts (if positive) caps statements prepared on the target by the
+	// connection, the least recently used one is closed on the target before
+	// preparing more, thus sessions never closing their statements don't leak
+	// them. Evicted statements are prepared again once they are executed.
+	MaxStmts int
+	// PrepareAsText executes prepared statements as text queries with their
+	// params interpolated instead, for targets (or proxies) handling prepared
+	// statements poorly. Statements are never prepared on the target then.
+	PrepareAsText bool
+	// ExactLifetime establishes connections on handshakes only (besides the
+	// first one of sessions captured without handshakes), thus connections
+	// closed by quits or lost (e.g. killed by the target) are never
+	// re-established implicitly, events on them fail with ErrConnClosed until
+	// the next handshake.
+	ExactLifetime bool
+	// FetchRows reads result sets of statements returning rows (e.g. SELECT)
+	// fully like clients do instead of discarding them, if the driver
+	// supports it (see FetchConn).
+	FetchRows bool
+	// FetchLimit stops reading result sets (if FetchRows) past the limit,
+	// counting them as truncated. The rest of a truncated result set is
+	// abandoned by dropping the connection, which is re-established then (or
+	// closed if ExactLifetime).
+	FetchLimit FetchLimit
+	// Reconnect is the policy of re-establishing lost connections, which are
+	// re-established once immediately if it's the zero value.
+	Reconnect Backoff
+	// Untracked connections (e.g. mirrors of the target) are not counted in
+	// stats.
+	Untracked bool
+	// Stats is the registry of stats, which is the default one if nil.
+	Stats *stats.Registry
+}
+
+// Backoff retries connecting to the target up to Attempts times, waiting for
+// delays growing exponentially from Base to Max between attempts, each of which
+// is randomized by up to the Jitter fraction of it.
+type Backoff struct {
+	Attempts int           `json:"attempts"`
+	Base     time.Duration `json:"base"`
+	Max      time.Duration `json:"max"`
+	Jitter   float64       `json:"jitter"`
+}
+
+// Delay returns the delay after the nth (from 0) failed attempt.
+func (b Backoff) Delay(n int) time.Duration {
+	d := b.Base
+	for i := 0; i < n && (b.Max <= 0 || d < b.Max); i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+	if b.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * b.Jitter * float64(d))
+	}
+	return d
+}
+
+// Result is the result of applying an event.
+type Result struct {
+	sql.Result
+	// Executed tells whether a statement was sent to the target, Query,
+	// Digest and Duration are only set for executed statements (and result
+	// events, for the statements they follow). Digest is empty for queries
+	// (and for stmt executes unless ConnConfig.Digests).
+	Executed bool
+	// Skipped tells whether the event is dropped by the interceptor.
+	Skipped  bool
+	Query    string
+	Digest   string
+	Duration time.Duration
+	// Fetched (if any) is the result set read fully by FetchRows, Duration
+	// includes the time of reading it then.
+	Fetched *Fetched
+}
+
+type statement struct {
+	query   string
+	digest  string
+	handle  TargetStmt
+	fetched bool
+	used    uint64
+}
+
+// Conn applies events of a session to the target on a dedicated connection,
+// which is re-established (with the session state restored) on connection
+// errors unless ExactLifetime. It is not safe for concurrent use.
+type Conn struct {
+	ConnConfig
+
+	id        uint64
+	log       *zap.Logger
+	schema    string
+	conn      TargetConn
+	closed    bool
+	stmts     map[uint64]statement
+	tick      uint64
+	vars      sessionVars
+	collation string
+	// last is the result of the last statement, which is compared with the
+	// following result event if any.
+	last Result
+	// warmed tells whether the connection is established by Warmup, which is
+	// taken over by the first handshake, and warm are statements prepared by
+	// it to be taken over by prepares of the same queries.
+	warmed bool
+	warm   map[string]TargetStmt
+}
+
+// NewConn returns a connection replaying the session of the id.
+func NewConn(cfg ConnConfig, id uint64, log *zap.Logger) *Conn {
+	if log == nil {
+		log = zap.L()
+	}
+	return &Conn{ConnConfig: cfg, id: id, log: log, stmts: make(map[uint64]statement)}
+}
+
+// ErrUnknownEvent is returned by Apply for events of unknown types.
+var ErrUnknownEvent = errors.New("unknown event")
+
+// ErrGap is returned by Apply for gap events, which mark data of the session
+// lost in the capture. Nothing is applied for them.
+var ErrGap = errors.New("data lost in capture")
+
+// ErrConnClosed is returned by Apply for events after the connection is closed
+// (or lost) in ExactLifetime mode.
+var ErrConnClosed = errors.New("connection is closed")
+
+// errTruncated is the cause of resetting connections abandoning truncated
+// result sets.
+var errTruncated = errors.New("result set is truncated")
+
+// AffectedRowsError is returned by Apply for result events of which rows
+// affected differ from the ones of the last statement replayed.
+type AffectedRowsError struct {
+	Expected uint64
+	Actual   int64
+}
+
+func (e *AffectedRowsError) Error() string {
+	return fmt.Sprintf("rows affected mismatch: %d expected, %d actual", e.Expected, e.Actual)
+}
+
+// IsConnError tells whether err is caused by a broken connection, after which
+// the connection is re-established by Apply.
+func IsConnError(err error) bool {
+	cause := errors.Unwrap(err)
+	return cause == context.DeadlineExceeded || cause == sql.ErrConnDone || cause == mysql.ErrInvalidConn || cause == driver.ErrBadConn
+}
+
+// Apply applies the event to the target, the event may be rewritten by the
+// interceptor. A nil error is returned for events skipped by the interceptor.
+func (c *Conn) Apply(ctx context.Context, e *event.MySQLEvent) (Result, error) {
+	if c.Interceptor == nil {
+		return c.apply(ctx, e)
+	}
+	ctx = context.WithValue(ctx, sessionKey{}, c.id)
+	if err := c.Interceptor.OnBeforeExecute(ctx, e); err == ErrSkip {
+		c.last = Result{}
+		return Result{Skipped: true}, nil
+	} else if err != nil {
+		return Result{}, err
+	}
+	res, err := c.apply(ctx, e)
+	c.Interceptor.OnAfterExecute(ctx, e, res, err)
+	return res, err
+}
+
+func (c *Conn) apply(ctx context.Context, e *event.MySQLEvent) (Result, error) {
+	var (
+		res    Result
+		err    error
+		warmed = c.warmed
+	)
+	c.warmed = false
+	switch e.Type {
+	case event.EventQuery:
+		res, err = c.retry(ctx, func() (Result, error) { return c.execute(ctx, e.Query) })
+	case event.EventStmtExecute:
+		res, err = c.retry(ctx, func() (Result, error) { return c.stmtExecute(ctx, e.StmtID, e.Params, e.ParamTypes, e.Cursor) })
+	case event.EventStmtPrepare:
+		err = c.stmtPrepare(ctx, e.StmtID, e.Query)
+	case event.EventStmtClose:
+		c.stmtClose(e.StmtID)
+	case event.EventHandshake:
+		if warmed && c.conn != nil && c.schema == e.DB && c.collation == CollationName(e.Charset) {
+			break
+		}
+		c.quit(false)
+		c.closed = false
+		c.collation = CollationName(e.Charset)
+		err = c.handshake(ctx, e.DB)
+	case event.EventStmtFetch:
+		res, err = c.stmtFetch(ctx, e.StmtID, e.Rows)
+	case event.EventInitDB:
+		res, err = c.initDB(ctx, e.DB)
+	case event.EventQuit:
+		c.quit(false)
+		c.closed = true
+	case event.EventGap:
+		return res, ErrGap
+	case event.EventResult:
+		return c.compare(e)
+	default:
+		return res, ErrUnknownEvent
+	}
+	if (e.Type == event.EventQuery || e.Type == event.EventStmtExecute) && err == nil {
+		c.last = res
+	} else {
+		c.last = Result{}
+	}
+	if err != nil && IsConnError(err) {
+		c.reset(ctx, e.String(), err)
+	} else if err == nil && res.Fetched != nil && res.Fetched.Truncated {
+		c.count(stats.TruncatedFetches, 1)
+		c.reset(ctx, e.String(), errTruncated)
+	}
+	return res, err
+}
+
+// reset handles the broken connection, which is re-established with the
+// session state restored unless ExactLifetime.
+func (c *Conn) reset(ctx context.Context, after string, err error) {
+	if c.ExactLifetime {
+		c.log.Warn("connection is lost after "+after, zap.String("cause", errors.Cause(err).Error()))
+		c.quit(false)
+		c.closed = true
+		return
+	}
+	c.log.Warn("reconnect after "+after, zap.String("cause", errors.Cause(err).Error()))
+	c.quit(true)
+	c.reconnect(ctx)
+}
+
+// reconnect re-establishes the connection with backoff, thus sessions survive
+// brief outages of the target.
+func (c *Conn) reconnect(ctx context.Context) {
+	for i := 0; ; i++ {
+		c.count(stats.Reconnects, 1)
+		err := c.handshake(ctx, c.schema)
+		if err == nil {
+			return
+		} else if i+1 >= c.Reconnect.Attempts || ctx.Err() != nil {
+			c.log.Warn("reconnect error", zap.Int("attempts", i+1), zap.Error(err))
+			return
+		}
+		d := c.Reconnect.Delay(i)
+		c.log.Debug("retry reconnecting after backoff", zap.Int("attempt", i+1), zap.Duration("backoff", d), zap.Error(err))
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Warmup establishes the connection as the handshake of the schema and the
+// charset would do before the session starts, thus the cost of connecting is
+// not paid by the replay. Queries are prepared as well to be taken over by the
+// prepares of them. It is taken over by the first event if it's a matching
+// handshake (or not a handshake).
+func (c *Conn) Warmup(ctx context.Context, schema string, charset uint64, queries []string) error {
+	c.quit(false)
+	c.collation = CollationName(charset)
+	if err := c.handshake(ctx, schema); err != nil {
+		return err
+	}
+	c.warmed = true
+	if c.PrepareAsText {
+		return nil
+	}
+	for _, query := range queries {
+		if _, ok := c.warm[query]; ok {
+			continue
+		}
+		handle, err := c.conn.Prepare(ctx, query)
+		if err != nil {
+			return errors.Annotate(err, "prepare "+query)
+		}
+		if c.warm == nil {
+			c.warm = make(map[string]TargetStmt)
+		}
+		c.warm[query] = handle
+	}
+	return nil
+}
+
+// Ping pings the target on the connection (if any) to keep it alive while the
+// session is idle.
+func (c *Conn) Ping(ctx context.Context) error {
+	if c.conn == nil {
+		return nil
+	}
+	c.count(stats.Pings, 1)
+	var err error
+	if pinger, ok := c.conn.(PingConn); ok {
+		err = pinger.Ping(ctx)
+	} else {
+		_, err = c.conn.Exec(ctx, "SELECT 1")
+	}
+	if err != nil && IsConnError(err) {
+		c.reset(ctx, "ping", err)
+	}
+	return errors.Trace(err)
+}
+
+// compare compares rows affected of the last statement with the result event,
+// the result of which carries the query, digest and duration of the statement
+// (so that it can be compared with the latency in the capture).
+func (c *Conn) compare(e *event.MySQLEvent) (Result, error) {
+	last := c.last
+	c.last = Result{}
+	if last.Result == nil {
+		return Result{}, nil
+	}
+	res := Result{Query: last.Query, Digest: last.Digest, Duration: last.Duration}
+	n, err := last.RowsAffected()
+	if err != nil || n == int64(e.Affected) {
+		return res, nil
+	}
+	c.count(stats.AffectedRowsMismatches, 1)
+	return res, &AffectedRowsError{Expected: e.Affected, Actual: n}
+}
+
+// retry runs f and re-runs it on errors accepted by Retry.
+func (c *Conn) retry(ctx context.Context, f func() (Result, error)) (Result, error) {
+	res, err := f()
+	for i := 0; i < c.Retries && err != nil && c.Retry != nil && c.Retry(err) && ctx.Err() == nil; i++ {
+		c.count(stats.Retries, 1)
+		c.log.Debug("retry after error", zap.Int("attempt", i+1), zap.Error(err))
+		res, err = f()
+	}
+	return res, err
+}
+
+func (c *Conn) count(name string, n int64) {
+	if !c.Untracked {
+		c.Stats.Add(name, n)
+	}
+}
+
+// Schema returns the current database of the session.
+func (c *Conn) Schema() string { return c.schema }
+
+// Close closes the connection and forgets the session state.
+func (c *Conn) Close() {
+	c.quit(false)
+}
+
+// config returns the config of connecting to the schema.
+func (c *Conn) config(schema string) *mysql.Config {
+	cfg := c.Target
+	if len(schema) > 0 && cfg.DBName != schema {
+		cfg = cfg.Clone()
+		cfg.DBName = schema
+	}
+	if len(c.collation) > 0 && cfg.Collation != c.collation {
+		if cfg == c.Target {
+			cfg = cfg.Clone()
+		}
+		cfg.Collation = c.collation
+	}
+	return cfg
+}
+
+func (c *Conn) handshake(ctx context.Context, schema string) error {
+	c.schema = schema
+	_, err := c.getConn(ctx)
+	return err
+}
+
+func (c *Conn) quit(reconnect bool) {
+	for query, handle := range c.warm {
+		handle.Close()
+		delete(c.warm, query)
+	}
+	for id, stmt := range c.stmts {
+		if stmt.handle != nil {
+			stmt.handle.Close()
+			stmt.handle = nil
+		}
+		if reconnect {
+			c.stmts[id] = stmt
+		} else {
+			delete(c.stmts, id)
+		}
+	}
+	if !reconnect {
+		c.vars.Reset()
+	}
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+		c.count(stats.Connections, -1)
+	}
+}
+
+// initDB switches the current database of the session like COM_INIT_DB, the
+// database is also used when reconnecting.
+func (c *Conn) initDB(ctx context.Context, schema string) (Result, error) {
+	return c.execute(ctx, "USE `"+strings.ReplaceAll(schema, "`", "``")+"`")
+}
+
+// initSession runs the session init statements and restores the session
+// state recorded before on a newly established connection.
+func (c *Conn) initSession(ctx context.Context) {
+	for _, queries := range [][]string{c.SessionInit, c.vars.Queries()} {
+		for _, query := range queries {
+			if _, err := c.conn.Exec(ctx, query); err != nil {
+				c.log.Warn("failed to init session", zap.String("query", query), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (c *Conn) execute(ctx context.Context, query string) (Result, error) {
+	conn, err := c.getConn(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	if c.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.QueryTimeout)
+		defer cancel()
+	}
+	c.count(stats.Queries, 1)
+	c.count(stats.ConnRunning, 1)
+	t := time.Now()
+	var fetched *Fetched
+	res, err := c.exec(ctx, conn, query, &fetched)
+	out := Result{Result: res, Executed: true, Query: query, Duration: time.Since(t), Fetched: fetched}
+	c.count(stats.ConnRunning, -1)
+	if err != nil {
+		c.count(stats.FailedQueries, 1)
+		out.Result = nil
+		return out, errors.Trace(err)
+	}
+	if IsSessionSet(query) {
+		c.vars.Record(query)
+	} else if schema, ok := ParseUseQuery(query); ok {
+		c.schema = schema
+	}
+	return out, nil
+}
+
+func (c *Conn) stmtPrepare(ctx context.Context, id uint64, query string) error {
+	stmt := c.stmts[id]
+	stmt.query, stmt.digest = query, ""
+	if stmt.handle != nil {
+		stmt.handle.Close()
+		stmt.handle = nil
+	}
+	delete(c.stmts, id)
+	c.tick += 1
+	stmt.used = c.tick
+	if c.PrepareAsText {
+		c.stmts[id] = stmt
+		return nil
+	}
+	c.evictStmt()
+	conn, err := c.getConn(ctx)
+	if err != nil {
+		return err
+	}
+	c.count(stats.StmtPrepares, 1)
+	if handle, ok := c.warm[query]; ok {
+		delete(c.warm, query)
+		stmt.handle = handle
+		c.stmts[id] = stmt
+		return nil
+	}
+	stmt.handle, err = conn.Prepare(ctx, stmt.query)
+	if err != nil {
+		c.count(stats.FailedStmtPrepares, 1)
+		return errors.Trace(err)
+	}
+	c.stmts[id] = stmt
+	return nil
+}
+
+// evictStmt closes the least recently used statement on the target if
+// statements prepared reach MaxStmts. The statement is kept, thus it's
+// prepared again by getStmt once executed.
+func (c *Conn) evictStmt() {
+	if c.MaxStmts <= 0 {
+		return
+	}
+	var (
+		victim uint64
+		open   int
+	)
+	for id, stmt := range c.stmts {
+		if stmt.handle == nil {
+			continue
+		}
+		if open == 0 || stmt.used < c.stmts[victim].used {
+			victim = id
+		}
+		open += 1
+	}
+	if open < c.MaxStmts {
+		return
+	}
+	c.log.Debug("evict prepared statement", zap.Uint64("stmt", victim), zap.Int("max", c.MaxStmts))
+	stmt := c.stmts[victim]
+	stmt.handle.Close()
+	stmt.handle = nil
+	c.stmts[victim] = stmt
+	c.count(stats.StmtEvictions, 1)
+}
+
+// stmtExecute executes the statement of the id, a cursor is opened by the
+// cursor type flags if the driver supports it.
+func (c *Conn) stmtExecute(ctx context.Context, id uint64, params []interface{}, types []uint16, cursor uint64) (Result, error) {
+	var loc *time.Location
+	if c.Target != nil {
+		loc = c.Target.Loc
+	}
+	var (
+		run     func(ctx context.Context) (sql.Result, error)
+		fetched *Fetched
+	)
+	if c.PrepareAsText {
+		query, err := c.interpolate(id, params, types, loc)
+		if err != nil {
+			return Result{}, err
+		}
+		conn, err := c.getConn(ctx)
+		if err != nil {
+			return Result{}, err
+		}
+		run = func(ctx context.Context) (sql.Result, error) { return c.exec(ctx, conn, query, &fetched) }
+	} else {
+		stmt, err := c.getStmt(ctx, id)
+		if err != nil {
+			return Result{}, err
+		}
+		if cs, ok := stmt.(CursorStmt); ok && cursor > 0 {
+			run = func(ctx context.Context) (sql.Result, error) { return cs.ExecCursor(ctx, params, types, byte(cursor)) }
+		} else if typed, ok := stmt.(TypedStmt); ok {
+			run = func(ctx context.Context) (sql.Result, error) { return typed.ExecTyped(ctx, params, types) }
+		} else {
+			if params, err = event.BindParams(params, types, loc); err != nil {
+				return Result{}, errors.Trace(err)
+			}
+			run = func(ctx context.Context) (sql.Result, error) { return c.execStmt(ctx, stmt, id, params, &fetched) }
+		}
+	}
+	if c.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.QueryTimeout)
+		defer cancel()
+	}
+	c.count(stats.StmtExecutes, 1)
+	c.count(stats.ConnRunning, 1)
+	t := time.Now()
+	res, err := run(ctx)
+	info := c.stmts[id]
+	out := Result{Result: res, Executed: true, Query: info.query, Duration: time.Since(t), Fetched: fetched}
+	if c.Digests {
+		if len(info.digest) == 0 {
+			info.digest = event.Digest(info.query)
+			c.stmts[id] = info
+		}
+		out.Digest = info.digest
+	}
+	c.count(stats.ConnRunning, -1)
+	if err != nil {
+		c.count(stats.FailedStmtExecutes, 1)
+		out.Result = nil
+		return out, errors.Trace(err)
+	}
+	return out, nil
+}
+
+// exec executes the query, result sets of queries returning rows are read into
+// fetched if FetchRows.
+func (c *Conn) exec(ctx context.Context, conn TargetConn, query string, fetched **Fetched) (sql.Result, error) {
+	if fc, ok := conn.(FetchConn); ok && c.FetchRows && event.ReturnsRows(query) {
+		f, err := fc.QueryAll(ctx, query, c.FetchLimit)
+		*fetched = &f
+		return nil, err
+	}
+	return conn.Exec(ctx, query)
+}
+
+// execStmt is like exec but executes the statement of the id.
+func (c *Conn) execStmt(ctx context.Context, stmt TargetStmt, id uint64, params []interface{}, fetched **Fetched) (sql.Result, error) {
+	if fs, ok := stmt.(FetchStmt); ok && c.FetchRows && event.ReturnsRows(c.stmts[id].query) {
+		f, err := fs.QueryAll(ctx, params, c.FetchLimit)
+		*fetched = &f
+		return nil, err
+	}
+	return stmt.Exec(ctx, params)
+}
+
+// interpolate returns the text query of executing the statement with params.
+func (c *Conn) interpolate(id uint64, params []interface{}, types []uint16, loc *time.Location) (string, error) {
+	stmt, ok := c.stmts[id]
+	if !ok {
+		return "", errors.Errorf("no such statement #%d", id)
+	}
+	c.tick += 1
+	stmt.used = c.tick
+	c.stmts[id] = stmt
+	query, err := event.InterpolateParams(stmt.query, params, types, loc)
+	return query, errors.Annotatef(err, "interpolate statement #%d", id)
+}
+
+// stmtFetch fetches rows from a server-side cursor if the driver supports it,
+// otherwise (e.g. database/sql) rows are fully fetched on execute instead.
+func (c *Conn) stmtFetch(ctx context.Context, id uint64, rows uint64) (Result, error) {
+	stmt, ok := c.stmts[id]
+	if !ok {
+		return Result{}, nil
+	}
+	c.tick += 1
+	stmt.used = c.tick
+	c.stmts[id] = stmt
+	if cursor, ok := stmt.handle.(CursorStmt); ok {
+		if c.QueryTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, c.QueryTimeout)
+			defer cancel()
+		}
+		t := time.Now()
+		res, err := cursor.Fetch(ctx, uint32(rows))
+		out := Result{Result: res, Executed: true, Query: stmt.query, Duration: time.Since(t)}
+		if c.Digests {
+			out.Digest = event.Digest(stmt.query)
+		}
+		return out, errors.Trace(err)
+	}
+	if !stmt.fetched {
+		stmt.fetched = true
+		c.stmts[id] = stmt
+		c.log.Warn("server-side cursor is replayed as a full fetch on execute", zap.Uint64("stmt", id), zap.String("digest", event.Digest(stmt.query)))
+	}
+	return Result{}, nil
+}
+
+func (c *Conn) stmtClose(id uint64) {
+	stmt, ok := c.stmts[id]
+	if !ok {
+		return
+	}
+	if stmt.handle != nil {
+		stmt.handle.Close()
+		stmt.handle = nil
+	}
+	delete(c.stmts, id)
+}
+
+func (c *Conn) getConn(ctx context.Context) (TargetConn, error) {
+	if c.conn == nil && c.closed && c.ExactLifetime {
+		return nil, ErrConnClosed
+	}
+	if c.conn == nil {
+		drv := c.Driver
+		if drv == nil {
+			drv = sqlDriver{}
+		}
+		conn, err := drv.Connect(ctx, c.config(c.schema))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		c.conn = conn
+		c.count(stats.Connections, 1)
+		c.initSession(ctx)
+	}
+	return c.conn, nil
+}
+
+func (c *Conn) getStmt(ctx context.Context, id uint64) (TargetStmt, error) {
+	stmt, ok := c.stmts[id]
+	if !ok {
+		return nil, errors.Errorf("no such statement #%d", id)
+	}
+	c.tick += 1
+	stmt.used = c.tick
+	c.stmts[id] = stmt
+	if stmt.handle != nil {
+		return stmt.handle, nil
+	}
+	c.evictStmt()
+	conn, err := c.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stmt.handle, err = conn.Prepare(ctx, stmt.query)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c.stmts[id] = stmt
+	return stmt.handle, nil
+}
@@ -0,0 +1,292 @@
+package replay
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+)
+
+// DefaultDriver is the name of the target driver backed by database/sql and
+// go-sql-driver/mysql.
+const DefaultDriver = "mysql"
+
+// TargetDriver establishes connections to the target, it must be safe for
+// concurrent use.
+type TargetDriver interface {
+	Connect(ctx context.Context, cfg *mysql.Config) (TargetConn, error)
+}
+
+// TargetConn is a single connection to the target used by a Conn, which is
+// never shared by goroutines. Errors caused by a broken connection should be
+// (or wrap) mysql.ErrInvalidConn or driver.ErrBadConn, so that the Conn is
+// re-established.
+type TargetConn interface {
+	Exec(ctx context.Context, query string) (sql.Result, error)
+	Prepare(ctx context.Context, query string) (TargetStmt, error)
+	Close() error
+}
+
+// TargetStmt is a prepared statement of a TargetConn.
+type TargetStmt interface {
+	Exec(ctx context.Context, args []interface{}) (sql.Result, error)
+	Close() error
+}
+
+// Fetched is a result set read fully, FirstRow is the time from sending the
+// statement to the first row (or the end of the result set if it's empty).
+// Truncated tells whether reading stopped at a FetchLimit, in which case the
+// rest of the result set is abandoned along with the connection.
+type Fetched struct {
+	Rows      int64
+	Bytes     int64
+	FirstRow  time.Duration
+	Truncated bool
+	// Checksum is the sum of checksums of rows, which doesn't depend on the
+	// order of rows.
+	Checksum uint64
+}
+
+// FetchLimit limits rows and bytes read from a result set, zero values mean no
+// limit.
+type FetchLimit struct {
+	Rows  int64 `json:"rows,omitempty"`
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+// Reached tells whether f reaches the limit, thus any more row exceeds it.
+func (l FetchLimit) Reached(f Fetched) bool {
+	return (l.Rows > 0 && f.Rows >= l.Rows) || (l.Bytes > 0 && f.Bytes >= l.Bytes)
+}
+
+// FetchConn is implemented by TargetConns able to read result sets of queries
+// fully, and FetchStmt by TargetStmts of them (see ConnConfig.FetchRows).
+type FetchConn interface {
+	QueryAll(ctx context.Context, query string, limit FetchLimit) (Fetched, error)
+}
+
+type FetchStmt interface {
+	QueryAll(ctx context.Context, args []interface{}, limit FetchLimit) (Fetched, error)
+}
+
+var (
+	driversLock sync.RWMutex
+	drivers     = map[string]TargetDriver{DefaultDriver: sqlDriver{}}
+)
+
+// RegisterDriver registers a target driver by name, so that it can be chosen
+// like `text play --driver <name>`. It is typically called in init of the
+// package providing the driver, and panics if the name is registered twice.
+func RegisterDriver(name string, driver TargetDriver) {
+	if driver == nil {
+		panic("replay: nil target driver of " + name)
+	}
+	driversLock.Lock()
+	defer driversLock.Unlock()
+	if _, ok := drivers[name]; ok {
+		panic("replay: target driver " + name + " is already registered")
+	}
+	drivers[name] = driver
+}
+
+// LookupDriver returns the target driver registered by name, an empty name
+// refers to the DefaultDriver.
+func LookupDriver(name string) (TargetDriver, error) {
+	if len(name) == 0 {
+		name = DefaultDriver
+	}
+	driversLock.RLock()
+	driver, ok := drivers[name]
+	driversLock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown target driver: %s (registered: %v)", name, Drivers())
+	}
+	return driver, nil
+}
+
+// Drivers returns names of registered target drivers in order.
+func Drivers() []string {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExecutorDriver is implemented by target drivers to name the executor (the
+// client library or protocol implementation) of their statements.
+type ExecutorDriver interface {
+	Executor() string
+}
+
+// Executors returns executors of registered target drivers in order.
+func Executors() []string {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+	seen := make(map[string]bool, len(drivers))
+	names := make([]string, 0, len(drivers))
+	for _, driver := range drivers {
+		if d, ok := driver.(ExecutorDriver); ok && !seen[d.Executor()] {
+			seen[d.Executor()] = true
+			names = append(names, d.Executor())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sqlDriver connects via database/sql, each connection owns a pool holding
+// only the connection itself.
+type sqlDriver struct{}
+
+func (sqlDriver) Executor() string { return "database/sql" }
+
+func (sqlDriver) Connect(ctx context.Context, cfg *mysql.Config) (TargetConn, error) {
+	pool, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		pool.Close()
+		return nil, errors.Trace(err)
+	}
+	return &sqlConn{pool: pool, conn: conn}, nil
+}
+
+type sqlConn struct {
+	pool *sql.DB
+	conn *sql.Conn
+}
+
+func (c *sqlConn) Exec(ctx context.Context, query string) (sql.Result, error) {
+	return c.conn.ExecContext(ctx, query)
+}
+
+func (c *sqlConn) Ping(ctx context.Context) error {
+	return c.conn.PingContext(ctx)
+}
+
+func (c *sqlConn) QueryAll(ctx context.Context, query string, limit FetchLimit) (Fetched, error) {
+	t := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rows, err := c.conn.QueryContext(ctx, query)
+	if err != nil {
+		return Fetched{}, err
+	}
+	return readAll(rows, t, limit, cancel)
+}
+
+func (c *sqlConn) Prepare(ctx context.Context, query string) (TargetStmt, error) {
+	stmt, err := c.conn.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return sqlStmt{stmt}, nil
+}
+
+// Close closes the underlying driver connection rather than returning it to
+// the pool.
+func (c *sqlConn) Close() error {
+	c.conn.Raw(func(driverConn interface{}) error {
+		if dc, ok := driverConn.(io.Closer); ok {
+			dc.Close()
+		}
+		return nil
+	})
+	c.conn.Close()
+	return c.pool.Close()
+}
+
+type sqlStmt struct{ *sql.Stmt }
+
+func (s sqlStmt) Exec(ctx context.Context, args []interface{}) (sql.Result, error) {
+	return s.ExecContext(ctx, args...)
+}
+
+func (s sqlStmt) QueryAll(ctx context.Context, args []interface{}, limit FetchLimit) (Fetched, error) {
+	t := time.Now()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rows, err := s.QueryContext(ctx, args...)
+	if err != nil {
+		return Fetched{}, err
+	}
+	return readAll(rows, t, limit, cancel)
+}
+
+// readAll reads all rows (of all result sets) of a statement sent at t. Once a
+// row beyond the limit arrives, the query is canceled rather than the rest of
+// rows being drained, which kills the underlying connection.
+func readAll(rows *sql.Rows, t time.Time, limit FetchLimit, cancel context.CancelFunc) (Fetched, error) {
+	defer rows.Close()
+	var out Fetched
+	for {
+		cols, err := rows.Columns()
+		if err != nil {
+			return out, err
+		}
+		var (
+			raw    = make([]sql.RawBytes, len(cols))
+			values = make([]interface{}, len(cols))
+		)
+		for i := range raw {
+			values[i] = &raw[i]
+		}
+		for rows.Next() {
+			if limit.Reached(out) {
+				out.Truncated = true
+				cancel()
+				return out, nil
+			}
+			if out.Rows == 0 {
+				out.FirstRow = time.Since(t)
+			}
+			if err = rows.Scan(values...); err != nil {
+				return out, err
+			}
+			out.Rows += 1
+			out.Checksum += checksumRow(raw)
+			for _, v := range raw {
+				out.Bytes += int64(len(v))
+			}
+		}
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	if out.Rows == 0 {
+		out.FirstRow = time.Since(t)
+	}
+	return out, rows.Err()
+}
+
+// checksumRow returns the fnv-1a hash of values of a row, NULLs differ from
+// empty values.
+func checksumRow(raw []sql.RawBytes) uint64 {
+	h := fnv.New64a()
+	var buf [binary.MaxVarintLen64 + 1]byte
+	for _, v := range raw {
+		if v == nil {
+			h.Write([]byte{0xff})
+			continue
+		}
+		buf[0] = 0
+		n := binary.PutUvarint(buf[1:], uint64(len(v)))
+		h.Write(buf[:n+1])
+		h.Write(v)
+	}
+	return h.Sum64()
+}
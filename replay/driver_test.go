@@ -0,0 +1,351 @@
+package replay
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/stats"
+)
+
+type fakeDriver struct {
+	dbs      []string
+	execs    []string
+	prepares []string
+	closed   []string
+	fail     map[string]error
+	refuse   int
+}
+
+func (d *fakeDriver) Connect(ctx context.Context, cfg *mysql.Config) (TargetConn, error) {
+	if d.refuse > 0 {
+		d.refuse -= 1
+		return nil, errors.New("connection refused")
+	}
+	d.dbs = append(d.dbs, cfg.DBName)
+	return fakeConn{d}, nil
+}
+
+type fakeConn struct{ d *fakeDriver }
+
+func (c fakeConn) Exec(ctx context.Context, query string) (sql.Result, error) {
+	c.d.execs = append(c.d.execs, query)
+	if err := c.d.fail[query]; err != nil {
+		delete(c.d.fail, query)
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeConn) Prepare(ctx context.Context, query string) (TargetStmt, error) {
+	c.d.prepares = append(c.d.prepares, query)
+	return fakeStmt{c.d, query}, nil
+}
+
+func (c fakeConn) Close() error { return nil }
+
+type fakeStmt struct {
+	d     *fakeDriver
+	query string
+}
+
+func (s fakeStmt) Exec(ctx context.Context, args []interface{}) (sql.Result, error) {
+	s.d.execs = append(s.d.execs, s.query)
+	return driver.RowsAffected(len(args)), nil
+}
+
+func (s fakeStmt) Close() error {
+	s.d.closed = append(s.d.closed, s.query)
+	return nil
+}
+
+func TestConnDriver(t *testing.T) {
+	d := &fakeDriver{fail: map[string]error{"select 2": mysql.ErrInvalidConn}}
+	c := NewConn(ConnConfig{Target: &mysql.Config{}, SessionInit: []string{"set @x = 1"}, Driver: d}, 1, nil)
+	defer c.Close()
+	ctx := context.Background()
+	for _, e := range []event.MySQLEvent{
+		{Type: event.EventHandshake, DB: "test"},
+		{Type: event.EventQuery, Query: "set names utf8mb4"},
+		{Type: event.EventStmtPrepare, StmtID: 1, Query: "select ?"},
+		{Type: event.EventQuery, Query: "use foo"},
+		{Type: event.EventQuery, Query: "select 2"},
+	} {
+		c.Apply(ctx, &e)
+	}
+	res, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventStmtExecute, StmtID: 1, Params: []interface{}{int64(1)}})
+	require.NoError(t, err)
+	require.True(t, res.Executed)
+	require.Equal(t, "select ?", res.Query)
+	n, _ := res.RowsAffected()
+	require.Equal(t, int64(1), n)
+
+	// the connection is re-established in the current db with the session restored
+	require.Equal(t, []string{"test", "foo"}, d.dbs)
+	require.Equal(t, []string{
+		"set @x = 1", "set names utf8mb4", "use foo", "select 2",
+		"set @x = 1", "set names utf8mb4", "select ?",
+	}, d.execs)
+}
+
+func TestConnRetry(t *testing.T) {
+	conflict := &mysql.MySQLError{Number: 9007, Message: "Write conflict"}
+	d := &fakeDriver{fail: map[string]error{"update t set a = 1": conflict}}
+	c := NewConn(ConnConfig{Target: &mysql.Config{}, Driver: d, Retry: IsTiDBRetryable, Retries: 1}, 1, nil)
+	defer c.Close()
+	ctx := context.Background()
+	_, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "update t set a = 1"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"update t set a = 1", "update t set a = 1"}, d.execs)
+
+	d.fail["select x"] = &mysql.MySQLError{Number: 1054, Message: "Unknown column"}
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select x"})
+	require.Error(t, err)
+	require.True(t, IsTiDBIncompatible(&mysql.MySQLError{Number: 1064}))
+	require.False(t, IsTiDBIncompatible(err))
+	require.Len(t, d.execs, 3)
+}
+
+func TestConnAffectedRows(t *testing.T) {
+	d := &fakeDriver{}
+	c := NewConn(ConnConfig{Target: &mysql.Config{}, Driver: d}, 1, nil)
+	defer c.Close()
+	ctx := context.Background()
+	_, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "update t set a = 1"})
+	require.NoError(t, err)
+	res, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventResult, Affected: 1})
+	require.NoError(t, err)
+	require.False(t, res.Executed)
+	require.Equal(t, "update t set a = 1", res.Query)
+
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "update t set a = 2"})
+	require.NoError(t, err)
+	res, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventResult, Affected: 3})
+	require.Equal(t, &AffectedRowsError{Expected: 3, Actual: 1}, err)
+	require.Equal(t, "update t set a = 2", res.Query)
+
+	// results are only compared with the statement right before them
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventResult, Affected: 3})
+	require.NoError(t, err)
+}
+
+func TestConnMaxStmts(t *testing.T) {
+	d := &fakeDriver{}
+	reg := stats.NewRegistry()
+	c := NewConn(ConnConfig{Target: &mysql.Config{}, Driver: d, MaxStmts: 2, Stats: reg}, 1, nil)
+	defer c.Close()
+	ctx := context.Background()
+	for _, e := range []event.MySQLEvent{
+		{Type: event.EventStmtPrepare, StmtID: 1, Query: "select 1"},
+		{Type: event.EventStmtPrepare, StmtID: 2, Query: "select 2"},
+		{Type: event.EventStmtExecute, StmtID: 1},
+		{Type: event.EventStmtPrepare, StmtID: 3, Query: "select 3"},
+	} {
+		_, err := c.Apply(ctx, &e)
+		require.NoError(t, err)
+	}
+	// the least recently used one is closed on the target but kept
+	require.Equal(t, []string{"select 2"}, d.closed)
+	require.Len(t, c.stmts, 3)
+	require.Equal(t, int64(1), reg.Get(stats.StmtEvictions))
+
+	// and it's prepared again once executed, which evicts another one
+	_, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventStmtExecute, StmtID: 2})
+	require.NoError(t, err)
+	require.Equal(t, []string{"select 1", "select 2", "select 3", "select 2"}, d.prepares)
+	require.Equal(t, []string{"select 2", "select 1"}, d.closed)
+	require.Equal(t, int64(2), reg.Get(stats.StmtEvictions))
+
+	// re-preparing a statement never evicts others
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventStmtPrepare, StmtID: 3, Query: "select 3"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"select 2", "select 1", "select 3"}, d.closed)
+	require.Equal(t, int64(2), reg.Get(stats.StmtEvictions))
+}
+
+func TestConnPrepareAsText(t *testing.T) {
+	d := &fakeDriver{}
+	c := NewConn(ConnConfig{Target: &mysql.Config{}, Driver: d, PrepareAsText: true}, 1, nil)
+	defer c.Close()
+	ctx := context.Background()
+	_, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventStmtPrepare, StmtID: 1, Query: "select * from t where a = ? limit ?"})
+	require.NoError(t, err)
+	res, err := c.Apply(ctx, &event.MySQLEvent{
+		Type:       event.EventStmtExecute,
+		StmtID:     1,
+		Params:     []interface{}{"it's", "10"},
+		ParamTypes: []uint16{event.TypeVarString, event.TypeLongLong},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "select * from t where a = ? limit ?", res.Query)
+	require.Equal(t, []string{"select * from t where a = 'it''s' limit 10"}, d.execs)
+	require.Empty(t, d.closed)
+}
+
+func TestConnExactLifetime(t *testing.T) {
+	d := &fakeDriver{fail: map[string]error{"select 2": mysql.ErrInvalidConn}}
+	reg := stats.NewRegistry()
+	c := NewConn(ConnConfig{Target: &mysql.Config{}, Driver: d, ExactLifetime: true, Stats: reg}, 1, nil)
+	defer c.Close()
+	ctx := context.Background()
+	_, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select 1"})
+	require.NoError(t, err)
+	require.NoError(t, c.Ping(ctx))
+	require.Equal(t, int64(1), reg.Get(stats.Pings))
+
+	// lost connections are never re-established until the next handshake
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select 2"})
+	require.Error(t, err)
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select 3"})
+	require.Equal(t, ErrConnClosed, errors.Cause(err))
+	require.NoError(t, c.Ping(ctx))
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventHandshake, DB: "test"})
+	require.NoError(t, err)
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select 4"})
+	require.NoError(t, err)
+
+	// and so are the ones closed by quits
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuit})
+	require.NoError(t, err)
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select 5"})
+	require.Equal(t, ErrConnClosed, errors.Cause(err))
+	require.Equal(t, []string{"", "test"}, d.dbs)
+	require.Equal(t, []string{"select 1", "SELECT 1", "select 2", "select 4"}, d.execs)
+}
+
+func TestConnWarmup(t *testing.T) {
+	d := &fakeDriver{}
+	c := NewConn(ConnConfig{Target: &mysql.Config{}, Driver: d}, 1, nil)
+	defer c.Close()
+	ctx := context.Background()
+	require.NoError(t, c.Warmup(ctx, "test", 0, []string{"select ?", "select 1"}))
+	require.Equal(t, []string{"test"}, d.dbs)
+
+	// the warmed connection and statements are taken over
+	for _, e := range []event.MySQLEvent{
+		{Type: event.EventHandshake, DB: "test"},
+		{Type: event.EventStmtPrepare, StmtID: 1, Query: "select ?"},
+		{Type: event.EventStmtExecute, StmtID: 1, Params: []interface{}{int64(1)}},
+		{Type: event.EventStmtPrepare, StmtID: 2, Query: "select ?"},
+	} {
+		_, err := c.Apply(ctx, &e)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []string{"test"}, d.dbs)
+	require.Equal(t, []string{"select ?", "select 1", "select ?"}, d.prepares)
+	require.Equal(t, []string{"select ?"}, d.execs)
+
+	// unless the handshake differs
+	require.NoError(t, c.Warmup(ctx, "test", 0, []string{"select 1"}))
+	_, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventHandshake, DB: "foo"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"test", "test", "foo"}, d.dbs)
+	require.Contains(t, d.closed, "select 1")
+}
+
+func TestConnReconnect(t *testing.T) {
+	b := Backoff{Base: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	require.Equal(t, 10*time.Millisecond, b.Delay(0))
+	require.Equal(t, 40*time.Millisecond, b.Delay(2))
+	require.Equal(t, 50*time.Millisecond, b.Delay(10))
+	b.Jitter = 0.5
+	for i := 0; i < 10; i++ {
+		require.InDelta(t, float64(20*time.Millisecond), float64(b.Delay(1)), float64(10*time.Millisecond))
+	}
+
+	d := &fakeDriver{fail: map[string]error{"select 2": mysql.ErrInvalidConn}}
+	reg := stats.NewRegistry()
+	c := NewConn(ConnConfig{Target: &mysql.Config{}, Driver: d, Reconnect: Backoff{Attempts: 3, Base: time.Millisecond}, Stats: reg}, 1, nil)
+	defer c.Close()
+	ctx := context.Background()
+	_, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventHandshake, DB: "test"})
+	require.NoError(t, err)
+	d.refuse = 2
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select 2"})
+	require.Error(t, err)
+	require.Equal(t, int64(3), reg.Get(stats.Reconnects))
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select 3"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"test", "test"}, d.dbs)
+
+	// give up after attempts
+	d.fail["select 4"], d.refuse = mysql.ErrInvalidConn, 3
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select 4"})
+	require.Error(t, err)
+	require.Equal(t, int64(6), reg.Get(stats.Reconnects))
+	require.Equal(t, 0, d.refuse)
+}
+
+type fakeFetchConn struct{ fakeConn }
+
+func (c fakeFetchConn) QueryAll(ctx context.Context, query string, limit FetchLimit) (Fetched, error) {
+	c.d.execs = append(c.d.execs, "fetch: "+query)
+	f := Fetched{FirstRow: time.Millisecond}
+	for i := 0; i < 2; i++ {
+		if limit.Reached(f) {
+			f.Truncated = true
+			break
+		}
+		f.Rows, f.Bytes = f.Rows+1, f.Bytes+4
+	}
+	return f, nil
+}
+
+type fakeFetchDriver struct{ fakeDriver }
+
+func (d *fakeFetchDriver) Connect(ctx context.Context, cfg *mysql.Config) (TargetConn, error) {
+	return fakeFetchConn{fakeConn{&d.fakeDriver}}, nil
+}
+
+func TestConnFetchRows(t *testing.T) {
+	d := &fakeFetchDriver{}
+	c := NewConn(ConnConfig{Target: &mysql.Config{}, Driver: d, FetchRows: true}, 1, nil)
+	defer c.Close()
+	ctx := context.Background()
+	res, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "(select 1) union (select 2)"})
+	require.NoError(t, err)
+	require.NotNil(t, res.Fetched)
+	require.Equal(t, int64(2), res.Fetched.Rows)
+	res, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "update t set a = 1"})
+	require.NoError(t, err)
+	require.Nil(t, res.Fetched)
+	require.Equal(t, []string{"fetch: (select 1) union (select 2)", "update t set a = 1"}, d.execs)
+}
+
+func TestConnFetchLimit(t *testing.T) {
+	d := &fakeFetchDriver{}
+	reg := stats.NewRegistry()
+	c := NewConn(ConnConfig{Target: &mysql.Config{}, Driver: d, FetchRows: true, FetchLimit: FetchLimit{Bytes: 4}, Stats: reg}, 1, nil)
+	defer c.Close()
+	ctx := context.Background()
+	res, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select a from t"})
+	require.NoError(t, err)
+	require.Equal(t, Fetched{Rows: 1, Bytes: 4, FirstRow: time.Millisecond, Truncated: true}, *res.Fetched)
+	require.Equal(t, int64(1), reg.Get(stats.TruncatedFetches))
+	// the connection is dropped along with the rest of the result set
+	require.Equal(t, int64(1), reg.Get(stats.Reconnects))
+
+	// result sets of exactly the limit are read completely
+	c.FetchLimit = FetchLimit{Rows: 2, Bytes: 8}
+	res, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select 1"})
+	require.NoError(t, err)
+	require.Equal(t, Fetched{Rows: 2, Bytes: 8, FirstRow: time.Millisecond}, *res.Fetched)
+	require.Equal(t, int64(1), reg.Get(stats.TruncatedFetches))
+	require.Equal(t, int64(1), reg.Get(stats.Reconnects))
+}
+
+func TestChecksumRow(t *testing.T) {
+	a := checksumRow([]sql.RawBytes{sql.RawBytes("1"), sql.RawBytes("x")})
+	b := checksumRow([]sql.RawBytes{sql.RawBytes("2"), sql.RawBytes("y")})
+	require.Equal(t, a, checksumRow([]sql.RawBytes{sql.RawBytes("1"), sql.RawBytes("x")}))
+	require.NotEqual(t, a, b)
+	// values are delimited, and NULLs differ from empty values
+	require.NotEqual(t, checksumRow([]sql.RawBytes{sql.RawBytes("1x"), sql.RawBytes("")}), a)
+	require.NotEqual(t, checksumRow([]sql.RawBytes{nil}), checksumRow([]sql.RawBytes{sql.RawBytes{}}))
+}
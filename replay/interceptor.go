@@ -0,0 +1,212 @@
+package replay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/event"
+)
+
+// ErrSkip can be returned by Interceptor.OnBeforeExecute to drop the event
+// silently, the result of which is marked as skipped.
+var ErrSkip = errors.New("skip event")
+
+// Interceptor intercepts events applied by a Conn. OnBeforeExecute may rewrite
+// the event in place or veto it by returning an error (ErrSkip drops it
+// silently while other errors are reported as failures of the event), and
+// OnAfterExecute observes the result of every event not vetoed. Interceptors
+// are shared by connections, thus must be safe for concurrent use.
+type Interceptor interface {
+	OnBeforeExecute(ctx context.Context, e *event.MySQLEvent) error
+	OnAfterExecute(ctx context.Context, e *event.MySQLEvent, res Result, err error)
+}
+
+type sessionKey struct{}
+
+// SessionID returns the id of the session whose event is being intercepted.
+func SessionID(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(sessionKey{}).(uint64)
+	return id, ok
+}
+
+// Chain returns an interceptor running is in order before executions (until
+// one of them fails) and in the reverse order after executions.
+func Chain(is ...Interceptor) Interceptor {
+	chain := make(interceptorChain, 0, len(is))
+	for _, i := range is {
+		if i != nil {
+			chain = append(chain, i)
+		}
+	}
+	switch len(chain) {
+	case 0:
+		return nil
+	case 1:
+		return chain[0]
+	default:
+		return chain
+	}
+}
+
+type interceptorChain []Interceptor
+
+func (chain interceptorChain) OnBeforeExecute(ctx context.Context, e *event.MySQLEvent) error {
+	for _, i := range chain {
+		if err := i.OnBeforeExecute(ctx, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (chain interceptorChain) OnAfterExecute(ctx context.Context, e *event.MySQLEvent, res Result, err error) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		chain[i].OnAfterExecute(ctx, e, res, err)
+	}
+}
+
+// InterceptorFuncs adapts functions to an Interceptor, nil functions are
+// no-ops.
+type InterceptorFuncs struct {
+	Before func(ctx context.Context, e *event.MySQLEvent) error
+	After  func(ctx context.Context, e *event.MySQLEvent, res Result, err error)
+}
+
+func (f InterceptorFuncs) OnBeforeExecute(ctx context.Context, e *event.MySQLEvent) error {
+	if f.Before == nil {
+		return nil
+	}
+	return f.Before(ctx, e)
+}
+
+func (f InterceptorFuncs) OnAfterExecute(ctx context.Context, e *event.MySQLEvent, res Result, err error) {
+	if f.After != nil {
+		f.After(ctx, e, res, err)
+	}
+}
+
+type hookRequest struct {
+	Phase        string          `json:"phase"`
+	Session      string          `json:"session,omitempty"`
+	Event        json.RawMessage `json:"event"`
+	Error        string          `json:"error,omitempty"`
+	RowsAffected int64           `json:"rowsAffected,omitempty"`
+	Duration     int64           `json:"duration,omitempty"`
+}
+
+type hookResponse struct {
+	Skip  bool            `json:"skip"`
+	Error string          `json:"error"`
+	Event json.RawMessage `json:"event"`
+}
+
+// CommandInterceptor delegates interception to an external command, which
+// talks json lines over its stdin and stdout. A request like
+// `{"phase":"before","session":"...","event":{...}}` is written before each
+// execution and is answered by a line like `{"skip":false,"error":"","event":{...}}`
+// where event (optional) replaces the original one. A request of phase
+// "after" is written after each execution (with error, rowsAffected and
+// duration in ms), which is not answered. Requests are serialized, so the
+// command is better kept simple and fast.
+type CommandInterceptor struct {
+	lock sync.Mutex
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	out  *bufio.Scanner
+}
+
+func NewCommandInterceptor(name string, args ...string) (*CommandInterceptor, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, errors.Annotate(err, "start hook")
+	}
+	ci := &CommandInterceptor{cmd: cmd, in: in, out: bufio.NewScanner(out)}
+	ci.out.Buffer(make([]byte, 0, 4096), 1<<26)
+	return ci, nil
+}
+
+func (ci *CommandInterceptor) request(req hookRequest, e *event.MySQLEvent, resp *hookResponse) error {
+	var err error
+	if req.Event, err = event.EncodeJSON(*e); err != nil {
+		return errors.Trace(err)
+	}
+	line, err := json.Marshal(req)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	if _, err = ci.in.Write(append(line, '\n')); err != nil {
+		return errors.Annotate(err, "write to hook")
+	}
+	if resp == nil {
+		return nil
+	}
+	if !ci.out.Scan() {
+		if err = ci.out.Err(); err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return errors.Annotate(err, "read from hook")
+	}
+	return errors.Annotate(json.Unmarshal(ci.out.Bytes(), resp), "decode hook response")
+}
+
+func (ci *CommandInterceptor) OnBeforeExecute(ctx context.Context, e *event.MySQLEvent) error {
+	var resp hookResponse
+	if err := ci.request(hookRequest{Phase: "before", Session: sessionName(ctx)}, e, &resp); err != nil {
+		return err
+	}
+	if len(resp.Event) > 0 && string(resp.Event) != "null" {
+		if err := event.DecodeJSON(resp.Event, e.Reset(e.Params[:0])); err != nil {
+			return errors.Annotate(err, "decode event from hook")
+		}
+	}
+	if resp.Skip {
+		return ErrSkip
+	} else if len(resp.Error) > 0 {
+		return errors.New(resp.Error)
+	}
+	return nil
+}
+
+func (ci *CommandInterceptor) OnAfterExecute(ctx context.Context, e *event.MySQLEvent, res Result, err error) {
+	req := hookRequest{Phase: "after", Session: sessionName(ctx), Duration: res.Duration.Milliseconds()}
+	if err != nil {
+		req.Error = err.Error()
+	}
+	if res.Result != nil {
+		req.RowsAffected, _ = res.RowsAffected()
+	}
+	ci.request(req, e, nil)
+}
+
+// Close closes stdin of the command and waits for it to exit.
+func (ci *CommandInterceptor) Close() error {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	ci.in.Close()
+	return errors.Trace(ci.cmd.Wait())
+}
+
+func sessionName(ctx context.Context) string {
+	if id, ok := SessionID(ctx); ok {
+		return fmt.Sprintf("%016x", id)
+	}
+	return ""
+}
@@ -0,0 +1,71 @@
+package replay
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/mysql-replay/event"
+)
+
+func TestInterceptorChain(t *testing.T) {
+	var calls []string
+	trace := func(name string, before error) Interceptor {
+		return InterceptorFuncs{
+			Before: func(ctx context.Context, e *event.MySQLEvent) error {
+				id, _ := SessionID(ctx)
+				require.Equal(t, uint64(7), id)
+				calls = append(calls, "before "+name)
+				e.StmtID += 1
+				return before
+			},
+			After: func(ctx context.Context, e *event.MySQLEvent, res Result, err error) {
+				calls = append(calls, "after "+name)
+			},
+		}
+	}
+
+	// stmt close events of unknown stmts are applied without a target
+	c := NewConn(ConnConfig{Interceptor: Chain(trace("a", nil), nil, trace("b", nil))}, 7, nil)
+	e := event.MySQLEvent{Type: event.EventStmtClose, StmtID: 1}
+	res, err := c.Apply(context.Background(), &e)
+	require.NoError(t, err)
+	require.False(t, res.Skipped)
+	require.Equal(t, uint64(3), e.StmtID)
+	require.Equal(t, []string{"before a", "before b", "after b", "after a"}, calls)
+
+	calls = nil
+	c = NewConn(ConnConfig{Interceptor: Chain(trace("a", ErrSkip), trace("b", nil))}, 7, nil)
+	res, err = c.Apply(context.Background(), &e)
+	require.NoError(t, err)
+	require.True(t, res.Skipped)
+	require.Equal(t, []string{"before a"}, calls)
+}
+
+func TestCommandInterceptor(t *testing.T) {
+	hook, err := NewCommandInterceptor("sh", "-c", `while read -r line; do
+  case "$line" in
+    *'"phase":"before"'*'"stmtID":1}'*) echo '{"skip":true}' ;;
+    *'"phase":"before"'*'"stmtID":2}'*) echo '{"error":"vetoed"}' ;;
+    *'"phase":"before"'*) echo '{"event":{"time":1,"type":5,"stmtID":9}}' ;;
+  esac
+done`)
+	require.NoError(t, err)
+	defer hook.Close()
+
+	c := NewConn(ConnConfig{Interceptor: hook}, 1, nil)
+	e := event.MySQLEvent{Time: 1, Type: event.EventStmtClose, StmtID: 1}
+	res, err := c.Apply(context.Background(), &e)
+	require.NoError(t, err)
+	require.True(t, res.Skipped)
+
+	e.StmtID = 2
+	_, err = c.Apply(context.Background(), &e)
+	require.EqualError(t, err, "vetoed")
+
+	e.StmtID = 3
+	_, err = c.Apply(context.Background(), &e)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), e.StmtID)
+	require.NoError(t, hook.Close())
+}
@@ -0,0 +1,273 @@
+// Package replay replays sessions of dumps against a MySQL compatible target,
+// it is the library behind `text play` for tools embedding replays.
+//
+// A minimal replay looks like:
+//
+//	target, _ := mysql.ParseDSN("root@tcp(127.0.0.1:4000)/")
+//	src := replay.NewDirSource("./dump", event.FormatTSV, 0)
+//	err := replay.New(replay.Config{ConnConfig: replay.ConnConfig{Target: target}, Speed: 1}).Run(ctx, src)
+package replay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/storage"
+	"go.uber.org/zap"
+)
+
+// Session describes a captured session, times are unix timestamps in ms.
+type Session struct {
+	ID    uint64
+	Start int64
+	End   int64
+	Name  string
+}
+
+// ErrNotSession is returned by ParseSessionName for names of other files.
+var ErrNotSession = errors.New("not a session file")
+
+// ParseSessionName parses names of session files like `<start>.<end>.<id>.<format>`.
+func ParseSessionName(name string, format string) (Session, error) {
+	s := Session{Name: name}
+	info := strings.Split(name, ".")
+	if len(info) != 4 || info[3] != format {
+		return s, ErrNotSession
+	}
+	var err error
+	if s.Start, err = strconv.ParseInt(info[0], 10, 64); err != nil {
+		return s, errors.Trace(err)
+	}
+	if s.End, err = strconv.ParseInt(info[1], 10, 64); err != nil {
+		return s, errors.Trace(err)
+	}
+	if s.ID, err = strconv.ParseUint(info[2], 16, 64); err != nil {
+		return s, errors.Trace(err)
+	}
+	return s, nil
+}
+
+// Stream is an opened session.
+type Stream interface {
+	event.Reader
+	io.Closer
+}
+
+// Source provides sessions to replay.
+type Source interface {
+	Sessions(ctx context.Context) ([]Session, error)
+	Open(ctx context.Context, s Session) (Stream, error)
+}
+
+// Sink receives results of events applied to the target, it is called
+// concurrently by sessions.
+type Sink interface {
+	OnResult(s Session, e *event.MySQLEvent, res Result, err error)
+}
+
+// SinkFunc adapts a function to a Sink.
+type SinkFunc func(s Session, e *event.MySQLEvent, res Result, err error)
+
+func (f SinkFunc) OnResult(s Session, e *event.MySQLEvent, res Result, err error) {
+	f(s, e, res, err)
+}
+
+type dirSource struct {
+	location    string
+	format      string
+	maxLineSize int
+	store       storage.Storage
+}
+
+// NewDirSource returns a source of session files under the location (a local
+// directory or an object storage url) in the format.
+func NewDirSource(location string, format string, maxLineSize int) Source {
+	return &dirSource{location: location, format: format, maxLineSize: maxLineSize}
+}
+
+func (src *dirSource) Sessions(ctx context.Context) ([]Session, error) {
+	if src.store == nil {
+		store, err := storage.Open(src.location)
+		if err != nil {
+			return nil, err
+		}
+		src.store = store
+	}
+	files, err := src.store.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]Session, 0, len(files))
+	for _, file := range files {
+		s, err := ParseSessionName(file.Name, src.format)
+		if err == ErrNotSession {
+			continue
+		} else if err != nil {
+			zap.L().Warn("skip input file", zap.String("name", file.Name), zap.Error(err))
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+type stream struct {
+	event.Reader
+	io.Closer
+}
+
+func (src *dirSource) Open(ctx context.Context, s Session) (Stream, error) {
+	if src.store == nil {
+		return nil, errors.New("sessions are not listed")
+	}
+	f, err := src.store.Open(ctx, s.Name)
+	if err != nil {
+		return nil, err
+	}
+	r, err := event.NewReader(src.format, f, src.maxLineSize)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return stream{Reader: r, Closer: f}, nil
+}
+
+// Config configures a replay.
+type Config struct {
+	ConnConfig
+	// Speed is the ratio of the replay speed to the captured one, events are
+	// applied as soon as possible if it is not positive.
+	Speed float64
+	// DryRun logs events (and passes them to the sink) instead of applying
+	// them.
+	DryRun bool
+	// SkipGaps stops replaying a session at its first gap of data lost in the
+	// capture, the gap is only warned otherwise.
+	SkipGaps bool
+	Logger   *zap.Logger
+	Sink     Sink
+}
+
+// Replayer replays sessions concurrently, events of a session are applied in
+// order on a connection of its own and are paced by the capture time.
+type Replayer struct {
+	cfg Config
+	log *zap.Logger
+
+	playStart int64
+	origStart int64
+}
+
+func New(cfg Config) *Replayer {
+	log := cfg.Logger
+	if log == nil {
+		log = zap.L()
+	}
+	return &Replayer{cfg: cfg, log: log}
+}
+
+// Run replays all sessions of src and waits for them, it stops once ctx is
+// done.
+func (r *Replayer) Run(ctx context.Context, src Source) error {
+	if !r.cfg.DryRun && r.cfg.Target == nil {
+		return errors.New("no target to replay against")
+	}
+	sessions, err := src.Sessions(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Start < sessions[j].Start })
+	r.playStart = time.Now().UnixNano() / int64(time.Millisecond)
+	if len(sessions) > 0 {
+		r.origStart = sessions[0].Start
+	}
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		if !r.sleep(ctx, s.Start) {
+			break
+		}
+		wg.Add(1)
+		go func(s Session) {
+			defer wg.Done()
+			r.play(ctx, src, s)
+		}(s)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// sleep waits until the event at t is due, it returns false if ctx is done.
+func (r *Replayer) sleep(ctx context.Context, t int64) bool {
+	if r.cfg.Speed <= 0 {
+		return ctx.Err() == nil
+	}
+	d := time.Duration((float64(t-r.origStart)/r.cfg.Speed+float64(r.playStart))*float64(time.Millisecond) - float64(time.Now().UnixNano()))
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (r *Replayer) play(ctx context.Context, src Source, s Session) {
+	log := r.log.Named(fmt.Sprintf("%016x", s.ID))
+	in, err := src.Open(ctx, s)
+	if err != nil {
+		log.Error("failed to open session", zap.String("name", s.Name), zap.Error(err))
+		return
+	}
+	defer in.Close()
+	conn := NewConn(r.cfg.ConnConfig, s.ID, log)
+	defer conn.Close()
+	defer r.cfg.Stats.SetLagging(s.ID, 0)
+	e := event.MySQLEvent{Params: []interface{}{}}
+	for {
+		if err = in.Read(&e); err == io.EOF {
+			return
+		} else if err != nil {
+			log.Error("failed to read event", zap.Error(err))
+			return
+		}
+		if !r.sleep(ctx, e.Time) {
+			return
+		}
+		if r.cfg.Speed > 0 {
+			lag := time.Now().UnixNano()/int64(time.Millisecond) - r.playStart - int64(float64(e.Time-r.origStart)/r.cfg.Speed)
+			r.cfg.Stats.SetLagging(s.ID, time.Duration(lag)*time.Millisecond)
+		}
+		var res Result
+		if e.Type == event.EventGap && r.cfg.SkipGaps {
+			log.Warn("skip the rest of the session due to data lost in capture", zap.Uint64("bytes", e.Gap))
+			return
+		} else if r.cfg.DryRun {
+			log.Info(e.String())
+		} else if res, err = conn.Apply(ctx, &e); err == ErrUnknownEvent {
+			log.Warn("unknown event", zap.Any("value", e))
+			continue
+		} else if err == ErrGap {
+			log.Warn("data lost in capture, events around it may be corrupted", zap.Uint64("bytes", e.Gap))
+			continue
+		} else if mismatch, ok := err.(*AffectedRowsError); ok {
+			log.Warn("affected rows mismatch", zap.String("query", res.Query), zap.Uint64("expected", mismatch.Expected), zap.Int64("actual", mismatch.Actual))
+		} else if err != nil && !IsConnError(err) {
+			log.Warn("failed to apply "+e.String(), zap.Error(err))
+		}
+		if r.cfg.Sink != nil {
+			r.cfg.Sink.OnResult(s, &e, res, err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package replay
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/mysql-replay/event"
+)
+
+func TestParseSessionName(t *testing.T) {
+	s, err := ParseSessionName("1000.2000.000000000000000c.tsv", event.FormatTSV)
+	require.NoError(t, err)
+	require.Equal(t, Session{ID: 12, Start: 1000, End: 2000, Name: "1000.2000.000000000000000c.tsv"}, s)
+
+	_, err = ParseSessionName("1000.2000.000000000000000c.json", event.FormatTSV)
+	require.Equal(t, ErrNotSession, err)
+	_, err = ParseSessionName("index.json", event.FormatJSON)
+	require.Equal(t, ErrNotSession, err)
+	_, err = ParseSessionName("x.2000.000000000000000c.tsv", event.FormatTSV)
+	require.Error(t, err)
+	require.NotEqual(t, ErrNotSession, err)
+}
+
+func TestSessionQueries(t *testing.T) {
+	for _, tt := range []struct {
+		query string
+		db    string
+		use   bool
+		set   bool
+	}{
+		{"use test", "test", true, false},
+		{" USE `a``b`; ", "a`b", true, false},
+		{"use a b", "", false, false},
+		{"set names utf8mb4", "", false, true},
+		{"SET @@session.sql_mode = ''", "", false, true},
+		{"set global max_connections = 10", "", false, false},
+		{"set transaction isolation level read committed", "", false, false},
+		{"set @@tidb_isolation_read_engines = 'tikv'", "", false, true},
+		{"set config tikv `split.qps-threshold` = 1000", "", false, false},
+		{"select 1", "", false, false},
+	} {
+		db, ok := ParseUseQuery(tt.query)
+		require.Equal(t, tt.use, ok, tt.query)
+		require.Equal(t, tt.db, db, tt.query)
+		require.Equal(t, tt.set, IsSessionSet(tt.query), tt.query)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1000.1001.0000000000000001.tsv"), []byte("1000\t0\t\"test\"\n1001\t2\t\"select 1\"\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1000.1000.0000000000000002.tsv"), []byte("1000\t2\t\"select 2\"\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "readme.txt"), []byte("not a session"), 0644))
+
+	src := NewDirSource(dir, event.FormatTSV, 0)
+	sessions, err := src.Sessions(context.Background())
+	require.NoError(t, err)
+	require.Len(t, sessions, 2)
+
+	var (
+		events = make(chan string, 4)
+		sink   = SinkFunc(func(s Session, e *event.MySQLEvent, res Result, err error) { events <- e.String() })
+	)
+	require.NoError(t, New(Config{DryRun: true, Sink: sink}).Run(context.Background(), src))
+	close(events)
+	var actual []string
+	for e := range events {
+		actual = append(actual, e)
+	}
+	require.ElementsMatch(t, []string{`connect {db:"test"} @1000`, `execute {query:"select 1"} @ 1001`, `execute {query:"select 2"} @ 1000`}, actual)
+}
+
+func TestSkipGaps(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "1000.1002.0000000000000001.tsv"), []byte("1000\t2\t\"select 1\"\n1001\t8\t20\n1002\t2\t\"select 2\"\n"), 0644))
+
+	for _, skip := range []bool{false, true} {
+		var actual []string
+		sink := SinkFunc(func(s Session, e *event.MySQLEvent, res Result, err error) { actual = append(actual, e.String()) })
+		require.NoError(t, New(Config{DryRun: true, SkipGaps: skip, Sink: sink}).Run(context.Background(), NewDirSource(dir, event.FormatTSV, 0)))
+		if skip {
+			require.Equal(t, []string{`execute {query:"select 1"} @ 1000`}, actual)
+		} else {
+			require.Equal(t, []string{`execute {query:"select 1"} @ 1000`, `gap {bytes:20} @1001`, `execute {query:"select 2"} @ 1002`}, actual)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package replay
+
+import (
+	"strings"
+
+	"github.com/zyguan/mysql-replay/event"
+)
+
+// collationNames maps collation ids sent in handshakes to names, only common
+// ones are listed since the driver rejects unknown names anyway.
+var collationNames = map[uint64]string{
+	8:   "latin1_swedish_ci",
+	28:  "gbk_chinese_ci",
+	33:  "utf8_general_ci",
+	45:  "utf8mb4_general_ci",
+	46:  "utf8mb4_bin",
+	47:  "latin1_bin",
+	48:  "latin1_general_ci",
+	63:  "binary",
+	83:  "utf8_bin",
+	87:  "gbk_bin",
+	192: "utf8_unicode_ci",
+	224: "utf8mb4_unicode_ci",
+	255: "utf8mb4_0900_ai_ci",
+}
+
+// CollationName returns the name of the collation id, or "" if unknown.
+func CollationName(id uint64) string { return collationNames[id] }
+
+// CharsetOfCollation returns the character set of the collation.
+func CharsetOfCollation(name string) string {
+	if i := strings.IndexByte(name, '_'); i > 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// IsSessionSet tells whether the query changes the state of the session,
+// which is re-applied when the connection is re-established. TiDB's `SET
+// CONFIG` changes configs of the cluster and is not a session set either.
+func IsSessionSet(query string) bool {
+	q := strings.TrimSpace(query)
+	if len(q) < 4 || !strings.EqualFold(q[:4], "set ") {
+		return false
+	}
+	rest := strings.TrimSpace(q[4:])
+	for _, prefix := range []string{"transaction ", "password", "global ", "@@global.", "persist", "config "} {
+		if len(rest) >= len(prefix) && strings.EqualFold(rest[:len(prefix)], prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseUseQuery returns the database of a `USE db` statement.
+func ParseUseQuery(query string) (string, bool) {
+	q := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(query), ";"))
+	if len(q) < 5 || !strings.EqualFold(q[:4], "use ") {
+		return "", false
+	}
+	db := strings.TrimSpace(q[4:])
+	if len(db) > 1 && db[0] == '`' && db[len(db)-1] == '`' {
+		return strings.ReplaceAll(db[1:len(db)-1], "``", "`"), true
+	}
+	if strings.ContainsAny(db, " \t`") {
+		return "", false
+	}
+	return db, true
+}
+
+// sessionVars keeps the latest SET statements (grouped by digest) of the
+// session in the order they were first seen.
+type sessionVars struct {
+	keys    []string
+	queries map[string]string
+}
+
+func (sv *sessionVars) Record(query string) {
+	if sv.queries == nil {
+		sv.queries = make(map[string]string)
+	}
+	key := event.Digest(query)
+	if _, ok := sv.queries[key]; !ok {
+		sv.keys = append(sv.keys, key)
+	}
+	sv.queries[key] = query
+}
+
+func (sv *sessionVars) Reset() {
+	sv.keys, sv.queries = sv.keys[:0], nil
+}
+
+func (sv *sessionVars) Queries() []string {
+	out := make([]string, 0, len(sv.keys))
+	for _, key := range sv.keys {
+		out = append(out, sv.queries[key])
+	}
+	return out
+}
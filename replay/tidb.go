@@ -0,0 +1,53 @@
+package replay
+
+import (
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+)
+
+// tidbRetryableErrors are errors of TiDB which are transient and safe to retry
+// the statement on, e.g. write conflicts and region unavailable.
+var tidbRetryableErrors = map[uint16]bool{
+	8002: true, // can not retry select for update statement
+	8022: true, // transaction commit failed, retryable
+	8028: true, // information schema changed
+	9001: true, // pd server timeout
+	9002: true, // tikv server timeout
+	9005: true, // region unavailable
+	9007: true, // write conflict
+}
+
+// tidbIncompatibleErrors are errors returned by TiDB for syntax or features it
+// doesn't support, statements failed with them are likely fine on MySQL.
+var tidbIncompatibleErrors = map[uint16]bool{
+	1064: true, // syntax error
+	1193: true, // unknown system variable
+	1235: true, // not supported yet
+	1305: true, // function does not exist
+	1548: true, // cannot load from mysql.proc
+	8108: true, // unsupported type
+	8200: true, // unsupported ddl
+	8214: true, // unsupported operation
+}
+
+// TiDBRetryable tells whether a statement failed with the error code is safe
+// to retry on TiDB.
+func TiDBRetryable(code uint16) bool { return tidbRetryableErrors[code] }
+
+// TiDBIncompatible tells whether the error code indicates syntax or features
+// not supported by TiDB.
+func TiDBIncompatible(code uint16) bool { return tidbIncompatibleErrors[code] }
+
+// IsTiDBRetryable tells whether err is a retryable error of TiDB, it can be
+// used as ConnConfig.Retry.
+func IsTiDBRetryable(err error) bool {
+	myErr, ok := errors.Cause(err).(*mysql.MySQLError)
+	return ok && TiDBRetryable(myErr.Number)
+}
+
+// IsTiDBIncompatible tells whether err is caused by syntax or features not
+// supported by TiDB.
+func IsTiDBIncompatible(err error) bool {
+	myErr, ok := errors.Cause(err).(*mysql.MySQLError)
+	return ok && TiDBIncompatible(myErr.Number)
+}
@@ -0,0 +1,1020 @@
+package replay
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/event"
+	"go.uber.org/zap"
+)
+
+// RawDriverName is the name of the registered RawDriver.
+const RawDriverName = "raw"
+
+func init() {
+	RegisterDriver(RawDriverName, RawDriver{})
+}
+
+// RawDriver speaks the mysql client protocol directly instead of going
+// through database/sql, so that commands are sent as they were captured:
+// statements are prepared and executed once per event (statement ids match
+// the captured ones as long as the connection was not re-established), params
+// are sent with their captured types, fetches of stmts are replayed by
+// server-side cursors and connections are closed by COM_QUIT. TLS and LOAD
+// DATA LOCAL INFILE are not supported.
+type RawDriver struct {
+	// Capture tells whether to keep the packets received for each command,
+	// which are returned by results via RawResponse.
+	Capture bool
+}
+
+// RawResponse is implemented by results of drivers capturing responses,
+// Response returns the packets (headers included) received for the command.
+type RawResponse interface {
+	Response() []byte
+}
+
+// CursorStmt is implemented by TargetStmts supporting server-side cursors,
+// ExecCursor executes the stmt with the captured cursor type flags and Fetch
+// fetches rows from the cursor opened by the last execution.
+type CursorStmt interface {
+	ExecCursor(ctx context.Context, params []interface{}, types []uint16, flags byte) (sql.Result, error)
+	Fetch(ctx context.Context, rows uint32) (sql.Result, error)
+}
+
+// TypedStmt is implemented by TargetStmts sending params with the captured
+// mysql types rather than the ones inferred from go values.
+type TypedStmt interface {
+	ExecTyped(ctx context.Context, params []interface{}, types []uint16) (sql.Result, error)
+}
+
+// PingConn is implemented by TargetConns able to ping the server (e.g. by
+// COM_PING), other connections are pinged by SELECT 1.
+type PingConn interface {
+	Ping(ctx context.Context) error
+}
+
+const (
+	comQuit        = 0x01
+	comQuery       = 0x03
+	comPing        = 0x0e
+	comStmtPrepare = 0x16
+	comStmtExecute = 0x17
+	comStmtClose   = 0x19
+	comStmtFetch   = 0x1c
+
+	maxPayloadLen = 1<<24 - 1
+
+	clientLongPassword    = 0x00000001
+	clientFoundRows       = 0x00000002
+	clientLongFlag        = 0x00000004
+	clientConnectWithDB   = 0x00000008
+	clientProtocol41      = 0x00000200
+	clientTransactions    = 0x00002000
+	clientSecureConn      = 0x00008000
+	clientMultiStatements = 0x00010000
+	clientMultiResults    = 0x00020000
+	clientPSMultiResults  = 0x00040000
+	clientPluginAuth      = 0x00080000
+
+	statusMoreResults  = 0x0008
+	statusCursorExists = 0x0040
+	statusLastRowSent  = 0x0080
+
+	cursorTypeReadOnly = 0x01
+
+	defaultCollationID = 45 // utf8mb4_general_ci
+)
+
+func (RawDriver) Executor() string { return "mysql-wire" }
+
+func (d RawDriver) Connect(ctx context.Context, cfg *mysql.Config) (TargetConn, error) {
+	if len(cfg.TLSConfig) > 0 && cfg.TLSConfig != "false" {
+		return nil, errors.New("tls is not supported by the raw driver")
+	}
+	network, addr := cfg.Net, cfg.Addr
+	if len(network) == 0 {
+		network = "tcp"
+	}
+	if len(addr) == 0 {
+		addr = "127.0.0.1:3306"
+	}
+	dialer := net.Dialer{Timeout: cfg.Timeout}
+	nc, err := dialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c := &wireConn{cfg: cfg, nc: nc, r: bufio.NewReaderSize(nc, 16384), capture: d.Capture}
+	if err = c.handshake(ctx); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	// params are session variables like what go-sql-driver does
+	keys := make([]string, 0, len(cfg.Params))
+	for k := range cfg.Params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		query := "SET " + k + "=" + cfg.Params[k]
+		if k == "charset" {
+			query = "SET NAMES " + strings.Split(cfg.Params[k], ",")[0]
+		}
+		if _, err = c.Exec(ctx, query); err != nil {
+			c.nc.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+type wireConn struct {
+	cfg     *mysql.Config
+	nc      net.Conn
+	r       *bufio.Reader
+	seq     byte
+	broken  bool
+	capture bool
+	resp    []byte
+}
+
+type wireResult struct {
+	affectedRows uint64
+	insertID     uint64
+	response     []byte
+}
+
+func (r wireResult) LastInsertId() (int64, error) { return int64(r.insertID), nil }
+
+func (r wireResult) RowsAffected() (int64, error) { return int64(r.affectedRows), nil }
+
+func (r wireResult) Response() []byte { return r.response }
+
+// begin starts a command, the deadline of the connection follows ctx and is
+// reset by the returned function.
+func (c *wireConn) begin(ctx context.Context) (func(), error) {
+	if c.broken {
+		return nil, mysql.ErrInvalidConn
+	}
+	c.seq = 0
+	c.resp = nil
+	deadline, ok := ctx.Deadline()
+	if !ok && c.cfg.ReadTimeout > 0 {
+		deadline = time.Now().Add(c.cfg.ReadTimeout)
+	}
+	c.nc.SetDeadline(deadline)
+	reset := func() { c.nc.SetDeadline(time.Time{}) }
+	done := ctx.Done()
+	if done == nil {
+		return reset, nil
+	}
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			c.nc.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	return func() { close(stop); reset() }, nil
+}
+
+// fail marks the connection broken on io errors, after which the stream is
+// out of sync.
+func (c *wireConn) fail(ctx context.Context, err error) error {
+	c.broken = true
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	zap.L().Debug("raw connection is broken", zap.Error(err))
+	return mysql.ErrInvalidConn
+}
+
+func (c *wireConn) readPacket() ([]byte, error) {
+	var payload []byte
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(c.r, header[:]); err != nil {
+			return nil, err
+		}
+		n := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+		if header[3] != c.seq {
+			return nil, errors.Errorf("packets out of order: expect %d, got %d", c.seq, header[3])
+		}
+		c.seq++
+		start := len(payload)
+		payload = append(payload, make([]byte, n)...)
+		if _, err := io.ReadFull(c.r, payload[start:]); err != nil {
+			return nil, err
+		}
+		if c.capture {
+			c.resp = append(append(c.resp, header[:]...), payload[start:]...)
+		}
+		if n < maxPayloadLen {
+			if len(payload) == 0 {
+				return nil, errors.New("unexpected empty packet")
+			}
+			return payload, nil
+		}
+	}
+}
+
+func (c *wireConn) writePacket(payload []byte) error {
+	for {
+		n := len(payload)
+		if n > maxPayloadLen {
+			n = maxPayloadLen
+		}
+		buf := make([]byte, 4, 4+n)
+		buf[0], buf[1], buf[2], buf[3] = byte(n), byte(n>>8), byte(n>>16), c.seq
+		c.seq++
+		if _, err := c.nc.Write(append(buf, payload[:n]...)); err != nil {
+			return err
+		}
+		payload = payload[n:]
+		if n < maxPayloadLen {
+			return nil
+		}
+	}
+}
+
+// command sends a command and reads its first response packet.
+func (c *wireConn) command(ctx context.Context, payload []byte, reply bool) ([]byte, error) {
+	if err := c.writePacket(payload); err != nil {
+		return nil, c.fail(ctx, err)
+	}
+	if !reply {
+		return nil, nil
+	}
+	data, err := c.readPacket()
+	if err != nil {
+		return nil, c.fail(ctx, err)
+	}
+	return data, nil
+}
+
+func (c *wireConn) handshake(ctx context.Context) error {
+	end, _ := c.begin(ctx)
+	defer end()
+	data, err := c.readPacket()
+	if err != nil {
+		return errors.Annotate(err, "read handshake")
+	}
+	if data[0] == 0xff {
+		return parseErrPacket(data)
+	} else if data[0] != 10 {
+		return errors.Errorf("unsupported protocol version %d", data[0])
+	}
+	r := wireReader{data: data, pos: 1}
+	r.nullStr() // server version
+	r.skip(4)   // connection id
+	scramble := append([]byte{}, r.next(8)...)
+	r.skip(1)
+	caps := uint32(r.uint16())
+	plugin := "mysql_native_password"
+	if r.more() {
+		r.skip(3) // charset & status
+		caps |= uint32(r.uint16()) << 16
+		n := int(r.byte())
+		r.skip(10)
+		if caps&clientSecureConn > 0 {
+			if n -= 8; n < 13 {
+				n = 13
+			}
+			scramble = append(scramble, r.next(n-1)...)
+			r.skip(1)
+		}
+		if caps&clientPluginAuth > 0 {
+			plugin = r.nullStr()
+		}
+	}
+	if r.err != nil {
+		return errors.Annotate(r.err, "read handshake")
+	}
+	if caps&clientProtocol41 == 0 {
+		return errors.New("server does not support protocol 41")
+	}
+
+	flags := uint32(clientLongPassword | clientLongFlag | clientProtocol41 | clientTransactions |
+		clientSecureConn | clientMultiResults | clientPSMultiResults | clientPluginAuth)
+	if c.cfg.ClientFoundRows {
+		flags |= clientFoundRows
+	}
+	if c.cfg.MultiStatements {
+		flags |= clientMultiStatements
+	}
+	if len(c.cfg.DBName) > 0 {
+		flags |= clientConnectWithDB
+	}
+	flags &= caps | clientProtocol41
+	auth, err := c.authResponse(plugin, scramble)
+	if err != nil {
+		return err
+	}
+	collation := byte(defaultCollationID)
+	for id, name := range collationNames {
+		if name == c.cfg.Collation {
+			collation = byte(id)
+		}
+	}
+	buf := make([]byte, 32, 128)
+	binary.LittleEndian.PutUint32(buf, flags)
+	binary.LittleEndian.PutUint32(buf[4:], maxPayloadLen)
+	buf[8] = collation
+	buf = append(append(buf, c.cfg.User...), 0)
+	buf = append(append(buf, byte(len(auth))), auth...)
+	if flags&clientConnectWithDB > 0 {
+		buf = append(append(buf, c.cfg.DBName...), 0)
+	}
+	buf = append(append(buf, plugin...), 0)
+	if err = c.writePacket(buf); err != nil {
+		return errors.Annotate(err, "write handshake response")
+	}
+	return c.auth(plugin, scramble)
+}
+
+func (c *wireConn) authResponse(plugin string, scramble []byte) ([]byte, error) {
+	pass := []byte(c.cfg.Passwd)
+	if len(pass) > 0 && len(scramble) < 20 {
+		return nil, errors.New("invalid scramble from the server")
+	}
+	switch plugin {
+	case "mysql_native_password":
+		if len(pass) == 0 {
+			return nil, nil
+		}
+		h1 := sha1.Sum(pass)
+		h2 := sha1.Sum(h1[:])
+		h := sha1.New()
+		h.Write(scramble[:20])
+		h.Write(h2[:])
+		return xorBytes(h.Sum(nil), h1[:]), nil
+	case "caching_sha2_password":
+		if len(pass) == 0 {
+			return nil, nil
+		}
+		h1 := sha256.Sum256(pass)
+		h2 := sha256.Sum256(h1[:])
+		h := sha256.New()
+		h.Write(h2[:])
+		h.Write(scramble[:20])
+		return xorBytes(h1[:], h.Sum(nil)), nil
+	}
+	return nil, errors.Errorf("auth plugin %s is not supported by the raw driver", plugin)
+}
+
+// auth reads the result of authentication, following auth switches and the
+// full authentication of caching_sha2_password via the server public key.
+func (c *wireConn) auth(plugin string, scramble []byte) error {
+	for {
+		data, err := c.readPacket()
+		if err != nil {
+			return errors.Annotate(err, "read auth result")
+		}
+		switch data[0] {
+		case 0x00:
+			return nil
+		case 0xff:
+			return parseErrPacket(data)
+		case 0xfe:
+			r := wireReader{data: data, pos: 1}
+			plugin = r.nullStr()
+			scramble = append([]byte{}, r.rest()...)
+			if n := len(scramble); n > 0 && scramble[n-1] == 0 {
+				scramble = scramble[:n-1]
+			}
+			auth, err := c.authResponse(plugin, scramble)
+			if err != nil {
+				return err
+			}
+			if err = c.writePacket(auth); err != nil {
+				return errors.Trace(err)
+			}
+		case 0x01:
+			if plugin != "caching_sha2_password" || len(data) < 2 {
+				return errors.Errorf("unexpected auth data for %s", plugin)
+			}
+			switch data[1] {
+			case 3: // fast auth succeeded, an ok packet follows
+			case 4:
+				if err = c.writePacket([]byte{2}); err != nil {
+					return errors.Trace(err)
+				}
+				data, err = c.readPacket()
+				if err != nil {
+					return errors.Annotate(err, "read public key")
+				}
+				block, _ := pem.Decode(data[1:])
+				if block == nil {
+					return errors.New("invalid public key of the server")
+				}
+				pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				key, ok := pub.(*rsa.PublicKey)
+				if !ok {
+					return errors.New("public key of the server is not rsa")
+				}
+				enc, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, key, xorBytes(append([]byte(c.cfg.Passwd), 0), scramble), nil)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				if err = c.writePacket(enc); err != nil {
+					return errors.Trace(err)
+				}
+			default:
+				return errors.Errorf("unexpected auth state %d of %s", data[1], plugin)
+			}
+		default:
+			return errors.Errorf("unexpected auth packet 0x%02x", data[0])
+		}
+	}
+}
+
+func (c *wireConn) Exec(ctx context.Context, query string) (sql.Result, error) {
+	end, err := c.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	data, err := c.command(ctx, append([]byte{comQuery}, query...), true)
+	if err != nil {
+		return nil, err
+	}
+	res, _, err := c.readResults(ctx, data)
+	return res, err
+}
+
+// readResults reads results of a command whose first response packet is
+// data, it returns the status of the last result.
+func (c *wireConn) readResults(ctx context.Context, data []byte) (sql.Result, uint16, error) {
+	var (
+		res    wireResult
+		status uint16
+		err    error
+	)
+	for {
+		switch data[0] {
+		case 0x00:
+			r := wireReader{data: data, pos: 1}
+			res.affectedRows = r.lenInt()
+			res.insertID = r.lenInt()
+			status = r.uint16()
+		case 0xff:
+			res.response = c.resp
+			return res, 0, parseErrPacket(data)
+		case 0xfb:
+			// reject LOAD DATA LOCAL INFILE by sending no content
+			if err = c.writePacket(nil); err != nil {
+				return nil, 0, c.fail(ctx, err)
+			}
+			if data, err = c.readPacket(); err != nil {
+				return nil, 0, c.fail(ctx, err)
+			}
+			continue
+		default:
+			r := wireReader{data: data}
+			n := r.lenInt()
+			if r.err != nil {
+				return nil, 0, c.fail(ctx, r.err)
+			}
+			if status, err = c.skipPackets(ctx, int(n)); err != nil {
+				return nil, 0, err
+			}
+			if status&statusCursorExists == 0 {
+				if status, err = c.readRows(ctx); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+		if status&statusMoreResults == 0 {
+			res.response = c.resp
+			return res, status, nil
+		}
+		if data, err = c.readPacket(); err != nil {
+			return nil, 0, c.fail(ctx, err)
+		}
+	}
+}
+
+// skipPackets skips n definitions followed by an eof packet, it returns the
+// status in the eof packet.
+func (c *wireConn) skipPackets(ctx context.Context, n int) (uint16, error) {
+	for i := 0; i < n; i++ {
+		if _, err := c.readPacket(); err != nil {
+			return 0, c.fail(ctx, err)
+		}
+	}
+	data, err := c.readPacket()
+	if err != nil {
+		return 0, c.fail(ctx, err)
+	}
+	if !isEOFPacket(data) {
+		return 0, c.fail(ctx, errors.Errorf("expect eof packet, got 0x%02x", data[0]))
+	}
+	return binary.LittleEndian.Uint16(data[3:]), nil
+}
+
+// readRows drains rows until the ending eof packet, it returns the status in
+// the eof packet.
+func (c *wireConn) readRows(ctx context.Context) (uint16, error) {
+	for {
+		data, err := c.readPacket()
+		if err != nil {
+			return 0, c.fail(ctx, err)
+		}
+		if isEOFPacket(data) {
+			return binary.LittleEndian.Uint16(data[3:]), nil
+		} else if data[0] == 0xff {
+			return 0, parseErrPacket(data)
+		}
+	}
+}
+
+func (c *wireConn) Ping(ctx context.Context) error {
+	end, err := c.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer end()
+	data, err := c.command(ctx, []byte{comPing}, true)
+	if err != nil {
+		return err
+	}
+	if data[0] == 0xff {
+		return parseErrPacket(data)
+	} else if data[0] != 0x00 {
+		return c.fail(ctx, errors.Errorf("unexpected ping response 0x%02x", data[0]))
+	}
+	return nil
+}
+
+func (c *wireConn) Prepare(ctx context.Context, query string) (TargetStmt, error) {
+	end, err := c.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	data, err := c.command(ctx, append([]byte{comStmtPrepare}, query...), true)
+	if err != nil {
+		return nil, err
+	}
+	if data[0] == 0xff {
+		return nil, parseErrPacket(data)
+	} else if data[0] != 0x00 || len(data) < 12 {
+		return nil, c.fail(ctx, errors.Errorf("unexpected prepare response 0x%02x", data[0]))
+	}
+	stmt := &wireStmt{
+		c:      c,
+		id:     binary.LittleEndian.Uint32(data[1:]),
+		cols:   int(binary.LittleEndian.Uint16(data[5:])),
+		params: int(binary.LittleEndian.Uint16(data[7:])),
+	}
+	if stmt.params > 0 {
+		if _, err = c.skipPackets(ctx, stmt.params); err != nil {
+			return nil, err
+		}
+	}
+	if stmt.cols > 0 {
+		if _, err = c.skipPackets(ctx, stmt.cols); err != nil {
+			return nil, err
+		}
+	}
+	return stmt, nil
+}
+
+// Close sends COM_QUIT and closes the connection.
+func (c *wireConn) Close() error {
+	if !c.broken {
+		c.nc.SetDeadline(time.Now().Add(time.Second))
+		c.seq = 0
+		c.writePacket([]byte{comQuit})
+	}
+	c.broken = true
+	return c.nc.Close()
+}
+
+type wireStmt struct {
+	c      *wireConn
+	id     uint32
+	cols   int
+	params int
+}
+
+func (s *wireStmt) Exec(ctx context.Context, args []interface{}) (sql.Result, error) {
+	return s.ExecTyped(ctx, args, nil)
+}
+
+func (s *wireStmt) ExecTyped(ctx context.Context, params []interface{}, types []uint16) (sql.Result, error) {
+	return s.ExecCursor(ctx, params, types, 0)
+}
+
+func (s *wireStmt) ExecCursor(ctx context.Context, params []interface{}, types []uint16, flags byte) (sql.Result, error) {
+	if len(params) != s.params {
+		return nil, errors.Errorf("expect %d params, got %d", s.params, len(params))
+	}
+	if len(types) > 0 && len(types) != len(params) {
+		return nil, errors.Errorf("%d param types for %d params", len(types), len(params))
+	}
+	buf := make([]byte, 10, 64)
+	buf[0] = comStmtExecute
+	binary.LittleEndian.PutUint32(buf[1:], s.id)
+	buf[5] = flags
+	binary.LittleEndian.PutUint32(buf[6:], 1)
+	if len(params) > 0 {
+		var err error
+		if buf, err = appendParams(buf, params, types); err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+	end, err := s.c.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	data, err := s.c.command(ctx, buf, true)
+	if err != nil {
+		return nil, err
+	}
+	res, _, err := s.c.readResults(ctx, data)
+	return res, err
+}
+
+// Fetch sends COM_STMT_FETCH as captured, thus it fails like the server does
+// if no cursor is opened by the last execution.
+func (s *wireStmt) Fetch(ctx context.Context, rows uint32) (sql.Result, error) {
+	end, err := s.c.begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+	buf := make([]byte, 9)
+	buf[0] = comStmtFetch
+	binary.LittleEndian.PutUint32(buf[1:], s.id)
+	binary.LittleEndian.PutUint32(buf[5:], rows)
+	if _, err = s.c.command(ctx, buf, false); err != nil {
+		return nil, err
+	}
+	if _, err = s.c.readRows(ctx); err != nil {
+		return nil, err
+	}
+	return wireResult{response: s.c.resp}, nil
+}
+
+func (s *wireStmt) Close() error {
+	if s.c.broken {
+		return nil
+	}
+	s.c.seq = 0
+	buf := make([]byte, 5)
+	buf[0] = comStmtClose
+	binary.LittleEndian.PutUint32(buf[1:], s.id)
+	if err := s.c.writePacket(buf); err != nil {
+		s.c.broken = true
+		return errors.Trace(err)
+	}
+	return nil
+}
+
+// appendParams appends the null bitmap, types and values of params in the
+// binary protocol, types are inferred from values if absent.
+func appendParams(buf []byte, params []interface{}, types []uint16) ([]byte, error) {
+	n := len(params)
+	bitmap := len(buf)
+	buf = append(buf, make([]byte, (n+7)/8)...)
+	buf = append(buf, 1)
+	typePos := len(buf)
+	buf = append(buf, make([]byte, 2*n)...)
+	for i, param := range params {
+		var t uint16
+		if len(types) > 0 {
+			t = types[i]
+			val, err := event.BindParam(param, t, time.UTC)
+			if err != nil {
+				return nil, fmt.Errorf("bind params[%d]: %v", i, err)
+			}
+			param = val
+		} else {
+			t = inferType(param)
+		}
+		if param == nil {
+			buf[bitmap+i/8] |= 1 << (i % 8)
+			if len(types) == 0 {
+				t = event.TypeNULL
+			}
+		} else {
+			var err error
+			if buf, t, err = appendValue(buf, param, t); err != nil {
+				return nil, fmt.Errorf("encode params[%d]: %v", i, err)
+			}
+		}
+		buf[typePos+2*i], buf[typePos+2*i+1] = byte(t), byte(t>>8)
+	}
+	return buf, nil
+}
+
+func inferType(param interface{}) uint16 {
+	switch param.(type) {
+	case nil:
+		return event.TypeNULL
+	case bool:
+		return event.TypeTiny
+	case int64, int, int32, int16, int8:
+		return event.TypeLongLong
+	case uint64, uint, uint32, uint16, uint8:
+		return event.TypeLongLong | 0x8000
+	case float32:
+		return event.TypeFloat
+	case float64:
+		return event.TypeDouble
+	case time.Time:
+		return event.TypeDateTime
+	case []byte:
+		return event.TypeBLOB
+	}
+	return event.TypeVarString
+}
+
+// appendValue appends param encoded as the type t, it returns the type
+// actually used, which differs from t if param cannot be encoded as t (e.g.
+// invalid datetime strings are sent as strings).
+func appendValue(buf []byte, param interface{}, t uint16) ([]byte, uint16, error) {
+	var b [8]byte
+	switch t & 0xff {
+	case event.TypeTiny, event.TypeShort, event.TypeYear, event.TypeInt24, event.TypeLong, event.TypeLongLong:
+		var x uint64
+		switch v := param.(type) {
+		case int64:
+			x = uint64(v)
+		case uint64:
+			x = v
+		case bool:
+			if v {
+				x = 1
+			}
+		default:
+			i, err := strconv.ParseInt(fmt.Sprint(v), 10, 64)
+			if err != nil {
+				return nil, t, err
+			}
+			x = uint64(i)
+		}
+		binary.LittleEndian.PutUint64(b[:], x)
+		switch t & 0xff {
+		case event.TypeTiny:
+			return append(buf, b[0]), t, nil
+		case event.TypeShort, event.TypeYear:
+			return append(buf, b[:2]...), t, nil
+		case event.TypeInt24, event.TypeLong:
+			return append(buf, b[:4]...), t, nil
+		}
+		return append(buf, b[:]...), t, nil
+	case event.TypeFloat, event.TypeDouble:
+		var x float64
+		switch v := param.(type) {
+		case float64:
+			x = v
+		case float32:
+			x = float64(v)
+		default:
+			f, err := strconv.ParseFloat(fmt.Sprint(v), 64)
+			if err != nil {
+				return nil, t, err
+			}
+			x = f
+		}
+		if t&0xff == event.TypeFloat {
+			binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(x)))
+			return append(buf, b[:4]...), t, nil
+		}
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(x))
+		return append(buf, b[:]...), t, nil
+	case event.TypeDate, event.TypeNewDate, event.TypeDateTime, event.TypeTimestamp:
+		switch v := param.(type) {
+		case time.Time:
+			return appendDateTime(buf, v), t, nil
+		case string:
+			if strings.Trim(v, "0-: .") == "" {
+				return append(buf, 0), t, nil
+			}
+			return appendLenStr(buf, v), event.TypeVarString, nil
+		}
+	case event.TypeTime:
+		if s, ok := param.(string); ok {
+			if out, ok := appendTime(buf, s); ok {
+				return out, t, nil
+			}
+			return appendLenStr(buf, s), event.TypeVarString, nil
+		}
+	}
+	switch v := param.(type) {
+	case []byte:
+		return appendLenStr(buf, string(v)), t, nil
+	case string:
+		return appendLenStr(buf, v), t, nil
+	case time.Time:
+		return appendDateTime(buf, v), event.TypeDateTime, nil
+	}
+	return appendLenStr(buf, fmt.Sprint(param)), t, nil
+}
+
+func appendDateTime(buf []byte, t time.Time) []byte {
+	var b [12]byte
+	binary.LittleEndian.PutUint16(b[1:], uint16(t.Year()))
+	b[3], b[4], b[5], b[6], b[7] = byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second())
+	binary.LittleEndian.PutUint32(b[8:], uint32(t.Nanosecond()/1000))
+	switch {
+	case t.Nanosecond() >= 1000:
+		b[0] = 11
+	case t.Hour() != 0 || t.Minute() != 0 || t.Second() != 0:
+		b[0] = 7
+	default:
+		b[0] = 4
+	}
+	return append(buf, b[:1+b[0]]...)
+}
+
+// appendTime appends a time value like -838:59:59.000000 in the binary
+// protocol.
+func appendTime(buf []byte, s string) ([]byte, bool) {
+	var b [13]byte
+	if strings.HasPrefix(s, "-") {
+		b[1], s = 1, s[1:]
+	}
+	frac := ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		s, frac = s[:i], s[i+1:]
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return buf, false
+	}
+	var vals [3]uint64
+	for i, p := range parts {
+		v, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return buf, false
+		}
+		vals[i] = v
+	}
+	micro := uint64(0)
+	if len(frac) > 0 {
+		if len(frac) > 6 {
+			frac = frac[:6]
+		}
+		v, err := strconv.ParseUint(frac+strings.Repeat("0", 6-len(frac)), 10, 32)
+		if err != nil {
+			return buf, false
+		}
+		micro = v
+	}
+	binary.LittleEndian.PutUint32(b[2:], uint32(vals[0]/24))
+	b[6], b[7], b[8] = byte(vals[0]%24), byte(vals[1]), byte(vals[2])
+	binary.LittleEndian.PutUint32(b[9:], uint32(micro))
+	switch {
+	case micro > 0:
+		b[0] = 12
+	case b[1] > 0 || vals[0] > 0 || vals[1] > 0 || vals[2] > 0:
+		b[0] = 8
+	}
+	return append(buf, b[:1+b[0]]...), true
+}
+
+func appendLenStr(buf []byte, s string) []byte {
+	n := uint64(len(s))
+	switch {
+	case n < 251:
+		buf = append(buf, byte(n))
+	case n < 1<<16:
+		buf = append(buf, 0xfc, byte(n), byte(n>>8))
+	case n < 1<<24:
+		buf = append(buf, 0xfd, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], n)
+		buf = append(append(buf, 0xfe), b[:]...)
+	}
+	return append(buf, s...)
+}
+
+func isEOFPacket(data []byte) bool { return len(data) >= 5 && len(data) < 9 && data[0] == 0xfe }
+
+func parseErrPacket(data []byte) error {
+	r := wireReader{data: data, pos: 1}
+	e := &mysql.MySQLError{Number: r.uint16()}
+	if r.more() && r.data[r.pos] == '#' {
+		r.skip(1)
+		r.skip(5)
+	}
+	e.Message = string(r.rest())
+	if r.err != nil {
+		return errors.Annotate(r.err, "read err packet")
+	}
+	return e
+}
+
+func xorBytes(a []byte, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i%len(b)]
+	}
+	return out
+}
+
+// wireReader reads fields from a packet, the first error is kept in err and
+// later reads return zero values.
+type wireReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *wireReader) more() bool { return r.err == nil && r.pos < len(r.data) }
+
+func (r *wireReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.pos+n > len(r.data) {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	bs := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return bs
+}
+
+func (r *wireReader) skip(n int) { r.next(n) }
+
+func (r *wireReader) rest() []byte { return r.next(len(r.data) - r.pos) }
+
+func (r *wireReader) byte() byte {
+	if bs := r.next(1); len(bs) == 1 {
+		return bs[0]
+	}
+	return 0
+}
+
+func (r *wireReader) uint16() uint16 {
+	if bs := r.next(2); len(bs) == 2 {
+		return binary.LittleEndian.Uint16(bs)
+	}
+	return 0
+}
+
+func (r *wireReader) nullStr() string {
+	if r.err != nil {
+		return ""
+	}
+	for i := r.pos; i < len(r.data); i++ {
+		if r.data[i] == 0 {
+			s := string(r.data[r.pos:i])
+			r.pos = i + 1
+			return s
+		}
+	}
+	r.err = io.ErrUnexpectedEOF
+	return ""
+}
+
+func (r *wireReader) lenInt() uint64 {
+	switch b := r.byte(); b {
+	case 0xfc:
+		bs := r.next(2)
+		if len(bs) == 2 {
+			return uint64(binary.LittleEndian.Uint16(bs))
+		}
+	case 0xfd:
+		bs := r.next(3)
+		if len(bs) == 3 {
+			return uint64(bs[0]) | uint64(bs[1])<<8 | uint64(bs[2])<<16
+		}
+	case 0xfe:
+		bs := r.next(8)
+		if len(bs) == 8 {
+			return binary.LittleEndian.Uint64(bs)
+		}
+	default:
+		return uint64(b)
+	}
+	return 0
+}
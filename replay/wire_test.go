@@ -0,0 +1,183 @@
+package replay
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/mysql-replay/event"
+)
+
+// fakeServer serves a strip-down mysql server protocol, which returns a
+// single row for selects and stmt executes, and records commands received.
+type fakeServer struct {
+	l    net.Listener
+	cmds chan []byte
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &fakeServer{l: l, cmds: make(chan []byte, 64)}
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(nc)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *fakeServer) serve(nc net.Conn) {
+	defer nc.Close()
+	var (
+		r   = bufio.NewReader(nc)
+		seq byte
+	)
+	write := func(payload ...byte) {
+		nc.Write(append([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq}, payload...))
+		seq++
+	}
+	read := func() []byte {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil
+		}
+		payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+		io.ReadFull(r, payload)
+		seq = header[3] + 1
+		return payload
+	}
+	ok := func() { write(0, 1, 0, 0, 0, 0, 0) }
+	eof := func(status uint16) { write(0xfe, 0, 0, byte(status), byte(status>>8)) }
+	coldef := func() { write(3, 'd', 'e', 'f') }
+	greeting := append([]byte{10}, "8.0.0\x00"...)
+	greeting = append(greeting, 1, 0, 0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 0, 0xff, 0xff, 45, 2, 0, 0xff, 0x81, 21)
+	greeting = append(greeting, make([]byte, 10)...)
+	greeting = append(greeting, "9abcdefghijk\x00mysql_native_password\x00"...)
+	write(greeting...)
+	s.cmds <- read()
+	ok()
+	for {
+		cmd := read()
+		if cmd == nil {
+			return
+		}
+		s.cmds <- cmd
+		switch cmd[0] {
+		case comQuery:
+			write(1)
+			coldef()
+			eof(0)
+			write(1, '1')
+			eof(0)
+		case comStmtPrepare:
+			write(0, 1, 0, 0, 0, 1, 0, 1, 0, 0, 0, 0)
+			coldef()
+			eof(0)
+			coldef()
+			eof(0)
+		case comStmtExecute:
+			write(1)
+			coldef()
+			if cmd[5]&cursorTypeReadOnly > 0 {
+				eof(statusCursorExists)
+				continue
+			}
+			eof(0)
+			write(0, 0, 1)
+			eof(0)
+		case comStmtFetch:
+			write(0, 0, 1)
+			eof(statusLastRowSent)
+		case comQuit:
+			return
+		}
+	}
+}
+
+func TestRawDriver(t *testing.T) {
+	s := newFakeServer(t)
+	cfg := &mysql.Config{Net: "tcp", Addr: s.l.Addr().String(), User: "root", Passwd: "pass", DBName: "test"}
+	c := NewConn(ConnConfig{Target: cfg, Driver: RawDriver{Capture: true}}, 1, nil)
+	ctx := context.Background()
+
+	_, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventHandshake, DB: "test"})
+	require.NoError(t, err)
+	auth := <-s.cmds
+	require.Contains(t, string(auth), "root\x00")
+	require.Contains(t, string(auth), "test\x00mysql_native_password\x00")
+
+	res, err := c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuery, Query: "select 1"})
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{comQuery}, "select 1"...), <-s.cmds)
+	require.Len(t, res.Result.(RawResponse).Response(), 5*4+1+4+5+2+5)
+
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventStmtPrepare, StmtID: 1, Query: "select ?"})
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{comStmtPrepare}, "select ?"...), <-s.cmds)
+
+	exec := &event.MySQLEvent{Type: event.EventStmtExecute, StmtID: 1, Params: []interface{}{"7"}, ParamTypes: []uint16{event.TypeLong | 0x8000}}
+	executed := func(flags byte) []byte {
+		return []byte{comStmtExecute, 1, 0, 0, 0, flags, 1, 0, 0, 0, 0, 1, event.TypeLong, 0x80, 7, 0, 0, 0}
+	}
+	_, err = c.Apply(ctx, exec)
+	require.NoError(t, err)
+	require.Equal(t, executed(0), <-s.cmds)
+
+	// cursor flags are sent as captured and fetches are never executions
+	cursor := *exec
+	cursor.Cursor = cursorTypeReadOnly
+	_, err = c.Apply(ctx, &cursor)
+	require.NoError(t, err)
+	require.Equal(t, executed(cursorTypeReadOnly), <-s.cmds)
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventStmtFetch, StmtID: 1, Rows: 10})
+	require.NoError(t, err)
+	require.Equal(t, []byte{comStmtFetch, 1, 0, 0, 0, 10, 0, 0, 0}, <-s.cmds)
+	_, err = c.Apply(ctx, exec)
+	require.NoError(t, err)
+	require.Equal(t, executed(0), <-s.cmds)
+
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventStmtClose, StmtID: 1})
+	require.NoError(t, err)
+	require.Equal(t, []byte{comStmtClose, 1, 0, 0, 0}, <-s.cmds)
+	_, err = c.Apply(ctx, &event.MySQLEvent{Type: event.EventQuit})
+	require.NoError(t, err)
+	require.Equal(t, []byte{comQuit}, <-s.cmds)
+}
+
+func TestAppendParams(t *testing.T) {
+	buf, err := appendParams(nil, []interface{}{nil, int64(-1), 1.5, "2021-01-02 03:04:05", "-25:00:01", []byte("ab")}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte{
+		0x01, 1,
+		event.TypeNULL, 0, event.TypeLongLong, 0, event.TypeDouble, 0, event.TypeVarString, 0, event.TypeVarString, 0, event.TypeBLOB, 0,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0, 0, 0, 0, 0, 0, 0xf8, 0x3f,
+		19, '2', '0', '2', '1', '-', '0', '1', '-', '0', '2', ' ', '0', '3', ':', '0', '4', ':', '0', '5',
+		9, '-', '2', '5', ':', '0', '0', ':', '0', '1',
+		2, 'a', 'b',
+	}, buf)
+
+	buf, err = appendParams(nil, []interface{}{"2021-01-02 03:04:05", "-25:00:01", "0000-00-00"}, []uint16{event.TypeDateTime, event.TypeTime, event.TypeDate})
+	require.NoError(t, err)
+	year := make([]byte, 2)
+	binary.LittleEndian.PutUint16(year, 2021)
+	require.Equal(t, append(append([]byte{
+		0, 1,
+		event.TypeDateTime, 0, event.TypeTime, 0, event.TypeDate, 0,
+		7}, year...),
+		1, 2, 3, 4, 5,
+		8, 1, 1, 0, 0, 0, 1, 0, 1,
+		0,
+	), buf)
+}
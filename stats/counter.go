@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -17,13 +18,49 @@ const (
 	StmtPrepares = "stmt.prepares"
 	DataIn       = "data.in"
 	DataOut      = "data.out"
+	BgQueries    = "bg.queries"
+	Retries      = "retries"
+	// Gaps and GapBytes count holes of data lost in captured tcp streams.
+	Gaps              = "gaps"
+	GapBytes          = "gap.bytes"
+	OutOfOrderPackets = "packets.ooo"
+	TruncatedPackets  = "packets.truncated"
+	DroppedPackets    = "packets.dropped"
+	// AffectedRowsMismatches counts statements of which rows affected differ
+	// from the ones in the capture.
+	AffectedRowsMismatches = "affected.mismatches"
+	// MirrorCompared and MirrorDiffs count statements compared with the mirror
+	// of the target and the ones of different outcomes.
+	MirrorCompared = "mirror.compared"
+	MirrorDiffs    = "mirror.diffs"
+	// StmtEvictions counts prepared statements evicted from connections
+	// exceeding their cap of statements.
+	StmtEvictions = "stmt.evictions"
+	// Pings counts pings keeping idle connections alive, and Reconnects counts
+	// attempts of re-establishing lost connections.
+	Pings      = "pings"
+	Reconnects = "reconnects"
+	// TruncatedFetches counts result sets of which reading stopped at limits.
+	TruncatedFetches = "fetch.truncated"
+	// EventsPrefix prefixes counters of events by type (see EventCounter),
+	// SkippedCommands counts client commands not supported (and is also the
+	// prefix of counters by command), and UndecodedPackets counts packets
+	// failed to decode.
+	EventsPrefix     = "events."
+	SkippedCommands  = "commands.skipped"
+	UndecodedPackets = "packets.undecoded"
 
 	FailedQueries      = "err.queries"
 	FailedStmtExecutes = "err.stmt.executes"
 	FailedStmtPrepares = "err.stmt.prepares"
+	FailedBgQueries    = "err.bg.queries"
 )
 
-var (
+// Registry holds counters, laggings, failures, progresses, labeled series,
+// pacing and result sets fetched of a replay, thus replays in the same process can be tracked
+// separately. A nil *Registry is the Default one, on which functions of the
+// package operate.
+type Registry struct {
 	nPackets      int64
 	nQueries      int64
 	nStreams      int64
@@ -41,107 +78,170 @@ var (
 	nWaitingConns int64
 
 	laggings sync.Map
+	pendings sync.Map
 
-	metrics = []string{Packets, Queries, StmtExecutes, StmtPrepares, Streams, Connections, FailedQueries, FailedStmtExecutes, FailedStmtPrepares, ConnWaiting, ConnRunning}
-	others  = make(map[string]int64)
-	lock    sync.RWMutex
-)
+	others map[string]int64
+	lock   sync.RWMutex
+
+	failures    map[failureKey]*FailureGroup
+	failureLock sync.Mutex
+
+	progresses sync.Map
+
+	labeled     map[Labels]*labeledSeries
+	labeledLock sync.Mutex
+
+	pacing *Histogram
+	onTime int64
+
+	firstRow     *Histogram
+	fetch        *Histogram
+	fetchedRows  int64
+	fetchedBytes int64
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		others:   make(map[string]int64),
+		failures: make(map[failureKey]*FailureGroup),
+		labeled:  make(map[Labels]*labeledSeries),
+		pacing:   NewHistogram(),
+		firstRow: NewHistogram(),
+		fetch:    NewHistogram(),
+	}
+}
+
+// Default is the registry of package level functions.
+var Default = NewRegistry()
+
+var metrics = []string{Packets, Queries, StmtExecutes, StmtPrepares, Streams, Connections, FailedQueries, FailedStmtExecutes, FailedStmtPrepares, ConnWaiting, ConnRunning}
+
+// EventCounter returns the name of the counter of events of the type name.
+func EventCounter(typeName string) string {
+	return EventsPrefix + strings.ReplaceAll(typeName, " ", "_")
+}
+
+func (r *Registry) get() *Registry {
+	if r == nil {
+		return Default
+	}
+	return r
+}
 
-func Add(name string, delta int64) int64 {
+func Add(name string, delta int64) int64 { return Default.Add(name, delta) }
+
+func Get(name string) int64 { return Default.Get(name) }
+
+func Dump() map[string]int64 { return Default.Dump() }
+
+func SetLagging(c uint64, d time.Duration) { Default.SetLagging(c, d) }
+
+func GetLagging() time.Duration { return Default.GetLagging() }
+
+func SetPending(c uint64, n int64) { Default.SetPending(c, n) }
+
+func GetPending() (int64, int) { return Default.GetPending() }
+
+func (r *Registry) Add(name string, delta int64) int64 {
+	r = r.get()
 	switch name {
 	case Packets:
-		return atomic.AddInt64(&nPackets, delta)
+		return atomic.AddInt64(&r.nPackets, delta)
 	case DataIn:
-		return atomic.AddInt64(&nDataIn, delta)
+		return atomic.AddInt64(&r.nDataIn, delta)
 	case DataOut:
-		return atomic.AddInt64(&nDataOut, delta)
+		return atomic.AddInt64(&r.nDataOut, delta)
 	case ConnRunning:
-		return atomic.AddInt64(&nRunningConns, delta)
+		return atomic.AddInt64(&r.nRunningConns, delta)
 	case ConnWaiting:
-		return atomic.AddInt64(&nWaitingConns, delta)
+		return atomic.AddInt64(&r.nWaitingConns, delta)
 	case Queries:
-		return atomic.AddInt64(&nQueries, delta)
+		return atomic.AddInt64(&r.nQueries, delta)
 	case StmtExecutes:
-		return atomic.AddInt64(&nStmtExecutes, delta)
+		return atomic.AddInt64(&r.nStmtExecutes, delta)
 	case StmtPrepares:
-		return atomic.AddInt64(&nStmtPrepares, delta)
+		return atomic.AddInt64(&r.nStmtPrepares, delta)
 	case Streams:
-		return atomic.AddInt64(&nStreams, delta)
+		return atomic.AddInt64(&r.nStreams, delta)
 	case Connections:
-		return atomic.AddInt64(&nConns, delta)
+		return atomic.AddInt64(&r.nConns, delta)
 	case FailedQueries:
-		return atomic.AddInt64(&nErrQueries, delta)
+		return atomic.AddInt64(&r.nErrQueries, delta)
 	case FailedStmtExecutes:
-		return atomic.AddInt64(&nErrStmtExecutes, delta)
+		return atomic.AddInt64(&r.nErrStmtExecutes, delta)
 	case FailedStmtPrepares:
-		return atomic.AddInt64(&nErrStmtPrepares, delta)
+		return atomic.AddInt64(&r.nErrStmtPrepares, delta)
 	default:
-		lock.Lock()
-		defer lock.Unlock()
-		others[name] += delta
-		return others[name]
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		r.others[name] += delta
+		return r.others[name]
 	}
 }
 
-func Get(name string) int64 {
+func (r *Registry) Get(name string) int64 {
+	r = r.get()
 	switch name {
 	case Packets:
-		return atomic.LoadInt64(&nPackets)
+		return atomic.LoadInt64(&r.nPackets)
 	case DataIn:
-		return atomic.LoadInt64(&nDataIn)
+		return atomic.LoadInt64(&r.nDataIn)
 	case DataOut:
-		return atomic.LoadInt64(&nDataOut)
+		return atomic.LoadInt64(&r.nDataOut)
 	case ConnRunning:
-		return atomic.LoadInt64(&nRunningConns)
+		return atomic.LoadInt64(&r.nRunningConns)
 	case ConnWaiting:
-		return atomic.LoadInt64(&nWaitingConns)
+		return atomic.LoadInt64(&r.nWaitingConns)
 	case Queries:
-		return atomic.LoadInt64(&nQueries)
+		return atomic.LoadInt64(&r.nQueries)
 	case StmtExecutes:
-		return atomic.LoadInt64(&nStmtExecutes)
+		return atomic.LoadInt64(&r.nStmtExecutes)
 	case StmtPrepares:
-		return atomic.LoadInt64(&nStmtPrepares)
+		return atomic.LoadInt64(&r.nStmtPrepares)
 	case Streams:
-		return atomic.LoadInt64(&nStreams)
+		return atomic.LoadInt64(&r.nStreams)
 	case Connections:
-		return atomic.LoadInt64(&nConns)
+		return atomic.LoadInt64(&r.nConns)
 	case FailedQueries:
-		return atomic.LoadInt64(&nErrQueries)
+		return atomic.LoadInt64(&r.nErrQueries)
 	case FailedStmtExecutes:
-		return atomic.LoadInt64(&nErrStmtExecutes)
+		return atomic.LoadInt64(&r.nErrStmtExecutes)
 	case FailedStmtPrepares:
-		return atomic.LoadInt64(&nErrStmtPrepares)
+		return atomic.LoadInt64(&r.nErrStmtPrepares)
 	default:
-		lock.RLock()
-		defer lock.RUnlock()
-		return others[name]
+		r.lock.RLock()
+		defer r.lock.RUnlock()
+		return r.others[name]
 	}
 }
 
-func Dump() map[string]int64 {
-	out := make(map[string]int64, len(metrics)+len(others))
+func (r *Registry) Dump() map[string]int64 {
+	r = r.get()
+	out := make(map[string]int64, len(metrics)+len(r.others))
 	for _, name := range metrics {
-		out[name] = Get(name)
+		out[name] = r.Get(name)
 	}
-	lock.RLock()
-	for k, v := range others {
+	r.lock.RLock()
+	for k, v := range r.others {
 		out[k] = v
 	}
-	lock.RUnlock()
+	r.lock.RUnlock()
 	return out
 }
 
-func SetLagging(c uint64, d time.Duration) {
+func (r *Registry) SetLagging(c uint64, d time.Duration) {
+	r = r.get()
 	if d <= 0 {
-		laggings.Delete(c)
+		r.laggings.Delete(c)
 	} else {
-		laggings.Store(c, d)
+		r.laggings.Store(c, d)
 	}
 }
 
-func GetLagging() time.Duration {
+func (r *Registry) GetLagging() time.Duration {
+	r = r.get()
 	var d time.Duration
-	laggings.Range(func(key, value interface{}) bool {
+	r.laggings.Range(func(key, value interface{}) bool {
 		if dd, ok := value.(time.Duration); ok && dd > d {
 			d = dd
 		}
@@ -149,3 +249,34 @@ func GetLagging() time.Duration {
 	})
 	return d
 }
+
+// SetPending sets the number of events of the connection c which have been due
+// before it caught up, that is the depth of the backlog it's working off.
+func (r *Registry) SetPending(c uint64, n int64) {
+	r = r.get()
+	if n <= 0 {
+		r.pendings.Delete(c)
+	} else {
+		r.pendings.Store(c, n)
+	}
+}
+
+// GetPending returns the max depth of backlogs of connections and the number
+// of connections with a backlog.
+func (r *Registry) GetPending() (int64, int) {
+	r = r.get()
+	var (
+		max   int64
+		conns int
+	)
+	r.pendings.Range(func(key, value interface{}) bool {
+		if n, ok := value.(int64); ok {
+			conns += 1
+			if n > max {
+				max = n
+			}
+		}
+		return true
+	})
+	return max, conns
+}
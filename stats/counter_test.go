@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	a, b := NewRegistry(), NewRegistry()
+	a.Add(Queries, 2)
+	a.Add(MirrorDiffs, 1)
+	b.Add(Queries, 1)
+	a.SetLagging(1, time.Second)
+	require.True(t, a.AddFailure("1062", "d", "insert"))
+
+	require.Equal(t, int64(2), a.Get(Queries))
+	require.Equal(t, int64(1), a.Dump()[MirrorDiffs])
+	require.Equal(t, int64(1), b.Get(Queries))
+	require.Zero(t, b.Get(MirrorDiffs))
+	require.Equal(t, time.Second, a.GetLagging())
+	require.Zero(t, b.GetLagging())
+	require.Len(t, a.Failures(-1), 1)
+	require.Empty(t, b.Failures(-1))
+	b.CountFailures("1062", "d", 5)
+	require.True(t, b.SampleFailure("1062", "d", "insert"))
+	require.Equal(t, []FailureGroup{{Code: "1062", Digest: "d", Count: 5, Samples: []string{"insert"}}}, b.Failures(-1))
+
+	var r *Registry
+	require.Equal(t, Default.Add(Retries, 1), r.Get(Retries))
+}
+
+func TestPending(t *testing.T) {
+	r := NewRegistry()
+	r.SetPending(1, 3)
+	r.SetPending(2, 5)
+	max, conns := r.GetPending()
+	require.Equal(t, int64(5), max)
+	require.Equal(t, 2, conns)
+	r.SetPending(2, 0)
+	max, conns = r.GetPending()
+	require.Equal(t, int64(3), max)
+	require.Equal(t, 1, conns)
+}
+
+func TestLabeled(t *testing.T) {
+	r := NewRegistry()
+	a, b := Labels{Target: "a:4000", Schema: "db"}, Labels{Target: "b:4000"}
+	r.ObserveLabeled(a, time.Millisecond, false)
+	r.ObserveLabeled(a, 3*time.Millisecond, true)
+	r.ObserveLabeled(b, time.Millisecond, false)
+	r.SetLabeled(LabeledStat{Labels: Labels{Target: "c:4000", Agent: "x"}, Statements: 5})
+	out := r.Labeled()
+	require.Len(t, out, 3)
+	require.Equal(t, a, out[0].Labels)
+	require.Equal(t, int64(2), out[0].Statements)
+	require.Equal(t, int64(1), out[0].Failures)
+	require.Equal(t, 3*time.Millisecond, out[0].Max)
+	require.Equal(t, b, out[1].Labels)
+	require.Equal(t, int64(5), out[2].Statements)
+}
+
+func TestPacing(t *testing.T) {
+	r := NewRegistry()
+	require.Equal(t, float64(100), r.Pacing().Score())
+	r.ObservePacing(-time.Second)
+	r.ObservePacing(PacingTolerance)
+	prev := r.Pacing()
+	r.ObservePacing(time.Second)
+	r.ObservePacing(0)
+	p := r.Pacing()
+	require.Equal(t, int64(4), p.Events)
+	require.Equal(t, int64(3), p.OnTime)
+	require.Equal(t, float64(75), p.Score())
+	require.Equal(t, time.Second, p.Max)
+	require.Equal(t, float64(50), p.Since(prev).Score())
+}
+
+func TestFetches(t *testing.T) {
+	r := NewRegistry()
+	require.Equal(t, FetchStat{}, r.Fetches())
+	r.ObserveFetch(2, 10, time.Millisecond, 3*time.Millisecond)
+	r.ObserveFetch(0, 0, time.Millisecond, time.Millisecond)
+	f := r.Fetches()
+	require.Equal(t, int64(2), f.ResultSets)
+	require.Equal(t, int64(2), f.Rows)
+	require.Equal(t, int64(10), f.Bytes)
+	require.True(t, f.FetchMean >= f.FirstRowMean)
+	require.True(t, f.FetchP99 >= 3*time.Millisecond)
+}
@@ -0,0 +1,106 @@
+package stats
+
+import "sort"
+
+// FailureGroup aggregates failed statements of an error code and a digest.
+type FailureGroup struct {
+	Code    string   `json:"code"`
+	Digest  string   `json:"digest"`
+	Count   int64    `json:"count"`
+	Samples []string `json:"samples"`
+}
+
+const (
+	// MaxFailureSamples is the max number of sample statements kept per group.
+	MaxFailureSamples = 3
+	// MaxFailureGroups bounds the number of groups, failures of new digests
+	// are then counted by their codes only.
+	MaxFailureGroups = 10000
+)
+
+type failureKey struct {
+	code   string
+	digest string
+}
+
+// AddFailure counts a failed statement into the group of the error code and
+// the digest, and tells whether the statement is kept as a sample, which is
+// supposed to be logged by the caller.
+func (r *Registry) AddFailure(code string, digest string, sample string) bool {
+	r = r.get()
+	r.failureLock.Lock()
+	defer r.failureLock.Unlock()
+	g := r.failureGroup(code, digest)
+	g.Count += 1
+	return g.sample(sample)
+}
+
+// CountFailures counts n failed statements into the group like AddFailure but
+// without a sample, which is for counts aggregated elsewhere (e.g. by agents).
+func (r *Registry) CountFailures(code string, digest string, n int64) {
+	r = r.get()
+	r.failureLock.Lock()
+	defer r.failureLock.Unlock()
+	r.failureGroup(code, digest).Count += n
+}
+
+// SampleFailure keeps the sample in the group like AddFailure but without
+// counting it, see CountFailures.
+func (r *Registry) SampleFailure(code string, digest string, sample string) bool {
+	r = r.get()
+	r.failureLock.Lock()
+	defer r.failureLock.Unlock()
+	return r.failureGroup(code, digest).sample(sample)
+}
+
+func (r *Registry) failureGroup(code string, digest string) *FailureGroup {
+	key := failureKey{code, digest}
+	g, ok := r.failures[key]
+	if !ok && len(r.failures) >= MaxFailureGroups {
+		key.digest = ""
+		g, ok = r.failures[key]
+	}
+	if !ok {
+		g = &FailureGroup{Code: key.code, Digest: key.digest}
+		r.failures[key] = g
+	}
+	return g
+}
+
+func (g *FailureGroup) sample(sample string) bool {
+	if len(g.Samples) < MaxFailureSamples {
+		g.Samples = append(g.Samples, sample)
+		return true
+	}
+	return false
+}
+
+// Failures returns the top n (all if n < 0) failure groups ordered by count.
+func (r *Registry) Failures(n int) []FailureGroup {
+	r = r.get()
+	r.failureLock.Lock()
+	out := make([]FailureGroup, 0, len(r.failures))
+	for _, g := range r.failures {
+		out = append(out, FailureGroup{Code: g.Code, Digest: g.Digest, Count: g.Count, Samples: append([]string(nil), g.Samples...)})
+	}
+	r.failureLock.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		if out[i].Code != out[j].Code {
+			return out[i].Code < out[j].Code
+		}
+		return out[i].Digest < out[j].Digest
+	})
+	if n >= 0 && n < len(out) {
+		out = out[:n]
+	}
+	return out
+}
+
+func AddFailure(code string, digest string, sample string) bool {
+	return Default.AddFailure(code, digest, sample)
+}
+
+func Failures(n int) []FailureGroup { return Default.Failures(n) }
@@ -0,0 +1,49 @@
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// FetchStat is a snapshot of result sets read fully, latencies of the first
+// rows are measured from sending the statements, and so are the ones of
+// reading result sets fully. Truncated result sets are counted as well.
+type FetchStat struct {
+	ResultSets   int64         `json:"result_sets"`
+	Truncated    int64         `json:"truncated"`
+	Rows         int64         `json:"rows"`
+	Bytes        int64         `json:"bytes"`
+	FirstRowMean time.Duration `json:"first_row_mean"`
+	FirstRowP99  time.Duration `json:"first_row_p99"`
+	FetchMean    time.Duration `json:"fetch_mean"`
+	FetchP99     time.Duration `json:"fetch_p99"`
+}
+
+// ObserveFetch counts a result set of rows (of bytes in total) read fully,
+// the first row of which arrives after firstRow and the last after total.
+func (r *Registry) ObserveFetch(rows int64, bytes int64, firstRow time.Duration, total time.Duration) {
+	r = r.get()
+	r.firstRow.Observe(firstRow)
+	r.fetch.Observe(total)
+	atomic.AddInt64(&r.fetchedRows, rows)
+	atomic.AddInt64(&r.fetchedBytes, bytes)
+}
+
+// Fetches returns a snapshot of result sets read so far.
+func (r *Registry) Fetches() FetchStat {
+	r = r.get()
+	return FetchStat{
+		ResultSets:   r.fetch.Count(),
+		Truncated:    r.Get(TruncatedFetches),
+		Rows:         atomic.LoadInt64(&r.fetchedRows),
+		Bytes:        atomic.LoadInt64(&r.fetchedBytes),
+		FirstRowMean: r.firstRow.Mean(),
+		FirstRowP99:  r.firstRow.Quantile(.99),
+		FetchMean:    r.fetch.Mean(),
+		FetchP99:     r.fetch.Quantile(.99),
+	}
+}
+
+func ObserveFetch(rows int64, bytes int64, firstRow time.Duration, total time.Duration) {
+	Default.ObserveFetch(rows, bytes, firstRow, total)
+}
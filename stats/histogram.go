@@ -0,0 +1,91 @@
+package stats
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	histMin     = 10 * time.Microsecond
+	histGrowth  = 1.1
+	histBuckets = 200
+)
+
+// Histogram is a lock-free latency histogram with exponential buckets
+// starting at 10us, each bucket is 10% wider than the previous one.
+type Histogram struct {
+	counts [histBuckets + 1]int64
+	total  int64
+	sum    int64
+	max    int64
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{}
+}
+
+func histBucket(d time.Duration) int {
+	if d <= histMin {
+		return 0
+	}
+	i := int(math.Log(float64(d)/float64(histMin))/math.Log(histGrowth)) + 1
+	if i > histBuckets {
+		return histBuckets
+	}
+	return i
+}
+
+func histUpper(i int) time.Duration {
+	return time.Duration(float64(histMin) * math.Pow(histGrowth, float64(i)))
+}
+
+func (h *Histogram) Observe(d time.Duration) {
+	if h == nil {
+		return
+	}
+	atomic.AddInt64(&h.counts[histBucket(d)], 1)
+	atomic.AddInt64(&h.total, 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&h.max, max, int64(d)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) Count() int64 { return atomic.LoadInt64(&h.total) }
+
+func (h *Histogram) Max() time.Duration { return time.Duration(atomic.LoadInt64(&h.max)) }
+
+func (h *Histogram) Mean() time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	return time.Duration(atomic.LoadInt64(&h.sum) / n)
+}
+
+// Quantile returns the upper bound of the bucket where the q-th quantile falls.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	n := h.Count()
+	if n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(n)))
+	if rank < 1 {
+		rank = 1
+	}
+	acc := int64(0)
+	for i := range h.counts {
+		acc += atomic.LoadInt64(&h.counts[i])
+		if acc >= rank {
+			if d := histUpper(i); d < h.Max() {
+				return d
+			}
+			return h.Max()
+		}
+	}
+	return h.Max()
+}
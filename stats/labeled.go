@@ -0,0 +1,106 @@
+package stats
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Labels identify a series of labeled stats, labels not set are empty.
+type Labels struct {
+	Target string `json:"target,omitempty"`
+	Job    string `json:"job,omitempty"`
+	Agent  string `json:"agent,omitempty"`
+	Schema string `json:"schema,omitempty"`
+}
+
+// MaxLabeledSeries bounds the number of labeled series, statements of new
+// series are then counted without their schemas.
+const MaxLabeledSeries = 1000
+
+// LabeledStat is a snapshot of the statements, failures and latency of a series.
+type LabeledStat struct {
+	Labels
+	Statements int64         `json:"statements"`
+	Failures   int64         `json:"failures"`
+	Mean       time.Duration `json:"mean"`
+	P99        time.Duration `json:"p99"`
+	Max        time.Duration `json:"max"`
+}
+
+type labeledSeries struct {
+	failures int64
+	latency  *Histogram
+	// remote (if any) is the snapshot reported by an agent, which replaces
+	// the series as a whole.
+	remote *LabeledStat
+}
+
+// ObserveLabeled counts a statement of the series by its latency and whether
+// it failed.
+func (r *Registry) ObserveLabeled(l Labels, d time.Duration, failed bool) {
+	r = r.get()
+	r.labeledLock.Lock()
+	s, ok := r.labeled[l]
+	if !ok && len(r.labeled) >= MaxLabeledSeries {
+		l.Schema = ""
+		s, ok = r.labeled[l]
+	}
+	if !ok {
+		s = &labeledSeries{latency: NewHistogram()}
+		r.labeled[l] = s
+	}
+	r.labeledLock.Unlock()
+	s.latency.Observe(d)
+	if failed {
+		atomic.AddInt64(&s.failures, 1)
+	}
+}
+
+// SetLabeled sets the series to the snapshot (e.g. reported by an agent).
+func (r *Registry) SetLabeled(stat LabeledStat) {
+	r = r.get()
+	r.labeledLock.Lock()
+	r.labeled[stat.Labels] = &labeledSeries{remote: &stat}
+	r.labeledLock.Unlock()
+}
+
+// Labeled returns snapshots of all series ordered by their labels.
+func (r *Registry) Labeled() []LabeledStat {
+	r = r.get()
+	r.labeledLock.Lock()
+	out := make([]LabeledStat, 0, len(r.labeled))
+	for l, s := range r.labeled {
+		if s.remote != nil {
+			out = append(out, *s.remote)
+			continue
+		}
+		out = append(out, LabeledStat{
+			Labels:     l,
+			Statements: s.latency.Count(),
+			Failures:   atomic.LoadInt64(&s.failures),
+			Mean:       s.latency.Mean(),
+			P99:        s.latency.Quantile(.99),
+			Max:        s.latency.Max(),
+		})
+	}
+	r.labeledLock.Unlock()
+	sort.Slice(out, func(i, j int) bool {
+		a, b := out[i].Labels, out[j].Labels
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		if a.Job != b.Job {
+			return a.Job < b.Job
+		}
+		if a.Agent != b.Agent {
+			return a.Agent < b.Agent
+		}
+		return a.Schema < b.Schema
+	})
+	return out
+}
+
+func ObserveLabeled(l Labels, d time.Duration, failed bool) { Default.ObserveLabeled(l, d, failed) }
+
+func Labeled() []LabeledStat { return Default.Labeled() }
@@ -0,0 +1,64 @@
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// PacingTolerance is how late an event may be dispatched after its intended
+// time to be counted as on time.
+const PacingTolerance = 10 * time.Millisecond
+
+// PacingStat is a snapshot of how late paced events are dispatched compared to
+// their intended times (scaled by the speed).
+type PacingStat struct {
+	Events int64         `json:"events"`
+	OnTime int64         `json:"on_time"`
+	Mean   time.Duration `json:"mean"`
+	P99    time.Duration `json:"p99"`
+	Max    time.Duration `json:"max"`
+}
+
+// Score is the fidelity score of the replay, which is the percentage of events
+// dispatched on time (100 if no event is paced).
+func (s PacingStat) Score() float64 {
+	if s.Events == 0 {
+		return 100
+	}
+	return float64(s.OnTime) * 100 / float64(s.Events)
+}
+
+// Since returns the stat of events paced after prev, latencies are still the
+// ones of all events.
+func (s PacingStat) Since(prev PacingStat) PacingStat {
+	s.Events -= prev.Events
+	s.OnTime -= prev.OnTime
+	return s
+}
+
+// ObservePacing counts an event dispatched late by d, d <= 0 means the event is
+// dispatched in time.
+func (r *Registry) ObservePacing(d time.Duration) {
+	r = r.get()
+	if d < 0 {
+		d = 0
+	}
+	r.pacing.Observe(d)
+	if d <= PacingTolerance {
+		atomic.AddInt64(&r.onTime, 1)
+	}
+}
+
+// Pacing returns a snapshot of events paced so far.
+func (r *Registry) Pacing() PacingStat {
+	r = r.get()
+	return PacingStat{
+		Events: r.pacing.Count(),
+		OnTime: atomic.LoadInt64(&r.onTime),
+		Mean:   r.pacing.Mean(),
+		P99:    r.pacing.Quantile(.99),
+		Max:    r.pacing.Max(),
+	}
+}
+
+func ObservePacing(d time.Duration) { Default.ObservePacing(d) }
@@ -0,0 +1,118 @@
+package stats
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Progress tracks how far a connection has gone through its captured session,
+// which is from start to end (unix ms) in captured time.
+type Progress struct {
+	id    uint64
+	name  string
+	start int64
+	end   int64
+
+	events     int64
+	pos        int64
+	lagging    int64
+	maxLagging int64
+	done       int32
+}
+
+// ProgressInfo is a snapshot of a Progress.
+type ProgressInfo struct {
+	ID     uint64 `json:"id"`
+	Name   string `json:"name"`
+	Events int64  `json:"events"`
+	// Percent is the position of the last event in the captured session.
+	Percent    float64       `json:"percent"`
+	Lagging    time.Duration `json:"lagging"`
+	MaxLagging time.Duration `json:"max_lagging"`
+	Done       bool          `json:"done"`
+}
+
+// TrackProgress registers the progress of the connection c.
+func (r *Registry) TrackProgress(c uint64, name string, start int64, end int64) *Progress {
+	p := &Progress{id: c, name: name, start: start, end: end, pos: start}
+	r.get().progresses.Store(c, p)
+	return p
+}
+
+func TrackProgress(c uint64, name string, start int64, end int64) *Progress {
+	return Default.TrackProgress(c, name, start, end)
+}
+
+// Observe counts an event at t (unix ms) applied.
+func (p *Progress) Observe(t int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.events, 1)
+	atomic.StoreInt64(&p.pos, t)
+}
+
+// SetLagging sets the current lagging of the connection.
+func (p *Progress) SetLagging(d time.Duration) {
+	if p == nil {
+		return
+	}
+	atomic.StoreInt64(&p.lagging, int64(d))
+	for {
+		max := atomic.LoadInt64(&p.maxLagging)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&p.maxLagging, max, int64(d)) {
+			return
+		}
+	}
+}
+
+// Finish marks the connection as done.
+func (p *Progress) Finish() {
+	if p == nil {
+		return
+	}
+	atomic.StoreInt64(&p.lagging, 0)
+	atomic.StoreInt32(&p.done, 1)
+}
+
+// Info returns a snapshot of the progress.
+func (p *Progress) Info() ProgressInfo {
+	info := ProgressInfo{
+		ID:         p.id,
+		Name:       p.name,
+		Events:     atomic.LoadInt64(&p.events),
+		Percent:    100,
+		Lagging:    time.Duration(atomic.LoadInt64(&p.lagging)),
+		MaxLagging: time.Duration(atomic.LoadInt64(&p.maxLagging)),
+		Done:       atomic.LoadInt32(&p.done) == 1,
+	}
+	if p.end > p.start {
+		info.Percent = float64(atomic.LoadInt64(&p.pos)-p.start) * 100 / float64(p.end-p.start)
+	}
+	return info
+}
+
+// Stragglers returns the top n (all if n < 0) connections fell behind the most,
+// connections never lagging more than min are excluded.
+func (r *Registry) Stragglers(n int, min time.Duration) []ProgressInfo {
+	var out []ProgressInfo
+	r.get().progresses.Range(func(key, value interface{}) bool {
+		if info := value.(*Progress).Info(); info.MaxLagging > 0 && info.MaxLagging >= min {
+			out = append(out, info)
+		}
+		return true
+	})
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].MaxLagging != out[j].MaxLagging {
+			return out[i].MaxLagging > out[j].MaxLagging
+		}
+		return out[i].ID < out[j].ID
+	})
+	if n >= 0 && n < len(out) {
+		out = out[:n]
+	}
+	return out
+}
+
+func Stragglers(n int, min time.Duration) []ProgressInfo { return Default.Stragglers(n, min) }
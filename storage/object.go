@@ -0,0 +1,100 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pingcap/errors"
+)
+
+var defaultEndpoints = map[string]string{
+	"s3": "s3.amazonaws.com",
+	"gs": "storage.googleapis.com",
+}
+
+// objectStorage talks to s3 compatible services. The endpoint can be
+// overridden by the `endpoint` query parameter (required by oss), and
+// credentials are loaded from the environment (AWS_ACCESS_KEY_ID,
+// MINIO_ACCESS_KEY, ~/.aws/credentials or IAM).
+type objectStorage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+	url    string
+}
+
+func newObjectStorage(u *url.URL) (*objectStorage, error) {
+	q := u.Query()
+	endpoint := q.Get("endpoint")
+	if len(endpoint) == 0 {
+		endpoint = defaultEndpoints[u.Scheme]
+	}
+	if len(endpoint) == 0 {
+		return nil, errors.Errorf("endpoint is required for %s storage", u.Scheme)
+	}
+	if len(u.Host) == 0 {
+		return nil, errors.New("bucket is required: " + u.String())
+	}
+	secure := true
+	if strings.HasPrefix(endpoint, "http://") {
+		secure = false
+	}
+	endpoint = strings.TrimPrefix(strings.TrimPrefix(endpoint, "http://"), "https://")
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds: credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		}),
+		Secure: secure,
+		Region: q.Get("region"),
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if len(prefix) > 0 {
+		prefix += "/"
+	}
+	return &objectStorage{client: client, bucket: u.Host, prefix: prefix, url: u.Scheme + "://" + u.Host + "/" + prefix}, nil
+}
+
+func (s *objectStorage) List(ctx context.Context) ([]File, error) {
+	var files []File
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix}) {
+		if obj.Err != nil {
+			return nil, errors.Trace(obj.Err)
+		}
+		name := strings.TrimPrefix(obj.Key, s.prefix)
+		if len(name) == 0 || strings.Contains(name, "/") {
+			continue
+		}
+		files = append(files, File{Name: name, Size: obj.Size})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (s *objectStorage) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, path.Join(s.prefix, name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return obj, nil
+}
+
+func (s *objectStorage) Put(ctx context.Context, name string, file string) error {
+	_, err := s.client.FPutObject(ctx, s.bucket, s.prefix+name, file, minio.PutObjectOptions{ContentType: "text/tab-separated-values"})
+	return errors.Trace(err)
+}
+
+func (s *objectStorage) String() string {
+	return s.url
+}
@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/errors"
+)
+
+// File describes an object of a storage.
+type File struct {
+	Name string
+	Size int64
+}
+
+// Storage is a flat namespace of session files, which is either a local
+// directory or a prefix of an object storage bucket.
+type Storage interface {
+	// List returns files under the storage sorted by name.
+	List(ctx context.Context) ([]File, error)
+	Open(ctx context.Context, name string) (io.ReadCloser, error)
+	// Put uploads the content of a local file as the given name.
+	Put(ctx context.Context, name string, path string) error
+	String() string
+}
+
+// IsRemote tells whether the location refers to an object storage.
+func IsRemote(location string) bool {
+	u, err := url.Parse(location)
+	return err == nil && len(u.Scheme) > 1 && u.Scheme != "file"
+}
+
+// Schemes returns url schemes of object storages known by Open, the ones
+// without a default endpoint require the `endpoint` query parameter.
+func Schemes() []string {
+	return []string{"s3", "gs", "oss"}
+}
+
+// Open returns a storage for the location, which is a local path or an url
+// like s3://bucket/prefix, gs://bucket/prefix or oss://bucket/prefix.
+func Open(location string) (Storage, error) {
+	if !IsRemote(location) {
+		return Local(strings.TrimPrefix(location, "file://")), nil
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return newObjectStorage(u)
+}
+
+// Local is a storage backed by a local directory.
+type Local string
+
+func (dir Local) List(ctx context.Context) ([]File, error) {
+	infos, err := os.ReadDir(string(dir))
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	files := make([]File, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		fi, err := info.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, File{Name: info.Name(), Size: fi.Size()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (dir Local) Open(ctx context.Context, name string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(string(dir), name))
+	return f, errors.Trace(err)
+}
+
+func (dir Local) Put(ctx context.Context, name string, path string) error {
+	return errors.Trace(os.Rename(path, filepath.Join(string(dir), name)))
+}
+
+func (dir Local) String() string {
+	return string(dir)
+}
@@ -0,0 +1,82 @@
+package stream
+
+import "sync/atomic"
+
+// pageSize approximates the size of a page buffered by the assembler of
+// gopacket for out-of-order segments.
+const pageSize = 2048
+
+// MemoryBudget accounts bytes buffered by streams and event handlers against a
+// limit. A nil budget is unlimited, and all of its methods are no-ops.
+type MemoryBudget struct {
+	limit int64
+	used  int64
+}
+
+// NewMemoryBudget returns a budget of limit bytes, or nil if limit is not
+// positive.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &MemoryBudget{limit: limit}
+}
+
+// Acquire accounts n bytes regardless of the limit.
+func (b *MemoryBudget) Acquire(n int64) {
+	if b == nil {
+		return
+	}
+	atomic.AddInt64(&b.used, n)
+}
+
+// TryAcquire accounts n bytes only if they fit in the limit.
+func (b *MemoryBudget) TryAcquire(n int64) bool {
+	if b == nil {
+		return true
+	}
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if used+n > b.limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+// Release gives back n bytes accounted before.
+func (b *MemoryBudget) Release(n int64) {
+	if b == nil {
+		return
+	}
+	atomic.AddInt64(&b.used, -n)
+}
+
+// Used returns the bytes accounted.
+func (b *MemoryBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&b.used)
+}
+
+// Exceeded tells whether the bytes accounted exceed the limit.
+func (b *MemoryBudget) Exceeded() bool {
+	return b != nil && atomic.LoadInt64(&b.used) > b.limit
+}
+
+// MaxBufferedPages returns the max number of pages the assembler may buffer,
+// which takes a quarter of the budget. It returns 0 (unlimited) for a nil
+// budget.
+func (b *MemoryBudget) MaxBufferedPages() int {
+	if b == nil {
+		return 0
+	}
+	n := int(b.limit / 4 / pageSize)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
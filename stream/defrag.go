@@ -0,0 +1,52 @@
+package stream
+
+import (
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/ip4defrag"
+	"github.com/google/gopacket/layers"
+)
+
+// fragmentTimeout is how long fragments of an incomplete ipv4 packet are kept.
+const fragmentTimeout = 30 * time.Second
+
+// Defragmenter reassembles fragmented ipv4 packets before looking for their
+// tcp layers, it's not safe for concurrent use.
+type Defragmenter struct {
+	ip4         *ip4defrag.IPv4Defragmenter
+	lastDiscard time.Time
+}
+
+func NewDefragmenter() *Defragmenter {
+	return &Defragmenter{ip4: ip4defrag.NewIPv4Defragmenter()}
+}
+
+// TCPLayer is like TCPLayer of the package, but a fragment is kept until all
+// fragments of its packet are seen, by then the tcp layer of the reassembled
+// packet is returned.
+func (d *Defragmenter) TCPLayer(pkt gopacket.Packet) (gopacket.Flow, *layers.TCP, bool) {
+	var ip4 *layers.IPv4
+	for _, layer := range pkt.Layers() {
+		if l, ok := layer.(gopacket.NetworkLayer); ok {
+			ip4, _ = l.(*layers.IPv4)
+		}
+	}
+	if ip4 == nil || (ip4.Flags&layers.IPv4MoreFragments == 0 && ip4.FragOffset == 0) {
+		return TCPLayer(pkt)
+	}
+	t := pkt.Metadata().Timestamp
+	if t.Sub(d.lastDiscard) > fragmentTimeout {
+		d.ip4.DiscardOlderThan(t.Add(-fragmentTimeout))
+		d.lastDiscard = t
+	}
+	whole, err := d.ip4.DefragIPv4WithTimestamp(ip4, t)
+	if err != nil || whole == nil {
+		return gopacket.Flow{}, nil, false
+	}
+	tcp, ok := gopacket.NewPacket(whole.Payload, whole.NextLayerType(), gopacket.Default).Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return gopacket.Flow{}, nil, false
+	}
+	return whole.NetworkFlow(), tcp, true
+}
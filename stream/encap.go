@@ -0,0 +1,102 @@
+package stream
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Encapsulations like 802.1Q VLAN, VXLAN (udp 4789) and GRE are decoded by
+// gopacket already, ERSPAN carried by GRE is registered here.
+const (
+	EthernetTypeERSPAN  layers.EthernetType = 0x88be
+	EthernetTypeERSPAN3 layers.EthernetType = 0x22eb
+)
+
+const (
+	erspan2HeaderLen    = 8
+	erspan3HeaderLen    = 12
+	erspan3SubHeaderLen = 8
+)
+
+// LayerTypeERSPAN is the layer of ERSPAN headers (type II and III), which is
+// followed by the mirrored ethernet frame.
+var LayerTypeERSPAN = gopacket.RegisterLayerType(2000, gopacket.LayerTypeMetadata{Name: "ERSPAN", Decoder: gopacket.DecodeFunc(decodeERSPAN)})
+
+func init() {
+	layers.EthernetTypeMetadata[EthernetTypeERSPAN] = layers.EnumMetadata{DecodeWith: gopacket.DecodeFunc(decodeERSPAN), Name: "ERSPAN", LayerType: LayerTypeERSPAN}
+	layers.EthernetTypeMetadata[EthernetTypeERSPAN3] = layers.EnumMetadata{DecodeWith: gopacket.DecodeFunc(decodeERSPAN3), Name: "ERSPAN", LayerType: LayerTypeERSPAN}
+}
+
+// ERSPAN is the header of a frame mirrored by ERSPAN. A type I frame has no
+// header, whose version is 0.
+type ERSPAN struct {
+	layers.BaseLayer
+	Version   uint8
+	VLAN      uint16
+	SessionID uint16
+}
+
+func (e *ERSPAN) LayerType() gopacket.LayerType { return LayerTypeERSPAN }
+
+// decodeERSPAN decodes frames of GRE protocol 0x88be, which are type II if the
+// version in the header is 1, or type I (no header) otherwise.
+func decodeERSPAN(data []byte, p gopacket.PacketBuilder) error {
+	e := &ERSPAN{}
+	if len(data) >= erspan2HeaderLen && data[0]>>4 == 1 {
+		e.Version = 1
+		e.VLAN = binary.BigEndian.Uint16(data[0:2]) & 0x0fff
+		e.SessionID = binary.BigEndian.Uint16(data[2:4]) & 0x03ff
+		e.BaseLayer = layers.BaseLayer{Contents: data[:erspan2HeaderLen], Payload: data[erspan2HeaderLen:]}
+	} else {
+		e.BaseLayer = layers.BaseLayer{Payload: data}
+	}
+	p.AddLayer(e)
+	return p.NextDecoder(layers.LayerTypeEthernet)
+}
+
+// decodeERSPAN3 decodes frames of GRE protocol 0x22eb.
+func decodeERSPAN3(data []byte, p gopacket.PacketBuilder) error {
+	if len(data) < erspan3HeaderLen {
+		return errors.New("erspan type iii header too short")
+	}
+	n := erspan3HeaderLen
+	if data[11]&0x01 != 0 {
+		// platform specific sub-header
+		n += erspan3SubHeaderLen
+	}
+	if len(data) < n {
+		return errors.New("erspan type iii sub-header too short")
+	}
+	e := &ERSPAN{
+		Version:   data[0] >> 4,
+		VLAN:      binary.BigEndian.Uint16(data[0:2]) & 0x0fff,
+		SessionID: binary.BigEndian.Uint16(data[2:4]) & 0x03ff,
+		BaseLayer: layers.BaseLayer{Contents: data[:n], Payload: data[n:]},
+	}
+	p.AddLayer(e)
+	return p.NextDecoder(layers.LayerTypeEthernet)
+}
+
+// TCPLayer returns the innermost tcp layer of the packet and the flow of the
+// network layer enclosing it, which skips tunnels like VXLAN and GRE.
+func TCPLayer(pkt gopacket.Packet) (gopacket.Flow, *layers.TCP, bool) {
+	var (
+		net gopacket.NetworkLayer
+		tcp *layers.TCP
+	)
+	for _, layer := range pkt.Layers() {
+		switch l := layer.(type) {
+		case gopacket.NetworkLayer:
+			net, tcp = l, nil
+		case *layers.TCP:
+			tcp = l
+		}
+	}
+	if net == nil || tcp == nil {
+		return gopacket.Flow{}, nil, false
+	}
+	return net.NetworkFlow(), tcp, true
+}
@@ -9,7 +9,16 @@ import (
 	"github.com/zyguan/mysql-replay/event"
 )
 
+// NewFactoryFromEventHandler returns a stream factory which decodes mysql
+// packets into events handled by handlers created by factory, connections are
+// rejected if factory returns nil.
 func NewFactoryFromEventHandler(factory func(ConnID) MySQLEventHandler, opts FactoryOptions) *mysqlStreamFactory {
+	return NewFactoryFromProtocol(MySQL, factory, opts)
+}
+
+// NewFactoryFromProtocol is like NewFactoryFromEventHandler but decodes
+// packets of the protocol.
+func NewFactoryFromProtocol(p Protocol, factory func(ConnID) MySQLEventHandler, opts FactoryOptions) *mysqlStreamFactory {
 	f := defaultHandlerFactory
 	if factory != nil {
 		f = func(conn ConnID) MySQLPacketHandler {
@@ -18,24 +27,33 @@ func NewFactoryFromEventHandler(factory func(ConnID) MySQLEventHandler, opts Fac
 				return RejectConn(conn)
 			}
 			return &eventHandler{
-				fsm:  NewMySQLFSM(conn.Logger("mysql-stream")),
-				conn: conn,
-				impl: impl,
+				dec:     p.NewDecoder(conn.Logger(p.Name() + "-stream")),
+				conn:    conn,
+				impl:    impl,
+				results: opts.Results,
 			}
 		}
 	}
-	return &mysqlStreamFactory{new: f, opts: opts}
+	return &mysqlStreamFactory{new: f, proto: p, opts: opts}
 }
 
+// MySQLEventHandler handles events of a single connection. A handler is
+// created by its factory when a new connection is seen, after which OnEvent is
+// called for each event of the connection in order and OnClose is called once
+// the connection is closed or flushed. Calls to a handler are never concurrent,
+// while handlers of different connections may be called concurrently unless
+// FactoryOptions.Synchronized is set. Events (including their params) are not
+// reused and may be retained by handlers.
 type MySQLEventHandler interface {
 	OnEvent(event event.MySQLEvent)
 	OnClose()
 }
 
 type eventHandler struct {
-	fsm  *MySQLFSM
-	conn ConnID
-	impl MySQLEventHandler
+	dec     Decoder
+	conn    ConnID
+	impl    MySQLEventHandler
+	results bool
 }
 
 func (h *eventHandler) Accept(ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, tcp *layers.TCP) bool {
@@ -43,40 +61,26 @@ func (h *eventHandler) Accept(ci gopacket.CaptureInfo, dir reassembly.TCPFlowDir
 }
 
 func (h *eventHandler) OnPacket(pkt MySQLPacket) {
-	h.fsm.Handle(pkt)
-	if !h.fsm.Ready() || !h.fsm.Changed() {
-		return
-	}
-	e := event.MySQLEvent{Time: pkt.Time.UnixNano() / int64(time.Millisecond)}
-	switch h.fsm.State() {
-	case StateComQuery:
-		e.Type = event.EventQuery
-		e.Query = h.fsm.Query()
-	case StateComStmtExecute:
-		stmt := h.fsm.Stmt()
-		e.Type = event.EventStmtExecute
-		e.StmtID = uint64(stmt.ID)
-		e.Params = h.fsm.StmtParams()
-	case StateComStmtPrepare1:
-		stmt := h.fsm.Stmt()
-		e.Type = event.EventStmtPrepare
-		e.StmtID = uint64(stmt.ID)
-		e.Query = stmt.Query
-	case StateComStmtClose:
-		stmt := h.fsm.Stmt()
-		e.Type = event.EventStmtClose
-		e.StmtID = uint64(stmt.ID)
-	case StateHandshake1:
-		e.Type = event.EventHandshake
-		e.DB = h.fsm.Schema()
-	case StateComQuit:
-		e.Type = event.EventQuit
-	default:
+	h.dec.Decode(pkt, h.emit)
+}
+
+func (h *eventHandler) emit(e event.MySQLEvent) {
+	if e.Type == event.EventResult && !h.results {
 		return
 	}
 	h.impl.OnEvent(e)
 }
 
+// OnGap emits a gap event, the decoder goes on as usual since the lost data
+// can't be recovered anyway.
+func (h *eventHandler) OnGap(pkt MySQLPacket) {
+	h.impl.OnEvent(event.MySQLEvent{
+		Time: pkt.Time.UnixNano() / int64(time.Millisecond),
+		Type: event.EventGap,
+		Gap:  uint64(pkt.Gap),
+	})
+}
+
 func (h *eventHandler) OnClose() {
 	h.impl.OnClose()
 }
@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/zyguan/mysql-replay/event"
+)
+
+// EventHandlerFactory creates an event handler for a connection, it returns
+// nil if the connection should be ignored by the handler.
+type EventHandlerFactory func(conn ConnID) MySQLEventHandler
+
+var (
+	handlersLock sync.RWMutex
+	handlers     = make(map[string]EventHandlerFactory)
+)
+
+// RegisterEventHandler registers an event handler factory by name, so that
+// it can be attached to pipelines like `text dump --handler <name>`. It is
+// typically called in init of the package providing the handler, and panics
+// if the name is registered twice.
+func RegisterEventHandler(name string, factory EventHandlerFactory) {
+	if factory == nil {
+		panic("stream: nil event handler factory of " + name)
+	}
+	handlersLock.Lock()
+	defer handlersLock.Unlock()
+	if _, ok := handlers[name]; ok {
+		panic("stream: event handler " + name + " is already registered")
+	}
+	handlers[name] = factory
+}
+
+// LookupEventHandler returns the event handler factory registered by name.
+func LookupEventHandler(name string) (EventHandlerFactory, bool) {
+	handlersLock.RLock()
+	defer handlersLock.RUnlock()
+	factory, ok := handlers[name]
+	return factory, ok
+}
+
+// EventHandlers returns names of registered event handlers in order.
+func EventHandlers() []string {
+	handlersLock.RLock()
+	defer handlersLock.RUnlock()
+	names := make([]string, 0, len(handlers))
+	for name := range handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LookupEventHandlers returns factories of the names, it fails if any of them
+// is not registered.
+func LookupEventHandlers(names []string) ([]EventHandlerFactory, error) {
+	factories := make([]EventHandlerFactory, 0, len(names))
+	for _, name := range names {
+		factory, ok := LookupEventHandler(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown event handler: %s (registered: %v)", name, EventHandlers())
+		}
+		factories = append(factories, factory)
+	}
+	return factories, nil
+}
+
+// MultiEventHandler returns a handler which passes events to all non-nil hs
+// in order, it returns nil if there is none.
+func MultiEventHandler(hs ...MySQLEventHandler) MySQLEventHandler {
+	impls := make(multiEventHandler, 0, len(hs))
+	for _, h := range hs {
+		if h != nil {
+			impls = append(impls, h)
+		}
+	}
+	switch len(impls) {
+	case 0:
+		return nil
+	case 1:
+		return impls[0]
+	default:
+		return impls
+	}
+}
+
+// MultiEventHandlerFactory combines factories like MultiEventHandler.
+func MultiEventHandlerFactory(factories ...EventHandlerFactory) EventHandlerFactory {
+	return func(conn ConnID) MySQLEventHandler {
+		hs := make([]MySQLEventHandler, 0, len(factories))
+		for _, factory := range factories {
+			if factory != nil {
+				hs = append(hs, factory(conn))
+			}
+		}
+		return MultiEventHandler(hs...)
+	}
+}
+
+type multiEventHandler []MySQLEventHandler
+
+func (hs multiEventHandler) OnEvent(e event.MySQLEvent) {
+	for _, h := range hs {
+		h.OnEvent(e)
+	}
+}
+
+func (hs multiEventHandler) OnClose() {
+	for _, h := range hs {
+		h.OnClose()
+	}
+}
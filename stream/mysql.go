@@ -6,9 +6,13 @@ import (
 	"fmt"
 	"io"
 	"math"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/google/gopacket/reassembly"
 	"github.com/pingcap/errors"
+	"github.com/zyguan/mysql-replay/stats"
 	"go.uber.org/zap"
 )
 
@@ -23,6 +27,9 @@ const (
 	StateComQuit
 	StateHandshake0
 	StateHandshake1
+	StateComInitDB
+	StateComStmtFetch
+	StateComResult
 )
 
 func StateName(state int) string {
@@ -47,6 +54,12 @@ func StateName(state int) string {
 		return "Handshake0"
 	case StateHandshake1:
 		return "Handshake1"
+	case StateComInitDB:
+		return "ComInitDB"
+	case StateComStmtFetch:
+		return "ComStmtFetch"
+	case StateComResult:
+		return "ComResult"
 	default:
 		return "Invalid"
 	}
@@ -78,12 +91,18 @@ type MySQLFSM struct {
 	changed bool
 	state   int
 	query   string        // com_query
-	stmt    Stmt          // com_stmt_prepare,com_stmt_execute,com_stmt_close
+	stmt    Stmt          // com_stmt_prepare,com_stmt_execute,com_stmt_close,com_stmt_fetch
 	params  []interface{} // com_stmt_execute
+	cursor  byte          // com_stmt_execute
+	rows    uint32        // com_stmt_fetch
+	result  uint64        // rows affected of com_query,com_stmt_execute
+	latency time.Duration // time to the response of com_query,com_stmt_execute
 
 	// session info
-	schema string          // handshake1
-	stmts  map[uint32]Stmt // com_stmt_prepare,com_stmt_execute,com_stmt_close
+	schema  string          // handshake1
+	charset uint8           // handshake1
+	user    string          // handshake1
+	stmts   map[uint32]Stmt // com_stmt_prepare,com_stmt_execute,com_stmt_close
 
 	// current command
 	data    *bytes.Buffer
@@ -108,8 +127,40 @@ func (fsm *MySQLFSM) Stmts() []Stmt {
 
 func (fsm *MySQLFSM) StmtParams() []interface{} { return fsm.params }
 
+// StmtParamTypes returns the param types of the last COM_STMT_EXECUTE, each of
+// which holds the type code in the low byte and the flags in the high byte.
+func (fsm *MySQLFSM) StmtParamTypes() []uint16 {
+	if fsm.stmt.NumParams == 0 || len(fsm.stmt.types) < fsm.stmt.NumParams<<1 {
+		return nil
+	}
+	types := make([]uint16, fsm.stmt.NumParams)
+	for i := range types {
+		types[i] = uint16(fsm.stmt.types[i<<1]) | uint16(fsm.stmt.types[(i<<1)+1])<<8
+	}
+	return types
+}
+
+// StmtCursor returns the cursor type flag of the last COM_STMT_EXECUTE, which
+// is non-zero if a server-side cursor is requested.
+func (fsm *MySQLFSM) StmtCursor() byte { return fsm.cursor }
+
+// FetchRows returns the number of rows requested by COM_STMT_FETCH.
+func (fsm *MySQLFSM) FetchRows() uint32 { return fsm.rows }
+
+// AffectedRows returns the number of rows affected by the last COM_QUERY or
+// COM_STMT_EXECUTE which is responded with an OK packet.
+func (fsm *MySQLFSM) AffectedRows() uint64 { return fsm.result }
+
+// Latency returns the time between the last COM_QUERY or COM_STMT_EXECUTE and
+// its OK packet as seen in the capture.
+func (fsm *MySQLFSM) Latency() time.Duration { return fsm.latency }
+
 func (fsm *MySQLFSM) Schema() string { return fsm.schema }
 
+func (fsm *MySQLFSM) Charset() uint8 { return fsm.charset }
+
+func (fsm *MySQLFSM) User() string { return fsm.user }
+
 func (fsm *MySQLFSM) Changed() bool { return fsm.changed }
 
 func (fsm *MySQLFSM) Ready() bool {
@@ -142,6 +193,8 @@ func (fsm *MySQLFSM) Handle(pkt MySQLPacket) {
 		fsm.handleComStmtPrepareResponse()
 	} else if fsm.state == StateHandshake0 {
 		fsm.handleHandshakeResponse()
+	} else if (fsm.state == StateComQuery || fsm.state == StateComStmtExecute) && len(fsm.packets) == fsm.count+1 {
+		fsm.handleResult()
 	}
 }
 
@@ -203,14 +256,16 @@ func (fsm *MySQLFSM) set(to int, msg ...string) {
 	case StateComQuery:
 		tmpl += fmt.Sprintf("{query:%q}", query)
 	case StateComStmtExecute:
-		tmpl += fmt.Sprintf("{query:%q,id:%d,params:%v}", query, fsm.stmt.ID, fsm.params)
+		tmpl += fmt.Sprintf("{query:%q,id:%d,params:%v,cursor:%d}", query, fsm.stmt.ID, fsm.params, fsm.cursor)
+	case StateComStmtFetch:
+		tmpl += fmt.Sprintf("{query:%q,id:%d,rows:%d}", query, fsm.stmt.ID, fsm.rows)
 	case StateComStmtPrepare0:
 		tmpl += fmt.Sprintf("{query:%q}", query)
 	case StateComStmtPrepare1:
 		tmpl += fmt.Sprintf("{query:%q,id:%d,num-params:%d}", query, fsm.stmt.ID, fsm.stmt.NumParams)
 	case StateComStmtClose:
 		tmpl += fmt.Sprintf("{query:%q,id:%d,num-params:%d}", query, fsm.stmt.ID, fsm.stmt.NumParams)
-	case StateHandshake1:
+	case StateHandshake1, StateComInitDB:
 		tmpl += fmt.Sprintf("{schema:%q}", fsm.schema)
 	}
 	if len(msg) > 0 {
@@ -239,13 +294,6 @@ func (fsm *MySQLFSM) assertDataChunk(offset int, exp []byte) bool {
 	return bytes.Equal(data[offset:offset+len(exp)], exp)
 }
 
-func (fsm *MySQLFSM) isClientCommand(cmd byte) bool {
-	if !fsm.assertDir(reassembly.TCPDirClientToServer) {
-		return false
-	}
-	return fsm.assertDataByte(0, cmd)
-}
-
 func (fsm *MySQLFSM) isHandshakeRequest() bool {
 	if !fsm.assertDir(reassembly.TCPDirServerToClient) {
 		return false
@@ -259,30 +307,72 @@ func (fsm *MySQLFSM) isHandshakeRequest() bool {
 
 func (fsm *MySQLFSM) handleInitPacket() {
 	if !fsm.load(0) {
+		stats.Add(stats.UndecodedPackets, 1)
 		fsm.set(StateUnknown, "init: cannot load packet")
 		return
 	}
-	if fsm.isClientCommand(comQuery) {
-		fsm.handleComQueryNoLoad()
-	} else if fsm.isClientCommand(comStmtExecute) {
-		fsm.handleComStmtExecuteNoLoad()
-	} else if fsm.isClientCommand(comStmtPrepare) {
-		fsm.handleComStmtPrepareRequestNoLoad()
-	} else if fsm.isClientCommand(comStmtClose) {
-		fsm.handleComStmtCloseNoLoad()
-	} else if fsm.isClientCommand(comQuit) {
-		fsm.set(StateComQuit)
+	if handle, ok := fsm.commandHandler(); ok {
+		handle(fsm)
 	} else if fsm.isHandshakeRequest() {
 		fsm.set(StateHandshake0)
 	} else {
 		if fsm.assertDir(reassembly.TCPDirClientToServer) && fsm.data.Len() > 0 {
-			fsm.set(StateUnknown, fmt.Sprintf("init: skip client command(0x%02x)", fsm.data.Bytes()[0]))
+			cmd := fsm.data.Bytes()[0]
+			stats.Add(stats.SkippedCommands, 1)
+			stats.Add(stats.SkippedCommands+"."+comName(cmd), 1)
+			fsm.set(StateUnknown, fmt.Sprintf("init: skip client command(0x%02x)", cmd))
 		} else {
+			stats.Add(stats.UndecodedPackets, 1)
 			fsm.set(StateUnknown, "init: unsupported packet")
 		}
 	}
 }
 
+// commandHandlers decode client commands in the init state, other commands are
+// skipped, see Commands.
+var commandHandlers = map[byte]func(fsm *MySQLFSM){
+	comQuery:       (*MySQLFSM).handleComQueryNoLoad,
+	comStmtExecute: (*MySQLFSM).handleComStmtExecuteNoLoad,
+	comStmtPrepare: (*MySQLFSM).handleComStmtPrepareRequestNoLoad,
+	comStmtClose:   (*MySQLFSM).handleComStmtCloseNoLoad,
+	comStmtFetch:   (*MySQLFSM).handleComStmtFetchNoLoad,
+	comInitDB:      (*MySQLFSM).handleComInitDBNoLoad,
+	comQuit:        (*MySQLFSM).handleComQuitNoLoad,
+}
+
+func (fsm *MySQLFSM) commandHandler() (func(fsm *MySQLFSM), bool) {
+	if !fsm.assertDir(reassembly.TCPDirClientToServer) || fsm.data.Len() == 0 {
+		return nil, false
+	}
+	handle, ok := commandHandlers[fsm.data.Bytes()[0]]
+	return handle, ok
+}
+
+func (fsm *MySQLFSM) handleComInitDBNoLoad() {
+	fsm.schema = string(fsm.data.Bytes()[1:])
+	fsm.set(StateComInitDB)
+}
+
+func (fsm *MySQLFSM) handleComQuitNoLoad() {
+	fsm.set(StateComQuit)
+}
+
+var comNames = []string{
+	"com_sleep", "com_quit", "com_init_db", "com_query", "com_field_list", "com_create_db", "com_drop_db",
+	"com_refresh", "com_shutdown", "com_statistics", "com_process_info", "com_connect", "com_process_kill",
+	"com_debug", "com_ping", "com_time", "com_delayed_insert", "com_change_user", "com_binlog_dump",
+	"com_table_dump", "com_connect_out", "com_register_slave", "com_stmt_prepare", "com_stmt_execute",
+	"com_stmt_send_long_data", "com_stmt_close", "com_stmt_reset", "com_set_option", "com_stmt_fetch",
+}
+
+// comName returns the name of the command like com_ping.
+func comName(cmd byte) string {
+	if int(cmd) < len(comNames) {
+		return comNames[cmd]
+	}
+	return fmt.Sprintf("com_0x%02x", cmd)
+}
+
 func (fsm *MySQLFSM) handleComQueryNoLoad() {
 	fsm.query = string(fsm.data.Bytes()[1:])
 	fsm.set(StateComQuery)
@@ -304,10 +394,12 @@ func (fsm *MySQLFSM) handleComStmtExecuteNoLoad() {
 		fsm.set(StateUnknown, "stmt execute: unknown stmt id")
 		return
 	}
-	if _, data, ok = readBytesN(data, 5); !ok {
+	var bs []byte
+	if bs, data, ok = readBytesN(data, 5); !ok {
 		fsm.set(StateUnknown, "stmt execute: cannot read flag and iteration-count")
 		return
 	}
+	cursor := bs[0]
 	if stmt.NumParams > 0 {
 		var (
 			nullBitmaps []byte
@@ -345,9 +437,29 @@ func (fsm *MySQLFSM) handleComStmtExecuteNoLoad() {
 	}
 	fsm.stmt = stmt
 	fsm.params = params
+	fsm.cursor = cursor
 	fsm.set(StateComStmtExecute)
 }
 
+func (fsm *MySQLFSM) handleComStmtFetchNoLoad() {
+	stmtID, data, ok := readUint32(fsm.data.Bytes()[1:])
+	if !ok {
+		fsm.set(StateUnknown, "stmt fetch: cannot read stmt id")
+		return
+	}
+	rows, _, ok := readUint32(data)
+	if !ok {
+		fsm.set(StateUnknown, "stmt fetch: cannot read number of rows")
+		return
+	}
+	if fsm.stmt, ok = fsm.stmts[stmtID]; !ok {
+		fsm.set(StateUnknown, "stmt fetch: unknown stmt id")
+		return
+	}
+	fsm.rows = rows
+	fsm.set(StateComStmtFetch)
+}
+
 func (fsm *MySQLFSM) handleComStmtCloseNoLoad() {
 	stmtID, _, ok := readUint32(fsm.data.Bytes()[1:])
 	if !ok {
@@ -401,6 +513,21 @@ func (fsm *MySQLFSM) handleComStmtPrepareResponse() {
 	fsm.set(StateComStmtPrepare1)
 }
 
+// handleResult handles the first packet of the response to a statement, only
+// OK packets are recognized as results while result sets are ignored.
+func (fsm *MySQLFSM) handleResult() {
+	if !fsm.load(fsm.count) || !fsm.assertDir(reassembly.TCPDirServerToClient) || !fsm.assertDataByte(0, iOK) {
+		return
+	}
+	data := fsm.data.Bytes()
+	if len(data) < 7 || (data[1] == 0xfe && len(data) < 10) {
+		return
+	}
+	fsm.result, _, _ = parseLengthEncodedInt(data[1:])
+	fsm.latency = fsm.packets[fsm.count].Time.Sub(fsm.packets[0].Time)
+	fsm.set(StateComResult)
+}
+
 func (fsm *MySQLFSM) handleHandshakeResponse() {
 	if !fsm.load(1) {
 		fsm.set(StateUnknown, "handshake: cannot load packet")
@@ -422,6 +549,12 @@ func (fsm *MySQLFSM) handleHandshakeResponse() {
 	}
 	flags |= clientFlag(bs[0])
 	flags |= clientFlag(bs[1]) << 8
+	for _, f := range clientFeatures {
+		if !f.supported && flags&f.flag > 0 {
+			fsm.set(StateUnknown, "handshake: "+f.name+" is not supported")
+			return
+		}
+	}
 	if flags&clientProtocol41 > 0 {
 		if bs, data, ok = readBytesN(data, 2); !ok {
 			fsm.set(StateUnknown, "handshake: cannot read extended capability flags")
@@ -429,14 +562,16 @@ func (fsm *MySQLFSM) handleHandshakeResponse() {
 		}
 		flags |= clientFlag(bs[0]) << 16
 		flags |= clientFlag(bs[1]) << 24
-		if _, data, ok = readBytesN(data, 28); !ok {
+		if bs, data, ok = readBytesN(data, 28); !ok {
 			fsm.set(StateUnknown, "handshake: cannot read max-packet size, character set and reserved")
 			return
 		}
-		if _, data, ok = readBytesNUL(data); !ok {
+		fsm.charset = bs[4]
+		if bs, data, ok = readBytesNUL(data); !ok {
 			fsm.set(StateUnknown, "handshake: cannot read username")
 			return
 		}
+		fsm.user = string(bs)
 		if flags&clientPluginAuthLenEncClientData > 0 {
 			var n uint64
 			if n, data, ok = readLenEncUint(data); !ok {
@@ -599,6 +734,7 @@ func parseExecParams(stmt Stmt, nullBitmap []byte, paramTypes []byte, paramValue
 			pos += 1
 			switch length {
 			case 0:
+				params[i] = "0 00:00:00"
 			case 8:
 				if paramValues[pos] > 1 {
 					return nil, errors.New("malformed values")
@@ -614,7 +750,7 @@ func parseExecParams(stmt Stmt, nullBitmap []byte, paramTypes []byte, paramValue
 			default:
 				return nil, errors.New("malformed values")
 			}
-		case fieldTypeNewDecimal, fieldTypeDecimal, fieldTypeVarChar, fieldTypeVarString, fieldTypeString, fieldTypeEnum, fieldTypeSet, fieldTypeGeometry, fieldTypeBit:
+		case fieldTypeNewDecimal, fieldTypeDecimal, fieldTypeVarChar, fieldTypeVarString, fieldTypeString, fieldTypeEnum, fieldTypeSet, fieldTypeGeometry, fieldTypeBit, fieldTypeJSON:
 			if len(paramValues) < pos+1 {
 				return nil, errors.New("malformed values")
 			}
@@ -811,3 +947,37 @@ func readLenEncUint(data []byte) (uint64, []byte, bool) {
 		return 0, data, false
 	}
 }
+
+// clientFeatures are protocol features negotiated by capability flags of the
+// handshake response, sessions negotiating unsupported ones are skipped.
+var clientFeatures = []struct {
+	flag      clientFlag
+	name      string
+	supported bool
+}{
+	{clientSSL, "tls", false},
+	{clientCompress, "compression", false},
+}
+
+// Commands returns names of client commands that can be decoded into events.
+func Commands() []string {
+	cmds := make([]int, 0, len(commandHandlers))
+	for cmd := range commandHandlers {
+		cmds = append(cmds, int(cmd))
+	}
+	sort.Ints(cmds)
+	names := make([]string, 0, len(cmds)+1)
+	for _, cmd := range cmds {
+		names = append(names, strings.ToUpper(comName(byte(cmd))))
+	}
+	return append(names, "HANDSHAKE_RESPONSE")
+}
+
+// Features reports protocol features supported by the decoder.
+func Features() map[string]bool {
+	features := make(map[string]bool, len(clientFeatures))
+	for _, f := range clientFeatures {
+		features[f.name] = f.supported
+	}
+	return features
+}
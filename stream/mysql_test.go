@@ -0,0 +1,50 @@
+package stream
+
+import (
+	"testing"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMySQLHandshakeFeatures(t *testing.T) {
+	response := func(flags clientFlag) []byte {
+		flags |= clientProtocol41 | clientSecureConn | clientConnectWithDB
+		data := []byte{byte(flags), byte(flags >> 8), byte(flags >> 16), byte(flags >> 24)}
+		data = append(data, make([]byte, 28)...)
+		data = append(data, "root\x00"...)
+		data = append(data, 0)
+		return append(data, "test\x00"...)
+	}
+	for _, tt := range []struct {
+		name  string
+		flags clientFlag
+		state int
+	}{
+		{"plain", 0, StateHandshake1},
+		{"tls", clientSSL, StateUnknown},
+		{"compression", clientCompress, StateUnknown},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			fsm := NewMySQLFSM(zap.NewNop())
+			greeting := append([]byte{handshakeV10}, "8.0.0\x00"...)
+			fsm.Handle(MySQLPacket{Dir: reassembly.TCPDirServerToClient, Seq: 0, Len: len(greeting), Data: greeting})
+			require.Equal(t, StateHandshake0, fsm.State())
+			data := response(tt.flags)
+			fsm.Handle(MySQLPacket{Dir: reassembly.TCPDirClientToServer, Seq: 1, Len: len(data), Data: data})
+			require.Equal(t, tt.state, fsm.State())
+			if tt.flags != 0 {
+				require.Equal(t, tt.state != StateUnknown, Features()[tt.name])
+			}
+		})
+	}
+}
+
+func TestMySQLCommands(t *testing.T) {
+	cmds := Commands()
+	require.Len(t, cmds, len(commandHandlers)+1)
+	require.Contains(t, cmds, "COM_QUERY")
+	require.Contains(t, cmds, "COM_STMT_FETCH")
+	require.Equal(t, "HANDSHAKE_RESPONSE", cmds[len(cmds)-1])
+}
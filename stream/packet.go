@@ -19,6 +19,13 @@ type MySQLPacketHandler interface {
 	OnClose()
 }
 
+// GapHandler is optionally implemented by a MySQLPacketHandler to be told of
+// data lost in the capture, OnGap is called with a packet marking the gap in
+// order with calls to OnPacket.
+type GapHandler interface {
+	OnGap(pkt MySQLPacket)
+}
+
 var _ MySQLPacketHandler = &defaultHandler{}
 
 type defaultHandler struct {
@@ -0,0 +1,290 @@
+package stream
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/zyguan/mysql-replay/event"
+	"go.uber.org/zap"
+)
+
+const (
+	pgProtocolV3    = 196608
+	pgSSLRequest    = 80877103
+	pgGSSRequest    = 80877104
+	pgCancelRequest = 80877102
+
+	pgMaxMessageSize = 1 << 30
+)
+
+type pgProtocol struct{}
+
+func (pgProtocol) Name() string { return "pg" }
+
+func (pgProtocol) NewFramer() Framer { return &pgFramer{} }
+
+func (pgProtocol) NewDecoder(log *zap.Logger) Decoder {
+	return &pgDecoder{log: log, stmts: make(map[string]uint64), portals: make(map[string]*pgPortal)}
+}
+
+// pgFramer frames messages of the postgres protocol, which are led by a type
+// byte and a 4-byte length except the untyped startup messages sent first by
+// clients. The payload of a message excludes the type and the length, and the
+// type is returned as the seq (0 for startup messages). Streams encrypted by
+// ssl or gss are skipped.
+type pgFramer struct {
+	started   bool
+	requested bool
+	encrypted bool
+}
+
+func (f *pgFramer) Start(dir reassembly.TCPFlowDirection, data []byte) bool {
+	return dir == reassembly.TCPDirClientToServer
+}
+
+func (f *pgFramer) Next(dir reassembly.TCPFlowDirection, data []byte) (int, []byte, int) {
+	if f.encrypted {
+		return len(data), nil, 0
+	}
+	if dir == reassembly.TCPDirServerToClient && f.requested {
+		// the single-byte answer to an ssl or gss request
+		f.requested = false
+		f.encrypted = data[0] == 'S' || data[0] == 'G'
+		return 1, nil, 0
+	}
+	if dir == reassembly.TCPDirClientToServer && !f.started && (len(data) == 0 || data[0] == 0) {
+		if len(data) < 8 {
+			return 0, nil, -1
+		}
+		n := int(binary.BigEndian.Uint32(data))
+		if n < 8 || n > pgMaxMessageSize {
+			return len(data), nil, 0
+		} else if len(data) < n {
+			return 0, nil, 0
+		}
+		switch binary.BigEndian.Uint32(data[4:]) {
+		case pgSSLRequest, pgGSSRequest:
+			f.requested = true
+			return n, nil, 0
+		case pgCancelRequest:
+			return n, nil, 0
+		}
+		f.started = true
+		return n, data[4:n], 0
+	}
+	f.started = f.started || dir == reassembly.TCPDirClientToServer
+	if len(data) < 5 {
+		return 0, nil, -1
+	}
+	n := int(binary.BigEndian.Uint32(data[1:]))
+	if n < 4 || n > pgMaxMessageSize {
+		return len(data), nil, int(data[0])
+	} else if len(data) < n+1 {
+		return 0, nil, int(data[0])
+	}
+	return n + 1, data[5 : n+1], int(data[0])
+}
+
+type pgPortal struct {
+	stmt     uint64
+	params   []interface{}
+	executed bool
+}
+
+// pgDecoder decodes frontend messages into events. Statements which are
+// named by strings in postgres are numbered in the order of parsing, and the
+// re-parse of a statement closes the previous one. A portal is executed as a
+// stmt execute at first and as fetches afterwards.
+type pgDecoder struct {
+	log     *zap.Logger
+	next    uint64
+	stmts   map[string]uint64
+	portals map[string]*pgPortal
+}
+
+func (d *pgDecoder) Decode(pkt MySQLPacket, emit func(e event.MySQLEvent)) {
+	if pkt.Dir != reassembly.TCPDirClientToServer {
+		return
+	}
+	var (
+		e = event.MySQLEvent{Time: pkt.Time.UnixNano() / int64(time.Millisecond)}
+		r = pgReader{data: pkt.Data}
+	)
+	switch pkt.Seq {
+	case 0:
+		if r.int32() != pgProtocolV3 {
+			return
+		}
+		e.Type = event.EventHandshake
+		for r.more() {
+			k := r.str()
+			if len(k) == 0 {
+				break
+			}
+			switch v := r.str(); k {
+			case "user":
+				e.User = v
+			case "database":
+				e.DB = v
+			}
+		}
+		if len(e.DB) == 0 {
+			e.DB = e.User
+		}
+		d.stmts = make(map[string]uint64)
+		d.portals = make(map[string]*pgPortal)
+	case 'Q':
+		e.Type = event.EventQuery
+		e.Query = r.str()
+	case 'P':
+		name, query := r.str(), r.str()
+		if id, ok := d.stmts[name]; ok {
+			emit(event.MySQLEvent{Time: e.Time, Type: event.EventStmtClose, StmtID: id})
+		}
+		d.next += 1
+		d.stmts[name] = d.next
+		e.Type = event.EventStmtPrepare
+		e.StmtID = d.next
+		e.Query = query
+	case 'B':
+		portal, name := r.str(), r.str()
+		formats := make([]int16, r.count())
+		for i := range formats {
+			formats[i] = r.int16()
+		}
+		params := make([]interface{}, r.count())
+		for i := range params {
+			n := r.int32()
+			if n < 0 {
+				continue
+			}
+			val := r.next(int(n))
+			if f := formats; len(f) == 1 && f[0] == 1 || len(f) > i && f[i] == 1 {
+				params[i] = append([]byte{}, val...)
+			} else {
+				params[i] = string(val)
+			}
+		}
+		if r.err != nil {
+			d.log.Debug("pg: cannot read bind message", zap.Error(r.err))
+			return
+		}
+		id, ok := d.stmts[name]
+		if !ok {
+			d.log.Debug("pg: bind to unknown stmt", zap.String("stmt", name))
+			return
+		}
+		d.portals[portal] = &pgPortal{stmt: id, params: params}
+		return
+	case 'E':
+		name, rows := r.str(), r.int32()
+		portal, ok := d.portals[name]
+		if !ok {
+			return
+		}
+		e.StmtID = portal.stmt
+		if portal.executed {
+			e.Type = event.EventStmtFetch
+			e.Rows = uint64(rows)
+		} else {
+			e.Type = event.EventStmtExecute
+			e.Params = portal.params
+			portal.executed = true
+		}
+	case 'C':
+		kind, name := r.byte(), r.str()
+		if kind == 'P' {
+			delete(d.portals, name)
+			return
+		}
+		id, ok := d.stmts[name]
+		if kind != 'S' || !ok {
+			return
+		}
+		delete(d.stmts, name)
+		e.Type = event.EventStmtClose
+		e.StmtID = id
+	case 'X':
+		e.Type = event.EventQuit
+	default:
+		return
+	}
+	if r.err != nil {
+		d.log.Debug(fmt.Sprintf("pg: cannot read message(%c)", pkt.Seq), zap.Error(r.err))
+		return
+	}
+	emit(e)
+}
+
+// pgReader reads fields from a message, the first error is kept in err and
+// later reads return zero values.
+type pgReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *pgReader) more() bool { return r.err == nil && r.pos < len(r.data) }
+
+func (r *pgReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || r.pos+n > len(r.data) {
+		r.err = fmt.Errorf("read %d bytes at %d of %d", n, r.pos, len(r.data))
+		return nil
+	}
+	bs := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return bs
+}
+
+func (r *pgReader) byte() byte {
+	if bs := r.next(1); len(bs) == 1 {
+		return bs[0]
+	}
+	return 0
+}
+
+func (r *pgReader) int16() int16 {
+	if bs := r.next(2); len(bs) == 2 {
+		return int16(binary.BigEndian.Uint16(bs))
+	}
+	return 0
+}
+
+// count reads a non-negative int16 count.
+func (r *pgReader) count() int {
+	n := int(r.int16())
+	if n < 0 && r.err == nil {
+		r.err = fmt.Errorf("negative count %d at %d", n, r.pos-2)
+	}
+	if r.err != nil {
+		return 0
+	}
+	return n
+}
+
+func (r *pgReader) int32() int32 {
+	if bs := r.next(4); len(bs) == 4 {
+		return int32(binary.BigEndian.Uint32(bs))
+	}
+	return 0
+}
+
+func (r *pgReader) str() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.data[r.pos:], 0)
+	if i < 0 {
+		r.err = fmt.Errorf("no string terminator at %d", r.pos)
+		return ""
+	}
+	s := string(r.data[r.pos : r.pos+i])
+	r.pos += i + 1
+	return s
+}
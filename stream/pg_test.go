@@ -0,0 +1,224 @@
+package stream
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/stretchr/testify/require"
+	"github.com/zyguan/mysql-replay/event"
+	"go.uber.org/zap"
+)
+
+const (
+	pgC2S = reassembly.TCPDirClientToServer
+	pgS2C = reassembly.TCPDirServerToClient
+)
+
+func pgStr(s string) []byte { return append([]byte(s), 0) }
+
+func pgInt16(n int16) []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, uint16(n))
+	return buf
+}
+
+func pgInt32(n int32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, uint32(n))
+	return buf
+}
+
+func pgJoin(parts ...[]byte) []byte {
+	var buf []byte
+	for _, p := range parts {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+// pgMessage returns a message led by the type (none if zero) and the length.
+func pgMessage(typ byte, payload []byte) []byte {
+	var buf []byte
+	if typ != 0 {
+		buf = append(buf, typ)
+	}
+	buf = append(buf, pgInt32(int32(len(payload)+4))...)
+	return append(buf, payload...)
+}
+
+func pgStartup(params ...string) []byte {
+	payload := pgInt32(pgProtocolV3)
+	for _, p := range params {
+		payload = append(payload, pgStr(p)...)
+	}
+	return pgMessage(0, append(payload, 0))
+}
+
+func TestPgFramer(t *testing.T) {
+	startup := pgStartup("user", "root")
+	query := pgMessage('Q', pgStr("select 1"))
+	type step struct {
+		dir     reassembly.TCPFlowDirection
+		data    []byte
+		size    int
+		payload []byte
+		seq     int
+	}
+	for _, tt := range []struct {
+		name  string
+		steps []step
+	}{
+		{"startup", []step{
+			{pgC2S, startup, len(startup), startup[4:], 0},
+			{pgC2S, query, len(query), pgStr("select 1"), 'Q'},
+		}},
+		{"incomplete", []step{
+			{pgC2S, startup[:6], 0, nil, -1},
+			{pgC2S, startup[:10], 0, nil, 0},
+			{pgC2S, startup, len(startup), startup[4:], 0},
+			{pgC2S, query[:3], 0, nil, -1},
+			{pgC2S, query[:8], 0, nil, 'Q'},
+			{pgS2C, pgMessage('Z', []byte{'I'}), 6, []byte{'I'}, 'Z'},
+		}},
+		{"ssl refused", []step{
+			{pgC2S, pgMessage(0, pgInt32(pgSSLRequest)), 8, nil, 0},
+			{pgS2C, []byte{'N'}, 1, nil, 0},
+			{pgC2S, startup, len(startup), startup[4:], 0},
+		}},
+		{"ssl accepted", []step{
+			{pgC2S, pgMessage(0, pgInt32(pgSSLRequest)), 8, nil, 0},
+			{pgS2C, []byte{'S'}, 1, nil, 0},
+			{pgC2S, []byte{0x16, 3, 1, 0, 1}, 5, nil, 0},
+			{pgS2C, query, len(query), nil, 0},
+		}},
+		{"cancel", []step{
+			{pgC2S, pgMessage(0, pgJoin(pgInt32(pgCancelRequest), pgInt32(1), pgInt32(2))), 16, nil, 0},
+		}},
+		{"invalid length", []step{
+			{pgC2S, startup, len(startup), startup[4:], 0},
+			{pgC2S, []byte{'Q', 0, 0, 0, 1, 'x'}, 6, nil, 'Q'},
+		}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Postgres.NewFramer()
+			require.True(t, f.Start(pgC2S, tt.steps[0].data))
+			require.False(t, f.Start(pgS2C, tt.steps[0].data))
+			for i, s := range tt.steps {
+				size, payload, seq := f.Next(s.dir, s.data)
+				require.Equal(t, s.size, size, "size of step %d", i)
+				require.Equal(t, s.payload, payload, "payload of step %d", i)
+				require.Equal(t, s.seq, seq, "seq of step %d", i)
+			}
+		})
+	}
+}
+
+func TestPgDecoder(t *testing.T) {
+	type message struct {
+		seq     int
+		payload []byte
+	}
+	bind := func(portal string, stmt string, formats []int16, params ...[]byte) message {
+		payload := pgJoin(pgStr(portal), pgStr(stmt), pgInt16(int16(len(formats))))
+		for _, f := range formats {
+			payload = append(payload, pgInt16(f)...)
+		}
+		payload = append(payload, pgInt16(int16(len(params)))...)
+		for _, p := range params {
+			if p == nil {
+				payload = append(payload, pgInt32(-1)...)
+				continue
+			}
+			payload = append(payload, pgInt32(int32(len(p)))...)
+			payload = append(payload, p...)
+		}
+		return message{'B', append(payload, pgInt16(0)...)}
+	}
+	execute := func(portal string, rows int32) message {
+		return message{'E', pgJoin(pgStr(portal), pgInt32(rows))}
+	}
+	parse := func(stmt string, query string) message {
+		return message{'P', pgJoin(pgStr(stmt), pgStr(query), pgInt16(0))}
+	}
+	for _, tt := range []struct {
+		name     string
+		messages []message
+		expect   []event.MySQLEvent
+	}{
+		{"startup", []message{
+			{0, pgStartup("user", "root", "database", "test")[4:]},
+			{0, pgStartup("user", "root")[4:]},
+			{0, pgJoin(pgInt32(pgProtocolV3-1), []byte{0})},
+		}, []event.MySQLEvent{
+			{Type: event.EventHandshake, User: "root", DB: "test"},
+			{Type: event.EventHandshake, User: "root", DB: "root"},
+		}},
+		{"simple query", []message{
+			{'Q', pgStr("select 1")},
+			{'S', nil},
+			{'X', nil},
+		}, []event.MySQLEvent{
+			{Type: event.EventQuery, Query: "select 1"},
+			{Type: event.EventQuit},
+		}},
+		{"extended query", []message{
+			parse("s1", "select $1, $2, $3"),
+			bind("", "s1", []int16{0, 1}, []byte("1"), []byte{0, 1}, nil),
+			execute("", 0),
+			bind("", "s1", []int16{1}, []byte("x"), []byte("y"), []byte("z")),
+			execute("", 0),
+			{'C', pgJoin([]byte{'P'}, pgStr(""))},
+			{'C', pgJoin([]byte{'S'}, pgStr("s1"))},
+		}, []event.MySQLEvent{
+			{Type: event.EventStmtPrepare, StmtID: 1, Query: "select $1, $2, $3"},
+			{Type: event.EventStmtExecute, StmtID: 1, Params: []interface{}{"1", []byte{0, 1}, nil}},
+			{Type: event.EventStmtExecute, StmtID: 1, Params: []interface{}{[]byte("x"), []byte("y"), []byte("z")}},
+			{Type: event.EventStmtClose, StmtID: 1},
+		}},
+		{"portal fetches", []message{
+			parse("", "select * from t"),
+			bind("c1", "", nil),
+			execute("c1", 10),
+			execute("c1", 10),
+			execute("c2", 10),
+		}, []event.MySQLEvent{
+			{Type: event.EventStmtPrepare, StmtID: 1, Query: "select * from t"},
+			{Type: event.EventStmtExecute, StmtID: 1, Params: []interface{}{}},
+			{Type: event.EventStmtFetch, StmtID: 1, Rows: 10},
+		}},
+		{"re-parse closes", []message{
+			parse("", "select 1"),
+			parse("", "select 2"),
+		}, []event.MySQLEvent{
+			{Type: event.EventStmtPrepare, StmtID: 1, Query: "select 1"},
+			{Type: event.EventStmtClose, StmtID: 1},
+			{Type: event.EventStmtPrepare, StmtID: 2, Query: "select 2"},
+		}},
+		{"malformed", []message{
+			{'Q', []byte("select 1")},
+			bind("", "unknown", nil),
+			{'B', pgJoin(pgStr(""), pgStr(""), pgInt16(-1))},
+			{'E', pgStr("")},
+		}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				dec    = Postgres.NewDecoder(zap.NewNop())
+				events []event.MySQLEvent
+				now    = time.Unix(1700000000, 0)
+			)
+			for _, m := range tt.messages {
+				dec.Decode(MySQLPacket{Time: now, Dir: pgC2S, Seq: m.seq, Data: m.payload}, func(e event.MySQLEvent) {
+					e.Time = 0
+					events = append(events, e)
+				})
+			}
+			dec.Decode(MySQLPacket{Time: now, Dir: pgS2C, Seq: 'Z', Data: []byte{'I'}}, func(e event.MySQLEvent) {
+				t.Errorf("unexpected event of the server: %v", e)
+			})
+			require.Equal(t, tt.expect, events)
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package stream
+
+import (
+	"time"
+
+	"github.com/google/gopacket/reassembly"
+	"github.com/zyguan/mysql-replay/event"
+	"github.com/zyguan/mysql-replay/stats"
+	"go.uber.org/zap"
+)
+
+// Protocol is a wire protocol of which streams can be decoded into events.
+type Protocol interface {
+	Name() string
+	// NewFramer returns a framer of a new stream.
+	NewFramer() Framer
+	// NewDecoder returns a decoder of a new connection.
+	NewDecoder(log *zap.Logger) Decoder
+}
+
+// Framer splits reassembled data of a stream into packets, it is stateful
+// and is called for data of both directions in order.
+type Framer interface {
+	// Start tells whether a direction may start with data when nothing has
+	// been seen in the other direction, data is dropped if not.
+	Start(dir reassembly.TCPFlowDirection, data []byte) bool
+	// Next returns the size of the next packet (header included) in data, its
+	// payload (which aliases data) and seq. It returns a zero size if more
+	// data is needed, and a nil payload if the data should be skipped. The seq
+	// is -1 if even the header is incomplete.
+	Next(dir reassembly.TCPFlowDirection, data []byte) (size int, payload []byte, seq int)
+}
+
+// Decoder decodes packets of a connection into events, calls of emit are
+// never retained.
+type Decoder interface {
+	Decode(pkt MySQLPacket, emit func(e event.MySQLEvent))
+}
+
+var (
+	// MySQL is the mysql client/server protocol.
+	MySQL Protocol = mysqlProtocol{}
+	// Postgres is the postgresql frontend/backend protocol (version 3).
+	Postgres Protocol = pgProtocol{}
+)
+
+// Protocols returns supported protocols.
+func Protocols() []Protocol { return []Protocol{MySQL, Postgres} }
+
+type mysqlProtocol struct{}
+
+func (mysqlProtocol) Name() string { return "mysql" }
+
+func (mysqlProtocol) NewFramer() Framer { return mysqlFramer{} }
+
+func (mysqlProtocol) NewDecoder(log *zap.Logger) Decoder {
+	return &mysqlDecoder{fsm: NewMySQLFSM(log)}
+}
+
+// mysqlFramer frames packets by the 3-byte length and 1-byte seq headers.
+type mysqlFramer struct{}
+
+func (mysqlFramer) Start(dir reassembly.TCPFlowDirection, data []byte) bool {
+	return len(data) >= 4 && data[3] == 0
+}
+
+func (mysqlFramer) Next(dir reassembly.TCPFlowDirection, data []byte) (int, []byte, int) {
+	if len(data) < 4 {
+		return 0, nil, -1
+	}
+	n := int(uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16)
+	if len(data) < n+4 {
+		return 0, nil, int(data[3])
+	}
+	return n + 4, data[4 : n+4], int(data[3])
+}
+
+type mysqlDecoder struct {
+	fsm *MySQLFSM
+}
+
+func (d *mysqlDecoder) Decode(pkt MySQLPacket, emit func(e event.MySQLEvent)) {
+	fsm := d.fsm
+	fsm.Handle(pkt)
+	if !fsm.Ready() || !fsm.Changed() {
+		return
+	}
+	e := event.MySQLEvent{Time: pkt.Time.UnixNano() / int64(time.Millisecond)}
+	switch fsm.State() {
+	case StateComQuery:
+		e.Type = event.EventQuery
+		e.Query = fsm.Query()
+	case StateComStmtExecute:
+		stmt := fsm.Stmt()
+		e.Type = event.EventStmtExecute
+		e.StmtID = uint64(stmt.ID)
+		e.Params = fsm.StmtParams()
+		e.ParamTypes = fsm.StmtParamTypes()
+		e.Cursor = uint64(fsm.StmtCursor())
+	case StateComStmtPrepare1:
+		stmt := fsm.Stmt()
+		e.Type = event.EventStmtPrepare
+		e.StmtID = uint64(stmt.ID)
+		e.Query = stmt.Query
+	case StateComStmtClose:
+		stmt := fsm.Stmt()
+		e.Type = event.EventStmtClose
+		e.StmtID = uint64(stmt.ID)
+	case StateHandshake1:
+		e.Type = event.EventHandshake
+		e.DB = fsm.Schema()
+		e.Charset = uint64(fsm.Charset())
+		e.User = fsm.User()
+	case StateComStmtFetch:
+		stmt := fsm.Stmt()
+		e.Type = event.EventStmtFetch
+		e.StmtID = uint64(stmt.ID)
+		e.Rows = uint64(fsm.FetchRows())
+	case StateComInitDB:
+		e.Type = event.EventInitDB
+		e.DB = fsm.Schema()
+	case StateComQuit:
+		e.Type = event.EventQuit
+	case StateComResult:
+		e.Type = event.EventResult
+		e.Affected = fsm.AffectedRows()
+		if d := fsm.Latency(); d > 0 {
+			e.Latency = uint64(d / time.Microsecond)
+		}
+	default:
+		return
+	}
+	stats.Add(stats.EventCounter(event.TypeName(e.Type)), 1)
+	emit(e)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"net"
 	"time"
 
 	"github.com/google/gopacket"
@@ -20,16 +21,24 @@ type MySQLPacket struct {
 	Len  int
 	Seq  int
 	Data []byte
+	// Gap (if positive) marks Gap bytes lost in the direction of the
+	// connection, such a packet carries no data.
+	Gap int
 }
 
+// ConnID identifies a connection by its network and transport flows, which
+// are oriented from the client to the server if the server is identified by
+// FactoryOptions.Ports, or by the first packet seen otherwise.
 type ConnID [2]gopacket.Flow
 
+// SrcAddr returns the source address like host:port, ipv6 hosts are enclosed
+// in brackets.
 func (k ConnID) SrcAddr() string {
-	return k[0].Src().String() + ":" + k[1].Src().String()
+	return net.JoinHostPort(k[0].Src().String(), k[1].Src().String())
 }
 
 func (k ConnID) DstAddr() string {
-	return k[0].Dst().String() + ":" + k[1].Dst().String()
+	return net.JoinHostPort(k[0].Dst().String(), k[1].Dst().String())
 }
 
 func (k ConnID) String() string {
@@ -67,43 +76,85 @@ type FactoryOptions struct {
 	ConnCacheSize uint
 	Synchronized  bool
 	ForceStart    bool
+	// Budget (if any) accounts bytes buffered by streams for partial packets.
+	Budget *MemoryBudget
+	// Ports (if any) maps tcp ports of servers to names of their protocols,
+	// then only connections to ports of the protocol of the factory are
+	// accepted, whose server sides are identified by the ports.
+	Ports map[uint16]string
+	// Results emits results of statements in the capture (e.g. rows affected)
+	// as events of event.EventResult.
+	Results bool
 }
 
 func NewFactoryFromPacketHandler(factory func(ConnID) MySQLPacketHandler, opts FactoryOptions) *mysqlStreamFactory {
 	if factory == nil {
 		factory = defaultHandlerFactory
 	}
-	return &mysqlStreamFactory{new: factory, opts: opts}
+	return &mysqlStreamFactory{new: factory, proto: MySQL, opts: opts}
 }
 
 var _ reassembly.StreamFactory = &mysqlStreamFactory{}
 
 type mysqlStreamFactory struct {
-	new  func(key ConnID) MySQLPacketHandler
-	opts FactoryOptions
+	new   func(key ConnID) MySQLPacketHandler
+	proto Protocol
+	opts  FactoryOptions
 }
 
 func (f *mysqlStreamFactory) New(netFlow, tcpFlow gopacket.Flow, tcp *layers.TCP, ac reassembly.AssemblerContext) reassembly.Stream {
-	conn := ConnID{netFlow, tcpFlow}
+	conn, reversed, ok := f.orient(ConnID{netFlow, tcpFlow})
 	log := conn.Logger("mysql-stream")
-	h, ch, done := f.new(conn), make(chan MySQLPacket, f.opts.ConnCacheSize), make(chan struct{})
+	var h MySQLPacketHandler
+	if ok {
+		h = f.new(conn)
+	} else {
+		h = RejectConn(conn)
+	}
+	ch, done := make(chan MySQLPacket, f.opts.ConnCacheSize), make(chan struct{})
 	if !f.opts.Synchronized {
 		go func() {
 			defer close(done)
 			for pkt := range ch {
-				h.OnPacket(pkt)
+				handlePacket(h, pkt)
 			}
 		}()
 	}
 	stats.Add(stats.Streams, 1)
 	return &mysqlStream{
-		conn: conn,
-		log:  log,
-		ch:   ch,
-		done: done,
-		h:    h,
-		opts: f.opts,
+		conn:     conn,
+		log:      log,
+		ch:       ch,
+		done:     done,
+		h:        h,
+		framer:   f.proto.NewFramer(),
+		opts:     f.opts,
+		reversed: reversed,
+	}
+}
+
+// orient orients conn from the client to the server by server ports, it tells
+// whether conn is reversed, and returns false if conn is not to a server of
+// the protocol.
+func (f *mysqlStreamFactory) orient(conn ConnID) (ConnID, bool, bool) {
+	if len(f.opts.Ports) == 0 {
+		return conn, false, true
+	}
+	name := f.proto.Name()
+	if f.opts.Ports[tcpPort(conn[1].Dst())] == name {
+		return conn, false, true
+	}
+	if f.opts.Ports[tcpPort(conn[1].Src())] == name {
+		return conn.Reverse(), true, true
+	}
+	return conn, false, false
+}
+
+func tcpPort(ep gopacket.Endpoint) uint16 {
+	if raw := ep.Raw(); len(raw) == 2 {
+		return binary.BigEndian.Uint16(raw)
 	}
+	return 0
 }
 
 var _ reassembly.Stream = &mysqlStream{}
@@ -122,11 +173,21 @@ type mysqlStream struct {
 	ch   chan MySQLPacket
 	done chan struct{}
 
-	h    MySQLPacketHandler
-	opts FactoryOptions
+	h      MySQLPacketHandler
+	framer Framer
+	opts   FactoryOptions
+
+	// buffered is the capacity of buf0 and buf1 accounted by the budget
+	buffered int64
+	// reversed is set if the first packet seen is from the server, directions
+	// of the assembler are flipped then.
+	reversed bool
 }
 
 func (s *mysqlStream) Accept(tcp *layers.TCP, ci gopacket.CaptureInfo, dir reassembly.TCPFlowDirection, nextSeq reassembly.Sequence, start *bool, ac reassembly.AssemblerContext) bool {
+	if s.reversed {
+		dir = dir.Reverse()
+	}
 	if !s.h.Accept(ci, dir, tcp) {
 		return false
 	}
@@ -141,9 +202,15 @@ func (s *mysqlStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.A
 	if length == 0 {
 		return
 	}
+	if s.opts.Budget != nil {
+		defer s.account()
+	}
 
 	data := sg.Fetch(length)
 	dir, _, _, skip := sg.Info()
+	if s.reversed {
+		dir = dir.Reverse()
+	}
 	buf := s.getBuf(dir)
 	ts := s.getTime(dir)
 
@@ -159,10 +226,14 @@ func (s *mysqlStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.A
 		s.log.Info("trim duplicated data", zap.String("dir", dir.String()), zap.Int("size", -skip))
 		data = data[-skip:]
 	}
+	if st := sg.Stats(); st.QueuedPackets > 0 {
+		// packets queued by the assembler arrived out of order
+		stats.Add(stats.OutOfOrderPackets, int64(st.QueuedPackets))
+	}
 
 	if buf == nil {
 		buf = bytes.NewBuffer(data)
-		if seq := lookupPacketSeq(buf); s.getBuf(!dir) == nil && seq != 0 {
+		if s.getBuf(!dir) == nil && !s.framer.Start(dir, data) {
 			s.log.Info("drop init packet with non-zero seq",
 				zap.String("dir", dir.String()), zap.String("data", formatData(data)))
 			return
@@ -170,6 +241,9 @@ func (s *mysqlStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.A
 	} else {
 		if skip > 0 {
 			s.log.Warn("fill skipped data", zap.String("dir", dir.String()), zap.Int("size", skip))
+			stats.Add(stats.Gaps, 1)
+			stats.Add(stats.GapBytes, int64(skip))
+			s.deliver(MySQLPacket{Conn: s.conn, Time: ts, Dir: dir, Gap: skip})
 			buf.Grow(skip)
 			buf.Write(make([]byte, skip))
 		}
@@ -181,15 +255,11 @@ func (s *mysqlStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.A
 	for buf.Len() > 0 {
 		pkt := s.getPkt(dir)
 		if pkt == nil {
-			pkt = &MySQLPacket{
-				Conn: s.conn,
-				Time: ts,
-				Dir:  dir,
-				Len:  lookupPacketLen(buf),
-				Seq:  lookupPacketSeq(buf),
-			}
+			pkt = &MySQLPacket{Conn: s.conn, Time: ts, Dir: dir}
 		}
-		if pkt.Seq == -1 || buf.Len() < pkt.Len+4 {
+		size, payload, seq := s.framer.Next(dir, buf.Bytes())
+		pkt.Seq = seq
+		if size == 0 {
 			s.log.Debug("wait for more packet data", zap.String("dir", dir.String()))
 			if s.getPkt(dir) == nil && pkt.Seq >= 0 {
 				s.setPkt(dir, pkt)
@@ -200,22 +270,66 @@ func (s *mysqlStream) ReassembledSG(sg reassembly.ScatterGather, ac reassembly.A
 			}
 			return
 		}
+		if payload == nil {
+			buf.Next(size)
+			s.setPkt(dir, nil)
+			continue
+		}
+		pkt.Len = len(payload)
 		pkt.Data = make([]byte, pkt.Len)
-		copy(pkt.Data, buf.Next(pkt.Len + 4)[4:])
+		copy(pkt.Data, payload)
+		buf.Next(size)
 		cnt += 1
 		stats.Add(stats.Packets, 1)
-		stats.Add(stats.DataIn, int64(pkt.Len)+4)
-		if s.opts.Synchronized {
-			s.h.OnPacket(*pkt)
-		} else {
-			s.ch <- *pkt
-		}
+		stats.Add(stats.DataIn, int64(size))
+		s.deliver(*pkt)
 		s.setPkt(dir, nil)
 	}
 	if ac == nil && cnt > 0 {
 		s.log.Info("fallback to last seen time",
 			zap.String("dir", dir.String()), zap.Int("packets", cnt), zap.Time("time", ts))
 	}
+	if s.opts.Budget != nil && buf.Cap() > maxIdleBufferSize {
+		// drop the buffer grown by large packets, which is never shrunk otherwise
+		s.setBuf(dir, new(bytes.Buffer))
+	}
+}
+
+// deliver passes pkt to the handler of the stream, or queues it if the stream
+// is not synchronized.
+func (s *mysqlStream) deliver(pkt MySQLPacket) {
+	if s.opts.Synchronized {
+		handlePacket(s.h, pkt)
+	} else {
+		s.ch <- pkt
+	}
+}
+
+// handlePacket passes pkt to h, gaps are only passed to a GapHandler.
+func handlePacket(h MySQLPacketHandler, pkt MySQLPacket) {
+	if pkt.Gap > 0 {
+		if gh, ok := h.(GapHandler); ok {
+			gh.OnGap(pkt)
+		}
+		return
+	}
+	h.OnPacket(pkt)
+}
+
+// maxIdleBufferSize is the max capacity of an empty buffer kept by a stream
+// under a memory budget.
+const maxIdleBufferSize = 64 << 10
+
+// account updates the bytes accounted by the budget for buffers of the stream.
+func (s *mysqlStream) account() {
+	n := int64(0)
+	for _, buf := range []*bytes.Buffer{s.buf0, s.buf1} {
+		if buf != nil {
+			n += int64(buf.Cap())
+		}
+	}
+	s.opts.Budget.Acquire(n - s.buffered)
+	s.buffered = n
 }
 
 func (s *mysqlStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
@@ -224,6 +338,8 @@ func (s *mysqlStream) ReassemblyComplete(ac reassembly.AssemblerContext) bool {
 		<-s.done
 	}
 	s.h.OnClose()
+	s.opts.Budget.Release(s.buffered)
+	s.buffered = 0
 	stats.Add(stats.Streams, -1)
 	return true
 }
@@ -276,21 +392,6 @@ func (s *mysqlStream) setTime(dir reassembly.TCPFlowDirection, t time.Time) {
 	}
 }
 
-func lookupPacketLen(buf *bytes.Buffer) int {
-	if buf.Len() < 3 {
-		return -1
-	}
-	bs := buf.Bytes()[:3]
-	return int(uint32(bs[0]) | uint32(bs[1])<<8 | uint32(bs[2])<<16)
-}
-
-func lookupPacketSeq(buf *bytes.Buffer) int {
-	if buf.Len() < 4 {
-		return -1
-	}
-	return int(buf.Bytes()[3])
-}
-
 func formatData(data []byte) string {
 	if len(data) > 500 {
 		return string(data[:297]) + "..." + string(data[len(data)-200:])